@@ -17,6 +17,10 @@ type Publication struct {
 	// Tags contains a map with custom key-values attached to a Publication. Tags map
 	// will be delivered to a client.
 	Tags map[string]string
+	// ExcludeClient is an ID of client connection which should not receive this
+	// Publication (usually the publisher itself). Set by Broker from
+	// PublishOptions.ExcludeClient, never kept in history.
+	ExcludeClient string
 }
 
 // ClientInfo contains information about client connection.
@@ -32,6 +36,17 @@ type ClientInfo struct {
 	ChanInfo []byte
 }
 
+// NewClientInfo creates ClientInfo. It may be used to attribute publications
+// sent over Node.Publish to a user – see WithClientInfo.
+func NewClientInfo(user string, client string, connInfo []byte, chanInfo []byte) *ClientInfo {
+	return &ClientInfo{
+		ClientID: client,
+		UserID:   user,
+		ConnInfo: connInfo,
+		ChanInfo: chanInfo,
+	}
+}
+
 // BrokerEventHandler can handle messages received from PUB/SUB system.
 type BrokerEventHandler interface {
 	// HandlePublication to handle received Publications.
@@ -89,6 +104,63 @@ type Closer interface {
 	Close(ctx context.Context) error
 }
 
+// StatsReporter is an interface that Broker and PresenceManager can optionally
+// implement to report health details of the underlying storage in Node.Info.
+// Stats are collected on demand – only when Node.Info called.
+type StatsReporter interface {
+	// Stats returns health details suitable for JSON encoding.
+	Stats(ctx context.Context) (map[string]any, error)
+}
+
+// HistoryResetter is an interface that Broker can optionally implement to support
+// resetting channel history. See Node.ResetHistory.
+type HistoryResetter interface {
+	// ResetHistory removes channel history and rotates stream epoch in one atomic
+	// operation. So clients with previously seen stream position can't recover from it.
+	ResetHistory(ch string) error
+}
+
+// HistoryContextBroker is an interface that Broker can optionally implement to
+// respect caller context (deadline and cancellation) when reading channel history.
+// See Node.HistoryContext.
+type HistoryContextBroker interface {
+	// HistoryContext is the same as Broker.History but aborts when ctx is done.
+	HistoryContext(ctx context.Context, ch string, opts HistoryOptions) ([]*Publication, StreamPosition, error)
+}
+
+// PublishContextBroker is an interface that Broker can optionally implement to
+// respect caller context (deadline and cancellation) when publishing to channel.
+// See Node.PublishContext.
+type PublishContextBroker interface {
+	// PublishContext is the same as Broker.Publish but aborts when ctx is done.
+	PublishContext(ctx context.Context, ch string, data []byte, opts PublishOptions) (StreamPosition, bool, error)
+}
+
+// ChannelActivityChecker is an interface that Broker can optionally implement to
+// report whether channel has subscribers on any node. See Node.ChannelActive.
+type ChannelActivityChecker interface {
+	// ChannelActive returns true if channel has at least one subscriber in cluster.
+	ChannelActive(ch string) (bool, error)
+}
+
+// HistoryConditionalRemover is an interface that Broker can optionally implement to
+// remove channel history only if nothing was published to it since the moment stream
+// top was obtained. See Config.RemoveInactiveChannelHistory.
+type HistoryConditionalRemover interface {
+	// RemoveHistoryIfTop atomically removes channel history if current stream top
+	// is equal to top. Returns true if history was removed.
+	RemoveHistoryIfTop(ch string, top StreamPosition) (bool, error)
+}
+
+// ChannelCloser is an interface that Broker can optionally implement to keep
+// tombstones of closed channels. See Node.CloseChannel.
+type ChannelCloser interface {
+	// CloseChannel marks channel closed for ttl.
+	CloseChannel(ch string, ttl time.Duration) error
+	// ChannelClosed returns true if channel is marked closed at the moment.
+	ChannelClosed(ch string) (bool, error)
+}
+
 // PublishOptions define some fields to alter behaviour of Publish operation.
 type PublishOptions struct {
 	// HistoryTTL sets history ttl to expire inactive history streams.
@@ -112,6 +184,32 @@ type PublishOptions struct {
 	// with second precision, so don't set something less than one second here. By default,
 	// Centrifuge uses 5 minutes as idempotent result TTL.
 	IdempotentResultTTL time.Duration
+	// ExcludeClient is an ID of client connection which should not receive the
+	// publication. Useful for publishers which render own messages optimistically.
+	// Broker must deliver it to all nodes as Publication.ExcludeClient.
+	ExcludeClient string
+	// CompactionKey enables history compaction for the publication: Broker replaces
+	// publication with the same key kept in channel history instead of appending a new
+	// one, so history contains at most one (latest) publication per key. Useful for
+	// state-sync channels where only the latest value matters. Compaction results into
+	// gaps in offsets of history publications – see SubscribeOptions.CompactedHistory
+	// for recovery semantics.
+	CompactionKey string
+	// ContentType of publication data. If set, it's passed to clients in Publication.Tags
+	// under PublicationTagContentType key. Data with content type other than ContentTypeJSON
+	// is delivered to JSON protocol clients encoded to a base64 JSON string.
+	ContentType string
+}
+
+// withExcludeClient returns Publication to broadcast with ExcludeClient set. A copy
+// is made to keep the original Publication (which may be kept in history) untouched.
+func withExcludeClient(pub *Publication, clientID string) *Publication {
+	if clientID == "" {
+		return pub
+	}
+	pubCopy := *pub
+	pubCopy.ExcludeClient = clientID
+	return &pubCopy
 }
 
 // Broker is responsible for PUB/SUB mechanics.
@@ -38,6 +38,11 @@ type MemoryBroker struct {
 	resultExpireQueue priority.Queue
 	resultCache       map[string]StreamPosition
 	resultCacheMu     sync.RWMutex
+
+	// closedChannels keep expiration time (Unix nanoseconds) of closed
+	// channel tombstones.
+	closedChannels   map[string]int64
+	closedChannelsMu sync.RWMutex
 }
 
 var _ Broker = (*MemoryBroker)(nil)
@@ -62,6 +67,8 @@ func NewMemoryBroker(n *Node, _ MemoryBrokerConfig) (*MemoryBroker, error) {
 		pubLocks:    pubLocks,
 		closeCh:     closeCh,
 		resultCache: map[string]StreamPosition{},
+
+		closedChannels: map[string]int64{},
 	}
 	return b, nil
 }
@@ -70,6 +77,7 @@ func NewMemoryBroker(n *Node, _ MemoryBrokerConfig) (*MemoryBroker, error) {
 func (b *MemoryBroker) Run(h BrokerEventHandler) error {
 	b.eventHandler = h
 	go b.expireResultCache()
+	go b.expireClosedChannels()
 	b.historyHub.runCleanups()
 	return nil
 }
@@ -88,6 +96,10 @@ func (b *MemoryBroker) pubLock(ch string) *sync.Mutex {
 
 // Publish adds message into history hub and calls node method to handle message.
 // We don't have any PUB/SUB here as Memory Engine is single node only.
+// Publication is broadcasted to local subscribers synchronously – when Publish
+// returns message is already in queues of all subscribed clients, and error
+// returned reflects broadcast errors. This gives a strong ordering guarantee
+// at the cost of publish latency growing with the number of subscribers.
 func (b *MemoryBroker) Publish(ch string, data []byte, opts PublishOptions) (StreamPosition, bool, error) {
 	mu := b.pubLock(ch)
 	mu.Lock()
@@ -117,7 +129,7 @@ func (b *MemoryBroker) Publish(ch string, data []byte, opts PublishOptions) (Str
 			}
 			b.saveResultToCache(ch, opts.IdempotencyKey, streamTop, resultExpireSeconds)
 		}
-		return streamTop, false, b.eventHandler.HandlePublication(ch, pub, streamTop)
+		return streamTop, false, b.eventHandler.HandlePublication(ch, withExcludeClient(pub, opts.ExcludeClient), streamTop)
 	}
 	streamPosition := StreamPosition{}
 	if opts.IdempotencyKey != "" {
@@ -127,7 +139,7 @@ func (b *MemoryBroker) Publish(ch string, data []byte, opts PublishOptions) (Str
 		}
 		b.saveResultToCache(ch, opts.IdempotencyKey, streamPosition, resultExpireSeconds)
 	}
-	return streamPosition, false, b.eventHandler.HandlePublication(ch, pub, StreamPosition{})
+	return streamPosition, false, b.eventHandler.HandlePublication(ch, withExcludeClient(pub, opts.ExcludeClient), StreamPosition{})
 }
 
 func (b *MemoryBroker) getResultFromCache(ch string, key string) (StreamPosition, bool) {
@@ -179,6 +191,42 @@ func (b *MemoryBroker) expireResultCache() {
 	}
 }
 
+// CloseChannel - see ChannelCloser interface description.
+func (b *MemoryBroker) CloseChannel(ch string, ttl time.Duration) error {
+	b.closedChannelsMu.Lock()
+	defer b.closedChannelsMu.Unlock()
+	b.closedChannels[ch] = time.Now().Add(ttl).UnixNano()
+	return nil
+}
+
+// ChannelClosed - see ChannelCloser interface description.
+func (b *MemoryBroker) ChannelClosed(ch string) (bool, error) {
+	b.closedChannelsMu.RLock()
+	defer b.closedChannelsMu.RUnlock()
+	expireAt, ok := b.closedChannels[ch]
+	return ok && expireAt > time.Now().UnixNano(), nil
+}
+
+func (b *MemoryBroker) expireClosedChannels() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.closeCh:
+			return
+		}
+		now := time.Now().UnixNano()
+		b.closedChannelsMu.Lock()
+		for ch, expireAt := range b.closedChannels {
+			if expireAt <= now {
+				delete(b.closedChannels, ch)
+			}
+		}
+		b.closedChannelsMu.Unlock()
+	}
+}
+
 // PublishJoin - see Broker interface description.
 func (b *MemoryBroker) PublishJoin(ch string, info *ClientInfo) error {
 	return b.eventHandler.HandleJoin(ch, info)
@@ -214,6 +262,32 @@ func (b *MemoryBroker) RemoveHistory(ch string) error {
 	return b.historyHub.remove(ch)
 }
 
+// RemoveHistoryIfTop - see HistoryConditionalRemover interface description.
+func (b *MemoryBroker) RemoveHistoryIfTop(ch string, top StreamPosition) (bool, error) {
+	return b.historyHub.removeIfTop(ch, top)
+}
+
+// ResetHistory - see HistoryResetter interface description.
+func (b *MemoryBroker) ResetHistory(ch string) error {
+	return b.historyHub.reset(ch)
+}
+
+// Stats - see StatsReporter interface description. Reports number of history
+// streams and publications kept in memory with a rough estimate of memory used.
+func (b *MemoryBroker) Stats(_ context.Context) (map[string]any, error) {
+	numStreams, numPublications, numBytes := b.historyHub.stats()
+	return map[string]any{
+		"history_num_streams":           numStreams,
+		"history_num_publications":      numPublications,
+		"history_memory_bytes_estimate": numBytes,
+	}, nil
+}
+
+// ChannelActive - see ChannelActivityChecker interface description.
+func (b *MemoryBroker) ChannelActive(ch string) (bool, error) {
+	return b.node.hub.NumSubscribers(ch) > 0, nil
+}
+
 type historyHub struct {
 	sync.RWMutex
 	streams         map[string]*memstream.Stream
@@ -356,20 +430,44 @@ func (h *historyHub) add(ch string, pub *Publication, opts PublishOptions) (Stre
 		}
 	}
 
-	if stream, ok := h.streams[ch]; ok {
-		offset, _ = stream.Add(pub, opts.HistorySize)
-		epoch = stream.Epoch()
-	} else {
-		stream := memstream.New()
-		offset, _ = stream.Add(pub, opts.HistorySize)
-		epoch = stream.Epoch()
+	stream, ok := h.streams[ch]
+	if !ok {
+		stream = memstream.New()
 		h.streams[ch] = stream
 	}
+	offset, _ = stream.AddCompacted(pub, opts.HistorySize, opts.CompactionKey)
+	epoch = stream.Epoch()
 	pub.Offset = offset
 
 	return StreamPosition{Offset: offset, Epoch: epoch}, nil
 }
 
+// pubSizeOverhead is an approximate size of Publication and stream item
+// structures not counting variable length fields.
+const pubSizeOverhead = 128
+
+func (h *historyHub) stats() (numStreams int, numPublications int, numBytes int) {
+	h.RLock()
+	defer h.RUnlock()
+	numStreams = len(h.streams)
+	for _, stream := range h.streams {
+		items, _, _ := stream.Get(0, false, -1, false)
+		numPublications += len(items)
+		for _, item := range items {
+			numBytes += pubSizeOverhead + len(item.Key)
+			pub := item.Value.(*Publication)
+			numBytes += len(pub.Data)
+			for k, v := range pub.Tags {
+				numBytes += len(k) + len(v)
+			}
+			if pub.Info != nil {
+				numBytes += len(pub.Info.ClientID) + len(pub.Info.UserID) + len(pub.Info.ConnInfo) + len(pub.Info.ChanInfo)
+			}
+		}
+	}
+	return numStreams, numPublications, numBytes
+}
+
 // Lock must be held outside.
 func (h *historyHub) createStream(ch string) StreamPosition {
 	stream := memstream.New()
@@ -466,3 +564,23 @@ func (h *historyHub) remove(ch string) error {
 	}
 	return nil
 }
+
+func (h *historyHub) removeIfTop(ch string, top StreamPosition) (bool, error) {
+	h.Lock()
+	defer h.Unlock()
+	stream, ok := h.streams[ch]
+	if !ok || getPosition(stream) != top {
+		return false, nil
+	}
+	stream.Clear()
+	return true, nil
+}
+
+func (h *historyHub) reset(ch string) error {
+	h.Lock()
+	defer h.Unlock()
+	if stream, ok := h.streams[ch]; ok {
+		stream.Reset()
+	}
+	return nil
+}
@@ -134,6 +134,28 @@ func TestMemoryBrokerResultCacheExpires(t *testing.T) {
 	e.resultCacheMu.Unlock()
 }
 
+func TestMemoryBrokerClosedChannelExpires(t *testing.T) {
+	t.Parallel()
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	require.NoError(t, e.CloseChannel("channel", time.Second))
+	closed, err := e.ChannelClosed("channel")
+	require.NoError(t, err)
+	require.True(t, closed)
+	closed, err = e.ChannelClosed("other")
+	require.NoError(t, err)
+	require.False(t, closed)
+
+	time.Sleep(2500 * time.Millisecond)
+	closed, err = e.ChannelClosed("channel")
+	require.NoError(t, err)
+	require.False(t, closed)
+	e.closedChannelsMu.RLock()
+	require.Len(t, e.closedChannels, 0)
+	e.closedChannelsMu.RUnlock()
+}
+
 func TestMemoryBrokerPublishIdempotent(t *testing.T) {
 	e := testMemoryBroker()
 	defer func() { _ = e.node.Shutdown(context.Background()) }()
@@ -212,6 +234,51 @@ func TestMemoryBrokerPublishIdempotentWithHistory(t *testing.T) {
 	require.Equal(t, 1, numPubs)
 }
 
+func TestMemoryBrokerPublishCompacted(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	for _, key := range []string{"a", "b", "a"} {
+		_, _, err := e.Publish("channel", []byte(`"`+key+`"`), PublishOptions{
+			HistorySize:   10,
+			HistoryTTL:    time.Minute,
+			CompactionKey: key,
+		})
+		require.NoError(t, err)
+	}
+	pubs, sp, err := e.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), sp.Offset)
+	require.Len(t, pubs, 2)
+	require.Equal(t, uint64(2), pubs[0].Offset)
+	require.Equal(t, []byte(`"b"`), pubs[0].Data)
+	require.Equal(t, uint64(3), pubs[1].Offset)
+	require.Equal(t, []byte(`"a"`), pubs[1].Data)
+
+	pubs, _, err = e.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1, Since: &StreamPosition{Offset: 0, Epoch: sp.Epoch}}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+}
+
+func TestMemoryBrokerPublishSynchronousBroadcast(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		// Large write delay keeps messages in client queue.
+		return ConnectReply{WriteDelay: time.Hour}, nil
+	})
+
+	client := newTestClientV2(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	queueLen := client.messageWriter.messages.Len()
+	_, err := node.Publish("test", []byte(`{}`))
+	require.NoError(t, err)
+	// Publication must be in subscriber queue as soon as Publish returns.
+	require.Equal(t, queueLen+1, client.messageWriter.messages.Len())
+}
+
 func TestMemoryEngineSubscribeUnsubscribe(t *testing.T) {
 	e := testMemoryBroker()
 	defer func() { _ = e.node.Shutdown(context.Background()) }()
@@ -443,6 +510,30 @@ func TestMemoryBrokerRecover(t *testing.T) {
 	require.Equal(t, 0, len(pubs))
 }
 
+func TestMemoryBrokerRemoveHistoryIfTop(t *testing.T) {
+	e := testMemoryBroker()
+	defer func() { _ = e.node.Shutdown(context.Background()) }()
+
+	top, _, err := e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+	_, _, err = e.Publish("channel", testPublicationData(), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+	require.NoError(t, err)
+
+	removed, err := e.RemoveHistoryIfTop("channel", top)
+	require.NoError(t, err)
+	require.False(t, removed)
+	pubs, currentTop, err := e.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 2)
+
+	removed, err = e.RemoveHistoryIfTop("channel", currentTop)
+	require.NoError(t, err)
+	require.True(t, removed)
+	pubs, _, err = e.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1}})
+	require.NoError(t, err)
+	require.Len(t, pubs, 0)
+}
+
 func BenchmarkMemoryPublish_1Ch(b *testing.B) {
 	e := testMemoryBroker()
 	defer func() { _ = e.node.Shutdown(context.Background()) }()
@@ -626,6 +717,51 @@ func TestClientSubscribeRecover(t *testing.T) {
 	}
 }
 
+func TestClientSubscribeRecoverCompacted(t *testing.T) {
+	t.Parallel()
+	for _, compacted := range []bool{true, false} {
+		t.Run(strconv.FormatBool(compacted), func(t *testing.T) {
+			node := defaultNodeNoHandlers()
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			node.OnConnect(func(client *Client) {
+				client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+					opts := SubscribeOptions{EnableRecovery: true, CompactedHistory: compacted}
+					cb(SubscribeReply{Options: opts}, nil)
+				})
+			})
+
+			client := newTestClient(t, node, "42")
+			connectClientV2(t, client)
+
+			var sp StreamPosition
+			for _, key := range []string{"a", "b", "a", "c", "b"} {
+				res, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute), WithCompactionKey(key))
+				require.NoError(t, err)
+				sp = res.StreamPosition
+			}
+
+			rwWrapper := testReplyWriterWrapper()
+			err := client.handleSubscribe(&protocol.SubscribeRequest{
+				Channel: "test",
+				Recover: true,
+				Epoch:   sp.Epoch,
+				Offset:  1,
+			}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+			require.NoError(t, err)
+			require.Nil(t, rwWrapper.replies[0].Error)
+			res := extractSubscribeResult(rwWrapper.replies)
+			require.Equal(t, compacted, res.Recovered)
+			if compacted {
+				// Offsets 3, 4, 5 left after compaction, offset 2 was replaced.
+				require.Len(t, res.Publications, 3)
+			} else {
+				// Offset 2 missing – continuity broken, nothing recovered.
+				require.Len(t, res.Publications, 0)
+			}
+		})
+	}
+}
+
 const historyIterationChannel = "test"
 
 type historyIterationTest struct {
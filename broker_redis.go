@@ -18,6 +18,7 @@ import (
 
 	"github.com/centrifugal/protocol"
 	"github.com/redis/rueidis"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 var (
@@ -36,6 +37,11 @@ const (
 	redisClientChannelPrefix = ".client."
 	// redisPubSubShardChannelSuffix is a suffix in channel name which we use to establish a sharded PUB/SUB connection.
 	redisPubSubShardChannelSuffix = ".shard"
+	// redisPubSubQueueFullLogInterval limits how often full PUB/SUB processor queue is logged.
+	redisPubSubQueueFullLogInterval = 10 * time.Second
+	// redisPubSubQueueLenUpdateInterval is an interval of PUB/SUB processor queue length
+	// gauge updates.
+	redisPubSubQueueLenUpdateInterval = 10 * time.Second
 )
 
 var _ Broker = (*RedisBroker)(nil)
@@ -54,8 +60,59 @@ type shardWrapper struct {
 	shard               *RedisShard
 	subClientsMu        sync.Mutex
 	subClients          [][]rueidis.DedicatedClient
+	pubSubConnectedAt   time.Time
 	pubSubStartChannels [][]*pubSubStart
 	controlPubSubStart  *controlPubSubStart
+	index               string
+	breaker             *shardBreaker
+	// pubSubQueues are processor queues of running PUB/SUB connections, protected
+	// by subClientsMu.
+	pubSubQueues map[chan rueidis.PubSubMessage]struct{}
+	// pubSubQueueFullCount counts full processor queue occurrences since
+	// pubSubQueueFullLoggedAt (unix nano).
+	pubSubQueueFullCount    int64
+	pubSubQueueFullLoggedAt int64
+}
+
+func (s *shardWrapper) addPubSubQueues(queues map[int]chan rueidis.PubSubMessage) {
+	s.subClientsMu.Lock()
+	defer s.subClientsMu.Unlock()
+	for _, q := range queues {
+		s.pubSubQueues[q] = struct{}{}
+	}
+}
+
+func (s *shardWrapper) removePubSubQueues(queues map[int]chan rueidis.PubSubMessage) {
+	s.subClientsMu.Lock()
+	defer s.subClientsMu.Unlock()
+	for _, q := range queues {
+		delete(s.pubSubQueues, q)
+	}
+}
+
+// pubSubQueueLen returns number of messages waiting in PUB/SUB processor queues.
+func (s *shardWrapper) pubSubQueueLen() int {
+	s.subClientsMu.Lock()
+	defer s.subClientsMu.Unlock()
+	var n int
+	for q := range s.pubSubQueues {
+		n += len(q)
+	}
+	return n
+}
+
+// pubSubQueueFull counts full processor queue and returns number of occurrences
+// to log, or 0 if it was already logged within redisPubSubQueueFullLogInterval.
+func (s *shardWrapper) pubSubQueueFull(now time.Time) int64 {
+	atomic.AddInt64(&s.pubSubQueueFullCount, 1)
+	loggedAt := atomic.LoadInt64(&s.pubSubQueueFullLoggedAt)
+	if now.UnixNano()-loggedAt < int64(redisPubSubQueueFullLogInterval) {
+		return 0
+	}
+	if !atomic.CompareAndSwapInt64(&s.pubSubQueueFullLoggedAt, loggedAt, now.UnixNano()) {
+		return 0
+	}
+	return atomic.SwapInt64(&s.pubSubQueueFullCount, 0)
 }
 
 // RedisBroker uses Redis to implement Broker functionality. This broker allows
@@ -77,6 +134,7 @@ type RedisBroker struct {
 	historyStreamScript     *rueidis.Lua
 	addHistoryListScript    *rueidis.Lua
 	addHistoryStreamScript  *rueidis.Lua
+	removeHistoryScript     *rueidis.Lua
 	shardChannel            string
 	messagePrefix           string
 	controlChannel          string
@@ -107,6 +165,43 @@ type RedisBrokerConfig struct {
 	// publishing to channels and using PUB/SUB.
 	SkipPubSub bool
 
+	// SkipPublishTime disables attaching publish time to publications sent over PUB/SUB.
+	// Publish time is used to observe broker_pub_sub_latency_seconds metric – time from
+	// publish till publication received from PUB/SUB on (possibly) another node. It
+	// costs 9 bytes per PUB/SUB message, history is not affected.
+	SkipPublishTime bool
+
+	// NumPubSubProcessors allows configuring number of workers which will process
+	// messages coming from Redis PUB/SUB. Messages are distributed over workers by
+	// channel hash so the order of messages within a channel is preserved. Zero value
+	// tells Centrifuge to use the number calculated as:
+	// runtime.NumCPU / numPubSubShards / numClusterShards (if used) (minimum 1).
+	NumPubSubProcessors int
+
+	// PubSubProcessorQueueSize is a size of buffered queue of each PUB/SUB processor.
+	// When queue is full reading from Redis PUB/SUB connection blocks until processor
+	// frees space, such situations are logged (at most once in 10 seconds) and counted in
+	// broker_pub_sub_queue_full_count metric. Number of messages waiting in queues is
+	// exposed with broker_redis_pub_sub_queue_len metric. Zero value means 256.
+	PubSubProcessorQueueSize int
+
+	// PublishTimeout is a timeout for a single publish to Redis. When publish is not
+	// finished in time RedisBroker.Publish returns ErrRedisPublishTimeout. Zero value
+	// means no publish timeout – only IOTimeout of RedisShard applies.
+	PublishTimeout time.Duration
+
+	// PublishBreakerThreshold is a number of consecutive publish timeouts after which
+	// Redis shard is considered unhealthy. While shard is unhealthy publishes to it fail
+	// fast with ErrRedisShardUnhealthy during PublishBreakerCooldown, after that a single
+	// probe publish is let through and shard becomes healthy again if it succeeds. Shard
+	// health is exposed over broker_redis_shard_healthy metric. Zero value disables
+	// circuit breaker.
+	PublishBreakerThreshold int
+
+	// PublishBreakerCooldown is a time publishes fail fast after Redis shard became
+	// unhealthy. Zero value means 5 seconds.
+	PublishBreakerCooldown time.Duration
+
 	// numPubSubShards defines how many PUB/SUB shards will be used by Centrifuge.
 	// Each PUB/SUB shard uses dedicated connection to Redis. Zero value means 1.
 	numPubSubShards int
@@ -116,12 +211,6 @@ type RedisBrokerConfig struct {
 	// Centrifuge to use 16 subscriber goroutines per PUB/SUB shard.
 	numPubSubSubscribers int
 
-	// numPubSubProcessors allows configuring number of workers which will process
-	// messages coming from Redis PUB/SUB. Zero value tells Centrifuge to use the
-	// number calculated as:
-	// runtime.NumCPU / numPubSubShards / numClusterShards (if used) (minimum 1).
-	numPubSubProcessors int
-
 	// numClusterShards when greater than zero allows turning on a mode in which
 	// broker will use Redis Cluster with sharded PUB/SUB feature available in
 	// Redis >= 7: https://redis.io/docs/manual/pubsub/#sharded-pubsub
@@ -162,19 +251,41 @@ func NewRedisBroker(n *Node, config RedisBrokerConfig) (*RedisBroker, error) {
 		config.numPubSubSubscribers = 16
 	}
 
-	if config.numPubSubProcessors == 0 {
-		config.numPubSubProcessors = runtime.NumCPU() / config.numPubSubShards
+	if config.PubSubProcessorQueueSize == 0 {
+		config.PubSubProcessorQueueSize = 256
+	}
+
+	if config.NumPubSubProcessors < 0 {
+		return nil, errors.New("broker: NumPubSubProcessors must not be negative")
+	}
+
+	if config.PubSubProcessorQueueSize < 0 {
+		return nil, errors.New("broker: PubSubProcessorQueueSize must not be negative")
+	}
+
+	if config.NumPubSubProcessors == 0 {
+		config.NumPubSubProcessors = runtime.NumCPU() / config.numPubSubShards
 		if config.numClusterShards > 0 {
-			config.numPubSubProcessors /= config.numClusterShards
+			config.NumPubSubProcessors /= config.numClusterShards
 		}
-		if config.numPubSubProcessors < 1 {
-			config.numPubSubProcessors = 1
+		if config.NumPubSubProcessors < 1 {
+			config.NumPubSubProcessors = 1
 		}
 	}
 
+	if config.PublishBreakerCooldown == 0 {
+		config.PublishBreakerCooldown = defaultRedisPublishBreakerCooldown
+	}
+
 	shardWrappers := make([]*shardWrapper, 0, len(config.Shards))
-	for _, s := range config.Shards {
-		shardWrappers = append(shardWrappers, &shardWrapper{shard: s})
+	for i, s := range config.Shards {
+		shardWrappers = append(shardWrappers, &shardWrapper{
+			shard:        s,
+			index:        strconv.Itoa(i),
+			breaker:      newShardBreaker(config.PublishBreakerThreshold, config.PublishBreakerCooldown),
+			pubSubQueues: make(map[chan rueidis.PubSubMessage]struct{}),
+		})
+		n.metrics.setRedisShardHealthy(strconv.Itoa(i), true)
 	}
 
 	b := &RedisBroker{
@@ -187,6 +298,7 @@ func NewRedisBroker(n *Node, config RedisBrokerConfig) (*RedisBroker, error) {
 		historyListScript:       rueidis.NewLuaScript(historyListSource),
 		addHistoryStreamScript:  rueidis.NewLuaScript(addHistoryStreamSource),
 		addHistoryListScript:    rueidis.NewLuaScript(addHistoryListSource),
+		removeHistoryScript:     rueidis.NewLuaScript(removeHistoryIfTopSource),
 		closeCh:                 make(chan struct{}),
 	}
 	b.shardChannel = config.Prefix + redisPubSubShardChannelSuffix
@@ -242,6 +354,9 @@ var (
 
 	//go:embed internal/redis_lua/broker_history_stream.lua
 	historyStreamSource string
+
+	//go:embed internal/redis_lua/broker_history_remove_if_top.lua
+	removeHistoryIfTopSource string
 )
 
 func (b *RedisBroker) getShard(channel string) *shardWrapper {
@@ -251,6 +366,13 @@ func (b *RedisBroker) getShard(channel string) *shardWrapper {
 	return b.shards[consistentIndex(channel, len(b.shards))]
 }
 
+// ShardForChannel returns RedisShard which RedisBroker uses for a channel. Useful
+// together with RedisShard.RedisClient to run custom commands on the same Redis
+// instance where channel data is stored.
+func (b *RedisBroker) ShardForChannel(ch string) *RedisShard {
+	return b.getShard(ch).shard
+}
+
 // Run – see Broker.Run.
 func (b *RedisBroker) Run(h BrokerEventHandler) error {
 	// Run all shards.
@@ -271,9 +393,27 @@ func (b *RedisBroker) Run(h BrokerEventHandler) error {
 			}
 		}
 	}
+	if !b.config.SkipPubSub && b.node.metrics != nil {
+		go b.updatePubSubQueueLen()
+	}
 	return nil
 }
 
+func (b *RedisBroker) updatePubSubQueueLen() {
+	ticker := time.NewTicker(redisPubSubQueueLenUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closeCh:
+			return
+		case <-ticker.C:
+			for _, s := range b.shards {
+				b.node.metrics.setRedisPubSubQueueLen(s.index, float64(s.pubSubQueueLen()))
+			}
+		}
+	}
+}
+
 func (b *RedisBroker) checkCapabilities(shard *RedisShard) error {
 	if !b.config.UseLists {
 		// Check whether Redis Streams supported.
@@ -415,7 +555,7 @@ func (b *RedisBroker) runControlPubSub(s *RedisShard, eventHandler BrokerEventHa
 	err := conn.Do(context.Background(), conn.B().Subscribe().Channel(controlChannel, nodeChannel).Build()).Error()
 	if err != nil {
 		startOnce(err)
-		b.node.Log(NewLogEntry(LogLevelError, "control pub/sub error", map[string]any{"error": err.Error()}))
+		b.node.Log(NewLogEntry(LogLevelError, "control pub/sub error", redisErrorLogFields(err)))
 		return
 	}
 
@@ -424,14 +564,14 @@ func (b *RedisBroker) runControlPubSub(s *RedisShard, eventHandler BrokerEventHa
 	select {
 	case err := <-wait:
 		if err != nil {
-			b.node.Log(NewLogEntry(LogLevelError, "control pub/sub error", map[string]any{"error": err.Error()}))
+			b.node.Log(NewLogEntry(LogLevelError, "control pub/sub error", redisErrorLogFields(err)))
 		}
 	case <-s.closeCh:
 	}
 }
 
 func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler, clusterShardIndex, psShardIndex int, useShardedPubSub bool, startOnce func(error)) {
-	numProcessors := b.config.numPubSubProcessors
+	numProcessors := b.config.NumPubSubProcessors
 	numSubscribers := b.config.numPubSubSubscribers
 
 	if b.node.LogEnabled(LogLevelDebug) {
@@ -460,7 +600,7 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 	// Run PUB/SUB message processors to spread received message processing work over worker goroutines.
 	processors := make(map[int]chan rueidis.PubSubMessage)
 	for i := 0; i < numProcessors; i++ {
-		processingCh := make(chan rueidis.PubSubMessage)
+		processingCh := make(chan rueidis.PubSubMessage, b.config.PubSubProcessorQueueSize)
 		processors[i] = processingCh
 		go func(ch chan rueidis.PubSubMessage) {
 			for {
@@ -478,6 +618,9 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 		}(processingCh)
 	}
 
+	s.addPubSubQueues(processors)
+	defer s.removePubSubQueues(processors)
+
 	conn, cancel := s.shard.client.Dedicate()
 	defer cancel()
 	defer conn.Close()
@@ -486,8 +629,20 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 
 	wait := conn.SetPubSubHooks(rueidis.PubSubHooks{
 		OnMessage: func(msg rueidis.PubSubMessage) {
+			processingCh := processors[index(msg.Channel, numProcessors)]
+			select {
+			case processingCh <- msg:
+				return
+			default:
+			}
+			b.node.metrics.incBrokerPubSubQueueFull()
+			if b.node.LogEnabled(LogLevelWarn) {
+				if numFull := s.pubSubQueueFull(time.Now()); numFull > 0 {
+					b.node.Log(NewLogEntry(LogLevelWarn, "Redis PUB/SUB processor queue is full", map[string]any{"shard": s.shard.string(), "queueSize": cap(processingCh), "numQueueFull": numFull}))
+				}
+			}
 			select {
-			case processors[index(msg.Channel, numProcessors)] <- msg:
+			case processingCh <- msg:
 			case <-done:
 			}
 		},
@@ -510,7 +665,7 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 	}
 	if err != nil {
 		startOnce(err)
-		b.node.Log(NewLogEntry(LogLevelError, "pub/sub error", map[string]any{"error": err.Error()}))
+		b.node.Log(NewLogEntry(LogLevelError, "pub/sub error", redisErrorLogFields(err)))
 		return
 	}
 
@@ -548,7 +703,7 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 				if len(batch) > 0 && i%redisSubscribeBatchLimit == 0 {
 					err := subscribeBatch(batch)
 					if err != nil {
-						b.node.Log(NewLogEntry(LogLevelError, "error subscribing", map[string]any{"error": err.Error()}))
+						b.node.Log(NewLogEntry(LogLevelError, "error subscribing", redisErrorLogFields(err)))
 						closeDoneOnce()
 						return
 					}
@@ -559,7 +714,7 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 			if len(batch) > 0 {
 				err := subscribeBatch(batch)
 				if err != nil {
-					b.node.Log(NewLogEntry(LogLevelError, "error subscribing", map[string]any{"error": err.Error()}))
+					b.node.Log(NewLogEntry(LogLevelError, "error subscribing", redisErrorLogFields(err)))
 					closeDoneOnce()
 					return
 				}
@@ -578,6 +733,7 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 		default:
 			s.subClientsMu.Lock()
 			s.subClients[clusterShardIndex][psShardIndex] = conn
+			s.pubSubConnectedAt = time.Now()
 			s.subClientsMu.Unlock()
 			defer func() {
 				s.subClientsMu.Lock()
@@ -593,22 +749,108 @@ func (b *RedisBroker) runPubSub(s *shardWrapper, eventHandler BrokerEventHandler
 	case err := <-wait:
 		startOnce(err)
 		if err != nil {
-			b.node.Log(NewLogEntry(LogLevelError, "pub/sub error", map[string]any{"error": err.Error()}))
+			b.node.Log(NewLogEntry(LogLevelError, "pub/sub error", redisErrorLogFields(err)))
 		}
 	case <-s.shard.closeCh:
 	}
 }
 
+// Stats - see StatsReporter interface description. Reports address of each
+// Redis shard, PING round-trip latency, state of PUB/SUB connections and time
+// of last PUB/SUB (re)connect.
+func (b *RedisBroker) Stats(ctx context.Context) (map[string]any, error) {
+	shards := make([]map[string]any, 0, len(b.shards))
+	for _, s := range b.shards {
+		shards = append(shards, b.shardStats(ctx, s))
+	}
+	return map[string]any{"shards": shards}, nil
+}
+
+func (b *RedisBroker) shardStats(ctx context.Context, s *shardWrapper) map[string]any {
+	stats := map[string]any{
+		"address": s.shard.string(),
+	}
+	started := time.Now()
+	if err := s.shard.client.Do(ctx, s.shard.client.B().Ping().Build()).Error(); err != nil {
+		stats["ping_error"] = err.Error()
+		if isRedisAuthError(err) {
+			stats["auth_error"] = true
+		}
+	} else {
+		stats["ping_latency"] = time.Since(started).String()
+	}
+	if b.config.SkipPubSub {
+		return stats
+	}
+	var numConnected, numTotal int
+	s.subClientsMu.Lock()
+	for _, clients := range s.subClients {
+		for _, client := range clients {
+			numTotal++
+			if client != nil {
+				numConnected++
+			}
+		}
+	}
+	connectedAt := s.pubSubConnectedAt
+	s.subClientsMu.Unlock()
+	stats["pub_sub_connected"] = numTotal > 0 && numConnected == numTotal
+	stats["pub_sub_num_connected"] = numConnected
+	stats["pub_sub_queue_len"] = s.pubSubQueueLen()
+	if !connectedAt.IsZero() {
+		stats["pub_sub_last_connect"] = connectedAt.UTC().Format(time.RFC3339)
+	}
+	return stats
+}
+
 func (b *RedisBroker) useShardedPubSub(s *RedisShard) bool {
 	return s.useCluster && b.config.numClusterShards > 0
 }
 
 // Publish - see Broker.Publish.
 func (b *RedisBroker) Publish(ch string, data []byte, opts PublishOptions) (StreamPosition, bool, error) {
-	return b.publish(b.getShard(ch), ch, data, opts)
+	return b.PublishContext(context.Background(), ch, data, opts)
+}
+
+// PublishContext - see PublishContextBroker.PublishContext.
+func (b *RedisBroker) PublishContext(ctx context.Context, ch string, data []byte, opts PublishOptions) (StreamPosition, bool, error) {
+	s := b.getShard(ch)
+	ok, probe := s.breaker.allow()
+	if !ok {
+		return StreamPosition{}, false, ErrRedisShardUnhealthy
+	}
+	sp, fromCache, err := b.publish(ctx, s, ch, data, opts)
+	breakerErr := err
+	if err != nil && ctx.Err() != nil {
+		// Caller gave up waiting – this says nothing about shard health.
+		breakerErr = context.Canceled
+	}
+	if changed, healthy := s.breaker.done(probe, breakerErr); changed {
+		b.node.metrics.setRedisShardHealthy(s.index, healthy)
+		if healthy {
+			b.node.Log(NewLogEntry(LogLevelInfo, "Redis shard is healthy again", map[string]any{"shard": s.shard.string()}))
+		} else {
+			b.node.Log(NewLogEntry(LogLevelError, "Redis shard is unhealthy, publishes fail fast", map[string]any{"shard": s.shard.string()}))
+		}
+	}
+	return sp, fromCache, err
+}
+
+func (b *RedisBroker) publish(ctx context.Context, s *shardWrapper, ch string, data []byte, opts PublishOptions) (StreamPosition, bool, error) {
+	publishCtx := ctx
+	if b.config.PublishTimeout > 0 {
+		var cancel context.CancelFunc
+		publishCtx, cancel = context.WithTimeout(ctx, b.config.PublishTimeout)
+		defer cancel()
+	}
+	sp, fromCache, err := b.publishContext(publishCtx, s, ch, data, opts)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return sp, fromCache, ErrRedisPublishTimeout
+	}
+	return sp, fromCache, err
 }
 
-func (b *RedisBroker) publish(s *shardWrapper, ch string, data []byte, opts PublishOptions) (StreamPosition, bool, error) {
+func (b *RedisBroker) publishContext(ctx context.Context, s *shardWrapper, ch string, data []byte, opts PublishOptions) (StreamPosition, bool, error) {
 	protoPub := &protocol.Publication{
 		Data: data,
 		Info: infoToProto(opts.ClientInfo),
@@ -618,6 +860,14 @@ func (b *RedisBroker) publish(s *shardWrapper, ch string, data []byte, opts Publ
 	if err != nil {
 		return StreamPosition{}, false, err
 	}
+	// Fields only required by PUB/SUB subscribers, not saved into history.
+	var pubSubFields []byte
+	if opts.ExcludeClient != "" {
+		pubSubFields = appendExcludeClient(pubSubFields, opts.ExcludeClient)
+	}
+	if !b.config.SkipPublishTime {
+		pubSubFields = appendPublishTime(pubSubFields, time.Now().UnixNano())
+	}
 
 	publishChannel := b.messageChannelID(s.shard, ch)
 	useShardedPublish := b.useShardedPubSub(s.shard)
@@ -643,21 +893,22 @@ func (b *RedisBroker) publish(s *shardWrapper, ch string, data []byte, opts Publ
 	}
 
 	if opts.HistorySize <= 0 || opts.HistoryTTL <= 0 {
+		pubSubMessage := append(byteMessage, pubSubFields...)
 		var resp rueidis.RedisResult
 		if useShardedPublish {
 			if resultExpire == "" {
 				if publishChannelStr == "" {
 					return StreamPosition{}, false, nil
 				}
-				cmd := s.shard.client.B().Spublish().Channel(string(publishChannel)).Message(convert.BytesToString(byteMessage)).Build()
-				resp = s.shard.client.Do(context.Background(), cmd)
+				cmd := s.shard.client.B().Spublish().Channel(string(publishChannel)).Message(convert.BytesToString(pubSubMessage)).Build()
+				resp = s.shard.client.Do(ctx, cmd)
 			} else {
 				resp = b.publishIdempotentScript.Exec(
-					context.Background(),
+					ctx,
 					s.shard.client,
 					[]string{string(resultKey)},
 					[]string{
-						convert.BytesToString(byteMessage),
+						convert.BytesToString(pubSubMessage),
 						publishChannelStr,
 						publishCommand,
 						resultExpire,
@@ -669,15 +920,15 @@ func (b *RedisBroker) publish(s *shardWrapper, ch string, data []byte, opts Publ
 				if publishChannelStr == "" {
 					return StreamPosition{}, false, nil
 				}
-				cmd := s.shard.client.B().Publish().Channel(string(publishChannel)).Message(convert.BytesToString(byteMessage)).Build()
-				resp = s.shard.client.Do(context.Background(), cmd)
+				cmd := s.shard.client.B().Publish().Channel(string(publishChannel)).Message(convert.BytesToString(pubSubMessage)).Build()
+				resp = s.shard.client.Do(ctx, cmd)
 			} else {
 				resp = b.publishIdempotentScript.Exec(
-					context.Background(),
+					ctx,
 					s.shard.client,
 					[]string{string(resultKey)},
 					[]string{
-						convert.BytesToString(byteMessage),
+						convert.BytesToString(pubSubMessage),
 						publishChannelStr,
 						publishCommand,
 						resultExpire,
@@ -689,6 +940,7 @@ func (b *RedisBroker) publish(s *shardWrapper, ch string, data []byte, opts Publ
 	}
 
 	historyMetaKey := b.historyMetaKey(s.shard, ch)
+	compactionKey := b.historyCompactionKey(s.shard, ch)
 
 	historyMetaTTL := opts.HistoryMetaTTL
 	if historyMetaTTL == 0 {
@@ -711,9 +963,9 @@ func (b *RedisBroker) publish(s *shardWrapper, ch string, data []byte, opts Publ
 	}
 
 	replies, err := script.Exec(
-		context.Background(),
+		ctx,
 		s.shard.client,
-		[]string{string(streamKey), string(historyMetaKey), string(resultKey)},
+		[]string{string(streamKey), string(historyMetaKey), string(resultKey), string(compactionKey)},
 		[]string{
 			convert.BytesToString(byteMessage),
 			strconv.Itoa(size),
@@ -723,6 +975,8 @@ func (b *RedisBroker) publish(s *shardWrapper, ch string, data []byte, opts Publ
 			strconv.FormatInt(time.Now().Unix(), 10),
 			publishCommand,
 			resultExpire,
+			convert.BytesToString(pubSubFields),
+			opts.CompactionKey,
 		},
 	).ToArray()
 	if err != nil {
@@ -885,14 +1139,19 @@ func (b *RedisBroker) unsubscribe(s *shardWrapper, ch string) error {
 
 // History - see Broker.History.
 func (b *RedisBroker) History(ch string, opts HistoryOptions) ([]*Publication, StreamPosition, error) {
-	return b.history(b.getShard(ch), ch, opts)
+	return b.history(context.Background(), b.getShard(ch), ch, opts)
+}
+
+// HistoryContext - see HistoryContextBroker.HistoryContext.
+func (b *RedisBroker) HistoryContext(ctx context.Context, ch string, opts HistoryOptions) ([]*Publication, StreamPosition, error) {
+	return b.history(ctx, b.getShard(ch), ch, opts)
 }
 
-func (b *RedisBroker) history(s *shardWrapper, ch string, opts HistoryOptions) ([]*Publication, StreamPosition, error) {
+func (b *RedisBroker) history(ctx context.Context, s *shardWrapper, ch string, opts HistoryOptions) ([]*Publication, StreamPosition, error) {
 	if b.config.UseLists {
-		return b.historyList(s.shard, ch, opts.Filter)
+		return b.historyList(ctx, s.shard, ch, opts.Filter)
 	}
-	return b.historyStream(s.shard, ch, opts)
+	return b.historyStream(ctx, s.shard, ch, opts)
 }
 
 // RemoveHistory - see Broker.RemoveHistory.
@@ -907,11 +1166,113 @@ func (b *RedisBroker) removeHistory(s *shardWrapper, ch string) error {
 	} else {
 		key = b.historyStreamKey(s.shard, ch)
 	}
-	cmd := s.shard.client.B().Del().Key(string(key)).Build()
+	compactionKey := b.historyCompactionKey(s.shard, ch)
+	cmd := s.shard.client.B().Del().Key(string(key), string(compactionKey)).Build()
 	resp := s.shard.client.Do(context.Background(), cmd)
 	return resp.Error()
 }
 
+// RemoveHistoryIfTop - see HistoryConditionalRemover interface description. Stream
+// meta is checked and history removed inside Lua script, so concurrent publication
+// can't be lost.
+func (b *RedisBroker) RemoveHistoryIfTop(ch string, top StreamPosition) (bool, error) {
+	s := b.getShard(ch)
+	var key channelID
+	if b.config.UseLists {
+		key = b.historyListKey(s.shard, ch)
+	} else {
+		key = b.historyStreamKey(s.shard, ch)
+	}
+	metaKey := b.historyMetaKey(s.shard, ch)
+	compactionKey := b.historyCompactionKey(s.shard, ch)
+	removed, err := b.removeHistoryScript.Exec(
+		context.Background(), s.shard.client,
+		[]string{string(key), string(metaKey), string(compactionKey)},
+		[]string{top.Epoch, strconv.FormatUint(top.Offset, 10)},
+	).AsInt64()
+	if err != nil {
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+// ResetHistory - see HistoryResetter interface description.
+func (b *RedisBroker) ResetHistory(ch string) error {
+	return b.resetHistory(b.getShard(ch), ch)
+}
+
+func (b *RedisBroker) resetHistory(s *shardWrapper, ch string) error {
+	var key channelID
+	if b.config.UseLists {
+		key = b.historyListKey(s.shard, ch)
+	} else {
+		key = b.historyStreamKey(s.shard, ch)
+	}
+	// Stream meta contains epoch, new epoch will be generated on next access.
+	metaKey := b.historyMetaKey(s.shard, ch)
+	compactionKey := b.historyCompactionKey(s.shard, ch)
+	cmd := s.shard.client.B().Del().Key(string(key), string(metaKey), string(compactionKey)).Build()
+	resp := s.shard.client.Do(context.Background(), cmd)
+	return resp.Error()
+}
+
+// ChannelActive - see ChannelActivityChecker interface description. Every node
+// subscribes to channel in Redis PUB/SUB while it has local subscribers, so number
+// of Redis subscribers to channel tells whether channel is active in cluster. Note,
+// in Redis Cluster without sharded PUB/SUB Redis only counts subscribers connected
+// to the queried Redis node.
+func (b *RedisBroker) ChannelActive(ch string) (bool, error) {
+	s := b.getShard(ch)
+	chID := string(b.messageChannelID(s.shard, ch))
+	var cmd rueidis.Completed
+	if b.useShardedPubSub(s.shard) {
+		cmd = s.shard.client.B().PubsubShardnumsub().Channel(chID).Build()
+	} else {
+		cmd = s.shard.client.B().PubsubNumsub().Channel(chID).Build()
+	}
+	replies, err := s.shard.client.Do(context.Background(), cmd).ToArray()
+	if err != nil {
+		return false, err
+	}
+	if len(replies) != 2 {
+		return false, errors.New("wrong number of replies for PUBSUB NUMSUB")
+	}
+	numSubscribers, err := replies[1].AsInt64()
+	if err != nil {
+		return false, err
+	}
+	return numSubscribers > 0, nil
+}
+
+// CloseChannel - see ChannelCloser interface description.
+func (b *RedisBroker) CloseChannel(ch string, ttl time.Duration) error {
+	s := b.getShard(ch).shard
+	cmd := s.client.B().Set().Key(string(b.closedChannelKey(s, ch))).Value("1").Px(ttl).Build()
+	return s.client.Do(context.Background(), cmd).Error()
+}
+
+// ChannelClosed - see ChannelCloser interface description.
+func (b *RedisBroker) ChannelClosed(ch string) (bool, error) {
+	s := b.getShard(ch).shard
+	cmd := s.client.B().Exists().Key(string(b.closedChannelKey(s, ch))).Build()
+	num, err := s.client.Do(context.Background(), cmd).AsInt64()
+	if err != nil {
+		return false, err
+	}
+	return num > 0, nil
+}
+
+func (b *RedisBroker) closedChannelKey(s *RedisShard, ch string) channelID {
+	if s.useCluster {
+		if b.config.numClusterShards > 0 {
+			ch = "{" + strconv.Itoa(consistentIndex(ch, b.config.numClusterShards)) + "}." + ch
+		} else {
+			ch = "{" + ch + "}"
+		}
+	}
+	return channelID(b.config.Prefix + ".closed." + ch)
+}
+
 func (b *RedisBroker) messageChannelID(s *RedisShard, ch string) channelID {
 	if b.useShardedPubSub(s) {
 		ch = "{" + strconv.Itoa(consistentIndex(ch, b.config.numClusterShards)) + "}." + ch
@@ -963,6 +1324,22 @@ func (b *RedisBroker) historyStreamKey(s *RedisShard, ch string) channelID {
 	return channelID(b.config.Prefix + ".stream." + ch)
 }
 
+// historyCompactionKey is a hash which maps publication compaction keys to
+// the entries of history stream (or list) to be replaced.
+func (b *RedisBroker) historyCompactionKey(s *RedisShard, ch string) channelID {
+	if s.useCluster {
+		if b.config.numClusterShards > 0 {
+			ch = "{" + strconv.Itoa(consistentIndex(ch, b.config.numClusterShards)) + "}." + ch
+		} else {
+			ch = "{" + ch + "}"
+		}
+	}
+	if b.config.UseLists {
+		return channelID(b.config.Prefix + ".list.compaction." + ch)
+	}
+	return channelID(b.config.Prefix + ".stream.compaction." + ch)
+}
+
 func (b *RedisBroker) historyMetaKey(s *RedisShard, ch string) channelID {
 	if s.useCluster {
 		if b.config.numClusterShards > 0 {
@@ -989,6 +1366,76 @@ func (b *RedisBroker) extractChannel(chID channelID) string {
 	return ch
 }
 
+// pubExcludeClientField is a field number used to attach PublishOptions.ExcludeClient
+// to a serialized protocol.Publication. Publication message does not define such a
+// field, so it's skipped as unknown when Publication is decoded (for example, upon
+// reading history).
+const pubExcludeClientField protowire.Number = 100
+
+func appendExcludeClient(data []byte, clientID string) []byte {
+	data = protowire.AppendTag(data, pubExcludeClientField, protowire.BytesType)
+	return protowire.AppendString(data, clientID)
+}
+
+// pubPublishTimeField is a field number used to attach publish time (Unix nanoseconds)
+// to a serialized protocol.Publication, see pubExcludeClientField.
+const pubPublishTimeField protowire.Number = 101
+
+func appendPublishTime(data []byte, publishTime int64) []byte {
+	data = protowire.AppendTag(data, pubPublishTimeField, protowire.Fixed64Type)
+	return protowire.AppendFixed64(data, uint64(publishTime))
+}
+
+func extractPublishTime(data []byte) int64 {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return 0
+		}
+		data = data[n:]
+		if num == pubPublishTimeField && typ == protowire.Fixed64Type {
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return 0
+			}
+			return int64(v)
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return 0
+		}
+		data = data[n:]
+	}
+	return 0
+}
+
+// maxPubSubLatency limits observed PUB/SUB latency. Bigger values (as well as negative)
+// are caused by clock skew between nodes rather than real delivery delays.
+const maxPubSubLatency = time.Minute
+
+func extractExcludeClient(data []byte) string {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ""
+		}
+		data = data[n:]
+		if num == pubExcludeClientField && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return ""
+			}
+			return v
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return ""
+		}
+		data = data[n:]
+	}
+	return ""
+}
+
 // Define prefixes to distinguish Join and Leave messages coming from PUB/SUB.
 var (
 	joinTypePrefix  = []byte("__j__")
@@ -1013,7 +1460,12 @@ func (b *RedisBroker) handleRedisClientMessage(eventHandler BrokerEventHandler,
 			// it to unmarshalled Publication.
 			pub.Offset = sp.Offset
 		}
-		_ = eventHandler.HandlePublication(channel, pubFromProto(&pub), sp)
+		if publishTime := extractPublishTime(pushData); publishTime > 0 {
+			if latency := time.Duration(time.Now().UnixNano() - publishTime); latency >= 0 && latency < maxPubSubLatency {
+				b.node.metrics.observePubSubLatency("redis", latency)
+			}
+		}
+		_ = eventHandler.HandlePublication(channel, withExcludeClient(pubFromProto(&pub), extractExcludeClient(pushData)), sp)
 	} else if pushType == joinPushType {
 		var info protocol.ClientInfo
 		err := info.UnmarshalVT(pushData)
@@ -1032,7 +1484,7 @@ func (b *RedisBroker) handleRedisClientMessage(eventHandler BrokerEventHandler,
 	return nil
 }
 
-func (b *RedisBroker) historyStream(s *RedisShard, ch string, opts HistoryOptions) ([]*Publication, StreamPosition, error) {
+func (b *RedisBroker) historyStream(ctx context.Context, s *RedisShard, ch string, opts HistoryOptions) ([]*Publication, StreamPosition, error) {
 	historyKey := b.historyStreamKey(s, ch)
 	historyMetaKey := b.historyMetaKey(s, ch)
 
@@ -1070,7 +1522,7 @@ func (b *RedisBroker) historyStream(s *RedisShard, ch string, opts HistoryOption
 
 	historyMetaTTLSeconds := int(historyMetaTTL.Seconds())
 
-	replies, err := b.historyStreamScript.Exec(context.Background(), s.client, []string{string(historyKey), string(historyMetaKey)}, []string{includePubs, strconv.FormatUint(offset, 10), strconv.Itoa(limit), reverse, strconv.Itoa(historyMetaTTLSeconds), strconv.FormatInt(time.Now().Unix(), 10)}).ToArray()
+	replies, err := b.historyStreamScript.Exec(ctx, s.client, []string{string(historyKey), string(historyMetaKey)}, []string{includePubs, strconv.FormatUint(offset, 10), strconv.Itoa(limit), reverse, strconv.Itoa(historyMetaTTLSeconds), strconv.FormatInt(time.Now().Unix(), 10)}).ToArray()
 	if err != nil {
 		return nil, StreamPosition{}, err
 	}
@@ -1147,7 +1599,7 @@ func (b *RedisBroker) historyStream(s *RedisShard, ch string, opts HistoryOption
 	return nil, StreamPosition{Offset: uint64(offs), Epoch: epoch}, nil
 }
 
-func (b *RedisBroker) historyList(s *RedisShard, ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
+func (b *RedisBroker) historyList(ctx context.Context, s *RedisShard, ch string, filter HistoryFilter) ([]*Publication, StreamPosition, error) {
 	historyKey := b.historyListKey(s, ch)
 	historyMetaKey := b.historyMetaKey(s, ch)
 
@@ -1160,7 +1612,7 @@ func (b *RedisBroker) historyList(s *RedisShard, ch string, filter HistoryFilter
 
 	historyMetaTTLSeconds := int(b.node.config.HistoryMetaTTL.Seconds())
 
-	replies, err := b.historyListScript.Exec(context.Background(), s.client, []string{string(historyKey), string(historyMetaKey)}, []string{includePubs, rightBound, strconv.Itoa(historyMetaTTLSeconds), strconv.FormatInt(time.Now().Unix(), 10)}).ToArray()
+	replies, err := b.historyListScript.Exec(ctx, s.client, []string{string(historyKey), string(historyMetaKey)}, []string{includePubs, rightBound, strconv.Itoa(historyMetaTTLSeconds), strconv.FormatInt(time.Now().Unix(), 10)}).ToArray()
 	if err != nil {
 		return nil, StreamPosition{}, err
 	}
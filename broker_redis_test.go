@@ -155,6 +155,31 @@ func TestRedisBroker_NoShards(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestRedisBroker_NegativePubSubProcessors(t *testing.T) {
+	n, _ := New(Config{})
+	_, err := NewRedisBroker(n, RedisBrokerConfig{
+		Shards:              []*RedisShard{{}},
+		NumPubSubProcessors: -1,
+	})
+	require.Error(t, err)
+	_, err = NewRedisBroker(n, RedisBrokerConfig{
+		Shards:                   []*RedisShard{{}},
+		PubSubProcessorQueueSize: -1,
+	})
+	require.Error(t, err)
+}
+
+func TestRedisBroker_PubSubQueueFullLogRateLimited(t *testing.T) {
+	s := &shardWrapper{}
+	now := time.Now()
+	require.Equal(t, int64(1), s.pubSubQueueFull(now))
+	for i := 0; i < 10; i++ {
+		require.Zero(t, s.pubSubQueueFull(now.Add(time.Second)))
+	}
+	// All occurrences since previous log entry are reported.
+	require.Equal(t, int64(11), s.pubSubQueueFull(now.Add(redisPubSubQueueFullLogInterval)))
+}
+
 func TestRedisBrokerSentinel(t *testing.T) {
 	b := NewTestRedisBrokerSentinel(t)
 	defer stopRedisBroker(b)
@@ -345,6 +370,120 @@ func TestRedisBrokerPublishIdempotent(t *testing.T) {
 	}
 }
 
+func TestRedisBrokerPublishCompacted(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+
+			b := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisBroker(b)
+
+			for _, key := range []string{"a", "b", "a"} {
+				_, _, err := b.Publish("channel", []byte(`"`+key+`"`), PublishOptions{
+					HistorySize:   10,
+					HistoryTTL:    time.Minute,
+					CompactionKey: key,
+				})
+				require.NoError(t, err)
+			}
+			pubs, sp, err := b.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1}})
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), sp.Offset)
+			require.Len(t, pubs, 2)
+			require.Equal(t, uint64(2), pubs[0].Offset)
+			require.Equal(t, []byte(`"b"`), pubs[0].Data)
+			require.Equal(t, uint64(3), pubs[1].Offset)
+			require.Equal(t, []byte(`"a"`), pubs[1].Data)
+
+			require.NoError(t, b.RemoveHistory("channel"))
+			_, _, err = b.Publish("channel", []byte(`"c"`), PublishOptions{
+				HistorySize:   10,
+				HistoryTTL:    time.Minute,
+				CompactionKey: "a",
+			})
+			require.NoError(t, err)
+			pubs, _, err = b.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1}})
+			require.NoError(t, err)
+			require.Len(t, pubs, 1)
+		})
+	}
+}
+
+func TestRedisBrokerStats(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+
+			b := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisBroker(b)
+
+			stats, err := b.Stats(context.Background())
+			require.NoError(t, err)
+			shards, ok := stats["shards"].([]map[string]any)
+			require.True(t, ok)
+			require.Len(t, shards, len(b.shards))
+			for _, shardStats := range shards {
+				require.NotContains(t, shardStats, "ping_error")
+				require.Contains(t, shardStats, "ping_latency")
+				require.Equal(t, true, shardStats["pub_sub_connected"])
+				require.Contains(t, shardStats, "pub_sub_last_connect")
+				require.Contains(t, shardStats, "pub_sub_queue_len")
+			}
+		})
+	}
+}
+
+func TestRedisBrokerShardForChannel(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+
+			b := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisBroker(b)
+
+			shard := b.ShardForChannel("test")
+			require.Equal(t, b.getShard("test").shard, shard)
+			client := shard.RedisClient()
+			key := "centrifuge_test_custom." + randString(8)
+			resp := client.Do(context.Background(), client.B().Set().Key(key).Value("1").Ex(time.Minute).Build())
+			require.NoError(t, resp.Error())
+			value, err := client.Do(context.Background(), client.B().Get().Key(key).Build()).ToString()
+			require.NoError(t, err)
+			require.Equal(t, "1", value)
+		})
+	}
+}
+
+func TestRedisBrokerCloseChannel(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+
+			b := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisBroker(b)
+
+			ch := "test" + randString(8)
+			closed, err := b.ChannelClosed(ch)
+			require.NoError(t, err)
+			require.False(t, closed)
+
+			require.NoError(t, b.CloseChannel(ch, 500*time.Millisecond))
+			closed, err = b.ChannelClosed(ch)
+			require.NoError(t, err)
+			require.True(t, closed)
+
+			time.Sleep(time.Second)
+			closed, err = b.ChannelClosed(ch)
+			require.NoError(t, err)
+			require.False(t, closed)
+		})
+	}
+}
+
 func TestRedisCurrentPosition(t *testing.T) {
 	for _, tt := range redisTests {
 		t.Run(tt.Name, func(t *testing.T) {
@@ -449,12 +588,69 @@ func TestRedisBrokerRecover(t *testing.T) {
 	}
 }
 
+func TestRedisBrokerRemoveHistoryIfTop(t *testing.T) {
+	for _, tt := range redisTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			b := newTestRedisBroker(t, node, tt.UseStreams, tt.UseCluster)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisBroker(b)
+
+			rawData := []byte("{}")
+
+			top, _, err := b.Publish("channel", rawData, PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+			_, _, err = b.Publish("channel", rawData, PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+			require.NoError(t, err)
+
+			removed, err := b.RemoveHistoryIfTop("channel", top)
+			require.NoError(t, err)
+			require.False(t, removed)
+			pubs, currentTop, err := b.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1}})
+			require.NoError(t, err)
+			require.Len(t, pubs, 2)
+
+			removed, err = b.RemoveHistoryIfTop("channel", currentTop)
+			require.NoError(t, err)
+			require.True(t, removed)
+			pubs, _, err = b.History("channel", HistoryOptions{Filter: HistoryFilter{Limit: -1}})
+			require.NoError(t, err)
+			require.Len(t, pubs, 0)
+		})
+	}
+}
+
 func pubSubChannels(t *testing.T, e *RedisBroker) ([]string, error) {
 	t.Helper()
 	client := e.shards[0].shard.client
 	return client.Do(context.Background(), client.B().PubsubChannels().Pattern(e.messagePrefix+"*").Build()).AsStrSlice()
 }
 
+func TestRedisBrokerChannelActive(t *testing.T) {
+	node := testNode(t)
+	b := NewTestRedisBroker(t, node, getUniquePrefix(), false)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	defer stopRedisBroker(b)
+
+	active, err := b.ChannelActive("active-test")
+	require.NoError(t, err)
+	require.False(t, active)
+
+	require.NoError(t, b.Subscribe("active-test"))
+	require.Eventually(t, func() bool {
+		active, err := b.ChannelActive("active-test")
+		require.NoError(t, err)
+		return active
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, b.Unsubscribe("active-test"))
+	require.Eventually(t, func() bool {
+		active, err := b.ChannelActive("active-test")
+		require.NoError(t, err)
+		return !active
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
 func TestRedisBrokerSubscribeUnsubscribe(t *testing.T) {
 	// Custom prefix to not collide with other tests.
 	node := testNode(t)
@@ -757,6 +953,44 @@ func BenchmarkRedisExtractPushData(b *testing.B) {
 	}
 }
 
+func TestRedisPublicationExcludeClient(t *testing.T) {
+	protoPub := &protocol.Publication{
+		Data: []byte(`{"data":"x"}`),
+		Tags: map[string]string{"tag": "value"},
+	}
+	data, err := protoPub.MarshalVT()
+	require.NoError(t, err)
+	require.Equal(t, "", extractExcludeClient(data))
+
+	data = appendExcludeClient(data, "client")
+	require.Equal(t, "client", extractExcludeClient(data))
+
+	var pub protocol.Publication
+	require.NoError(t, pub.UnmarshalVT(data))
+	require.Equal(t, protoPub.Data, pub.Data)
+	require.Equal(t, protoPub.Tags, pub.Tags)
+	require.Empty(t, pubFromProto(&pub).ExcludeClient)
+}
+
+func TestRedisPublicationPublishTime(t *testing.T) {
+	protoPub := &protocol.Publication{
+		Data: []byte(`{"data":"x"}`),
+	}
+	data, err := protoPub.MarshalVT()
+	require.NoError(t, err)
+	require.Zero(t, extractPublishTime(data))
+
+	publishTime := time.Now().UnixNano()
+	data = appendExcludeClient(data, "client")
+	data = appendPublishTime(data, publishTime)
+	require.Equal(t, publishTime, extractPublishTime(data))
+	require.Equal(t, "client", extractExcludeClient(data))
+
+	var pub protocol.Publication
+	require.NoError(t, pub.UnmarshalVT(data))
+	require.Equal(t, protoPub.Data, pub.Data)
+}
+
 func TestRedisExtractPushData(t *testing.T) {
 	data := []byte(`__p1:16901:xyz.123__\x12\nchat:index\x1aU\"\x0e{\"input\":\"__\"}*C\n\x0242\x12$37cb00a9-bcfa-4284-a1ae-607c7da3a8f4\x1a\x15{\"name\": \"Alexander\"}\"\x00`)
 	pushData, pushType, sp, ok := extractPushData(data)
@@ -956,7 +1190,9 @@ func TestRedisPubSubTwoNodes(t *testing.T) {
 		Prefix:               prefix,
 		Shards:               []*RedisShard{s},
 		numPubSubSubscribers: 4,
-		numPubSubProcessors:  2,
+		NumPubSubProcessors:  2,
+		// Small queue to exercise processor queue saturation.
+		PubSubProcessorQueueSize: 1,
 	})
 	node1.SetBroker(b1)
 	defer func() { _ = node1.Shutdown(context.Background()) }()
@@ -1536,7 +1772,7 @@ func testRedisClientSubscribeRecover(t *testing.T, tt recoverTest, useStreams bo
 
 	historyResult, err := node.recoverHistory(channel, StreamPosition{tt.SinceOffset, streamTop.Epoch}, 0)
 	require.NoError(t, err)
-	recoveredPubs, recovered := isRecovered(historyResult, tt.SinceOffset, streamTop.Epoch)
+	recoveredPubs, recovered := isRecovered(historyResult, tt.SinceOffset, streamTop.Epoch, false)
 	require.Equal(t, tt.NumRecovered, len(recoveredPubs))
 	require.Equal(t, tt.Recovered, recovered)
 }
@@ -1696,7 +1932,7 @@ func BenchmarkPubSubThroughput(b *testing.B) {
 				Shards:               []*RedisShard{s},
 				numPubSubShards:      tt.NumPubSubShards,
 				numPubSubSubscribers: tt.NumPubSubSubscribers,
-				numPubSubProcessors:  tt.NumPubSubProcessors,
+				NumPubSubProcessors:  tt.NumPubSubProcessors,
 			})
 			defer stopRedisBroker(b1)
 
@@ -0,0 +1,105 @@
+package centrifuge
+
+import (
+	"sync"
+)
+
+// brokerSubscriptions keeps channels Node is subscribed to in Broker to reconcile
+// them with Hub channels. See Config.BrokerSubscriptionReconcileInterval.
+type brokerSubscriptions struct {
+	mu sync.Mutex
+	// channels map value is true when unsubscription from channel is scheduled
+	// but not yet done by subDissolver.
+	channels map[string]bool
+}
+
+func newBrokerSubscriptions() *brokerSubscriptions {
+	return &brokerSubscriptions{
+		channels: make(map[string]bool),
+	}
+}
+
+func (s *brokerSubscriptions) add(ch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[ch] = false
+}
+
+// unsubscribing marks channel as waiting for delayed unsubscription.
+func (s *brokerSubscriptions) unsubscribing(ch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[ch]; ok {
+		s.channels[ch] = true
+	}
+}
+
+func (s *brokerSubscriptions) remove(ch string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.channels, ch)
+}
+
+// state returns whether Node is subscribed to channel in Broker and whether
+// unsubscription is pending.
+func (s *brokerSubscriptions) state(ch string) (subscribed bool, pending bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, subscribed = s.channels[ch]
+	return subscribed, pending
+}
+
+func (s *brokerSubscriptions) channelNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channels := make([]string, 0, len(s.channels))
+	for ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// reconcileBrokerSubscriptions compares channels subscribed in Broker with Hub
+// channels and issues corrective Subscribe/Unsubscribe calls.
+func (n *Node) reconcileBrokerSubscriptions() {
+	for _, ch := range n.hub.Channels() {
+		if subscribed, _ := n.brokerSubscriptions.state(ch); !subscribed {
+			n.reconcileBrokerSubscription(ch)
+		}
+	}
+	for _, ch := range n.brokerSubscriptions.channelNames() {
+		n.reconcileBrokerSubscription(ch)
+	}
+}
+
+func (n *Node) reconcileBrokerSubscription(ch string) {
+	mu := n.subLock(ch)
+	mu.Lock()
+	defer mu.Unlock()
+	subscribed, pending := n.brokerSubscriptions.state(ch)
+	if pending {
+		// subDissolver will unsubscribe.
+		return
+	}
+	hasSubscribers := n.hub.NumSubscribers(ch) > 0
+	if hasSubscribers == subscribed {
+		return
+	}
+	if hasSubscribers {
+		n.logger.log(newLogEntry(LogLevelWarn, "channel with subscribers not subscribed in broker, subscribing", map[string]any{"channel": ch}))
+		if err := n.broker.Subscribe(ch); err != nil {
+			n.logger.log(newErrorLogEntry(err, "error subscribing to channel during reconciliation", map[string]any{"channel": ch}))
+			return
+		}
+		n.brokerSubscriptions.add(ch)
+		n.metrics.incBrokerSubscriptionReconciled("subscribe")
+		return
+	}
+	n.logger.log(newLogEntry(LogLevelWarn, "channel without subscribers subscribed in broker, unsubscribing", map[string]any{"channel": ch}))
+	if err := n.broker.Unsubscribe(ch); err != nil {
+		n.logger.log(newErrorLogEntry(err, "error unsubscribing from channel during reconciliation", map[string]any{"channel": ch}))
+		return
+	}
+	n.brokerSubscriptions.remove(ch)
+	n.metrics.incBrokerSubscriptionReconciled("unsubscribe")
+}
@@ -0,0 +1,71 @@
+package centrifuge
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_reconcileBrokerSubscriptions(t *testing.T) {
+	node, err := New(Config{BrokerSubscriptionReconcileInterval: time.Hour})
+	require.NoError(t, err)
+	broker := NewTestBroker()
+	node.SetBroker(broker)
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+	require.NoError(t, node.Run())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+	require.EqualValues(t, 1, atomic.LoadInt32(&broker.subscribeCount))
+	subscribed, _ := node.brokerSubscriptions.state("test")
+	require.True(t, subscribed)
+
+	// Nothing to reconcile.
+	node.reconcileBrokerSubscriptions()
+	require.EqualValues(t, 1, atomic.LoadInt32(&broker.subscribeCount))
+	require.EqualValues(t, 0, atomic.LoadInt32(&broker.unsubscribeCount))
+
+	// Channel with subscribers lost in broker.
+	node.brokerSubscriptions.remove("test")
+	// Channel without subscribers left in broker.
+	node.brokerSubscriptions.add("stale")
+	// Channel waiting for delayed unsubscribe is not touched.
+	node.brokerSubscriptions.add("pending")
+	node.brokerSubscriptions.unsubscribing("pending")
+
+	node.reconcileBrokerSubscriptions()
+	require.EqualValues(t, 2, atomic.LoadInt32(&broker.subscribeCount))
+	require.EqualValues(t, 1, atomic.LoadInt32(&broker.unsubscribeCount))
+	subscribed, _ = node.brokerSubscriptions.state("test")
+	require.True(t, subscribed)
+	subscribed, _ = node.brokerSubscriptions.state("stale")
+	require.False(t, subscribed)
+	subscribed, pending := node.brokerSubscriptions.state("pending")
+	require.True(t, subscribed)
+	require.True(t, pending)
+}
+
+func TestNode_addSubscriptionBrokerErrorRollback(t *testing.T) {
+	node, err := New(Config{BrokerSubscriptionReconcileInterval: time.Hour})
+	require.NoError(t, err)
+	broker := NewTestBroker()
+	broker.errorOnSubscribe = true
+	node.SetBroker(broker)
+	require.NoError(t, node.Run())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	require.Error(t, node.addSubscription("test", client))
+	require.Equal(t, 0, node.hub.NumSubscribers("test"))
+	subscribed, _ := node.brokerSubscriptions.state("test")
+	require.False(t, subscribed)
+}
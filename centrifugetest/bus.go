@@ -0,0 +1,273 @@
+// Package centrifugetest contains helpers to test Centrifuge-based
+// applications. Its main part is Bus – an in-process replacement for
+// a real broker (like Redis) which allows running several Centrifuge
+// nodes inside one test process and exchanging publications, join/leave
+// messages and control commands between them.
+package centrifugetest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/centrifugal/centrifuge/internal/saferand"
+)
+
+// BusConfig is a configuration for Bus.
+type BusConfig struct {
+	// Latency is an artificial delay applied to every message delivered
+	// over Bus. Delivery order to each node is still preserved. Zero value
+	// means that messages are delivered synchronously inside publish call.
+	Latency time.Duration
+	// DropProbability is a probability in range [0, 1] that a message will
+	// not be delivered to a node. Drop decision is made for each receiving
+	// node separately. Useful to test gap detection and recovery.
+	DropProbability float64
+	// Seed for drop decisions. Set it to get reproducible drops.
+	Seed int64
+}
+
+// Bus connects Brokers of several Nodes running in one process. Publication
+// history is shared between all Brokers created by the same Bus, just like
+// it is when nodes use one Redis instance.
+type Bus struct {
+	config BusConfig
+	rand   *saferand.Rand
+
+	mu       sync.RWMutex
+	history  *centrifuge.MemoryBroker
+	started  bool
+	handlers map[*Broker]centrifuge.BrokerEventHandler
+}
+
+// NewBus creates new Bus.
+func NewBus(config BusConfig) (*Bus, error) {
+	if config.DropProbability < 0 || config.DropProbability > 1 {
+		return nil, errors.New("drop probability must be in range [0, 1]")
+	}
+	if config.Latency < 0 {
+		return nil, errors.New("latency must not be negative")
+	}
+	return &Bus{
+		config:   config,
+		rand:     saferand.New(config.Seed),
+		handlers: map[*Broker]centrifuge.BrokerEventHandler{},
+	}, nil
+}
+
+// NewBroker creates Broker connected to Bus for the provided Node. Call
+// Node.SetBroker with the result before running Node.
+func (b *Bus) NewBroker(n *centrifuge.Node) (*Broker, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.history == nil {
+		history, err := centrifuge.NewMemoryBroker(n, centrifuge.MemoryBrokerConfig{})
+		if err != nil {
+			return nil, err
+		}
+		b.history = history
+	}
+	return &Broker{
+		bus:     b,
+		node:    n,
+		queue:   make(chan busMessage, 1024),
+		closeCh: make(chan struct{}),
+	}, nil
+}
+
+func (b *Bus) register(broker *Broker, h centrifuge.BrokerEventHandler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[broker] = h
+	if !b.started {
+		b.started = true
+		return b.history.Run(busEventHandler{bus: b})
+	}
+	return nil
+}
+
+func (b *Bus) unregister(broker *Broker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, broker)
+	if b.started && len(b.handlers) == 0 {
+		// Last node left – release resources of shared history storage.
+		_ = b.history.Close(context.Background())
+	}
+}
+
+func (b *Bus) drop() bool {
+	p := b.config.DropProbability
+	if p <= 0 {
+		return false
+	}
+	return float64(b.rand.Int63n(1_000_000)) < p*1_000_000
+}
+
+// broadcast delivers message to all registered brokers, or only to a broker
+// of node with nodeID if it's not empty.
+func (b *Bus) broadcast(nodeID string, fn func(h centrifuge.BrokerEventHandler) error) error {
+	b.mu.RLock()
+	handlers := make(map[*Broker]centrifuge.BrokerEventHandler, len(b.handlers))
+	for broker, h := range b.handlers {
+		handlers[broker] = h
+	}
+	b.mu.RUnlock()
+	for broker, h := range handlers {
+		if nodeID != "" && broker.node.ID() != nodeID {
+			continue
+		}
+		if b.drop() {
+			continue
+		}
+		if err := broker.deliver(h, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// busEventHandler receives events from shared MemoryBroker and fans
+// them out to all nodes.
+type busEventHandler struct {
+	bus *Bus
+}
+
+func (h busEventHandler) HandlePublication(ch string, pub *centrifuge.Publication, sp centrifuge.StreamPosition) error {
+	return h.bus.broadcast("", func(h centrifuge.BrokerEventHandler) error {
+		return h.HandlePublication(ch, pub, sp)
+	})
+}
+
+func (h busEventHandler) HandleJoin(ch string, info *centrifuge.ClientInfo) error {
+	return h.bus.broadcast("", func(h centrifuge.BrokerEventHandler) error {
+		return h.HandleJoin(ch, info)
+	})
+}
+
+func (h busEventHandler) HandleLeave(ch string, info *centrifuge.ClientInfo) error {
+	return h.bus.broadcast("", func(h centrifuge.BrokerEventHandler) error {
+		return h.HandleLeave(ch, info)
+	})
+}
+
+func (h busEventHandler) HandleControl(data []byte) error {
+	return h.bus.broadcast("", func(h centrifuge.BrokerEventHandler) error {
+		return h.HandleControl(data)
+	})
+}
+
+type busMessage struct {
+	deliverAt time.Time
+	handler   centrifuge.BrokerEventHandler
+	fn        func(h centrifuge.BrokerEventHandler) error
+}
+
+// Broker is a centrifuge.Broker connected to Bus.
+type Broker struct {
+	bus  *Bus
+	node *centrifuge.Node
+
+	queue     chan busMessage
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+var _ centrifuge.Broker = (*Broker)(nil)
+var _ centrifuge.HistoryResetter = (*Broker)(nil)
+var _ centrifuge.Closer = (*Broker)(nil)
+
+func (b *Broker) deliver(h centrifuge.BrokerEventHandler, fn func(h centrifuge.BrokerEventHandler) error) error {
+	if b.bus.config.Latency == 0 {
+		return fn(h)
+	}
+	select {
+	case b.queue <- busMessage{deliverAt: time.Now().Add(b.bus.config.Latency), handler: h, fn: fn}:
+	case <-b.closeCh:
+	}
+	return nil
+}
+
+func (b *Broker) runDelivery() {
+	for {
+		select {
+		case <-b.closeCh:
+			return
+		case msg := <-b.queue:
+			if d := time.Until(msg.deliverAt); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-b.closeCh:
+					return
+				}
+			}
+			_ = msg.fn(msg.handler)
+		}
+	}
+}
+
+// Run - see centrifuge.Broker interface description.
+func (b *Broker) Run(h centrifuge.BrokerEventHandler) error {
+	if b.bus.config.Latency > 0 {
+		go b.runDelivery()
+	}
+	return b.bus.register(b, h)
+}
+
+// Close disconnects Broker from Bus.
+func (b *Broker) Close(_ context.Context) error {
+	b.closeOnce.Do(func() {
+		b.bus.unregister(b)
+		close(b.closeCh)
+	})
+	return nil
+}
+
+// Subscribe is noop here – all messages delivered to all nodes.
+func (b *Broker) Subscribe(_ string) error {
+	return nil
+}
+
+// Unsubscribe is noop here.
+func (b *Broker) Unsubscribe(_ string) error {
+	return nil
+}
+
+// Publish - see centrifuge.Broker interface description.
+func (b *Broker) Publish(ch string, data []byte, opts centrifuge.PublishOptions) (centrifuge.StreamPosition, bool, error) {
+	return b.bus.history.Publish(ch, data, opts)
+}
+
+// PublishJoin - see centrifuge.Broker interface description.
+func (b *Broker) PublishJoin(ch string, info *centrifuge.ClientInfo) error {
+	return b.bus.history.PublishJoin(ch, info)
+}
+
+// PublishLeave - see centrifuge.Broker interface description.
+func (b *Broker) PublishLeave(ch string, info *centrifuge.ClientInfo) error {
+	return b.bus.history.PublishLeave(ch, info)
+}
+
+// PublishControl - see centrifuge.Broker interface description.
+func (b *Broker) PublishControl(data []byte, nodeID, _ string) error {
+	return b.bus.broadcast(nodeID, func(h centrifuge.BrokerEventHandler) error {
+		return h.HandleControl(data)
+	})
+}
+
+// History - see centrifuge.Broker interface description.
+func (b *Broker) History(ch string, opts centrifuge.HistoryOptions) ([]*centrifuge.Publication, centrifuge.StreamPosition, error) {
+	return b.bus.history.History(ch, opts)
+}
+
+// RemoveHistory - see centrifuge.Broker interface description.
+func (b *Broker) RemoveHistory(ch string) error {
+	return b.bus.history.RemoveHistory(ch)
+}
+
+// ResetHistory - see centrifuge.HistoryResetter interface description.
+func (b *Broker) ResetHistory(ch string) error {
+	return b.bus.history.ResetHistory(ch)
+}
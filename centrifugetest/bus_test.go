@@ -0,0 +1,145 @@
+package centrifugetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/stretchr/testify/require"
+)
+
+func newBusNode(t *testing.T, bus *Bus) *centrifuge.Node {
+	t.Helper()
+	n, err := centrifuge.New(centrifuge.Config{})
+	require.NoError(t, err)
+	b, err := bus.NewBroker(n)
+	require.NoError(t, err)
+	n.SetBroker(b)
+	t.Cleanup(func() { _ = n.Shutdown(context.Background()) })
+	return n
+}
+
+func runBusNodes(t *testing.T, nodes ...*centrifuge.Node) {
+	t.Helper()
+	for _, n := range nodes {
+		require.NoError(t, n.Run())
+	}
+}
+
+func TestBusNotify(t *testing.T) {
+	bus, err := NewBus(BusConfig{})
+	require.NoError(t, err)
+	node1 := newBusNode(t, bus)
+	node2 := newBusNode(t, bus)
+
+	received := make(chan centrifuge.NotificationEvent, 1)
+	node1.OnNotification(func(centrifuge.NotificationEvent) {})
+	node2.OnNotification(func(e centrifuge.NotificationEvent) {
+		received <- e
+	})
+	runBusNodes(t, node1, node2)
+
+	require.NoError(t, node1.Notify("test", []byte("data"), node2.ID()))
+	select {
+	case e := <-received:
+		require.Equal(t, node1.ID(), e.FromNodeID)
+		require.Equal(t, "test", e.Op)
+		require.Equal(t, []byte("data"), e.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+	}
+}
+
+func TestBusNodeRegistry(t *testing.T) {
+	bus, err := NewBus(BusConfig{})
+	require.NoError(t, err)
+	node1 := newBusNode(t, bus)
+	node2 := newBusNode(t, bus)
+	runBusNodes(t, node1, node2)
+
+	require.Eventually(t, func() bool {
+		info, err := node1.Info()
+		return err == nil && len(info.Nodes) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBusSharedHistory(t *testing.T) {
+	bus, err := NewBus(BusConfig{})
+	require.NoError(t, err)
+	node1 := newBusNode(t, bus)
+	node2 := newBusNode(t, bus)
+	runBusNodes(t, node1, node2)
+
+	_, err = node1.Publish("test", []byte(`{}`), centrifuge.WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	res, err := node2.History("test", centrifuge.WithLimit(centrifuge.NoLimit))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 1)
+	require.Equal(t, uint64(1), res.Offset)
+}
+
+func TestBusDrop(t *testing.T) {
+	bus, err := NewBus(BusConfig{DropProbability: 1})
+	require.NoError(t, err)
+	node1 := newBusNode(t, bus)
+	node2 := newBusNode(t, bus)
+
+	received := make(chan centrifuge.NotificationEvent, 1)
+	node1.OnNotification(func(centrifuge.NotificationEvent) {})
+	node2.OnNotification(func(e centrifuge.NotificationEvent) {
+		received <- e
+	})
+	runBusNodes(t, node1, node2)
+
+	require.NoError(t, node1.Notify("test", nil, node2.ID()))
+	select {
+	case <-received:
+		t.Fatal("notification must be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// History is not affected by drops.
+	_, err = node1.Publish("test", []byte(`{}`), centrifuge.WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	res, err := node2.History("test", centrifuge.WithLimit(centrifuge.NoLimit))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 1)
+}
+
+func TestBusLatency(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	bus, err := NewBus(BusConfig{Latency: latency})
+	require.NoError(t, err)
+	node1 := newBusNode(t, bus)
+	node2 := newBusNode(t, bus)
+
+	received := make(chan string, 3)
+	node1.OnNotification(func(centrifuge.NotificationEvent) {})
+	node2.OnNotification(func(e centrifuge.NotificationEvent) {
+		received <- e.Op
+	})
+	runBusNodes(t, node1, node2)
+
+	started := time.Now()
+	for _, op := range []string{"1", "2", "3"} {
+		require.NoError(t, node1.Notify(op, nil, node2.ID()))
+	}
+	for _, op := range []string{"1", "2", "3"} {
+		select {
+		case got := <-received:
+			require.Equal(t, op, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("notification not received")
+		}
+	}
+	require.GreaterOrEqual(t, time.Since(started), latency)
+}
+
+func TestNewBusInvalidConfig(t *testing.T) {
+	_, err := NewBus(BusConfig{DropProbability: 2})
+	require.Error(t, err)
+	_, err = NewBus(BusConfig{Latency: -time.Second})
+	require.Error(t, err)
+}
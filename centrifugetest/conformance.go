@@ -0,0 +1,356 @@
+package centrifugetest
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/stretchr/testify/require"
+)
+
+// NewBrokerFunc creates Broker for the provided Node. Broker must not be
+// running yet – conformance suite calls Broker.Run itself.
+type NewBrokerFunc func(t *testing.T, n *centrifuge.Node) centrifuge.Broker
+
+// NewPresenceManagerFunc creates PresenceManager for the provided Node.
+// Presence information must expire after presenceTTL.
+type NewPresenceManagerFunc func(t *testing.T, n *centrifuge.Node, presenceTTL time.Duration) centrifuge.PresenceManager
+
+const conformanceWaitTimeout = 5 * time.Second
+
+// TestBrokerConformance checks that Broker implementation satisfies the behavioral
+// contract described in centrifuge.Broker interface docs. Call it from a test of
+// custom Broker implementation.
+func TestBrokerConformance(t *testing.T, newBroker NewBrokerFunc) {
+	t.Run("publication_delivered_to_handler", func(t *testing.T) {
+		b, h := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		require.NoError(t, b.Subscribe(ch))
+		waitForEvent(t, h.publications, func() {
+			_, _, err := b.Publish(ch, []byte(`{"data":"x"}`), centrifuge.PublishOptions{
+				Tags: map[string]string{"tag": "value"},
+			})
+			require.NoError(t, err)
+		}, func(e conformanceEvent) bool {
+			return e.ch == ch && string(e.pub.Data) == `{"data":"x"}` && e.pub.Tags["tag"] == "value"
+		})
+	})
+
+	t.Run("join_and_leave_delivered_to_handler", func(t *testing.T) {
+		b, h := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		require.NoError(t, b.Subscribe(ch))
+		info := &centrifuge.ClientInfo{ClientID: "client", UserID: "user"}
+		waitForEvent(t, h.joins, func() {
+			require.NoError(t, b.PublishJoin(ch, info))
+		}, func(e conformanceEvent) bool {
+			return e.ch == ch && e.info.ClientID == "client" && e.info.UserID == "user"
+		})
+		waitForEvent(t, h.leaves, func() {
+			require.NoError(t, b.PublishLeave(ch, info))
+		}, func(e conformanceEvent) bool {
+			return e.ch == ch && e.info.ClientID == "client" && e.info.UserID == "user"
+		})
+	})
+
+	t.Run("control_delivered_to_handler", func(t *testing.T) {
+		b, h := runConformanceBroker(t, newBroker)
+		waitForEvent(t, h.controls, func() {
+			require.NoError(t, b.PublishControl([]byte("control"), "", ""))
+		}, func(e conformanceEvent) bool {
+			return string(e.data) == "control"
+		})
+	})
+
+	t.Run("history_size_and_ordering", func(t *testing.T) {
+		b, _ := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		var sp centrifuge.StreamPosition
+		for i := 1; i <= 5; i++ {
+			var err error
+			sp, _, err = b.Publish(ch, []byte(strconv.Itoa(i)), centrifuge.PublishOptions{
+				HistorySize: 3,
+				HistoryTTL:  time.Minute,
+			})
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), sp.Offset)
+		}
+		pubs, top, err := b.History(ch, centrifuge.HistoryOptions{
+			Filter: centrifuge.HistoryFilter{Limit: centrifuge.NoLimit},
+		})
+		require.NoError(t, err)
+		require.Equal(t, sp, top)
+		require.Len(t, pubs, 3)
+		for i, pub := range pubs {
+			require.Equal(t, uint64(i+3), pub.Offset)
+			require.Equal(t, strconv.Itoa(i+3), string(pub.Data))
+		}
+	})
+
+	t.Run("history_limit_and_reverse", func(t *testing.T) {
+		b, _ := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		publishHistory(t, b, ch, 5)
+
+		pubs, top, err := b.History(ch, centrifuge.HistoryOptions{
+			Filter: centrifuge.HistoryFilter{Limit: 0},
+		})
+		require.NoError(t, err)
+		require.Len(t, pubs, 0)
+		require.Equal(t, uint64(5), top.Offset)
+
+		pubs, _, err = b.History(ch, centrifuge.HistoryOptions{
+			Filter: centrifuge.HistoryFilter{Limit: 2},
+		})
+		require.NoError(t, err)
+		require.Len(t, pubs, 2)
+		require.Equal(t, uint64(1), pubs[0].Offset)
+		require.Equal(t, uint64(2), pubs[1].Offset)
+
+		pubs, _, err = b.History(ch, centrifuge.HistoryOptions{
+			Filter: centrifuge.HistoryFilter{Limit: 2, Reverse: true},
+		})
+		require.NoError(t, err)
+		require.Len(t, pubs, 2)
+		require.Equal(t, uint64(5), pubs[0].Offset)
+		require.Equal(t, uint64(4), pubs[1].Offset)
+	})
+
+	t.Run("history_since_position", func(t *testing.T) {
+		b, _ := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		sp := publishHistory(t, b, ch, 5)
+
+		pubs, top, err := b.History(ch, centrifuge.HistoryOptions{
+			Filter: centrifuge.HistoryFilter{
+				Since: &centrifuge.StreamPosition{Offset: 2, Epoch: sp.Epoch},
+				Limit: centrifuge.NoLimit,
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, sp, top)
+		require.Len(t, pubs, 3)
+		require.Equal(t, uint64(3), pubs[0].Offset)
+		require.Equal(t, uint64(5), pubs[2].Offset)
+	})
+
+	t.Run("history_expires", func(t *testing.T) {
+		b, _ := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		_, _, err := b.Publish(ch, []byte(`{}`), centrifuge.PublishOptions{
+			HistorySize: 10,
+			HistoryTTL:  time.Second,
+		})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			pubs, _, err := b.History(ch, centrifuge.HistoryOptions{
+				Filter: centrifuge.HistoryFilter{Limit: centrifuge.NoLimit},
+			})
+			return err == nil && len(pubs) == 0
+		}, conformanceWaitTimeout, 100*time.Millisecond)
+	})
+
+	t.Run("history_remove", func(t *testing.T) {
+		b, _ := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		publishHistory(t, b, ch, 2)
+		require.NoError(t, b.RemoveHistory(ch))
+		pubs, _, err := b.History(ch, centrifuge.HistoryOptions{
+			Filter: centrifuge.HistoryFilter{Limit: centrifuge.NoLimit},
+		})
+		require.NoError(t, err)
+		require.Len(t, pubs, 0)
+	})
+
+	t.Run("idempotent_publish", func(t *testing.T) {
+		b, _ := runConformanceBroker(t, newBroker)
+		ch := uniqueChannel()
+		opts := centrifuge.PublishOptions{
+			HistorySize:    10,
+			HistoryTTL:     time.Minute,
+			IdempotencyKey: "key",
+		}
+		sp1, suppressed, err := b.Publish(ch, []byte(`{}`), opts)
+		require.NoError(t, err)
+		require.False(t, suppressed)
+		sp2, suppressed, err := b.Publish(ch, []byte(`{}`), opts)
+		require.NoError(t, err)
+		require.True(t, suppressed)
+		require.Equal(t, sp1, sp2)
+	})
+}
+
+// TestPresenceManagerConformance checks that PresenceManager implementation satisfies
+// the behavioral contract described in centrifuge.PresenceManager interface docs.
+func TestPresenceManagerConformance(t *testing.T, newPresenceManager NewPresenceManagerFunc) {
+	t.Run("add_and_remove", func(t *testing.T) {
+		m := newConformancePresenceManager(t, newPresenceManager, time.Minute)
+		ch := uniqueChannel()
+		require.NoError(t, m.AddPresence(ch, "client1", &centrifuge.ClientInfo{ClientID: "client1", UserID: "user1"}))
+		require.NoError(t, m.AddPresence(ch, "client2", &centrifuge.ClientInfo{ClientID: "client2", UserID: "user1"}))
+		require.NoError(t, m.AddPresence(ch, "client3", &centrifuge.ClientInfo{ClientID: "client3", UserID: "user2"}))
+
+		presence, err := m.Presence(ch)
+		require.NoError(t, err)
+		require.Len(t, presence, 3)
+		require.Equal(t, "user1", presence["client1"].UserID)
+
+		stats, err := m.PresenceStats(ch)
+		require.NoError(t, err)
+		require.Equal(t, centrifuge.PresenceStats{NumClients: 3, NumUsers: 2}, stats)
+
+		require.NoError(t, m.RemovePresence(ch, "client1", "user1"))
+		presence, err = m.Presence(ch)
+		require.NoError(t, err)
+		require.Len(t, presence, 2)
+		require.NotContains(t, presence, "client1")
+
+		stats, err = m.PresenceStats(ch)
+		require.NoError(t, err)
+		require.Equal(t, centrifuge.PresenceStats{NumClients: 2, NumUsers: 2}, stats)
+	})
+
+	t.Run("add_updates_info", func(t *testing.T) {
+		m := newConformancePresenceManager(t, newPresenceManager, time.Minute)
+		ch := uniqueChannel()
+		require.NoError(t, m.AddPresence(ch, "client", &centrifuge.ClientInfo{ClientID: "client", UserID: "user", ConnInfo: []byte(`{"v":1}`)}))
+		require.NoError(t, m.AddPresence(ch, "client", &centrifuge.ClientInfo{ClientID: "client", UserID: "user", ConnInfo: []byte(`{"v":2}`)}))
+		presence, err := m.Presence(ch)
+		require.NoError(t, err)
+		require.Len(t, presence, 1)
+		require.Equal(t, `{"v":2}`, string(presence["client"].ConnInfo))
+	})
+
+	t.Run("empty_channel", func(t *testing.T) {
+		m := newConformancePresenceManager(t, newPresenceManager, time.Minute)
+		ch := uniqueChannel()
+		presence, err := m.Presence(ch)
+		require.NoError(t, err)
+		require.Len(t, presence, 0)
+		stats, err := m.PresenceStats(ch)
+		require.NoError(t, err)
+		require.Equal(t, centrifuge.PresenceStats{}, stats)
+		require.NoError(t, m.RemovePresence(ch, "client", "user"))
+	})
+
+	t.Run("presence_expires", func(t *testing.T) {
+		m := newConformancePresenceManager(t, newPresenceManager, time.Second)
+		ch := uniqueChannel()
+		require.NoError(t, m.AddPresence(ch, "client", &centrifuge.ClientInfo{ClientID: "client", UserID: "user"}))
+		require.Eventually(t, func() bool {
+			presence, err := m.Presence(ch)
+			return err == nil && len(presence) == 0
+		}, conformanceWaitTimeout, 100*time.Millisecond)
+	})
+}
+
+type conformanceEvent struct {
+	ch   string
+	pub  *centrifuge.Publication
+	info *centrifuge.ClientInfo
+	data []byte
+}
+
+// conformanceEventHandler records events received from Broker.
+type conformanceEventHandler struct {
+	publications chan conformanceEvent
+	joins        chan conformanceEvent
+	leaves       chan conformanceEvent
+	controls     chan conformanceEvent
+}
+
+func newConformanceEventHandler() *conformanceEventHandler {
+	return &conformanceEventHandler{
+		publications: make(chan conformanceEvent, 128),
+		joins:        make(chan conformanceEvent, 128),
+		leaves:       make(chan conformanceEvent, 128),
+		controls:     make(chan conformanceEvent, 128),
+	}
+}
+
+func record(events chan conformanceEvent, e conformanceEvent) error {
+	select {
+	case events <- e:
+	default:
+		// Nobody interested, drop.
+	}
+	return nil
+}
+
+func (h *conformanceEventHandler) HandlePublication(ch string, pub *centrifuge.Publication, _ centrifuge.StreamPosition) error {
+	return record(h.publications, conformanceEvent{ch: ch, pub: pub})
+}
+
+func (h *conformanceEventHandler) HandleJoin(ch string, info *centrifuge.ClientInfo) error {
+	return record(h.joins, conformanceEvent{ch: ch, info: info})
+}
+
+func (h *conformanceEventHandler) HandleLeave(ch string, info *centrifuge.ClientInfo) error {
+	return record(h.leaves, conformanceEvent{ch: ch, info: info})
+}
+
+func (h *conformanceEventHandler) HandleControl(data []byte) error {
+	return record(h.controls, conformanceEvent{data: data})
+}
+
+func runConformanceBroker(t *testing.T, newBroker NewBrokerFunc) (centrifuge.Broker, *conformanceEventHandler) {
+	t.Helper()
+	n, err := centrifuge.New(centrifuge.Config{})
+	require.NoError(t, err)
+	b := newBroker(t, n)
+	h := newConformanceEventHandler()
+	require.NoError(t, b.Run(h))
+	if closer, ok := b.(centrifuge.Closer); ok {
+		t.Cleanup(func() { _ = closer.Close(context.Background()) })
+	}
+	return b, h
+}
+
+func newConformancePresenceManager(t *testing.T, newPresenceManager NewPresenceManagerFunc, presenceTTL time.Duration) centrifuge.PresenceManager {
+	t.Helper()
+	n, err := centrifuge.New(centrifuge.Config{})
+	require.NoError(t, err)
+	return newPresenceManager(t, n, presenceTTL)
+}
+
+// waitForEvent calls publish periodically until matching event received – brokers
+// may establish subscriptions asynchronously so the first publish can be missed.
+func waitForEvent(t *testing.T, events chan conformanceEvent, publish func(), match func(conformanceEvent) bool) {
+	t.Helper()
+	timeout := time.After(conformanceWaitTimeout)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	publish()
+	for {
+		select {
+		case e := <-events:
+			if match(e) {
+				return
+			}
+		case <-ticker.C:
+			publish()
+		case <-timeout:
+			t.Fatal("timeout waiting for event from broker")
+		}
+	}
+}
+
+func publishHistory(t *testing.T, b centrifuge.Broker, ch string, num int) centrifuge.StreamPosition {
+	t.Helper()
+	var sp centrifuge.StreamPosition
+	for i := 0; i < num; i++ {
+		var err error
+		sp, _, err = b.Publish(ch, []byte(`{}`), centrifuge.PublishOptions{
+			HistorySize: 10,
+			HistoryTTL:  time.Minute,
+		})
+		require.NoError(t, err)
+	}
+	return sp
+}
+
+func uniqueChannel() string {
+	return "conformance_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
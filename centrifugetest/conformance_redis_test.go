@@ -0,0 +1,56 @@
+//go:build integration
+
+package centrifugetest
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/stretchr/testify/require"
+)
+
+func newConformanceRedisShard(t *testing.T, n *centrifuge.Node) *centrifuge.RedisShard {
+	s, err := centrifuge.NewRedisShard(n, centrifuge.RedisShardConfig{
+		Address:        "127.0.0.1:6379",
+		IOTimeout:      10 * time.Second,
+		ConnectTimeout: 10 * time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func conformanceRedisPrefix() string {
+	return "centrifuge-conformance-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+func TestRedisBrokerConformance(t *testing.T) {
+	for _, useLists := range []bool{false, true} {
+		useLists := useLists
+		t.Run("lists_"+strconv.FormatBool(useLists), func(t *testing.T) {
+			TestBrokerConformance(t, func(t *testing.T, n *centrifuge.Node) centrifuge.Broker {
+				b, err := centrifuge.NewRedisBroker(n, centrifuge.RedisBrokerConfig{
+					Prefix:   conformanceRedisPrefix(),
+					UseLists: useLists,
+					Shards:   []*centrifuge.RedisShard{newConformanceRedisShard(t, n)},
+				})
+				require.NoError(t, err)
+				return b
+			})
+		})
+	}
+}
+
+func TestRedisPresenceManagerConformance(t *testing.T) {
+	TestPresenceManagerConformance(t, func(t *testing.T, n *centrifuge.Node, presenceTTL time.Duration) centrifuge.PresenceManager {
+		m, err := centrifuge.NewRedisPresenceManager(n, centrifuge.RedisPresenceManagerConfig{
+			Prefix:      conformanceRedisPrefix(),
+			PresenceTTL: presenceTTL,
+			Shards:      []*centrifuge.RedisShard{newConformanceRedisShard(t, n)},
+		})
+		require.NoError(t, err)
+		return m
+	})
+}
@@ -0,0 +1,37 @@
+package centrifugetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBrokerConformance(t *testing.T) {
+	TestBrokerConformance(t, func(t *testing.T, n *centrifuge.Node) centrifuge.Broker {
+		b, err := centrifuge.NewMemoryBroker(n, centrifuge.MemoryBrokerConfig{})
+		require.NoError(t, err)
+		return b
+	})
+}
+
+func TestMemoryPresenceManagerConformance(t *testing.T) {
+	TestPresenceManagerConformance(t, func(t *testing.T, n *centrifuge.Node, presenceTTL time.Duration) centrifuge.PresenceManager {
+		m, err := centrifuge.NewMemoryPresenceManager(n, centrifuge.MemoryPresenceManagerConfig{
+			PresenceTTL: presenceTTL,
+		})
+		require.NoError(t, err)
+		return m
+	})
+}
+
+func TestBusBrokerConformance(t *testing.T) {
+	TestBrokerConformance(t, func(t *testing.T, n *centrifuge.Node) centrifuge.Broker {
+		bus, err := NewBus(BusConfig{})
+		require.NoError(t, err)
+		b, err := bus.NewBroker(n)
+		require.NoError(t, err)
+		return b
+	})
+}
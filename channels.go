@@ -0,0 +1,173 @@
+package centrifuge
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	channelsOp       = "centrifuge_channels"
+	numSubscribersOp = "centrifuge_num_subscribers"
+)
+
+// numSubscribersCacheTTL is a time cluster subscriber count for a channel is cached
+// on Node to avoid survey on every Node.NumSubscribersCluster call.
+const numSubscribersCacheTTL = time.Second
+
+// ChannelInfo contains information about channel aggregated over all nodes.
+type ChannelInfo struct {
+	// NumSubscribers is an approximate number of channel subscribers in a cluster.
+	// Approximate since subscriptions may change while nodes are being asked.
+	NumSubscribers int
+}
+
+type channelsRequest struct {
+	Pattern string `json:"pattern,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+type channelsResponse struct {
+	Channels map[string]int `json:"channels"`
+}
+
+// ChannelsFiltered returns active channels from all running nodes matching a glob
+// pattern (see path.Match for pattern syntax, empty pattern matches all channels)
+// together with a number of subscribers. Each node is asked for channels of its
+// Hub over Survey so the result reflects real subscriptions and does not depend on
+// Broker. At most limit channels returned if limit > 0. Survey timeout may be
+// controlled over context deadline.
+func (n *Node) ChannelsFiltered(ctx context.Context, pattern string, limit int) (map[string]ChannelInfo, error) {
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(channelsRequest{Pattern: pattern, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	results, err := n.Survey(ctx, channelsOp, data, "")
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for uid, result := range results {
+		if result.Code != 0 {
+			continue
+		}
+		var resp channelsResponse
+		if err := json.Unmarshal(result.Data, &resp); err != nil {
+			n.logger.log(newErrorLogEntry(err, "error unmarshal channels response", map[string]any{"node": uid}))
+			continue
+		}
+		for ch, numSubscribers := range resp.Channels {
+			counts[ch] += numSubscribers
+		}
+	}
+	channelNames := make([]string, 0, len(counts))
+	for ch := range counts {
+		channelNames = append(channelNames, ch)
+	}
+	if limit > 0 && len(channelNames) > limit {
+		// Make result stable when channels from different nodes exceed limit.
+		sort.Strings(channelNames)
+		channelNames = channelNames[:limit]
+	}
+	channels := make(map[string]ChannelInfo, len(channelNames))
+	for _, ch := range channelNames {
+		channels[ch] = ChannelInfo{NumSubscribers: counts[ch]}
+	}
+	return channels, nil
+}
+
+func (n *Node) handleChannelsSurvey(e SurveyEvent, cb SurveyCallback) {
+	var req channelsRequest
+	if err := json.Unmarshal(e.Data, &req); err != nil {
+		n.logger.log(newErrorLogEntry(err, "error unmarshal channels request", map[string]any{"data": string(e.Data)}))
+		cb(SurveyReply{Code: 1})
+		return
+	}
+	match := func(ch string) bool {
+		if req.Pattern == "" {
+			return true
+		}
+		ok, _ := path.Match(req.Pattern, ch)
+		return ok
+	}
+	data, err := json.Marshal(channelsResponse{Channels: n.hub.channelsFiltered(match, req.Limit)})
+	if err != nil {
+		cb(SurveyReply{Code: 2})
+		return
+	}
+	cb(SurveyReply{Data: data})
+}
+
+// NumSubscribers returns a number of channel subscribers on this Node only. This is
+// cheap since only reads Hub state.
+func (n *Node) NumSubscribers(ch string) int {
+	return n.hub.NumSubscribers(ch)
+}
+
+type numSubscribersCacheEntry struct {
+	numSubscribers int
+	expireAt       time.Time
+}
+
+// NumSubscribersCluster returns a number of channel subscribers on all running nodes.
+// Counts from remote nodes collected over Survey, result is cached for a short time
+// (1 second) so frequent calls for the same channel do not produce much traffic between
+// nodes. Survey timeout may be controlled over context deadline.
+func (n *Node) NumSubscribersCluster(ctx context.Context, ch string) (int, error) {
+	now := time.Now()
+	n.numSubscribersCacheMu.Lock()
+	entry, ok := n.numSubscribersCache[ch]
+	n.numSubscribersCacheMu.Unlock()
+	if ok && now.Before(entry.expireAt) {
+		n.metrics.incNumSubscribersCache(true)
+		return entry.numSubscribers, nil
+	}
+	n.metrics.incNumSubscribersCache(false)
+
+	results, err := n.Survey(ctx, numSubscribersOp, []byte(ch), "")
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for uid, result := range results {
+		if result.Code != 0 {
+			continue
+		}
+		numSubscribers, err := strconv.Atoi(string(result.Data))
+		if err != nil {
+			n.logger.log(newErrorLogEntry(err, "error parsing num subscribers response", map[string]any{"node": uid}))
+			continue
+		}
+		total += numSubscribers
+	}
+
+	n.numSubscribersCacheMu.Lock()
+	defer n.numSubscribersCacheMu.Unlock()
+	if now.Sub(n.numSubscribersCacheClean) > numSubscribersCacheTTL {
+		// Remove expired entries from time to time to keep cache size bounded by
+		// a number of channels requested during TTL.
+		for cachedCh, cachedEntry := range n.numSubscribersCache {
+			if now.After(cachedEntry.expireAt) {
+				delete(n.numSubscribersCache, cachedCh)
+			}
+		}
+		n.numSubscribersCacheClean = now
+	}
+	n.numSubscribersCache[ch] = numSubscribersCacheEntry{
+		numSubscribers: total,
+		expireAt:       now.Add(numSubscribersCacheTTL),
+	}
+	return total, nil
+}
+
+func (n *Node) handleNumSubscribersSurvey(e SurveyEvent, cb SurveyCallback) {
+	cb(SurveyReply{Data: strconv.AppendInt(nil, int64(n.hub.NumSubscribers(string(e.Data))), 10)})
+}
@@ -0,0 +1,69 @@
+package centrifuge
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNode_ChannelsFiltered(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	newTestSubscribedClientV2(t, node, "42", "news:1")
+	newTestSubscribedClientV2(t, node, "43", "news:1")
+	newTestSubscribedClientV2(t, node, "42", "news:2")
+	newTestSubscribedClientV2(t, node, "42", "chat:1")
+
+	channels, err := node.ChannelsFiltered(context.Background(), "", 0)
+	require.NoError(t, err)
+	require.Len(t, channels, 3)
+	require.Equal(t, 2, channels["news:1"].NumSubscribers)
+
+	channels, err = node.ChannelsFiltered(context.Background(), "news:*", 0)
+	require.NoError(t, err)
+	require.Len(t, channels, 2)
+	require.Equal(t, 2, channels["news:1"].NumSubscribers)
+	require.Equal(t, 1, channels["news:2"].NumSubscribers)
+
+	channels, err = node.ChannelsFiltered(context.Background(), "news:*", 1)
+	require.NoError(t, err)
+	require.Len(t, channels, 1)
+
+	channels, err = node.ChannelsFiltered(context.Background(), "unknown:*", 0)
+	require.NoError(t, err)
+	require.Len(t, channels, 0)
+
+	_, err = node.ChannelsFiltered(context.Background(), "[", 0)
+	require.ErrorIs(t, err, path.ErrBadPattern)
+}
+
+func TestNode_NumSubscribers(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	require.Equal(t, 0, node.NumSubscribers("test"))
+	newTestSubscribedClientV2(t, node, "42", "test")
+	require.Equal(t, 1, node.NumSubscribers("test"))
+
+	numSubscribers, err := node.NumSubscribersCluster(context.Background(), "test")
+	require.NoError(t, err)
+	require.Equal(t, 1, numSubscribers)
+
+	// Result cached so a new subscriber is not visible immediately.
+	newTestSubscribedClientV2(t, node, "43", "test")
+	require.Equal(t, 2, node.NumSubscribers("test"))
+	numSubscribers, err = node.NumSubscribersCluster(context.Background(), "test")
+	require.NoError(t, err)
+	require.Equal(t, 1, numSubscribers)
+
+	node.numSubscribersCacheMu.Lock()
+	node.numSubscribersCache["test"] = numSubscribersCacheEntry{expireAt: time.Now().Add(-time.Second)}
+	node.numSubscribersCacheMu.Unlock()
+	numSubscribers, err = node.NumSubscribersCluster(context.Background(), "test")
+	require.NoError(t, err)
+	require.Equal(t, 2, numSubscribers)
+}
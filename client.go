@@ -1,12 +1,19 @@
 package centrifuge
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/centrifugal/centrifuge/internal/queue"
 	"github.com/centrifugal/centrifuge/internal/recovery"
@@ -136,6 +143,9 @@ const (
 	flagPositioning
 	flagServerSide
 	flagClientSideRefresh
+	// flagSubscribeCanceled set on a subscription in progress when client
+	// unsubscribed before subscription finished.
+	flagSubscribeCanceled
 )
 
 // ChannelContext contains extra context for channel connection subscribed to.
@@ -162,6 +172,7 @@ const (
 	timerOpExpire   timerOp = 3
 	timerOpPing     timerOp = 4
 	timerOpPong     timerOp = 5
+	timerOpIdle     timerOp = 6
 )
 
 type status uint8
@@ -240,6 +251,7 @@ type Client struct {
 	storage           map[string]any
 	storageMu         sync.Mutex
 	authenticated     bool
+	connectedAt       int64
 	clientSideRefresh bool
 	status            status
 	timerOp           timerOp
@@ -247,6 +259,8 @@ type Client struct {
 	nextExpire        int64
 	nextPing          int64
 	nextPong          int64
+	nextIdleCheck     int64
+	lastActive        int64
 	lastSeen          int64
 	lastPing          int64
 	pingInterval      time.Duration
@@ -256,12 +270,14 @@ type Client struct {
 	startWriterOnce   sync.Once
 	replyWithoutQueue bool
 	unusable          bool
+	commandSem        chan struct{}
 }
 
 // ClientCloseFunc must be called on Transport handler close to clean up Client.
 type ClientCloseFunc func() error
 
-// NewClient initializes new Client.
+// NewClient initializes new Client. See Transport docs for a description of
+// connection lifecycle for custom transports.
 func NewClient(ctx context.Context, n *Node, t Transport) (*Client, ClientCloseFunc, error) {
 	uidObject, err := uuid.NewRandom()
 	if err != nil {
@@ -409,6 +425,10 @@ func (c *Client) onTimerOp() {
 		return
 	}
 	op := c.timerOp
+	if op == timerOpExpire {
+		// Expiration point reached, next one will be set upon successful check.
+		c.nextExpire = 0
+	}
 	c.mu.Unlock()
 	switch op {
 	case timerOpStale:
@@ -421,6 +441,8 @@ func (c *Client) onTimerOp() {
 		c.sendPing()
 	case timerOpPong:
 		c.checkPong()
+	case timerOpIdle:
+		c.checkIdle()
 	}
 }
 
@@ -453,6 +475,11 @@ func (c *Client) scheduleNextTimer() {
 		minEventTime = c.nextPong
 		needTimer = true
 	}
+	if c.nextIdleCheck > 0 && (minEventTime == 0 || c.nextIdleCheck < minEventTime) {
+		nextTimerOp = timerOpIdle
+		minEventTime = c.nextIdleCheck
+		needTimer = true
+	}
 	if needTimer {
 		c.timerOp = nextTimerOp
 		afterDuration := time.Duration(minEventTime-time.Now().UnixNano()) * time.Nanosecond
@@ -522,6 +549,21 @@ func (c *Client) checkPong() {
 	c.mu.Unlock()
 }
 
+// checkIdle closes connection if there was no activity during ClientIdleTimeout,
+// otherwise schedules next check.
+func (c *Client) checkIdle() {
+	idleTimeout := c.node.config.ClientIdleTimeout.Nanoseconds()
+	lastActive := atomic.LoadInt64(&c.lastActive)
+	if time.Now().UnixNano()-lastActive >= idleTimeout {
+		_ = c.close(DisconnectExpired)
+		return
+	}
+	c.mu.Lock()
+	c.nextIdleCheck = lastActive + idleTimeout
+	c.scheduleNextTimer()
+	c.mu.Unlock()
+}
+
 // Lock must be held outside.
 func (c *Client) addPingUpdate(isFirst bool, scheduleNext bool) {
 	delay := c.pingInterval
@@ -539,8 +581,15 @@ func (c *Client) addPingUpdate(isFirst bool, scheduleNext bool) {
 }
 
 // Lock must be held outside.
-func (c *Client) addPresenceUpdate(scheduleNext bool) {
-	c.nextPresence = time.Now().Add(c.node.config.ClientPresenceUpdateInterval).UnixNano()
+func (c *Client) addPresenceUpdate(isFirst bool, scheduleNext bool) {
+	delay := c.node.config.ClientPresenceUpdateInterval
+	if halfInterval := delay.Nanoseconds() / 2; isFirst && halfInterval > 0 {
+		// Run first presence update in random interval between PresenceUpdateInterval/2
+		// and PresenceUpdateInterval to spread updates in time (useful when many
+		// connections reconnect almost immediately, i.e. after node restart).
+		delay = time.Duration(halfInterval+randSource.Int63n(halfInterval)) * time.Nanosecond
+	}
+	c.nextPresence = time.Now().Add(delay).UnixNano()
 	if scheduleNext {
 		c.scheduleNextTimer()
 	}
@@ -569,6 +618,14 @@ func (c *Client) closeStale() {
 	}
 }
 
+// Flush blocks until messages enqueued to client's write queue before the call are
+// written to transport, connection closed or ctx done. Write delay configured for
+// connection is skipped while Flush waits. Mostly useful in tests to wait for data
+// delivered to transport instead of polling it.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.messageWriter.flush(ctx)
+}
+
 func (c *Client) transportEnqueue(data []byte, ch string, frameType protocol.FrameType) error {
 	item := queue.Item{
 		Data:      data,
@@ -579,13 +636,50 @@ func (c *Client) transportEnqueue(data []byte, ch string, frameType protocol.Fra
 	}
 	disconnect := c.messageWriter.enqueue(item)
 	if disconnect != nil {
+		if frameType == protocol.FrameTypePushPublication {
+			reason := pubDropReasonClosed
+			if disconnect.Code == DisconnectSlow.Code {
+				reason = pubDropReasonSlow
+			}
+			c.node.metrics.incTransportPubDropped(c.transport.Name(), reason)
+		}
 		// close in goroutine to not block message broadcast.
 		go func() { _ = c.close(*disconnect) }()
 		return io.EOF
 	}
+	if frameType == protocol.FrameTypePushPublication {
+		c.node.metrics.incTransportPubEnqueued(c.transport.Name())
+	}
 	return nil
 }
 
+// refreshPresence updates presence info for all client channels with presence
+// enabled. Called by Node presenceUpdater.
+func (c *Client) refreshPresence() {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	c.mu.RLock()
+	if c.status == statusClosed {
+		c.mu.RUnlock()
+		return
+	}
+	channels := make(map[string]ChannelContext, len(c.channels))
+	for channel, channelContext := range c.channels {
+		if !channelHasFlag(channelContext.flags, flagSubscribed) || !channelHasFlag(channelContext.flags, flagEmitPresence) {
+			continue
+		}
+		channels[channel] = channelContext
+	}
+	c.mu.RUnlock()
+
+	for channel, channelContext := range channels {
+		err := c.updateChannelPresence(channel, channelContext)
+		if err != nil {
+			c.node.logger.log(newErrorLogEntry(err, "error updating presence for channel", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
+		}
+	}
+}
+
 // updateChannelPresence updates client presence info for channel so it
 // won't expire until client disconnect.
 func (c *Client) updateChannelPresence(ch string, chCtx ChannelContext) error {
@@ -612,6 +706,17 @@ func (c *Client) Context() context.Context {
 	return c.ctx
 }
 
+// commandContext returns context for Broker and PresenceManager calls made to serve
+// client command. It's derived from command ctx (connection context, possibly with
+// tracing span) and canceled when connection closes or Config.ClientCommandTimeout
+// passes.
+func (c *Client) commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.node.config.ClientCommandTimeout > 0 {
+		return context.WithTimeout(ctx, c.node.config.ClientCommandTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
 func (c *Client) checkSubscriptionExpiration(channel string, channelContext ChannelContext, delay time.Duration, resultCB func(bool)) {
 	now := c.node.nowTimeGetter().Unix()
 	expireAt := channelContext.expireAt
@@ -682,12 +787,17 @@ func (c *Client) updatePresence() {
 		c.eventHub.aliveHandler()
 	}
 
-	for channel, channelContext := range channels {
-		err := c.updateChannelPresence(channel, channelContext)
-		if err != nil {
-			c.node.logger.log(newLogEntry(LogLevelError, "error updating presence for channel", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+	if c.node.presenceManager != nil {
+		for _, channelContext := range channels {
+			if channelHasFlag(channelContext.flags, flagEmitPresence) {
+				// Presence itself is updated by Node in batches, see presenceUpdater.
+				c.node.presenceUpdater.add(c)
+				break
+			}
 		}
+	}
 
+	for channel, channelContext := range channels {
 		c.checkSubscriptionExpiration(channel, channelContext, config.ClientExpiredSubCloseDelay, func(result bool) {
 			if !result {
 				serverSide := channelHasFlag(channelContext.flags, flagServerSide)
@@ -713,7 +823,7 @@ func (c *Client) updatePresence() {
 		}
 	}
 	c.mu.Lock()
-	c.addPresenceUpdate(true)
+	c.addPresenceUpdate(false, true)
 	c.mu.Unlock()
 }
 
@@ -736,12 +846,23 @@ func (c *Client) checkPosition(checkDelay time.Duration, ch string, chCtx Channe
 		historyMetaTTL = time.Duration(chCtx.metaTTLSeconds) * time.Second
 	}
 
-	streamTop, err := c.node.streamTop(ch, historyMetaTTL)
+	streamTop, cached, err := c.node.positionStreamTop(ch, historyMetaTTL)
 	if err != nil {
 		// Check later.
 		return true
 	}
-
+	if c.isValidPosition(streamTop, nowUnix, ch) {
+		return true
+	}
+	if !cached {
+		return false
+	}
+	// Cached stream top may be outdated (for example, epoch changed after client
+	// subscribed), so confirm with actual stream top before unsubscribing.
+	streamTop, err = c.node.streamTop(ch, historyMetaTTL)
+	if err != nil {
+		return true
+	}
 	return c.isValidPosition(streamTop, nowUnix, ch)
 }
 
@@ -784,6 +905,24 @@ func (c *Client) sessionID() string {
 	return c.session
 }
 
+// connectedAtNano returns time when client was authenticated in Unix nanoseconds.
+func (c *Client) connectedAtNano() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connectedAt
+}
+
+// LastActive returns time of the last command received from client (pings are
+// only taken into account with Config.ClientIdleCountPings). Zero time is returned
+// if client has not sent any command yet.
+func (c *Client) LastActive() time.Time {
+	lastActive := atomic.LoadInt64(&c.lastActive)
+	if lastActive == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastActive)
+}
+
 // UserID returns user id associated with client connection.
 func (c *Client) UserID() string {
 	return c.user
@@ -964,8 +1103,12 @@ func (c *Client) close(disconnect Disconnect) error {
 	c.stopTimer()
 
 	channels := make(map[string]ChannelContext, len(c.channels))
+	var subscribedChannels []string
 	for channel, channelContext := range c.channels {
 		channels[channel] = channelContext
+		if channelHasFlag(channelContext.flags, flagSubscribed) {
+			subscribedChannels = append(subscribedChannels, channel)
+		}
 	}
 	c.mu.Unlock()
 
@@ -975,7 +1118,7 @@ func (c *Client) close(disconnect Disconnect) error {
 		for channel := range channels {
 			err := c.unsubscribe(channel, unsub, &disconnect)
 			if err != nil {
-				c.node.logger.log(newLogEntry(LogLevelError, "error unsubscribing client from channel", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+				c.node.logger.log(newErrorLogEntry(err, "error unsubscribing client from channel", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
 			}
 		}
 	}
@@ -987,7 +1130,7 @@ func (c *Client) close(disconnect Disconnect) error {
 	if authenticated {
 		err := c.node.removeClient(c)
 		if err != nil {
-			c.node.logger.log(newLogEntry(LogLevelError, "error removing client", map[string]any{"user": c.user, "client": c.uid, "error": err.Error()}))
+			c.node.logger.log(newErrorLogEntry(err, "error removing client", map[string]any{"user": c.user, "client": c.uid}))
 		}
 	}
 
@@ -1003,14 +1146,19 @@ func (c *Client) close(disconnect Disconnect) error {
 	_ = c.transport.Close(disconnect)
 
 	if disconnect.Code != DisconnectConnectionClosed.Code {
-		c.node.logger.log(newLogEntry(LogLevelDebug, "closing client connection", map[string]any{"client": c.uid, "user": c.user, "reason": disconnect.Reason}))
-	}
-	if disconnect.Code != DisconnectConnectionClosed.Code {
+		c.node.logger.logLazy(LogLevelDebug, "closing client connection", func() map[string]any {
+			return map[string]any{"client": c.uid, "user": c.user, "reason": disconnect.Reason}
+		})
 		c.node.metrics.incServerDisconnect(disconnect.Code)
 	}
+	if prevStatus == statusConnected {
+		c.emitClientEvent(ClientEventDisconnect, "", 0)
+	}
 	if c.eventHub.disconnectHandler != nil && prevStatus == statusConnected {
 		c.eventHub.disconnectHandler(DisconnectEvent{
 			Disconnect: disconnect,
+			Channels:   subscribedChannels,
+			Cause:      disconnectCause(disconnect),
 		})
 	}
 	return nil
@@ -1055,6 +1203,19 @@ func (c *Client) clientInfo(ch string) *ClientInfo {
 	}
 }
 
+func (c *Client) channelClientInfo(ch string) *ClientInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientInfo(ch)
+}
+
+// Handle processes one inbound frame of data with Centrifuge commands encoded according
+// to transport ProtocolType. Supposed to be called by message-based transports for every
+// received message. Returns false if connection must be closed by transport handler.
+func (c *Client) Handle(data []byte) bool {
+	return HandleReadFrame(c, bytes.NewReader(data))
+}
+
 // HandleCommand processes a single protocol.Command. Supposed to be called only
 // from a transport connection reader.
 func (c *Client) HandleCommand(cmd *protocol.Command, cmdProtocolSize int) bool {
@@ -1186,6 +1347,9 @@ func (c *Client) dispatchCommand(cmd *protocol.Command, cmdSize int) (*Disconnec
 		c.lastPing = -c.lastPing
 		c.lastSeen = time.Now().Unix()
 		c.mu.Unlock()
+		if c.node.config.ClientIdleCountPings {
+			atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		}
 		return nil, true
 	}
 
@@ -1196,6 +1360,10 @@ func (c *Client) dispatchCommand(cmd *protocol.Command, cmdSize int) (*Disconnec
 
 	started := time.Now()
 
+	if cmd.Ping == nil || c.node.config.ClientIdleCountPings {
+		atomic.StoreInt64(&c.lastActive, started.UnixNano())
+	}
+
 	if cmd.Connect != nil {
 		frameType = protocol.FrameTypeConnect
 	} else if cmd.Subscribe != nil {
@@ -1229,39 +1397,79 @@ func (c *Client) dispatchCommand(cmd *protocol.Command, cmdSize int) (*Disconnec
 		return &DisconnectBadRequest, false
 	}
 
+	if c.commandSem != nil && isConcurrentCommand(cmd) {
+		select {
+		case c.commandSem <- struct{}{}:
+		case <-c.ctx.Done():
+			return nil, false
+		}
+		go c.handleCommandConcurrently(cmd, cmdSize, frameType, metricChannel, started)
+		return nil, true
+	}
+
+	return c.handleCommand(cmd, cmdSize, frameType, metricChannel, started)
+}
+
+// isConcurrentCommand returns true for commands which may be processed concurrently
+// with other commands of the same connection when Client concurrency is enabled.
+func isConcurrentCommand(cmd *protocol.Command) bool {
+	return cmd.Publish != nil || cmd.Rpc != nil || cmd.History != nil || cmd.Presence != nil || cmd.PresenceStats != nil
+}
+
+// handleCommandConcurrently processes command outside connection reader. Must be
+// called with acquired commandSem slot, the slot is released upon completion.
+func (c *Client) handleCommandConcurrently(cmd *protocol.Command, cmdSize int, frameType protocol.FrameType, metricChannel string, started time.Time) {
+	defer func() { <-c.commandSem }()
+	disconnect, _ := c.handleCommand(cmd, cmdSize, frameType, metricChannel, started)
+	if disconnect != nil {
+		if disconnect.Code != DisconnectConnectionClosed.Code {
+			c.node.logger.log(newLogEntry(LogLevelInfo, "disconnect after handling command", map[string]any{"command": fmt.Sprintf("%v", cmd), "client": c.ID(), "user": c.UserID(), "reason": disconnect.Reason}))
+		}
+		_ = c.close(*disconnect)
+	}
+}
+
+func (c *Client) handleCommand(cmd *protocol.Command, cmdSize int, frameType protocol.FrameType, metricChannel string, started time.Time) (disconnect *Disconnect, proceed bool) {
 	var handleErr error
 
+	defer func() {
+		if r := recover(); r != nil {
+			disconnect, proceed = c.handleCommandPanic(r, cmd, frameType, metricChannel, started)
+		}
+	}()
+
+	ctx := c.ctx
+	if c.node.config.Tracer != nil {
+		attributes := map[string]string{"client": c.uid, "user": c.UserID()}
+		if metricChannel != "" {
+			attributes["channel"] = metricChannel
+		}
+		var span Span
+		ctx, span = c.node.config.Tracer.StartSpan(ctx, commandSpanName(frameType.String()), attributes)
+		defer func() { span.End(handleErr) }()
+	}
+
 	handleErr = c.issueCommandReadEvent(cmd, cmdSize)
 	if handleErr != nil {
 		return c.handleCommandDispatchError(metricChannel, cmd, frameType, handleErr, started)
 	}
 
-	if cmd.Connect != nil {
-		handleErr = c.handleConnect(cmd.Connect, cmd, started, nil)
-	} else if cmd.Ping != nil {
-		handleErr = c.handlePing(cmd, started, nil)
-	} else if cmd.Subscribe != nil {
-		handleErr = c.handleSubscribe(cmd.Subscribe, cmd, started, nil)
-	} else if cmd.Unsubscribe != nil {
-		handleErr = c.handleUnsubscribe(cmd.Unsubscribe, cmd, started, nil)
-	} else if cmd.Publish != nil {
-		handleErr = c.handlePublish(cmd.Publish, cmd, started, nil)
-	} else if cmd.Presence != nil {
-		handleErr = c.handlePresence(cmd.Presence, cmd, started, nil)
-	} else if cmd.PresenceStats != nil {
-		handleErr = c.handlePresenceStats(cmd.PresenceStats, cmd, started, nil)
-	} else if cmd.History != nil {
-		handleErr = c.handleHistory(cmd.History, cmd, started, nil)
-	} else if cmd.Rpc != nil {
-		handleErr = c.handleRPC(cmd.Rpc, cmd, started, nil)
-	} else if cmd.Send != nil {
-		handleErr = c.handleSend(cmd.Send, cmd, started)
-	} else if cmd.Refresh != nil {
-		handleErr = c.handleRefresh(cmd.Refresh, cmd, started, nil)
-	} else if cmd.SubRefresh != nil {
-		handleErr = c.handleSubRefresh(cmd.SubRefresh, cmd, started, nil)
+	if commandHandler := c.node.clientEvents.commandHandler; commandHandler != nil {
+		timing := &commandTiming{}
+		middlewareStarted := time.Now()
+		handleErr = commandHandler(CommandContext{
+			Client:  c,
+			Method:  frameType.String(),
+			Command: cmd,
+			ctx:     ctx,
+			timing:  timing,
+		})
+		if !timing.started.IsZero() {
+			started = timing.started
+		}
+		c.node.metrics.observeCommandMiddlewareDuration(time.Since(middlewareStarted) - timing.duration)
 	} else {
-		return &DisconnectBadRequest, false
+		handleErr = c.dispatchCommandHandler(ctx, cmd, started)
 	}
 	if handleErr != nil {
 		return c.handleCommandDispatchError(metricChannel, cmd, frameType, handleErr, started)
@@ -1269,12 +1477,76 @@ func (c *Client) dispatchCommand(cmd *protocol.Command, cmdSize int) (*Disconnec
 	return nil, true
 }
 
+// handleCommandContext is the innermost CommandHandlerFunc in a chain of command
+// middlewares – it runs built-in command processing.
+func handleCommandContext(ctx CommandContext) error {
+	ctx.timing.started = time.Now()
+	defer func() { ctx.timing.duration = time.Since(ctx.timing.started) }()
+	return ctx.Client.dispatchCommandHandler(ctx.Context(), ctx.Command, ctx.timing.started)
+}
+
+// dispatchCommandHandler runs built-in command processing. Broker and PresenceManager
+// calls made to serve command use context derived from ctx. Connect command is an
+// exception: context passed to ConnectingHandler may become connection context, so
+// it's always based on connection context.
+func (c *Client) dispatchCommandHandler(ctx context.Context, cmd *protocol.Command, started time.Time) error {
+	switch {
+	case cmd.Connect != nil:
+		return c.handleConnect(cmd.Connect, cmd, started, nil)
+	case cmd.Ping != nil:
+		return c.handlePing(cmd, started, nil)
+	case cmd.Subscribe != nil:
+		return c.handleSubscribe(cmd.Subscribe, cmd, started, nil)
+	case cmd.Unsubscribe != nil:
+		return c.handleUnsubscribe(cmd.Unsubscribe, cmd, started, nil)
+	case cmd.Publish != nil:
+		return c.handlePublish(ctx, cmd.Publish, cmd, started, nil)
+	case cmd.Presence != nil:
+		return c.handlePresence(ctx, cmd.Presence, cmd, started, nil)
+	case cmd.PresenceStats != nil:
+		return c.handlePresenceStats(ctx, cmd.PresenceStats, cmd, started, nil)
+	case cmd.History != nil:
+		return c.handleHistory(ctx, cmd.History, cmd, started, nil)
+	case cmd.Rpc != nil:
+		return c.handleRPC(cmd.Rpc, cmd, started, nil)
+	case cmd.Send != nil:
+		return c.handleSend(cmd.Send, cmd, started)
+	case cmd.Refresh != nil:
+		return c.handleRefresh(cmd.Refresh, cmd, started, nil)
+	case cmd.SubRefresh != nil:
+		return c.handleSubRefresh(cmd.SubRefresh, cmd, started, nil)
+	default:
+		return DisconnectBadRequest
+	}
+}
+
+// handleCommandPanic recovers from a panic inside application event handler so that
+// one broken handler does not take down the whole process. Client receives internal
+// error in reply to the command (or disconnected with server error for connect command).
+func (c *Client) handleCommandPanic(r any, cmd *protocol.Command, frameType protocol.FrameType, metricChannel string, started time.Time) (*Disconnect, bool) {
+	c.node.metrics.incHandlerPanic(frameType)
+	c.node.logger.log(newLogEntry(LogLevelError, "panic in event handler", map[string]any{"command": frameType.String(), "client": c.ID(), "user": c.UserID(), "panic": fmt.Sprintf("%v", r), "stack": string(debug.Stack())}))
+	if cmd.Connect != nil {
+		return c.handleCommandDispatchError(metricChannel, cmd, frameType, DisconnectServerError, started)
+	}
+	if cmd.Subscribe != nil {
+		// Release channel reserved during subscribe request validation.
+		c.mu.RLock()
+		channelContext, ok := c.channels[cmd.Subscribe.Channel]
+		c.mu.RUnlock()
+		if ok && !channelHasFlag(channelContext.flags, flagSubscribed) {
+			c.onSubscribeError(cmd.Subscribe.Channel)
+		}
+	}
+	return c.handleCommandDispatchError(metricChannel, cmd, frameType, ErrorInternal, started)
+}
+
 func (c *Client) writeEncodedPush(rep *protocol.Reply, rw *replyWriter, ch string, frameType protocol.FrameType) {
 	encoder := protocol.GetPushEncoder(c.transport.Protocol().toProto())
 	var err error
 	data, err := encoder.Encode(rep.Push)
 	if err != nil {
-		c.node.logger.log(newLogEntry(LogLevelError, "error encoding connect push", map[string]any{"push": fmt.Sprintf("%v", rep.Push), "client": c.ID(), "user": c.UserID(), "error": err.Error()}))
+		c.node.logger.log(newErrorLogEntry(err, "error encoding connect push", map[string]any{"push": fmt.Sprintf("%v", rep.Push), "client": c.ID(), "user": c.UserID()}))
 		go func() { _ = c.close(DisconnectInappropriateProtocol) }()
 		return
 	}
@@ -1298,7 +1570,7 @@ func (c *Client) writeEncodedCommandReply(ch string, frameType protocol.FrameTyp
 
 	replyData, err := replyEncoder.Encode(rep)
 	if err != nil {
-		c.node.logger.log(newLogEntry(LogLevelError, "error encoding reply", map[string]any{"reply": fmt.Sprintf("%v", rep), "client": c.ID(), "user": c.UserID(), "error": err.Error()}))
+		c.node.logger.log(newErrorLogEntry(err, "error encoding reply", map[string]any{"reply": fmt.Sprintf("%v", rep), "client": c.ID(), "user": c.UserID()}))
 		go func() { _ = c.close(DisconnectInappropriateProtocol) }()
 		return
 	}
@@ -1310,6 +1582,11 @@ func (c *Client) writeEncodedCommandReply(ch string, frameType protocol.FrameTyp
 
 	if c.replyWithoutQueue {
 		err = c.messageWriter.config.WriteFn(item)
+		var retryErr *writeRetryError
+		if errors.As(err, &retryErr) {
+			// No queue to retry from, so retry right away.
+			err = retryErr.retry()
+		}
 		if err != nil {
 			go func() { _ = c.close(DisconnectWriteError) }()
 		}
@@ -1339,18 +1616,17 @@ func (c *Client) checkExpired() {
 	now := time.Now().Unix()
 	ttl := exp - now
 
-	if !clientSideRefresh && c.eventHub.refreshHandler != nil {
-		if ttl > 0 {
-			c.mu.Lock()
-			if c.status != statusClosed {
-				c.addExpireUpdate(time.Duration(ttl)*time.Second, true)
-			}
-			c.mu.Unlock()
-		}
-	}
-
 	if ttl > 0 {
-		// Connection was successfully refreshed.
+		// Connection was successfully refreshed, schedule next expiration check.
+		expireAfter := time.Duration(ttl) * time.Second
+		if clientSideRefresh {
+			expireAfter += c.node.config.ClientExpiredCloseDelay
+		}
+		c.mu.Lock()
+		if c.status != statusClosed {
+			c.addExpireUpdate(expireAfter, true)
+		}
+		c.mu.Unlock()
 		return
 	}
 
@@ -1417,6 +1693,7 @@ func (c *Client) triggerConnect() {
 	if c.status != statusConnecting {
 		return
 	}
+	c.emitClientEvent(ClientEventConnect, "", 0)
 	if c.node.clientEvents.connectHandler == nil {
 		c.status = statusConnected
 		return
@@ -1425,10 +1702,25 @@ func (c *Client) triggerConnect() {
 	c.status = statusConnected
 }
 
+// emitClientEvent passes event to ClientEventHandler if it's set.
+func (c *Client) emitClientEvent(eventType ClientEventType, channel string, payloadSize int) {
+	if c.node.clientEventQueue == nil {
+		return
+	}
+	c.node.emitClientEvent(ClientEvent{
+		Type:        eventType,
+		Time:        time.Now(),
+		ClientID:    c.uid,
+		UserID:      c.user,
+		Channel:     channel,
+		PayloadSize: payloadSize,
+	})
+}
+
 func (c *Client) scheduleOnConnectTimers() {
 	// Make presence and refresh handlers always run after client connect event.
 	c.mu.Lock()
-	c.addPresenceUpdate(false)
+	c.addPresenceUpdate(true, false)
 	if c.exp > 0 {
 		expireAfter := time.Duration(c.exp-time.Now().Unix()) * time.Second
 		if c.clientSideRefresh {
@@ -1440,6 +1732,12 @@ func (c *Client) scheduleOnConnectTimers() {
 	if c.pingInterval > 0 {
 		c.addPingUpdate(true, false)
 	}
+	// Connection may be established without connect command from client (i.e.
+	// by unidirectional transports), consider connect as activity then.
+	atomic.CompareAndSwapInt64(&c.lastActive, 0, time.Now().UnixNano())
+	if idleTimeout := c.node.config.ClientIdleTimeout; idleTimeout > 0 {
+		c.nextIdleCheck = atomic.LoadInt64(&c.lastActive) + idleTimeout.Nanoseconds()
+	}
 	// Only schedule next timer once here after setting required points in time for ops.
 	c.scheduleNextTimer()
 	c.mu.Unlock()
@@ -1595,13 +1893,17 @@ func (c *Client) handleRefresh(req *protocol.RefreshRequest, cmd *protocol.Comma
 // onSubscribeError cleans up a channel from client channels if an error during subscribe happened.
 // Channel kept in a map during subscribe request to check for duplicate subscription attempts.
 func (c *Client) onSubscribeError(channel string) {
-	c.mu.Lock()
+	c.mu.RLock()
 	_, ok := c.channels[channel]
-	delete(c.channels, channel)
-	c.mu.Unlock()
+	c.mu.RUnlock()
 	if ok {
+		// Remove subscription while channel is still reserved in a map, so that
+		// concurrent subscribe attempt can't add a subscription we then remove.
 		_ = c.node.removeSubscription(channel, c)
 	}
+	c.mu.Lock()
+	delete(c.channels, channel)
+	c.mu.Unlock()
 }
 
 func (c *Client) handleSubscribe(req *protocol.SubscribeRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
@@ -1637,6 +1939,20 @@ func (c *Client) handleSubscribe(req *protocol.SubscribeRequest, cmd *protocol.C
 			return
 		}
 
+		if c.node.config.CheckClosedChannels && !reply.IgnoreChannelClosed {
+			closed, err := c.node.channelClosed(req.Channel)
+			if err != nil {
+				c.onSubscribeError(req.Channel)
+				c.logWriteInternalErrorFlush(req.Channel, protocol.FrameTypeSubscribe, cmd, err, "error checking channel closed", started, rw)
+				return
+			}
+			if closed {
+				c.onSubscribeError(req.Channel)
+				c.writeDisconnectOrErrorFlush(req.Channel, protocol.FrameTypeSubscribe, cmd, ErrorChannelClosed, started, rw)
+				return
+			}
+		}
+
 		ctx := c.subscribeCmd(req, reply, cmd, false, started, rw)
 
 		if ctx.disconnect != nil {
@@ -1650,6 +1966,8 @@ func (c *Client) handleSubscribe(req *protocol.SubscribeRequest, cmd *protocol.C
 			return
 		}
 
+		c.emitClientEvent(ClientEventSubscribe, req.Channel, 0)
+
 		if channelHasFlag(ctx.channelContext.flags, flagEmitJoinLeave) && ctx.clientInfo != nil {
 			go func() { _ = c.node.publishJoin(req.Channel, ctx.clientInfo) }()
 		}
@@ -1758,13 +2076,22 @@ func (c *Client) handleUnsubscribe(req *protocol.UnsubscribeRequest, cmd *protoc
 		return c.logDisconnectBadRequest("channel required for unsubscribe")
 	}
 
+	c.mu.RLock()
+	channelContext, ok := c.channels[channel]
+	c.mu.RUnlock()
+	if ok && channelHasFlag(channelContext.flags, flagServerSide) {
+		// Server-side subscriptions are managed by server only.
+		c.node.logger.log(newLogEntry(LogLevelInfo, "attempt to unsubscribe from server-side subscription", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
+		return ErrorPermissionDenied
+	}
+
 	if err := c.unsubscribe(channel, unsubscribeClient, nil); err != nil {
 		return err
 	}
 
 	protoReply, err := c.getUnsubscribeCommandReply(&protocol.UnsubscribeResult{})
 	if err != nil {
-		c.node.logger.log(newLogEntry(LogLevelError, "error encoding unsubscribe", map[string]any{"error": err.Error()}))
+		c.node.logger.log(newErrorLogEntry(err, "error encoding unsubscribe"))
 		return DisconnectServerError
 	}
 	c.writeEncodedCommandReply(channel, protocol.FrameTypeUnsubscribe, cmd, protoReply, rw)
@@ -1781,7 +2108,7 @@ func (c *Client) getUnsubscribeCommandReply(res *protocol.UnsubscribeResult) (*p
 	return protocol.ReplyPool.AcquireUnsubscribeReply(res), nil
 }
 
-func (c *Client) handlePublish(req *protocol.PublishRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
+func (c *Client) handlePublish(cmdCtx context.Context, req *protocol.PublishRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
 	if c.eventHub.publishHandler == nil {
 		return ErrorNotAvailable
 	}
@@ -1793,10 +2120,26 @@ func (c *Client) handlePublish(req *protocol.PublishRequest, cmd *protocol.Comma
 		return c.logDisconnectBadRequest("channel and data required for publish")
 	}
 
+	if !c.node.config.ClientInsecureSkipPayloadValidation && c.transport.Protocol() == ProtocolTypeJSON && !json.Valid(data) {
+		c.node.logger.log(newLogEntry(LogLevelInfo, "invalid JSON data in publish", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
+		return ErrorBadRequest
+	}
+
+	if err := c.validateChannel(channel); err != nil {
+		c.node.logger.log(newLogEntry(LogLevelInfo, "invalid channel for publish", map[string]any{"reason": err.Error(), "channel": channel, "user": c.user, "client": c.uid}))
+		return ErrorBadRequest
+	}
+
 	c.mu.RLock()
+	channelContext, subscribed := c.channels[channel]
 	info := c.clientInfo(channel)
 	c.mu.RUnlock()
 
+	if c.node.config.ClientSubscribeToPublish && (!subscribed || !channelHasFlag(channelContext.flags, flagSubscribed)) {
+		c.node.logger.log(newLogEntry(LogLevelInfo, "publish to channel without subscription", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
+		return ErrorPermissionDenied
+	}
+
 	event := PublishEvent{
 		Channel:    channel,
 		Data:       data,
@@ -1810,16 +2153,20 @@ func (c *Client) handlePublish(req *protocol.PublishRequest, cmd *protocol.Comma
 		}
 
 		if reply.Result == nil {
-			_, err := c.node.Publish(
-				event.Channel, event.Data,
+			ctx, cancel := c.commandContext(cmdCtx)
+			_, err := c.node.PublishContext(
+				ctx, event.Channel, event.Data,
 				WithHistory(reply.Options.HistorySize, reply.Options.HistoryTTL, reply.Options.HistoryMetaTTL),
 				WithClientInfo(reply.Options.ClientInfo),
+				WithExcludeClient(reply.Options.ExcludeClient),
 			)
+			cancel()
 			if err != nil {
 				c.logWriteInternalErrorFlush(channel, protocol.FrameTypePublish, cmd, err, "error publish", started, rw)
 				return
 			}
 		}
+		c.emitClientEvent(ClientEventPublish, channel, len(event.Data))
 
 		protoReply, err := c.getPublishCommandReply(&protocol.PublishResult{})
 		if err != nil {
@@ -1843,7 +2190,7 @@ func (c *Client) getPublishCommandReply(res *protocol.PublishResult) (*protocol.
 	return protocol.ReplyPool.AcquirePublishReply(res), nil
 }
 
-func (c *Client) handlePresence(req *protocol.PresenceRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
+func (c *Client) handlePresence(cmdCtx context.Context, req *protocol.PresenceRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
 	if c.eventHub.presenceHandler == nil {
 		return ErrorNotAvailable
 	}
@@ -1865,7 +2212,9 @@ func (c *Client) handlePresence(req *protocol.PresenceRequest, cmd *protocol.Com
 
 		var presence map[string]*ClientInfo
 		if reply.Result == nil {
-			result, err := c.node.Presence(event.Channel)
+			ctx, cancel := c.commandContext(cmdCtx)
+			result, err := c.node.PresenceContext(ctx, event.Channel)
+			cancel()
 			if err != nil {
 				c.logWriteInternalErrorFlush(channel, protocol.FrameTypePresence, cmd, err, "error getting presence", started, rw)
 				return
@@ -1904,7 +2253,7 @@ func (c *Client) getPresenceCommandReply(res *protocol.PresenceResult) (*protoco
 	return protocol.ReplyPool.AcquirePresenceReply(res), nil
 }
 
-func (c *Client) handlePresenceStats(req *protocol.PresenceStatsRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
+func (c *Client) handlePresenceStats(cmdCtx context.Context, req *protocol.PresenceStatsRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
 	if c.eventHub.presenceStatsHandler == nil {
 		return ErrorNotAvailable
 	}
@@ -1926,7 +2275,9 @@ func (c *Client) handlePresenceStats(req *protocol.PresenceStatsRequest, cmd *pr
 
 		var presenceStats PresenceStats
 		if reply.Result == nil {
-			result, err := c.node.PresenceStats(event.Channel)
+			ctx, cancel := c.commandContext(cmdCtx)
+			result, err := c.node.PresenceStatsContext(ctx, event.Channel)
+			cancel()
 			if err != nil {
 				c.logWriteInternalErrorFlush(channel, protocol.FrameTypePresenceStats, cmd, err, "error getting presence stats", started, rw)
 				return
@@ -1961,7 +2312,7 @@ func (c *Client) getPresenceStatsCommandReply(res *protocol.PresenceStatsResult)
 	return protocol.ReplyPool.AcquirePresenceStatsReply(res), nil
 }
 
-func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
+func (c *Client) handleHistory(cmdCtx context.Context, req *protocol.HistoryRequest, cmd *protocol.Command, started time.Time, rw *replyWriter) error {
 	if c.eventHub.historyHandler == nil {
 		return ErrorNotAvailable
 	}
@@ -1984,6 +2335,12 @@ func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Comma
 	if maxPublicationLimit > 0 && (filter.Limit < 0 || filter.Limit > maxPublicationLimit) {
 		filter.Limit = maxPublicationLimit
 	}
+	maxInReply := c.node.config.HistoryMaxPublicationsInReply
+	if maxInReply > 0 && (filter.Limit < 0 || filter.Limit > maxInReply) {
+		// Limit request itself, so that forward pagination with Since does not skip
+		// publications.
+		filter.Limit = maxInReply
+	}
 
 	filter.Reverse = req.Reverse
 
@@ -2002,9 +2359,11 @@ func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Comma
 		var offset uint64
 		var epoch string
 		if reply.Result == nil {
-			result, err := c.node.History(event.Channel,
+			ctx, cancel := c.commandContext(cmdCtx)
+			result, err := c.node.HistoryContext(ctx, event.Channel,
 				WithHistoryFilter(event.Filter),
 			)
+			cancel()
 			if err != nil {
 				c.logWriteInternalErrorFlush(channel, protocol.FrameTypeHistory, cmd, err, "error getting history", started, rw)
 				return
@@ -2018,9 +2377,18 @@ func (c *Client) handleHistory(req *protocol.HistoryRequest, cmd *protocol.Comma
 			epoch = reply.Result.Epoch
 		}
 
+		if maxInReply > 0 && len(pubs) > maxInReply {
+			// HistoryHandler may return more publications than requested.
+			pubs = pubs[:maxInReply]
+		}
+
+		isJSON := c.transport.Protocol() == ProtocolTypeJSON
 		protoPubs := make([]*protocol.Publication, 0, len(pubs))
 		for _, pub := range pubs {
 			protoPub := pubToProto(pub)
+			if isJSON {
+				protoPub = pubToJSONProto(protoPub)
+			}
 			protoPubs = append(protoPubs, protoPub)
 		}
 
@@ -2177,6 +2545,22 @@ func (c *Client) connectCmd(req *protocol.ConnectRequest, cmd *protocol.Command,
 	userConnectionLimit := config.UserConnectionLimit
 	channelLimit := config.ClientChannelLimit
 
+	if hardLimit := config.NodeClientConnectionHardLimit; hardLimit > 0 {
+		// Connects in progress are counted too, so that a burst of concurrent
+		// connects can't pass the check before being added to Hub.
+		numConnecting := atomic.AddInt64(&c.node.numConnecting, 1)
+		defer atomic.AddInt64(&c.node.numConnecting, -1)
+		if c.node.hub.NumClients()+int(numConnecting) > hardLimit {
+			c.node.metrics.incNodeConnectionLimit(nodeConnectionLimitHard)
+			c.node.logger.log(newLogEntry(LogLevelInfo, "node connection hard limit reached", map[string]any{"client": c.uid, "limit": hardLimit}))
+			c.startWriter(0, 0, 0)
+			return nil, ErrorTooManyRequests
+		}
+	}
+	if softLimit := config.NodeClientConnectionSoftLimit; softLimit > 0 && c.node.hub.NumClients() >= softLimit {
+		c.node.metrics.incNodeConnectionLimit(nodeConnectionLimitSoft)
+	}
+
 	var (
 		credentials       *Credentials
 		authData          protocol.Raw
@@ -2211,6 +2595,9 @@ func (c *Client) connectCmd(req *protocol.ConnectRequest, cmd *protocol.Command,
 			c.pingInterval, c.pongTimeout = getPingPongPeriodValues(c.transport.PingPongConfig())
 		}
 		c.replyWithoutQueue = reply.ReplyWithoutQueue
+		if reply.MaxConcurrentCommands > 0 {
+			c.commandSem = make(chan struct{}, reply.MaxConcurrentCommands)
+		}
 		c.startWriter(reply.WriteDelay, reply.MaxMessagesInFrame, reply.QueueInitialCap)
 
 		if reply.Credentials != nil {
@@ -2278,10 +2665,20 @@ func (c *Client) connectCmd(req *protocol.ConnectRequest, cmd *protocol.Command,
 		return nil, DisconnectConnectionClosed
 	}
 
-	if c.node.LogEnabled(LogLevelDebug) {
-		c.node.logger.log(newLogEntry(LogLevelDebug, "client authenticated", map[string]any{"client": c.uid, "user": c.user}))
+	if c.node.config.UserSubscribeToPersonal && user != "" {
+		personalChannel := c.node.PersonalChannel(user)
+		if _, ok := subscriptions[personalChannel]; !ok {
+			if subscriptions == nil {
+				subscriptions = make(map[string]SubscribeOptions, 1)
+			}
+			subscriptions[personalChannel] = SubscribeOptions{}
+		}
 	}
 
+	c.node.logger.logLazy(LogLevelDebug, "client authenticated", func() map[string]any {
+		return map[string]any{"client": c.uid, "user": c.user}
+	})
+
 	if userConnectionLimit > 0 && user != "" && len(c.node.hub.UserConnections(user)) >= userConnectionLimit {
 		c.node.logger.log(newLogEntry(LogLevelInfo, "limit of connections for user reached", map[string]any{"user": user, "client": c.uid, "limit": userConnectionLimit}))
 		return nil, DisconnectConnectionLimit
@@ -2323,14 +2720,34 @@ func (c *Client) connectCmd(req *protocol.ConnectRequest, cmd *protocol.Command,
 	// Client successfully connected.
 	c.mu.Lock()
 	c.authenticated = true
+	c.connectedAt = time.Now().UnixNano()
+	connectedAt := c.connectedAt
 	c.mu.Unlock()
 
 	err := c.node.addClient(c)
 	if err != nil {
-		c.node.logger.log(newLogEntry(LogLevelError, "error adding client", map[string]any{"client": c.uid, "error": err.Error()}))
+		if errors.Is(err, ErrShuttingDown) {
+			return nil, DisconnectShutdown
+		}
+		c.node.logger.log(newErrorLogEntry(err, "error adding client", map[string]any{"client": c.uid}))
 		return nil, DisconnectServerError
 	}
 
+	if c.node.config.UserPersonalSingleConnection && user != "" {
+		// Take over: disconnect all user connections established before this one
+		// on all nodes. Connections established later are kept, so when several
+		// connections of user arrive concurrently the newest one wins.
+		err := c.node.Disconnect(
+			user,
+			WithCustomDisconnect(DisconnectConnectionLimit),
+			WithDisconnectClientWhitelist([]string{c.uid}),
+			withDisconnectConnectedBefore(connectedAt),
+		)
+		if err != nil {
+			c.node.logger.log(newErrorLogEntry(err, "error disconnecting previous user connections", map[string]any{"user": user, "client": c.uid}))
+		}
+	}
+
 	if !clientSideRefresh {
 		// Server will do refresh itself.
 		res.Expires = false
@@ -2396,7 +2813,7 @@ func (c *Client) connectCmd(req *protocol.ConnectRequest, cmd *protocol.Command,
 			protoReply, err := c.getConnectPushReply(res)
 			if err != nil {
 				c.unlockServerSideSubscriptions(subCtxMap)
-				c.node.logger.log(newLogEntry(LogLevelError, "error encoding connect", map[string]any{"error": err.Error()}))
+				c.node.logger.log(newErrorLogEntry(err, "error encoding connect"))
 				return nil, DisconnectServerError
 			}
 			c.writeEncodedPush(protoReply, rw, "", protocol.FrameTypePushConnect)
@@ -2405,7 +2822,7 @@ func (c *Client) connectCmd(req *protocol.ConnectRequest, cmd *protocol.Command,
 		protoReply, err := c.getConnectCommandReply(res)
 		if err != nil {
 			c.unlockServerSideSubscriptions(subCtxMap)
-			c.node.logger.log(newLogEntry(LogLevelError, "error encoding connect", map[string]any{"error": err.Error()}))
+			c.node.logger.log(newErrorLogEntry(err, "error encoding connect"))
 			return nil, DisconnectServerError
 		}
 		c.writeEncodedCommandReply("", protocol.FrameTypeConnect, cmd, protoReply, rw)
@@ -2459,6 +2876,7 @@ func (c *Client) startWriter(batchDelay time.Duration, maxMessagesInFrame int, q
 		var writeMu sync.Mutex
 		messageWriterConf := writerConfig{
 			MaxQueueSize: c.node.config.ClientQueueMaxSize,
+			MaxFrameSize: c.node.config.ClientMaxFrameSize,
 			WriteFn: func(item queue.Item) error {
 				channelGroup := "_"
 				if item.Channel != "" && c.node.config.GetChannelNamespaceLabel != nil && c.node.config.ChannelNamespaceLabelForTransportMessagesSent {
@@ -2475,20 +2893,21 @@ func (c *Client) startWriter(batchDelay time.Duration, maxMessagesInFrame int, q
 				writeMu.Lock()
 				defer writeMu.Unlock()
 				if err := c.transport.Write(item.Data); err != nil {
-					switch v := err.(type) {
-					case *Disconnect:
-						go func() { _ = c.close(*v) }()
-					case Disconnect:
-						go func() { _ = c.close(v) }()
-					default:
-						go func() { _ = c.close(DisconnectWriteError) }()
-					}
-					return err
+					return c.handleTransportWriteError(err, len(item.Data), func() error {
+						writeMu.Lock()
+						defer writeMu.Unlock()
+						return c.transport.Write(item.Data)
+					})
 				}
 				return nil
 			},
 			WriteManyFn: func(items ...queue.Item) error {
-				messages := make([][]byte, 0, len(items))
+				messagesPtr := getMessages(len(items))
+				messages := *messagesPtr
+				defer func() {
+					*messagesPtr = messages
+					putMessages(messagesPtr)
+				}()
 				for i := 0; i < len(items); i++ {
 					if c.node.clientEvents.transportWriteHandler != nil {
 						pass := c.node.clientEvents.transportWriteHandler(c, TransportWriteEvent(items[i]))
@@ -2506,15 +2925,17 @@ func (c *Client) startWriter(batchDelay time.Duration, maxMessagesInFrame int, q
 				writeMu.Lock()
 				defer writeMu.Unlock()
 				if err := c.transport.WriteMany(messages...); err != nil {
-					switch v := err.(type) {
-					case *Disconnect:
-						go func() { _ = c.close(*v) }()
-					case Disconnect:
-						go func() { _ = c.close(v) }()
-					default:
-						go func() { _ = c.close(DisconnectWriteError) }()
+					size := 0
+					for _, message := range messages {
+						size += len(message)
 					}
-					return err
+					// Messages slice is returned to pool, retry may happen later.
+					retryMessages := append([][]byte(nil), messages...)
+					return c.handleTransportWriteError(err, size, func() error {
+						writeMu.Lock()
+						defer writeMu.Unlock()
+						return c.transport.WriteMany(retryMessages...)
+					})
 				}
 				return nil
 			},
@@ -2525,6 +2946,62 @@ func (c *Client) startWriter(batchDelay time.Duration, maxMessagesInFrame int, q
 	})
 }
 
+// handleTransportWriteError applies TransportWriteErrorDecision to failed write.
+// Returns nil if connection should be kept, *writeRetryError if write should be
+// retried by writer.
+func (c *Client) handleTransportWriteError(err error, size int, retry func() error) error {
+	if isUnrecoverableWriteError(err) {
+		c.node.metrics.incTransportWriteError(c.transport.Name(), TransportWriteErrorDisconnect)
+		c.closeOnWriteError(err)
+		return err
+	}
+	decision := TransportWriteErrorDisconnect
+	if c.node.clientEvents.transportWriteErrorHandler != nil {
+		decision = c.node.clientEvents.transportWriteErrorHandler(c, TransportWriteErrorEvent{Error: err, Size: size})
+	}
+	c.node.metrics.incTransportWriteError(c.transport.Name(), decision)
+	switch decision {
+	case TransportWriteErrorDrop:
+		return nil
+	case TransportWriteErrorRetry:
+		return &writeRetryError{err: err, retry: func() error {
+			if err := retry(); err != nil {
+				c.closeOnWriteError(err)
+				return err
+			}
+			return nil
+		}}
+	}
+	c.closeOnWriteError(err)
+	return err
+}
+
+// isUnrecoverableWriteError checks whether connection can't be used after write
+// error – Transport asked to disconnect or connection is already closed.
+func isUnrecoverableWriteError(err error) bool {
+	var disconnect Disconnect
+	var disconnectPtr *Disconnect
+	if errors.As(err, &disconnect) || errors.As(err, &disconnectPtr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+func (c *Client) closeOnWriteError(err error) {
+	switch v := err.(type) {
+	case *Disconnect:
+		go func() { _ = c.close(*v) }()
+	case Disconnect:
+		go func() { _ = c.close(v) }()
+	default:
+		go func() { _ = c.close(DisconnectWriteError) }()
+	}
+}
+
 func (c *Client) releaseConnectCommandReply(reply *protocol.Reply) {
 	protocol.ReplyPool.ReleaseConnectReply(reply)
 }
@@ -2603,6 +3080,31 @@ func (c *Client) getSubscribePushReply(channel string, res *protocol.SubscribeRe
 	})
 }
 
+var (
+	errChannelTooLong      = errors.New("channel too long")
+	errChannelInvalidUTF8  = errors.New("channel is not a valid UTF-8 string")
+	errChannelControlChars = errors.New("channel contains control characters")
+)
+
+// validateChannel checks channel name from client request.
+func (c *Client) validateChannel(channel string) error {
+	if channelMaxLength := c.node.config.ChannelMaxLength; channelMaxLength > 0 && len(channel) > channelMaxLength {
+		return errChannelTooLong
+	}
+	if !utf8.ValidString(channel) {
+		return errChannelInvalidUTF8
+	}
+	for _, r := range channel {
+		if unicode.IsControl(r) {
+			return errChannelControlChars
+		}
+	}
+	if c.node.config.ChannelValidator != nil {
+		return c.node.config.ChannelValidator(channel)
+	}
+	return nil
+}
+
 func (c *Client) validateSubscribeRequest(cmd *protocol.SubscribeRequest) (*Error, *Disconnect) {
 	channel := cmd.Channel
 	if channel == "" {
@@ -2611,11 +3113,10 @@ func (c *Client) validateSubscribeRequest(cmd *protocol.SubscribeRequest) (*Erro
 	}
 
 	config := c.node.config
-	channelMaxLength := config.ChannelMaxLength
 	channelLimit := config.ClientChannelLimit
 
-	if channelMaxLength > 0 && len(channel) > channelMaxLength {
-		c.node.logger.log(newLogEntry(LogLevelInfo, "channel too long", map[string]any{"max": channelMaxLength, "channel": channel, "user": c.user, "client": c.uid}))
+	if err := c.validateChannel(channel); err != nil {
+		c.node.logger.log(newLogEntry(LogLevelInfo, "invalid channel for subscribe", map[string]any{"reason": err.Error(), "channel": channel, "user": c.user, "client": c.uid}))
 		return ErrorBadRequest, nil
 	}
 
@@ -2658,7 +3159,10 @@ type subscribeContext struct {
 	channelContext ChannelContext
 }
 
-func isRecovered(historyResult HistoryResult, cmdOffset uint64, cmdEpoch string) ([]*protocol.Publication, bool) {
+// isRecovered checks whether all publications since cmdOffset were recovered from
+// history. For compacted history gaps in offsets are expected (see
+// SubscribeOptions.CompactedHistory) so only stream top is checked.
+func isRecovered(historyResult HistoryResult, cmdOffset uint64, cmdEpoch string, compacted bool) ([]*protocol.Publication, bool) {
 	latestOffset := historyResult.Offset
 	latestEpoch := historyResult.Epoch
 
@@ -2673,7 +3177,7 @@ func isRecovered(historyResult HistoryResult, cmdOffset uint64, cmdEpoch string)
 	if len(recoveredPubs) == 0 {
 		recovered = latestOffset == cmdOffset && (cmdEpoch == "" || latestEpoch == cmdEpoch)
 	} else {
-		recovered = recoveredPubs[0].Offset == nextOffset &&
+		recovered = (compacted || recoveredPubs[0].Offset == nextOffset) &&
 			recoveredPubs[len(recoveredPubs)-1].Offset == latestOffset &&
 			(cmdEpoch == "" || latestEpoch == cmdEpoch)
 	}
@@ -2725,7 +3229,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 
 	err := c.node.addSubscription(channel, c)
 	if err != nil {
-		c.node.logger.log(newLogEntry(LogLevelError, "error adding subscription", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+		c.node.logger.log(newErrorLogEntry(err, "error adding subscription", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
 		c.pubSubSync.StopBuffering(channel)
 		if clientErr, ok := err.(*Error); ok && clientErr != ErrorInternal {
 			return errorDisconnectContext(clientErr, nil)
@@ -2737,7 +3241,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 	if reply.Options.EmitPresence {
 		err = c.node.addPresence(channel, c.uid, info)
 		if err != nil {
-			c.node.logger.log(newLogEntry(LogLevelError, "error adding presence", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+			c.node.logger.log(newErrorLogEntry(err, "error adding presence", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
 			c.pubSubSync.StopBuffering(channel)
 			ctx.disconnect = &DisconnectServerError
 			return ctx
@@ -2772,7 +3276,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 					res.Recovered = false
 					c.node.metrics.incRecover(res.Recovered)
 				} else {
-					c.node.logger.log(newLogEntry(LogLevelError, "error on recover", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+					c.node.logger.log(newErrorLogEntry(err, "error on recover", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
 					c.pubSubSync.StopBuffering(channel)
 					if clientErr, ok := err.(*Error); ok && clientErr != ErrorInternal {
 						return errorDisconnectContext(clientErr, nil)
@@ -2784,14 +3288,19 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 				latestOffset = historyResult.Offset
 				latestEpoch = historyResult.Epoch
 				var recovered bool
-				recoveredPubs, recovered = isRecovered(historyResult, cmdOffset, cmdEpoch)
+				recoveredPubs, recovered = isRecovered(historyResult, cmdOffset, cmdEpoch, reply.Options.CompactedHistory)
+				if c.transport.Protocol() == ProtocolTypeJSON {
+					for i, pub := range recoveredPubs {
+						recoveredPubs[i] = pubToJSONProto(pub)
+					}
+				}
 				res.Recovered = recovered
 				c.node.metrics.incRecover(res.Recovered)
 			}
 		} else {
 			streamTop, err := c.node.streamTop(channel, reply.Options.HistoryMetaTTL)
 			if err != nil {
-				c.node.logger.log(newLogEntry(LogLevelError, "error getting stream state for channel", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+				c.node.logger.log(newErrorLogEntry(err, "error getting stream state for channel", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
 				c.pubSubSync.StopBuffering(channel)
 				if clientErr, ok := err.(*Error); ok && clientErr != ErrorInternal {
 					return errorDisconnectContext(clientErr, nil)
@@ -2808,7 +3317,11 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 
 		bufferedPubs := c.pubSubSync.LockBufferAndReadBuffered(channel)
 		var okMerge bool
-		recoveredPubs, okMerge = recovery.MergePublications(recoveredPubs, bufferedPubs)
+		if reply.Options.CompactedHistory {
+			recoveredPubs, okMerge = recovery.MergeCompactedPublications(recoveredPubs, bufferedPubs)
+		} else {
+			recoveredPubs, okMerge = recovery.MergePublications(recoveredPubs, bufferedPubs)
+		}
 		if !okMerge {
 			c.pubSubSync.StopBuffering(channel)
 			ctx.disconnect = &DisconnectInsufficientState
@@ -2843,7 +3356,7 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		// Write subscription reply only if initiated by client.
 		protoReply, err := c.getSubscribeCommandReply(res)
 		if err != nil {
-			c.node.logger.log(newLogEntry(LogLevelError, "error encoding subscribe", map[string]any{"error": err.Error()}))
+			c.node.logger.log(newErrorLogEntry(err, "error encoding subscribe"))
 			if !serverSide {
 				// Will be called later in case of server side sub.
 				c.pubSubSync.StopBuffering(channel)
@@ -2898,6 +3411,17 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 	if !serverSide {
 		// In case of server-side sub this will be done later by the caller.
 		c.mu.Lock()
+		if chCtx, ok := c.channels[channel]; ok && channelHasFlag(chCtx.flags, flagSubscribeCanceled) {
+			// Client unsubscribed while subscription was in progress, roll back.
+			// Channel stays reserved in a map until onSubscribeError removes
+			// subscription and releases it.
+			c.mu.Unlock()
+			c.pubSubSync.StopBuffering(channel)
+			if reply.Options.EmitPresence {
+				_ = c.node.removePresence(channel, c.uid, c.user)
+			}
+			return errorDisconnectContext(ErrorNotAvailable, nil)
+		}
 		c.channels[channel] = channelContext
 		c.mu.Unlock()
 		// Stop syncing recovery and PUB/SUB.
@@ -2905,9 +3429,9 @@ func (c *Client) subscribeCmd(req *protocol.SubscribeRequest, reply SubscribeRep
 		c.pubSubSync.StopBuffering(channel)
 	}
 
-	if c.node.logger.enabled(LogLevelDebug) {
-		c.node.logger.log(newLogEntry(LogLevelDebug, "client subscribed to channel", map[string]any{"client": c.uid, "user": c.user, "channel": req.Channel}))
-	}
+	c.node.logger.logLazy(LogLevelDebug, "client subscribed to channel", func() map[string]any {
+		return map[string]any{"client": c.uid, "user": c.user, "channel": req.Channel}
+	})
 
 	ctx.result = res
 	ctx.clientInfo = info
@@ -2960,11 +3484,14 @@ func (c *Client) writePublicationUpdatePosition(ch string, pub *protocol.Publica
 		return nil
 	}
 	if !channelHasFlag(channelContext.flags, flagPositioning) {
+		c.mu.Unlock()
+		if data == nil {
+			// Publication skipped, no position to update.
+			return nil
+		}
 		if hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
-			c.mu.Unlock()
 			return nil
 		}
-		c.mu.Unlock()
 		return c.transportEnqueue(data, ch, protocol.FrameTypePushPublication)
 	}
 	serverSide := channelHasFlag(channelContext.flags, flagServerSide)
@@ -2973,18 +3500,18 @@ func (c *Client) writePublicationUpdatePosition(ch string, pub *protocol.Publica
 	pubOffset := pub.Offset
 	pubEpoch := sp.Epoch
 	if pubEpoch != channelContext.streamPosition.Epoch {
-		if c.node.logger.enabled(LogLevelDebug) {
-			c.node.logger.log(newLogEntry(LogLevelDebug, "client insufficient state", map[string]any{"channel": ch, "user": c.user, "client": c.uid, "epoch": pubEpoch, "expectedEpoch": channelContext.streamPosition.Epoch}))
-		}
+		c.node.logger.logLazy(LogLevelDebug, "client insufficient state", func() map[string]any {
+			return map[string]any{"channel": ch, "user": c.user, "client": c.uid, "epoch": pubEpoch, "expectedEpoch": channelContext.streamPosition.Epoch}
+		})
 		// Oops: sth lost, let client reconnect/resubscribe to recover its state.
 		go func() { c.handleInsufficientState(ch, serverSide) }()
 		c.mu.Unlock()
 		return nil
 	}
 	if pubOffset != nextExpectedOffset {
-		if c.node.logger.enabled(LogLevelDebug) {
-			c.node.logger.log(newLogEntry(LogLevelDebug, "client insufficient state", map[string]any{"channel": ch, "user": c.user, "client": c.uid, "offset": pubOffset, "expectedOffset": nextExpectedOffset}))
-		}
+		c.node.logger.logLazy(LogLevelDebug, "client insufficient state", func() map[string]any {
+			return map[string]any{"channel": ch, "user": c.user, "client": c.uid, "offset": pubOffset, "expectedOffset": nextExpectedOffset}
+		})
 		// Oops: sth lost, let client reconnect/resubscribe to recover its state.
 		go func() { c.handleInsufficientState(ch, serverSide) }()
 		c.mu.Unlock()
@@ -2994,6 +3521,10 @@ func (c *Client) writePublicationUpdatePosition(ch string, pub *protocol.Publica
 	channelContext.streamPosition.Offset = pub.Offset
 	c.channels[ch] = channelContext
 	c.mu.Unlock()
+	if data == nil {
+		// Publication skipped, only position updated.
+		return nil
+	}
 	if hasFlag(c.transport.DisabledPushFlags(), PushFlagPublication) {
 		return nil
 	}
@@ -3016,6 +3547,18 @@ func (c *Client) writePublication(ch string, pub *protocol.Publication, data []b
 	return nil
 }
 
+// skipPublication advances client stream position in channel without delivering
+// publication. Used for publications dropped by BroadcastFilterHandler, so that
+// positioned subscriptions do not treat them as lost.
+func (c *Client) skipPublication(ch string, pub *protocol.Publication, sp StreamPosition) {
+	if pub.Offset == 0 {
+		return
+	}
+	c.pubSubSync.SyncPublication(ch, pub, func() {
+		_ = c.writePublicationUpdatePosition(ch, pub, nil, sp)
+	})
+}
+
 func (c *Client) writeJoin(ch string, join *protocol.Join, data []byte) error {
 	if c.node.LogEnabled(LogLevelTrace) {
 		c.traceOutPush(&protocol.Push{Channel: ch, Join: join})
@@ -3060,24 +3603,32 @@ func (c *Client) writeLeave(ch string, leave *protocol.Leave, data []byte) error
 
 // Lock must be held outside.
 func (c *Client) unsubscribe(channel string, unsubscribe Unsubscribe, disconnect *Disconnect) error {
-	c.mu.RLock()
+	c.mu.Lock()
 	info := c.clientInfo(channel)
 	chCtx, ok := c.channels[channel]
-	c.mu.RUnlock()
 	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	if !channelHasFlag(chCtx.flags, flagSubscribed) && c.status != statusClosed {
+		// Subscription is still in progress: keep channel in a map so that concurrent
+		// subscribe attempts get ErrorAlreadySubscribed, subscribe will roll back itself
+		// upon finishing. Closed client can't subscribe anymore, so in this case
+		// subscription is cleaned up right away.
+		chCtx.flags |= flagSubscribeCanceled
+		c.channels[channel] = chCtx
+		c.mu.Unlock()
 		return nil
 	}
-
-	serverSide := channelHasFlag(chCtx.flags, flagServerSide)
-
-	c.mu.Lock()
 	delete(c.channels, channel)
 	c.mu.Unlock()
 
+	serverSide := channelHasFlag(chCtx.flags, flagServerSide)
+
 	if channelHasFlag(chCtx.flags, flagEmitPresence) && channelHasFlag(chCtx.flags, flagSubscribed) {
 		err := c.node.removePresence(channel, c.uid, c.user)
 		if err != nil {
-			c.node.logger.log(newLogEntry(LogLevelError, "error removing channel presence", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+			c.node.logger.log(newErrorLogEntry(err, "error removing channel presence", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
 		}
 	}
 
@@ -3086,7 +3637,7 @@ func (c *Client) unsubscribe(channel string, unsubscribe Unsubscribe, disconnect
 	}
 
 	if err := c.node.removeSubscription(channel, c); err != nil {
-		c.node.logger.log(newLogEntry(LogLevelError, "error removing subscription", map[string]any{"channel": channel, "user": c.user, "client": c.uid, "error": err.Error()}))
+		c.node.logger.log(newErrorLogEntry(err, "error removing subscription", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
 		return err
 	}
 
@@ -3101,9 +3652,9 @@ func (c *Client) unsubscribe(channel string, unsubscribe Unsubscribe, disconnect
 		}
 	}
 
-	if c.node.logger.enabled(LogLevelDebug) {
-		c.node.logger.log(newLogEntry(LogLevelDebug, "client unsubscribed from channel", map[string]any{"channel": channel, "user": c.user, "client": c.uid}))
-	}
+	c.node.logger.logLazy(LogLevelDebug, "client unsubscribed from channel", func() map[string]any {
+		return map[string]any{"channel": channel, "user": c.user, "client": c.uid}
+	})
 
 	return nil
 }
@@ -3117,12 +3668,13 @@ func (c *Client) logWriteInternalErrorFlush(ch string, frameType protocol.FrameT
 	defer func() {
 		c.node.metrics.observeCommandDuration(frameType, time.Since(started))
 	}()
-	if clientErr, ok := err.(*Error); ok {
+	var clientErr *Error
+	if errors.As(err, &clientErr) {
 		errorReply := &protocol.Reply{Error: clientErr.toProto()}
 		c.writeError(ch, frameType, cmd, errorReply, rw)
 		return
 	}
-	c.node.logger.log(newLogEntry(LogLevelError, message, map[string]any{"error": err.Error()}))
+	c.node.logger.log(newErrorLogEntry(err, message))
 
 	errorReply := &protocol.Reply{Error: ErrorInternal.toProto()}
 	c.writeError(ch, frameType, cmd, errorReply, rw)
@@ -3132,8 +3684,10 @@ func (c *Client) logWriteInternalErrorFlush(ch string, frameType protocol.FrameT
 	}
 }
 
+// toClientErr extracts *Error from err (possibly wrapped), falls back to ErrorInternal.
 func toClientErr(err error) *Error {
-	if clientErr, ok := err.(*Error); ok {
+	var clientErr *Error
+	if errors.As(err, &clientErr) {
 		return clientErr
 	}
 	return ErrorInternal
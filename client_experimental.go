@@ -21,6 +21,7 @@ func (c *Client) WritePublication(channel string, publication *Publication, sp S
 	protoType := c.transport.Protocol().toProto()
 
 	if protoType == protocol.TypeJSON {
+		pub = pubToJSONProto(pub)
 		if c.transport.Unidirectional() {
 			push := &protocol.Push{Channel: channel, Pub: pub}
 			var err error
@@ -7,12 +7,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/centrifugal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -161,6 +165,38 @@ func TestClientTimerSchedule(t *testing.T) {
 	require.Equal(t, timerOpPresence, client.timerOp)
 }
 
+func TestClientFirstPresenceUpdateJitter(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	transport := newTestTransport(func() {})
+	client, _ := newClient(context.Background(), node, transport)
+	interval := node.config.ClientPresenceUpdateInterval
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	started := time.Now()
+	client.addPresenceUpdate(true, false)
+	require.GreaterOrEqual(t, client.nextPresence, started.Add(interval/2).UnixNano())
+	require.LessOrEqual(t, client.nextPresence, time.Now().Add(interval).UnixNano())
+}
+
+func TestClientExpireReschedule(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	client.mu.Lock()
+	client.exp = time.Now().Unix() + 60
+	client.clientSideRefresh = true
+	client.nextExpire = time.Now().Add(-time.Second).UnixNano()
+	client.timerOp = timerOpExpire
+	client.mu.Unlock()
+	client.onTimerOp()
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	require.Equal(t, statusConnected, client.status)
+	require.Greater(t, client.nextExpire, time.Now().Add(59*time.Second).UnixNano())
+}
+
 func TestClientGetPingData(t *testing.T) {
 	data := getPingData(true, ProtocolTypeJSON)
 	require.Equal(t, jsonPingPush, data)
@@ -223,6 +259,96 @@ func TestClientV2DisconnectNoPong(t *testing.T) {
 	}
 }
 
+func TestClientDisconnectEventChannels(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	done := make(chan struct{})
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+		client.OnDisconnect(func(event DisconnectEvent) {
+			require.Equal(t, DisconnectForceNoReconnect.Code, event.Code)
+			require.ElementsMatch(t, []string{"test1", "test2"}, event.Channels)
+			require.Equal(t, DisconnectCauseServer, event.Cause)
+			close(done)
+		})
+	})
+	client := newTestClientV2(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test1")
+	subscribeClientV2(t, client, "test2")
+	client.Disconnect(DisconnectForceNoReconnect)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no disconnect in timeout")
+	}
+}
+
+func TestDisconnectCause(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, DisconnectCauseClient, disconnectCause(DisconnectConnectionClosed))
+	require.Equal(t, DisconnectCauseWriteError, disconnectCause(DisconnectWriteError))
+	require.Equal(t, DisconnectCauseExpired, disconnectCause(DisconnectExpired))
+	require.Equal(t, DisconnectCauseSlow, disconnectCause(DisconnectSlow))
+	require.Equal(t, DisconnectCauseShutdown, disconnectCause(DisconnectShutdown))
+	require.Equal(t, DisconnectCauseServer, disconnectCause(DisconnectForceReconnect))
+	require.Equal(t, DisconnectCauseServer, disconnectCause(Disconnect{Code: 4000, Reason: "custom"}))
+}
+
+func TestClientDisconnectHandlerOnceOnShutdownRace(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+
+	const numClients = 50
+	var mu sync.Mutex
+	calls := map[string]int{}
+	node.OnConnect(func(client *Client) {
+		client.OnDisconnect(func(event DisconnectEvent) {
+			require.Contains(t, []DisconnectCause{DisconnectCauseClient, DisconnectCauseShutdown}, event.Cause)
+			mu.Lock()
+			calls[client.ID()]++
+			mu.Unlock()
+		})
+	})
+
+	clients := make([]*Client, 0, numClients)
+	for i := 0; i < numClients; i++ {
+		client := newTestClientV2(t, node, fmt.Sprintf("user%d", i))
+		connectClientV2(t, client)
+		clients = append(clients, client)
+	}
+
+	// Transport close races with Node shutdown for every client.
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			<-start
+			_ = client.close(DisconnectConnectionClosed)
+		}(client)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		_ = node.Shutdown(context.Background())
+	}()
+	close(start)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, calls, numClients)
+	for clientID, n := range calls {
+		require.Equal(t, 1, n, clientID)
+	}
+}
+
 func TestClientV2PingPong(t *testing.T) {
 	t.Parallel()
 	node := defaultTestNode()
@@ -444,6 +570,120 @@ func TestClientSubscribe(t *testing.T) {
 	require.Equal(t, ErrorAlreadySubscribed, err)
 }
 
+func TestClientConcurrentSubscribeUnsubscribe(t *testing.T) {
+	broker := NewTestBroker()
+	node := nodeWithBroker(broker)
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			go cb(SubscribeReply{Options: SubscribeOptions{EmitPresence: true}}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rwWrapper := testReplyWriterWrapper()
+			_ = client.handleSubscribe(&protocol.SubscribeRequest{
+				Channel: "test",
+			}, &protocol.Command{Id: 1}, time.Now(), rwWrapper.rw)
+		}()
+		go func() {
+			defer wg.Done()
+			rwWrapper := testReplyWriterWrapper()
+			_ = client.handleUnsubscribe(&protocol.UnsubscribeRequest{
+				Channel: "test",
+			}, &protocol.Command{Id: 2}, time.Now(), rwWrapper.rw)
+		}()
+	}
+	wg.Wait()
+
+	// Wait for subscription in progress to finish.
+	require.Eventually(t, func() bool {
+		client.mu.RLock()
+		defer client.mu.RUnlock()
+		chCtx, ok := client.channels["test"]
+		return !ok || channelHasFlag(chCtx.flags, flagSubscribed)
+	}, time.Second, 5*time.Millisecond)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleUnsubscribe(&protocol.UnsubscribeRequest{
+		Channel: "test",
+	}, &protocol.Command{Id: 3}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+
+	client.mu.RLock()
+	_, ok := client.channels["test"]
+	client.mu.RUnlock()
+	require.False(t, ok)
+	require.Equal(t, 0, node.Hub().NumSubscribers("test"))
+	presence, err := node.Presence("test")
+	require.NoError(t, err)
+	require.Len(t, presence.Presence, 0)
+
+	// Broker unsubscribe is delayed by subscription dissolver.
+	require.Eventually(t, func() bool {
+		_, subscribed := broker.subscribed.Load("test")
+		return !subscribed
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestClientJoinAndPresenceIncludeChannelInfo(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{
+				Options: SubscribeOptions{
+					EmitJoinLeave: true,
+					PushJoinLeave: true,
+					EmitPresence:  true,
+					ChannelInfo:   []byte(`{"role":"user` + client.UserID() + `"}`),
+				},
+			}, nil)
+		})
+	})
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client1 := newTestClientCustomTransport(t, context.Background(), node, transport, "1")
+	connectClientV2(t, client1)
+	subscribeClientV2(t, client1, "test")
+
+	done := make(chan struct{})
+	go func() {
+		for data := range transport.sink {
+			if strings.Contains(string(data), `"join"`) && strings.Contains(string(data), `"chan_info":{"role":"user2"}`) {
+				close(done)
+				return
+			}
+		}
+	}()
+
+	client2 := newTestClient(t, node, "2")
+	connectClientV2(t, client2)
+	subscribeClientV2(t, client2, "test")
+
+	select {
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout waiting for join with channel info")
+	case <-done:
+	}
+
+	result, err := node.Presence("test")
+	require.NoError(t, err)
+	require.Len(t, result.Presence, 2)
+	require.Equal(t, []byte(`{"role":"user1"}`), result.Presence[client1.ID()].ChanInfo)
+	require.Equal(t, []byte(`{"role":"user2"}`), result.Presence[client2.ID()].ChanInfo)
+}
+
 func TestClientSubscribeBrokerErrorOnSubscribe(t *testing.T) {
 	t.Parallel()
 	broker := NewTestBroker()
@@ -741,6 +981,132 @@ func TestClientSubscribeValidateErrors(t *testing.T) {
 	require.Equal(t, DisconnectBadRequest, err)
 }
 
+func TestClientValidateChannel(t *testing.T) {
+	node := defaultTestNode()
+	node.config.ChannelMaxLength = 10
+	node.config.ChannelValidator = func(channel string) error {
+		if strings.HasPrefix(channel, "forbidden") {
+			return errors.New("forbidden")
+		}
+		return nil
+	}
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	for _, channel := range []string{"test\x00", "test\xff", "very_long_channel", "forbidden"} {
+		rwWrapper := testReplyWriterWrapper()
+		err := client.handleSubscribe(&protocol.SubscribeRequest{
+			Channel: channel,
+		}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+		require.Equal(t, ErrorBadRequest, err, channel)
+
+		rwWrapper = testReplyWriterWrapper()
+		err = client.handlePublish(client.Context(), &protocol.PublishRequest{
+			Channel: channel,
+			Data:    []byte(`{}`),
+		}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+		require.Equal(t, ErrorBadRequest, err, channel)
+	}
+
+	subscribeClientV2(t, client, "test")
+}
+
+func TestClientSubscribeToPersonal(t *testing.T) {
+	node := defaultTestNode()
+	node.config.UserSubscribeToPersonal = true
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	require.Equal(t, "user#42", node.PersonalChannel("42"))
+
+	client := newTestClient(t, node, "42")
+	rwWrapper := testReplyWriterWrapper()
+	res, err := client.connectCmd(&protocol.ConnectRequest{}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Contains(t, res.Subs, "user#42")
+	require.Contains(t, client.channels, "user#42")
+	require.Equal(t, 1, node.NumSubscribers("user#42"))
+
+	_, err = node.PublishToUser("42", []byte(`{}`))
+	require.NoError(t, err)
+
+	anonymous := newTestClient(t, node, "")
+	rwWrapper = testReplyWriterWrapper()
+	res, err = anonymous.connectCmd(&protocol.ConnectRequest{}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, res.Subs, 0)
+}
+
+func TestClientUserPersonalSingleConnection(t *testing.T) {
+	node := defaultTestNode()
+	node.config.UserPersonalSingleConnection = true
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client1 := newTestClient(t, node, "42")
+	connectClientV2(t, client1)
+	otherUserClient := newTestClient(t, node, "43")
+	connectClientV2(t, otherUserClient)
+
+	client2 := newTestClient(t, node, "42")
+	connectClientV2(t, client2)
+
+	client1.mu.RLock()
+	require.True(t, client1.status == statusClosed)
+	client1.mu.RUnlock()
+	client2.mu.RLock()
+	require.False(t, client2.status == statusClosed)
+	client2.mu.RUnlock()
+	require.Len(t, node.hub.UserConnections("42"), 1)
+	require.Len(t, node.hub.UserConnections("43"), 1)
+
+	// Disconnect of connections established before older time must keep newer connection.
+	err := node.Disconnect("42", withDisconnectConnectedBefore(client2.connectedAtNano()-1))
+	require.NoError(t, err)
+	require.Len(t, node.hub.UserConnections("42"), 1)
+}
+
+func TestClientUserPersonalSingleConnectionOlderTakeover(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	olderClient := newTestClient(t, node, "42")
+	connectClientV2(t, olderClient)
+	newerClient := newTestClient(t, node, "42")
+	connectClientV2(t, newerClient)
+	require.Less(t, olderClient.connectedAtNano(), newerClient.connectedAtNano())
+
+	// Takeover of older connection delivered after newer connection established
+	// (for example from another node) must not disconnect newer connection.
+	err := node.Disconnect(
+		"42",
+		WithCustomDisconnect(DisconnectConnectionLimit),
+		WithDisconnectClientWhitelist([]string{olderClient.ID()}),
+		withDisconnectConnectedBefore(olderClient.connectedAtNano()),
+	)
+	require.NoError(t, err)
+
+	newerClient.mu.RLock()
+	require.False(t, newerClient.status == statusClosed)
+	newerClient.mu.RUnlock()
+	olderClient.mu.RLock()
+	require.False(t, olderClient.status == statusClosed)
+	olderClient.mu.RUnlock()
+	require.Len(t, node.hub.UserConnections("42"), 2)
+
+	// Takeover of newer connection disconnects older one.
+	err = node.Disconnect(
+		"42",
+		WithCustomDisconnect(DisconnectConnectionLimit),
+		WithDisconnectClientWhitelist([]string{newerClient.ID()}),
+		withDisconnectConnectedBefore(newerClient.connectedAtNano()),
+	)
+	require.NoError(t, err)
+	connections := node.hub.UserConnections("42")
+	require.Len(t, connections, 1)
+	require.Contains(t, connections, newerClient.ID())
+}
+
 func TestClientSubscribeReceivePublication(t *testing.T) {
 	t.Parallel()
 	node := defaultTestNode()
@@ -868,6 +1234,32 @@ func TestUserConnectionLimit(t *testing.T) {
 	require.Equal(t, DisconnectConnectionLimit, err)
 }
 
+func TestNodeClientConnectionHardLimit(t *testing.T) {
+	node := defaultTestNode()
+	node.config.NodeClientConnectionSoftLimit = 1
+	node.config.NodeClientConnectionHardLimit = 2
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	connectingCalls := 0
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		connectingCalls++
+		return ConnectReply{Credentials: &Credentials{UserID: "42"}}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		client, _ := newClient(context.Background(), node, newTestTransport(func() {}))
+		connectClientV2(t, client)
+	}
+	require.Equal(t, 2, node.hub.NumClients())
+
+	rwWrapper := testReplyWriterWrapper()
+	client, _ := newClient(context.Background(), node, newTestTransport(func() {}))
+	_, err := client.connectCmd(&protocol.ConnectRequest{}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.Equal(t, ErrorTooManyRequests, err)
+	require.Equal(t, 2, connectingCalls, "handler must not be called above hard limit")
+	require.Zero(t, node.numConnecting)
+}
+
 type testContextKey int
 
 var keyTest testContextKey = 1
@@ -1319,6 +1711,29 @@ func TestClientUnsubscribeClientSide(t *testing.T) {
 	}
 }
 
+func TestClientUnsubscribeClientSideFromServerSideSubscription(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{
+			Subscriptions: map[string]SubscribeOptions{
+				"server": {},
+			},
+		}, nil
+	})
+
+	client := newTestClientV2(t, node, "42")
+	connectClientV2(t, client)
+	require.Equal(t, 1, node.Hub().NumSubscribers("server"))
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleUnsubscribe(&protocol.UnsubscribeRequest{Channel: "server"}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.Equal(t, ErrorPermissionDenied, err)
+	require.Equal(t, 1, node.Hub().NumSubscribers("server"))
+}
+
 func TestClientUnsubscribeServerSide(t *testing.T) {
 	t.Parallel()
 	node := defaultTestNode()
@@ -1497,7 +1912,7 @@ func TestClientPublishNotAvailable(t *testing.T) {
 		Channel: "test",
 		Data:    []byte(`{}`),
 	}
-	err := client.handlePublish(cmd, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	err := client.handlePublish(client.Context(), cmd, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, ErrorNotAvailable, err)
 }
 
@@ -1601,7 +2016,7 @@ func TestClientPublishHandler(t *testing.T) {
 	}
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePublish(&protocol.PublishRequest{
+	err := client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Channel: "test",
 		Data:    []byte(`{"input": "no time"}`),
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -1609,7 +2024,7 @@ func TestClientPublishHandler(t *testing.T) {
 	require.Nil(t, rwWrapper.replies[0].Error)
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePublish(&protocol.PublishRequest{
+	err = client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Channel: "test",
 		Data:    []byte(`{"input": "with timestamp"}`),
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -1617,7 +2032,7 @@ func TestClientPublishHandler(t *testing.T) {
 	require.Nil(t, rwWrapper.replies[0].Error)
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePublish(&protocol.PublishRequest{
+	err = client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Channel: "test",
 		Data:    []byte(`{"input": "with error"}`),
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -1625,7 +2040,7 @@ func TestClientPublishHandler(t *testing.T) {
 	require.Equal(t, ErrorBadRequest.Code, rwWrapper.replies[0].Error.Code)
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePublish(&protocol.PublishRequest{
+	err = client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Channel: "test",
 		Data:    []byte(`{"input": "with disconnect"}`),
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -1655,7 +2070,7 @@ func TestClientPublishError(t *testing.T) {
 	connectClientV2(t, client)
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePublish(&protocol.PublishRequest{
+	err := client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Channel: "test",
 		Data:    []byte(`{"input": "no time"}`),
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -1663,6 +2078,67 @@ func TestClientPublishError(t *testing.T) {
 	require.Equal(t, ErrorInternal.toProto(), rwWrapper.replies[0].Error)
 }
 
+func TestClientPublishSubscribeToPublish(t *testing.T) {
+	node := defaultTestNode()
+	node.config.ClientSubscribeToPublish = true
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handlePublish(client.Context(), &protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte(`{}`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.Equal(t, ErrorPermissionDenied, err)
+
+	subscribeClientV2(t, client, "test")
+	err = client.handlePublish(client.Context(), &protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte(`{}`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Nil(t, rwWrapper.replies[0].Error)
+}
+
+func TestClientPublishPayloadValidation(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handlePublish(client.Context(), &protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte(`{"input": "test"`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.Equal(t, ErrorBadRequest, err)
+
+	// Protobuf clients may publish arbitrary binary data.
+	transport := newTestTransport(func() {})
+	transport.setProtocolType(ProtocolTypeProtobuf)
+	protobufClient := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+	connectClientV2(t, protobufClient)
+	rwWrapper = testReplyWriterWrapper()
+	err = protobufClient.handlePublish(protobufClient.Context(), &protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte{0x00, 0x01},
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Nil(t, rwWrapper.replies[0].Error)
+
+	node.config.ClientInsecureSkipPayloadValidation = true
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handlePublish(client.Context(), &protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte(`{"input": "test"`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Nil(t, rwWrapper.replies[0].Error)
+}
+
 func TestClientPing(t *testing.T) {
 	node := defaultTestNode()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -1675,6 +2151,56 @@ func TestClientPing(t *testing.T) {
 	require.Error(t, ErrorNotAvailable, err)
 }
 
+func TestClientIdleTimeout(t *testing.T) {
+	node := defaultTestNode()
+	node.config.ClientIdleTimeout = time.Hour
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	transport := newTestTransport(cancelFn)
+	client := newTestClientCustomTransport(t, ctx, node, transport, "42")
+	connectClientV2(t, client)
+	require.False(t, client.LastActive().IsZero())
+
+	// Ping does not count as activity by default.
+	lastActive := time.Now().Add(-time.Hour + time.Second).UnixNano()
+	atomic.StoreInt64(&client.lastActive, lastActive)
+	_, _ = client.dispatchCommand(&protocol.Command{Id: 1, Ping: &protocol.PingRequest{}}, 0)
+	require.Equal(t, lastActive, atomic.LoadInt64(&client.lastActive))
+
+	// Idle check fires right before idle timeout passed – connection kept.
+	client.checkIdle()
+	require.NoError(t, ctx.Err())
+	client.mu.RLock()
+	require.Equal(t, lastActive+time.Hour.Nanoseconds(), client.nextIdleCheck)
+	client.mu.RUnlock()
+
+	// Command arrives just as the next check fires.
+	_, _ = client.dispatchCommand(&protocol.Command{Id: 2, Rpc: &protocol.RPCRequest{}}, 0)
+	require.Greater(t, atomic.LoadInt64(&client.lastActive), lastActive)
+	client.checkIdle()
+	require.NoError(t, ctx.Err())
+
+	atomic.StoreInt64(&client.lastActive, time.Now().Add(-time.Hour).UnixNano())
+	client.checkIdle()
+	require.Error(t, ctx.Err())
+	require.Equal(t, DisconnectExpired.Code, transport.disconnect.Code)
+}
+
+func TestClientIdleCountPings(t *testing.T) {
+	node := defaultTestNode()
+	node.config.ClientIdleTimeout = time.Hour
+	node.config.ClientIdleCountPings = true
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	atomic.StoreInt64(&client.lastActive, 1)
+	_, _ = client.dispatchCommand(&protocol.Command{Id: 1, Ping: &protocol.PingRequest{}}, 0)
+	require.Greater(t, atomic.LoadInt64(&client.lastActive), int64(1))
+}
+
 func TestClientPresence(t *testing.T) {
 	node := defaultNodeNoHandlers()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -1696,13 +2222,13 @@ func TestClientPresence(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePresence(&protocol.PresenceRequest{
+	err := client.handlePresence(client.Context(), &protocol.PresenceRequest{
 		Channel: "",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, DisconnectBadRequest, err)
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePresence(&protocol.PresenceRequest{
+	err = client.handlePresence(client.Context(), &protocol.PresenceRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -1713,13 +2239,13 @@ func TestClientPresence(t *testing.T) {
 	require.Equal(t, 1, len(result.Presence))
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePresenceStats(&protocol.PresenceStatsRequest{
+	err = client.handlePresenceStats(client.Context(), &protocol.PresenceStatsRequest{
 		Channel: "",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, DisconnectBadRequest, err)
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePresenceStats(&protocol.PresenceStatsRequest{
+	err = client.handlePresenceStats(client.Context(), &protocol.PresenceStatsRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -1756,7 +2282,7 @@ func TestClientPresenceTakeover(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePresence(&protocol.PresenceRequest{
+	err := client.handlePresence(client.Context(), &protocol.PresenceRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -1766,7 +2292,7 @@ func TestClientPresenceTakeover(t *testing.T) {
 	require.Equal(t, 1, len(result.Presence))
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePresenceStats(&protocol.PresenceStatsRequest{
+	err = client.handlePresenceStats(client.Context(), &protocol.PresenceStatsRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -1791,7 +2317,7 @@ func TestClientPresenceError(t *testing.T) {
 	connectClientV2(t, client)
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePresence(&protocol.PresenceRequest{
+	err := client.handlePresence(client.Context(), &protocol.PresenceRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -1808,7 +2334,7 @@ func TestClientPresenceNotAvailable(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePresence(&protocol.PresenceRequest{
+	err := client.handlePresence(client.Context(), &protocol.PresenceRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, ErrorNotAvailable, err)
@@ -1839,7 +2365,7 @@ func TestClientPresenceStatsNotAvailable(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePresenceStats(&protocol.PresenceStatsRequest{
+	err := client.handlePresenceStats(client.Context(), &protocol.PresenceStatsRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, ErrorNotAvailable, err)
@@ -1862,7 +2388,7 @@ func TestClientPresenceStatsError(t *testing.T) {
 	connectClientV2(t, client)
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePresenceStats(&protocol.PresenceStatsRequest{
+	err := client.handlePresenceStats(client.Context(), &protocol.PresenceStatsRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -1889,13 +2415,13 @@ func TestClientHistoryNoFilter(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handleHistory(&protocol.HistoryRequest{
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, DisconnectBadRequest, err)
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handleHistory(&protocol.HistoryRequest{
+	err = client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -1927,7 +2453,7 @@ func TestClientHistoryWithLimit(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handleHistory(&protocol.HistoryRequest{
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "test",
 		Limit:   3,
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -1961,7 +2487,7 @@ func TestClientHistoryWithSinceAndLimit(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handleHistory(&protocol.HistoryRequest{
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "test",
 		Limit:   2,
 		Since: &protocol.StreamPosition{
@@ -2005,7 +2531,7 @@ func TestClientHistoryTakeover(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handleHistory(&protocol.HistoryRequest{
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "test",
 		Limit:   3,
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -2018,6 +2544,139 @@ func TestClientHistoryTakeover(t *testing.T) {
 	require.NotZero(t, result.Epoch)
 }
 
+func TestClientHistoryMaxPublicationsInReply(t *testing.T) {
+	node := defaultTestNode()
+	node.config.HistoryMaxPublicationsInReply = 3
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+
+	client.OnHistory(func(e HistoryEvent, cb HistoryCallback) {
+		cb(HistoryReply{}, nil)
+	})
+
+	for i := 0; i < 10; i++ {
+		_, _ = node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	}
+
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	for _, reverse := range []bool{false, true} {
+		rwWrapper := testReplyWriterWrapper()
+		err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
+			Channel: "test",
+			Limit:   -1,
+			Reverse: reverse,
+		}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+		require.NoError(t, err)
+		require.Len(t, rwWrapper.replies, 1)
+		require.Nil(t, rwWrapper.replies[0].Error)
+		result := rwWrapper.replies[0].History
+		require.Equal(t, 3, len(result.Publications))
+		require.Equal(t, uint64(10), result.Offset)
+		if reverse {
+			require.Equal(t, uint64(10), result.Publications[0].Offset)
+			require.Equal(t, uint64(8), result.Publications[2].Offset)
+		} else {
+			require.Equal(t, uint64(1), result.Publications[0].Offset)
+			require.Equal(t, uint64(3), result.Publications[2].Offset)
+		}
+	}
+
+	// Forward pagination with Since does not skip publications.
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
+		Channel: "test",
+		Limit:   -1,
+		Since:   &protocol.StreamPosition{Offset: 3, Epoch: ""},
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Nil(t, rwWrapper.replies[0].Error)
+	result := rwWrapper.replies[0].History
+	require.Len(t, result.Publications, 3)
+	require.Equal(t, uint64(4), result.Publications[0].Offset)
+	require.Equal(t, uint64(6), result.Publications[2].Offset)
+}
+
+func TestClientHistoryMaxPublicationsInReplyHandlerResult(t *testing.T) {
+	node := defaultTestNode()
+	node.config.HistoryMaxPublicationsInReply = 2
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+
+	client.OnHistory(func(e HistoryEvent, cb HistoryCallback) {
+		require.Equal(t, 2, e.Filter.Limit)
+		pubs := make([]*Publication, 0, 5)
+		for i := 1; i <= 5; i++ {
+			pubs = append(pubs, &Publication{Offset: uint64(i), Data: []byte(`{}`)})
+		}
+		cb(HistoryReply{Result: &HistoryResult{Publications: pubs}}, nil)
+	})
+
+	connectClientV2(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
+		Channel: "test",
+		Limit:   -1,
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	result := rwWrapper.replies[0].History
+	require.Len(t, result.Publications, 2)
+	require.Equal(t, uint64(1), result.Publications[0].Offset)
+}
+
+func TestClientHistoryCommandTimeout(t *testing.T) {
+	node := defaultTestNode()
+	node.config.ClientCommandTimeout = 10 * time.Millisecond
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.SetBroker(newBlockingContextBroker(t, node))
+
+	client := newTestClient(t, node, "42")
+
+	client.OnHistory(func(e HistoryEvent, cb HistoryCallback) {
+		cb(HistoryReply{}, nil)
+	})
+
+	connectClientV2(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
+		Channel: "test",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Equal(t, ErrorInternal.Code, rwWrapper.replies[0].Error.Code)
+}
+
+func TestClientPublishCommandTimeout(t *testing.T) {
+	node := defaultTestNode()
+	node.config.ClientCommandTimeout = 10 * time.Millisecond
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.SetBroker(newBlockingContextBroker(t, node))
+
+	client := newTestClient(t, node, "42")
+
+	client.OnPublish(func(e PublishEvent, cb PublishCallback) {
+		cb(PublishReply{}, nil)
+	})
+
+	connectClientV2(t, client)
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handlePublish(client.Context(), &protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte(`{}`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Equal(t, ErrorInternal.Code, rwWrapper.replies[0].Error.Code)
+}
+
 func TestClientHistoryUnrecoverablePositionEpoch(t *testing.T) {
 	node := defaultTestNode()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -2043,7 +2702,7 @@ func TestClientHistoryUnrecoverablePositionEpoch(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handleHistory(&protocol.HistoryRequest{
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "test",
 		Limit:   2,
 		Since: &protocol.StreamPosition{
@@ -2072,7 +2731,7 @@ func TestClientHistoryBrokerError(t *testing.T) {
 	connectClientV2(t, client)
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handleHistory(&protocol.HistoryRequest{
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.NoError(t, err)
@@ -2089,7 +2748,7 @@ func TestClientHistoryNotAvailable(t *testing.T) {
 	subscribeClientV2(t, client, "test")
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handleHistory(&protocol.HistoryRequest{
+	err := client.handleHistory(client.Context(), &protocol.HistoryRequest{
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, ErrorNotAvailable, err)
@@ -2126,6 +2785,258 @@ func TestExtractUnidirectionalDisconnect(t *testing.T) {
 	require.Equal(t, DisconnectExpired, d)
 }
 
+func TestClientHandle(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+
+	require.True(t, client.Handle([]byte(`{"id":1,"connect":{}}`)))
+	select {
+	case data := <-transport.sink:
+		require.Contains(t, string(data), `"id":1`)
+		require.Contains(t, string(data), `"connect"`)
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout waiting for connect reply")
+	}
+	require.Equal(t, "42", client.UserID())
+	require.False(t, client.Handle(nil))
+}
+
+func TestClientConcurrentCommands(t *testing.T) {
+	t.Parallel()
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	release := make(chan struct{})
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{MaxConcurrentCommands: 2}, nil
+	})
+	node.OnConnect(func(client *Client) {
+		client.OnRPC(func(event RPCEvent, cb RPCCallback) {
+			if event.Method == "slow" {
+				<-release
+			}
+			cb(RPCReply{}, nil)
+		})
+	})
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+
+	waitReply := func() string {
+		select {
+		case data := <-transport.sink:
+			return string(data)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "timeout waiting for reply")
+		}
+		return ""
+	}
+
+	require.True(t, client.Handle([]byte(`{"id":1,"connect":{}}`)))
+	require.Contains(t, waitReply(), `"id":1`)
+
+	// Slow RPC must not block the following one, reply to the second
+	// command comes first.
+	require.True(t, client.Handle([]byte(`{"id":2,"rpc":{"method":"slow"}}`)))
+	require.True(t, client.Handle([]byte(`{"id":3,"rpc":{"method":"fast"}}`)))
+	require.Contains(t, waitReply(), `"id":3`)
+	close(release)
+	require.Contains(t, waitReply(), `"id":2`)
+}
+
+func TestClientConcurrentCommandsPanic(t *testing.T) {
+	t.Parallel()
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{MaxConcurrentCommands: 1}, nil
+	})
+	node.OnConnect(func(client *Client) {
+		client.OnRPC(func(event RPCEvent, cb RPCCallback) {
+			if event.Method == "panic" {
+				panic("boom")
+			}
+			cb(RPCReply{}, nil)
+		})
+	})
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+
+	waitReply := func() string {
+		select {
+		case data := <-transport.sink:
+			return string(data)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "timeout waiting for reply")
+		}
+		return ""
+	}
+
+	require.True(t, client.Handle([]byte(`{"id":1,"connect":{}}`)))
+	require.Contains(t, waitReply(), `"id":1`)
+
+	require.True(t, client.Handle([]byte(`{"id":2,"rpc":{"method":"panic"}}`)))
+	reply := waitReply()
+	require.Contains(t, reply, `"id":2`)
+	require.Contains(t, reply, `"code":100`)
+
+	// Semaphore slot released so next command is processed.
+	require.True(t, client.Handle([]byte(`{"id":3,"rpc":{"method":"ok"}}`)))
+	reply = waitReply()
+	require.Contains(t, reply, `"id":3`)
+	require.NotContains(t, reply, `"error"`)
+}
+
+func TestClientHandlerPanic(t *testing.T) {
+	t.Parallel()
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			if e.Channel == "panic" {
+				panic("boom")
+			}
+			cb(SubscribeReply{}, nil)
+		})
+	})
+
+	client := newTestConnectedClientV2(t, node, "42")
+
+	disconnect, proceed := client.handleCommand(&protocol.Command{
+		Id:        2,
+		Subscribe: &protocol.SubscribeRequest{Channel: "panic"},
+	}, 0, protocol.FrameTypeSubscribe, "panic", time.Now())
+	require.Nil(t, disconnect)
+	require.True(t, proceed)
+	require.NotContains(t, client.channels, "panic")
+
+	// Client still usable after panic.
+	disconnect, proceed = client.handleCommand(&protocol.Command{
+		Id:        3,
+		Subscribe: &protocol.SubscribeRequest{Channel: "test"},
+	}, 0, protocol.FrameTypeSubscribe, "test", time.Now())
+	require.Nil(t, disconnect)
+	require.True(t, proceed)
+	require.Contains(t, client.channels, "test")
+
+	var m dto.Metric
+	require.NoError(t, node.metrics.handlerPanicCount.WithLabelValues(protocol.FrameTypeSubscribe.String()).Write(&m))
+	require.Equal(t, float64(1), m.GetCounter().GetValue())
+}
+
+func TestClientCommandMiddleware(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	var calls []string
+	node.UseCommandMiddleware(func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx CommandContext) error {
+			calls = append(calls, "first:"+ctx.Method)
+			return next(ctx)
+		}
+	})
+	node.UseCommandMiddleware(func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx CommandContext) error {
+			calls = append(calls, "second:"+ctx.Method)
+			if ctx.Command.Publish != nil {
+				return ErrorPermissionDenied
+			}
+			return next(ctx)
+		}
+	})
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+
+	waitReply := func() string {
+		select {
+		case data := <-transport.sink:
+			return string(data)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "timeout waiting for reply")
+		}
+		return ""
+	}
+
+	require.True(t, client.Handle([]byte(`{"id":1,"connect":{}}`)))
+	require.Contains(t, waitReply(), `"id":1`)
+	require.Equal(t, []string{"first:connect", "second:connect"}, calls)
+
+	require.True(t, client.Handle([]byte(`{"id":2,"subscribe":{"channel":"test"}}`)))
+	require.Contains(t, waitReply(), `"id":2`)
+	require.Contains(t, client.channels, "test")
+
+	require.True(t, client.Handle([]byte(`{"id":3,"publish":{"channel":"test","data":{}}}`)))
+	reply := waitReply()
+	require.Contains(t, reply, `"id":3`)
+	require.Contains(t, reply, `"code":103`)
+}
+
+func TestClientCommandMiddlewareContext(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	tracer := &testTracer{}
+	node.config.Tracer = tracer
+
+	type ctxKey struct{}
+	var commandSpan *testSpan
+	node.UseCommandMiddleware(func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx CommandContext) error {
+			return next(ctx.WithContext(context.WithValue(ctx.Context(), ctxKey{}, "value")))
+		}
+	})
+	node.UseCommandMiddleware(func(next CommandHandlerFunc) CommandHandlerFunc {
+		return func(ctx CommandContext) error {
+			require.Equal(t, "value", ctx.Context().Value(ctxKey{}))
+			// Derived from Client context.
+			_, ok := GetCredentials(ctx.Context())
+			require.True(t, ok)
+			commandSpan = testSpanFromContext(ctx.Context())
+			return next(ctx)
+		}
+	})
+
+	client := newTestClient(t, node, "42")
+	require.True(t, client.HandleCommand(&protocol.Command{Id: 1, Connect: &protocol.ConnectRequest{}}, 0))
+	require.NotNil(t, commandSpan)
+	require.Equal(t, "centrifuge.command.connect", commandSpan.name)
+}
+
+func TestClientConnectingHandlerPanic(t *testing.T) {
+	t.Parallel()
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		panic("boom")
+	})
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	transport := newTestTransport(cancelFn)
+	client := newTestClientCustomTransport(t, ctx, node, transport, "42")
+	require.False(t, client.Handle([]byte(`{"id":1,"connect":{}}`)))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "client not closed")
+	}
+	require.Equal(t, DisconnectServerError.Code, transport.disconnect.Code)
+}
+
 func TestClientHandleEmptyData(t *testing.T) {
 	t.Parallel()
 	node := defaultTestNode()
@@ -2161,6 +3072,59 @@ func TestClientHandleBrokenData(t *testing.T) {
 	}
 }
 
+func TestClientHandleMessageSizeLimit(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	node.config.ClientMessageSizeLimit = 16
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	data, err := json.Marshal(&protocol.Command{Id: 1, Subscribe: &protocol.SubscribeRequest{
+		Channel: "test",
+	}})
+	require.NoError(t, err)
+	require.Greater(t, len(data), 16)
+	proceed := HandleReadFrame(client, bytes.NewReader(data))
+	require.False(t, proceed)
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		require.Fail(t, "client not closed")
+	}
+}
+
+func TestClientHandleCommandsPerFrameLimit(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	node.config.ClientCommandsPerFrameLimit = 2
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	var frame [][]byte
+	for i := 1; i <= 3; i++ {
+		data, err := json.Marshal(&protocol.Command{Id: uint32(i), Subscribe: &protocol.SubscribeRequest{
+			Channel: fmt.Sprintf("test%d", i),
+		}})
+		require.NoError(t, err)
+		frame = append(frame, data)
+	}
+
+	proceed := HandleReadFrame(client, bytes.NewReader(bytes.Join(frame[:2], []byte("\n"))))
+	require.True(t, proceed)
+
+	proceed = HandleReadFrame(client, bytes.NewReader(bytes.Join(frame, []byte("\n"))))
+	require.False(t, proceed)
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		require.Fail(t, "client not closed")
+	}
+}
+
 func TestClientHandleCommandNotAuthenticated(t *testing.T) {
 	t.Parallel()
 	node := defaultTestNode()
@@ -2250,6 +3214,11 @@ func TestErrorDisconnectContext(t *testing.T) {
 func TestToClientError(t *testing.T) {
 	require.Equal(t, ErrorInternal, toClientErr(errors.New("boom")))
 	require.Equal(t, ErrorLimitExceeded, toClientErr(ErrorLimitExceeded))
+	require.Equal(t, ErrorPermissionDenied, toClientErr(fmt.Errorf("check failed: %w", ErrorPermissionDenied)))
+	customErr := &Error{Code: 1000, Message: "custom", Temporary: true}
+	protoErr := toClientErr(fmt.Errorf("wrapped: %w", customErr)).toProto()
+	require.Equal(t, uint32(1000), protoErr.Code)
+	require.True(t, protoErr.Temporary)
 }
 
 func TestClientAlreadyAuthenticated(t *testing.T) {
@@ -2512,7 +3481,7 @@ func TestClientHandlePublishNotAllowed(t *testing.T) {
 
 	rwWrapper := testReplyWriterWrapper()
 
-	err := client.handlePublish(&protocol.PublishRequest{
+	err := client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Data:    []byte(`{"hello": 1}`),
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -2538,14 +3507,14 @@ func TestClientHandlePublish(t *testing.T) {
 	connectClientV2(t, client)
 
 	rwWrapper := testReplyWriterWrapper()
-	err := client.handlePublish(&protocol.PublishRequest{
+	err := client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Data:    []byte(`{"hello":1}`),
 		Channel: "",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
 	require.Equal(t, DisconnectBadRequest, err)
 
 	rwWrapper = testReplyWriterWrapper()
-	err = client.handlePublish(&protocol.PublishRequest{
+	err = client.handlePublish(client.Context(), &protocol.PublishRequest{
 		Data:    []byte(`{"hello":1}`),
 		Channel: "test",
 	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
@@ -2593,6 +3562,78 @@ func TestClientSideRefresh(t *testing.T) {
 	require.Nil(t, rwWrapper.replies[0].Error)
 }
 
+func TestClientSideRefreshTokenErrors(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{
+			ClientSideRefresh: true,
+		}, nil
+	})
+
+	expireAt := time.Now().Unix() + 60
+
+	node.OnConnect(func(client *Client) {
+		client.OnRefresh(func(e RefreshEvent, cb RefreshCallback) {
+			switch e.Token {
+			case "expired":
+				cb(RefreshReply{}, ErrorTokenExpired)
+			case "invalid":
+				cb(RefreshReply{}, DisconnectInvalidToken)
+			default:
+				cb(RefreshReply{ExpireAt: expireAt, Info: []byte(`{"new":true}`)}, nil)
+			}
+		})
+	})
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	transport := newTestTransport(cancelFn)
+	newCtx := SetCredentials(ctx, &Credentials{
+		UserID:   "42",
+		ExpireAt: time.Now().Unix() + 60,
+	})
+	client, _ := newClient(newCtx, node, transport)
+	connectClientV2(t, client)
+
+	// Valid token prolongs connection and updates info.
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleRefresh(&protocol.RefreshRequest{
+		Token: "valid",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Nil(t, rwWrapper.replies[0].Error)
+	require.True(t, rwWrapper.replies[0].Refresh.Expires)
+	require.NotZero(t, rwWrapper.replies[0].Refresh.Ttl)
+	require.Equal(t, expireAt, client.exp)
+	require.Equal(t, []byte(`{"new":true}`), client.info)
+
+	// Expired token results into error, client may retry with fresh token.
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRefresh(&protocol.RefreshRequest{
+		Token: "expired",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Equal(t, ErrorTokenExpired.toProto(), rwWrapper.replies[0].Error)
+	select {
+	case <-client.Context().Done():
+		require.Fail(t, "client must not be closed")
+	default:
+	}
+
+	// Invalid token results into disconnect.
+	rwWrapper = testReplyWriterWrapper()
+	err = client.handleRefresh(&protocol.RefreshRequest{
+		Token: "invalid",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		require.Fail(t, "client not closed")
+	}
+}
+
 func TestServerSideRefresh(t *testing.T) {
 	t.Parallel()
 	node := defaultNodeNoHandlers()
@@ -3004,6 +4045,70 @@ func TestClientCheckPosition(t *testing.T) {
 	require.True(t, got)
 }
 
+func TestClientCheckPositionMissedPublication(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EnablePositioning: true}}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	_, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		client.mu.RLock()
+		defer client.mu.RUnlock()
+		return client.channels["test"].streamPosition.Offset == 1
+	}, time.Second, 5*time.Millisecond)
+
+	client.mu.RLock()
+	chCtx := client.channels["test"]
+	client.mu.RUnlock()
+	chCtx.positionCheckTime = 0
+	require.True(t, client.checkPosition(time.Second, "test", chCtx))
+
+	// Stream top is cached for all subscribers of channel.
+	_, cached, err := node.positionStreamTop("test", 0)
+	require.NoError(t, err)
+	require.True(t, cached)
+
+	// Simulate publication dropped by broker: client position is behind stream top.
+	client.mu.Lock()
+	chCtx = client.channels["test"]
+	chCtx.streamPosition.Offset = 0
+	client.channels["test"] = chCtx
+	client.mu.Unlock()
+	chCtx.positionCheckTime = 0
+	require.False(t, client.checkPosition(time.Second, "test", chCtx))
+}
+
+func TestClientFlush(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+	connectClientV2(t, client)
+	require.NoError(t, client.Flush(context.Background()))
+	for len(transport.sink) > 0 {
+		<-transport.sink
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.transportEnqueue([]byte(`{}`), "", protocol.FrameTypePushPublication))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, client.Flush(ctx))
+	require.Len(t, transport.sink, 10)
+}
+
 func TestClientIsValidPosition(t *testing.T) {
 	node := defaultTestNode()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -3155,6 +4260,204 @@ func TestClientTransportWriteError(t *testing.T) {
 	}
 }
 
+func TestClientTransportWriteErrorDrop(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	errorCh := make(chan TransportWriteErrorEvent, 1)
+	node.OnTransportWriteError(func(client *Client, event TransportWriteErrorEvent) TransportWriteErrorDecision {
+		errorCh <- event
+		return TransportWriteErrorDrop
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transport := newTestTransport(cancel)
+	transport.sink = make(chan []byte, 100)
+	transport.writeErr = errors.New("boom")
+	transport.writeErrorContent = "test trigger message"
+
+	newCtx := SetCredentials(ctx, &Credentials{UserID: "42"})
+	client, _ := newClient(newCtx, node, transport)
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	_, err := node.Publish("test", []byte(`{"text": "test trigger message"}`))
+	require.NoError(t, err)
+	select {
+	case event := <-errorCh:
+		require.EqualError(t, event.Error, "boom")
+		require.NotZero(t, event.Size)
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout waiting for write error")
+	}
+
+	_, err = node.Publish("test", []byte(`{"text": "test message"}`))
+	require.NoError(t, err)
+	for {
+		select {
+		case data := <-transport.sink:
+			if strings.Contains(string(data), "test message") {
+				require.Equal(t, 1, node.Hub().NumSubscribers("test"))
+				return
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "timeout waiting for message")
+			return
+		}
+	}
+}
+
+func TestClientTransportWriteErrorRetry(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transport := newTestTransport(cancel)
+	transport.sink = make(chan []byte, 100)
+	transport.writeErr = errors.New("boom")
+	transport.writeErrorContent = "test trigger message"
+
+	var numErrors int32
+	node.OnTransportWriteError(func(client *Client, event TransportWriteErrorEvent) TransportWriteErrorDecision {
+		atomic.AddInt32(&numErrors, 1)
+		// Called from writer goroutine, so transport is not written concurrently.
+		transport.writeErr = nil
+		return TransportWriteErrorRetry
+	})
+
+	newCtx := SetCredentials(ctx, &Credentials{UserID: "42"})
+	client, _ := newClient(newCtx, node, transport)
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	_, err := node.Publish("test", []byte(`{"text": "test trigger message"}`))
+	require.NoError(t, err)
+	_, err = node.Publish("test", []byte(`{"text": "test message"}`))
+	require.NoError(t, err)
+
+	// Failed message is written before the next one.
+	var received []string
+	for len(received) < 2 {
+		select {
+		case data := <-transport.sink:
+			if strings.Contains(string(data), "test trigger message") {
+				received = append(received, "trigger")
+			} else if strings.Contains(string(data), "test message") {
+				received = append(received, "message")
+			}
+		case <-time.After(time.Second):
+			require.Fail(t, "timeout waiting for messages")
+			return
+		}
+	}
+	require.Equal(t, []string{"trigger", "message"}, received)
+	require.Equal(t, int32(1), atomic.LoadInt32(&numErrors))
+	require.Equal(t, 1, node.Hub().NumSubscribers("test"))
+}
+
+func TestClientTransportWriteErrorRetryOnce(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transport := newTestTransport(cancel)
+	transport.sink = make(chan []byte, 100)
+	transport.writeErr = errors.New("boom")
+	transport.writeErrorContent = "test trigger message"
+
+	var numErrors int32
+	node.OnTransportWriteError(func(client *Client, event TransportWriteErrorEvent) TransportWriteErrorDecision {
+		atomic.AddInt32(&numErrors, 1)
+		return TransportWriteErrorRetry
+	})
+
+	doneDisconnect := make(chan struct{})
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+		client.OnDisconnect(func(event DisconnectEvent) {
+			require.Equal(t, DisconnectWriteError.Code, event.Code)
+			close(doneDisconnect)
+		})
+	})
+
+	newCtx := SetCredentials(ctx, &Credentials{UserID: "42"})
+	client, _ := newClient(newCtx, node, transport)
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	_, err := node.Publish("test", []byte(`{"text": "test trigger message"}`))
+	require.NoError(t, err)
+
+	select {
+	case <-doneDisconnect:
+	case <-time.After(time.Second):
+		require.Fail(t, "client not closed")
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&numErrors))
+}
+
+func TestClientTransportWriteErrorUnrecoverable(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		Name               string
+		Error              error
+		ExpectedDisconnect Disconnect
+	}{
+		{"disconnect", DisconnectSlow, DisconnectSlow},
+		{"disconnect_pointer", &DisconnectSlow, DisconnectSlow},
+		{"eof", io.EOF, DisconnectWriteError},
+		{"closed", fmt.Errorf("write: %w", net.ErrClosed), DisconnectWriteError},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := defaultTestNode()
+			defer func() { _ = node.Shutdown(context.Background()) }()
+
+			node.OnTransportWriteError(func(client *Client, event TransportWriteErrorEvent) TransportWriteErrorDecision {
+				require.Fail(t, "handler must not be called for unrecoverable error")
+				return TransportWriteErrorDrop
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			transport := newTestTransport(cancel)
+			transport.sink = make(chan []byte, 100)
+			transport.writeErr = tt.Error
+			transport.writeErrorContent = "test trigger message"
+
+			doneDisconnect := make(chan struct{})
+			node.OnConnect(func(client *Client) {
+				client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+					cb(SubscribeReply{}, nil)
+				})
+				client.OnDisconnect(func(event DisconnectEvent) {
+					require.Equal(t, tt.ExpectedDisconnect.Code, event.Code)
+					close(doneDisconnect)
+				})
+			})
+
+			newCtx := SetCredentials(ctx, &Credentials{UserID: "42"})
+			client, _ := newClient(newCtx, node, transport)
+			connectClientV2(t, client)
+			subscribeClientV2(t, client, "test")
+
+			_, err := node.Publish("test", []byte(`{"text": "test trigger message"}`))
+			require.NoError(t, err)
+
+			select {
+			case <-doneDisconnect:
+			case <-time.After(time.Second):
+				require.Fail(t, "client not closed")
+			}
+		})
+	}
+}
+
 func TestFlagExists(t *testing.T) {
 	flags := PushFlagDisconnect
 	require.True(t, hasFlag(flags, PushFlagDisconnect))
@@ -3821,3 +5124,30 @@ func TestClient_HandleCommandV2(t *testing.T) {
 	}, 0)
 	require.False(t, ok)
 }
+
+func TestClientPublicationDeliveryMetrics(t *testing.T) {
+	t.Parallel()
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	counterValue := func(c prometheus.Counter) float64 {
+		var m dto.Metric
+		require.NoError(t, c.Write(&m))
+		return m.GetCounter().GetValue()
+	}
+
+	client := newTestSubscribedClientV2(t, node, "42", "test")
+	enqueued := node.metrics.transportPubEnqueuedCount.WithLabelValues(transportWebsocket)
+	droppedSlow := node.metrics.transportPubDroppedCount.WithLabelValues(transportWebsocket, pubDropReasonSlow)
+
+	_, err := node.Publish("test", []byte(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, float64(1), counterValue(enqueued))
+	require.Equal(t, float64(0), counterValue(droppedSlow))
+
+	client.messageWriter.config.MaxQueueSize = 1
+	_, err = node.Publish("test", []byte(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, float64(1), counterValue(enqueued))
+	require.Equal(t, float64(1), counterValue(droppedSlow))
+}
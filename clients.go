@@ -0,0 +1,125 @@
+package centrifuge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	unsubscribeClientOp = "centrifuge_unsubscribe_client"
+	disconnectClientOp  = "centrifuge_disconnect_client"
+)
+
+// clientLookupTimeout is how long nodes are asked for a client connection
+// before giving up with ErrClientNotFound.
+const clientLookupTimeout = 3 * time.Second
+
+const (
+	clientOpCodeNotFound   uint32 = 1
+	clientOpCodeBadRequest uint32 = 2
+)
+
+// ErrClientNotFound returned when client connection with provided ID does
+// not exist on any running node.
+var ErrClientNotFound = errors.New("client not found")
+
+type unsubscribeClientRequest struct {
+	Client  string `json:"client"`
+	Channel string `json:"channel"`
+}
+
+// UnsubscribeClient unsubscribes a single client connection with provided ID
+// from channel, other connections of the same user stay subscribed. Connection
+// may live on any node: if it's not connected to the current Node then other
+// nodes are asked over Survey. Returns ErrClientNotFound if no node has such
+// connection.
+func (n *Node) UnsubscribeClient(clientID string, ch string) error {
+	if c, ok := n.hub.Connection(clientID); ok {
+		c.Unsubscribe(ch)
+		return nil
+	}
+	data, err := json.Marshal(unsubscribeClientRequest{Client: clientID, Channel: ch})
+	if err != nil {
+		return err
+	}
+	return n.clientOpSurvey(unsubscribeClientOp, data)
+}
+
+func (n *Node) handleUnsubscribeClientSurvey(e SurveyEvent, cb SurveyCallback) {
+	var req unsubscribeClientRequest
+	if err := json.Unmarshal(e.Data, &req); err != nil {
+		n.logger.log(newErrorLogEntry(err, "error unmarshal unsubscribe client request", map[string]any{"data": string(e.Data)}))
+		cb(SurveyReply{Code: clientOpCodeBadRequest})
+		return
+	}
+	c, ok := n.hub.Connection(req.Client)
+	if !ok {
+		cb(SurveyReply{Code: clientOpCodeNotFound})
+		return
+	}
+	c.Unsubscribe(req.Channel)
+	cb(SurveyReply{})
+}
+
+type disconnectClientRequest struct {
+	Client     string     `json:"client"`
+	Disconnect Disconnect `json:"disconnect"`
+}
+
+// DisconnectClient closes a single client connection with provided ID, other
+// connections of the same user stay connected. If disconnect is nil then
+// DisconnectForceNoReconnect is used. Connection may live on any node: if it's
+// not connected to the current Node then other nodes are asked over Survey.
+// Returns ErrClientNotFound if no node has such connection.
+func (n *Node) DisconnectClient(clientID string, disconnect *Disconnect) error {
+	d := DisconnectForceNoReconnect
+	if disconnect != nil {
+		d = *disconnect
+	}
+	if c, ok := n.hub.Connection(clientID); ok {
+		c.Disconnect(d)
+		return nil
+	}
+	data, err := json.Marshal(disconnectClientRequest{Client: clientID, Disconnect: d})
+	if err != nil {
+		return err
+	}
+	return n.clientOpSurvey(disconnectClientOp, data)
+}
+
+func (n *Node) handleDisconnectClientSurvey(e SurveyEvent, cb SurveyCallback) {
+	var req disconnectClientRequest
+	if err := json.Unmarshal(e.Data, &req); err != nil {
+		n.logger.log(newErrorLogEntry(err, "error unmarshal disconnect client request", map[string]any{"data": string(e.Data)}))
+		cb(SurveyReply{Code: clientOpCodeBadRequest})
+		return
+	}
+	c, ok := n.hub.Connection(req.Client)
+	if !ok {
+		cb(SurveyReply{Code: clientOpCodeNotFound})
+		return
+	}
+	c.Disconnect(req.Disconnect)
+	cb(SurveyReply{})
+}
+
+// clientOpSurvey asks all nodes to perform operation over a client connection,
+// succeeds if one of the nodes had that connection.
+func (n *Node) clientOpSurvey(op string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), clientLookupTimeout)
+	defer cancel()
+	results, err := n.Survey(ctx, op, data, "")
+	// Survey returns context error if some nodes did not reply in time, but the
+	// node with connection may be among those replied.
+	for _, result := range results {
+		if result.Code == 0 {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return ErrClientNotFound
+}
@@ -0,0 +1,191 @@
+package centrifuge
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifuge/internal/controlpb"
+	"github.com/centrifugal/centrifuge/internal/controlproto"
+
+	"github.com/stretchr/testify/require"
+)
+
+// surveyReplyBroker is a MemoryBroker which replies to survey requests on
+// behalf of another node.
+type surveyReplyBroker struct {
+	*MemoryBroker
+	node *Node
+	uid  string
+	code uint32
+}
+
+func (b *surveyReplyBroker) PublishControl(data []byte, nodeID, shardKey string) error {
+	cmd, err := controlproto.NewProtobufDecoder().DecodeCommand(data)
+	if err == nil && cmd.SurveyRequest != nil {
+		go func() {
+			_ = b.node.handleSurveyResponse(b.uid, &controlpb.SurveyResponse{Id: cmd.SurveyRequest.Id, Code: b.code})
+		}()
+	}
+	return b.MemoryBroker.PublishControl(data, nodeID, shardKey)
+}
+
+// nodeWithSurveyReplies returns Node which knows about two other nodes: one
+// replies to survey requests with code, another one never replies.
+func nodeWithSurveyReplies(t *testing.T, code uint32) *Node {
+	n, err := New(Config{})
+	require.NoError(t, err)
+	b, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	n.SetBroker(&surveyReplyBroker{MemoryBroker: b, node: n, uid: "other_node", code: code})
+	require.NoError(t, n.Run())
+	n.nodes.add(&controlpb.Node{Uid: "other_node"})
+	n.nodes.add(&controlpb.Node{Uid: "silent_node"})
+	return n
+}
+
+func TestHub_Connection(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	client := newTestConnectedClientV2(t, n, "42")
+
+	c, ok := n.Hub().Connection(client.ID())
+	require.True(t, ok)
+	require.Equal(t, client, c)
+	_, ok = n.Hub().Connection("unknown")
+	require.False(t, ok)
+}
+
+func TestNode_UnsubscribeClient(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	n.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(_ SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+
+	client1 := newTestSubscribedClientV2(t, n, "42", "test")
+	client2 := newTestSubscribedClientV2(t, n, "42", "test")
+
+	require.NoError(t, n.UnsubscribeClient(client1.ID(), "test"))
+	require.Eventually(t, func() bool {
+		return len(client1.Channels()) == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"test"}, client2.Channels())
+	require.Equal(t, 1, n.Hub().NumSubscribers("test"))
+
+	require.ErrorIs(t, n.UnsubscribeClient("unknown", "test"), ErrClientNotFound)
+}
+
+func TestNode_UnsubscribeClientPartialSurvey(t *testing.T) {
+	t.Parallel()
+	n := nodeWithSurveyReplies(t, 0)
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	// Client found on other node, silent node does not affect result.
+	require.NoError(t, n.UnsubscribeClient("remote", "test"))
+
+	n = nodeWithSurveyReplies(t, clientOpCodeNotFound)
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	require.ErrorIs(t, n.UnsubscribeClient("remote", "test"), context.DeadlineExceeded)
+}
+
+func TestNode_UnsubscribeClientSurvey(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	n.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(_ SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+	client := newTestSubscribedClientV2(t, n, "42", "test")
+
+	reply := func(data []byte) SurveyReply {
+		var result SurveyReply
+		n.handleUnsubscribeClientSurvey(SurveyEvent{Op: unsubscribeClientOp, Data: data}, func(r SurveyReply) {
+			result = r
+		})
+		return result
+	}
+
+	data, err := json.Marshal(unsubscribeClientRequest{Client: "unknown", Channel: "test"})
+	require.NoError(t, err)
+	require.Equal(t, clientOpCodeNotFound, reply(data).Code)
+
+	require.Equal(t, clientOpCodeBadRequest, reply([]byte("{")).Code)
+
+	data, err = json.Marshal(unsubscribeClientRequest{Client: client.ID(), Channel: "test"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), reply(data).Code)
+	require.Eventually(t, func() bool {
+		return len(client.Channels()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNode_DisconnectClient(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	disconnected := make(chan DisconnectEvent, 2)
+	n.OnConnect(func(client *Client) {
+		client.OnDisconnect(func(e DisconnectEvent) {
+			disconnected <- e
+		})
+	})
+
+	client1 := newTestConnectedClientV2(t, n, "42")
+	client2 := newTestConnectedClientV2(t, n, "42")
+
+	require.NoError(t, n.DisconnectClient(client1.ID(), &DisconnectConnectionLimit))
+	select {
+	case e := <-disconnected:
+		require.Equal(t, DisconnectConnectionLimit.Code, e.Code)
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout waiting for disconnect")
+	}
+	require.Eventually(t, func() bool {
+		_, ok := n.Hub().Connection(client1.ID())
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok := n.Hub().Connection(client2.ID())
+	require.True(t, ok)
+
+	require.ErrorIs(t, n.DisconnectClient("unknown", nil), ErrClientNotFound)
+}
+
+func TestNode_DisconnectClientPartialSurvey(t *testing.T) {
+	t.Parallel()
+	n := nodeWithSurveyReplies(t, 0)
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	// Client found on other node, silent node does not affect result.
+	require.NoError(t, n.DisconnectClient("remote", nil))
+}
+
+func TestNode_DisconnectClientSurvey(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	client := newTestConnectedClientV2(t, n, "42")
+
+	reply := func(data []byte) SurveyReply {
+		var result SurveyReply
+		n.handleDisconnectClientSurvey(SurveyEvent{Op: disconnectClientOp, Data: data}, func(r SurveyReply) {
+			result = r
+		})
+		return result
+	}
+
+	data, err := json.Marshal(disconnectClientRequest{Client: "unknown", Disconnect: DisconnectForceNoReconnect})
+	require.NoError(t, err)
+	require.Equal(t, clientOpCodeNotFound, reply(data).Code)
+
+	require.Equal(t, clientOpCodeBadRequest, reply([]byte("{")).Code)
+
+	data, err = json.Marshal(disconnectClientRequest{Client: client.ID(), Disconnect: DisconnectForceNoReconnect})
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), reply(data).Code)
+	require.Eventually(t, func() bool {
+		_, ok := n.Hub().Connection(client.ID())
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,6 +1,8 @@
 package centrifuge
 
 import (
+	"errors"
+	"fmt"
 	"time"
 )
 
@@ -16,14 +18,47 @@ type Config struct {
 	LogLevel LogLevel
 	// LogHandler is a handler function Node will send logs to.
 	LogHandler LogHandler
+	// LogSamplingInterval when set enables log sampling: only the first entry with the
+	// same level and message logged during the interval, others are suppressed. When
+	// the same entry logged after the interval passed an additional entry with the count
+	// of suppressed entries is logged before it. Counts not reported this way are
+	// logged periodically. By default, sampling is disabled.
+	LogSamplingInterval time.Duration
 	// NodeInfoMetricsAggregateInterval sets interval for automatic metrics
 	// aggregation. It's not reasonable to have it less than one second.
 	// Zero value means 60 * time.Second.
 	NodeInfoMetricsAggregateInterval time.Duration
+	// NodeInfoPublishInterval sets how often node publishes information about itself
+	// to other nodes. Other nodes consider node gone if they have not received its
+	// information for 2 * NodeInfoPublishInterval + 1 second.
+	// Zero value means 3 * time.Second.
+	NodeInfoPublishInterval time.Duration
+	// NodeInfoPublishClientsChange when set makes node publish its information
+	// right away once the number of clients changed by this fraction (for example,
+	// 0.1 means 10%) since the last publication. Node information is published not
+	// more often than once per second in this case. Zero value disables this.
+	NodeInfoPublishClientsChange float64
 	// ClientPresenceUpdateInterval sets an interval how often connected
-	// clients update presence information.
+	// clients update presence information. Updates are made by Node in batches
+	// from a single goroutine, first update of each client is randomly delayed
+	// to spread updates in time.
 	// Zero value means 25 * time.Second.
 	ClientPresenceUpdateInterval time.Duration
+	// JoinLeaveReconcileInterval enables periodic reconciliation of join/leave
+	// messages with channel presence. Node remembers members announced with Join
+	// in channels with local subscribers and sends Leave to local subscribers when
+	// member presence expires without Leave – which happens when a node with
+	// member connection dies. Only members seen in presence are reconciled. Each
+	// reconciliation calls Node.Presence for every tracked channel, so use an interval
+	// comparable with presence expiration. Zero value disables reconciliation.
+	JoinLeaveReconcileInterval time.Duration
+	// BrokerSubscriptionReconcileInterval enables periodic reconciliation of channels
+	// subscribed in Broker with channels which have subscribers on this Node. Node
+	// subscribes to channels with subscribers it's not subscribed to in Broker and
+	// unsubscribes from channels without subscribers, such discrepancies are logged
+	// and counted in node_broker_subscriptions_reconciled_count metric. Zero value
+	// disables reconciliation.
+	BrokerSubscriptionReconcileInterval time.Duration
 	// ClientExpiredCloseDelay is an extra time given to client to refresh
 	// its connection in the end of connection TTL. At moment only used for
 	// a client-side refresh workflow.
@@ -39,6 +74,24 @@ type Config struct {
 	// received yet).
 	// Zero value means 15 * time.Second.
 	ClientStaleCloseDelay time.Duration
+	// ClientIdleTimeout is a time after which connection without any activity is
+	// closed with DisconnectExpired. Every command sent by a client is activity, pings
+	// and pongs are only counted when ClientIdleCountPings is on. Zero value means
+	// idle connections are not closed. See also Client.LastActive.
+	ClientIdleTimeout time.Duration
+	// ClientIdleCountPings makes pings from clients and pongs to server pings count as
+	// activity for ClientIdleTimeout.
+	ClientIdleCountPings bool
+	// ClientCommandTimeout bounds time spent in Broker and PresenceManager calls made
+	// to serve client publish, history and presence commands. On timeout client
+	// receives an internal error. Only respected by Broker implementing
+	// PublishContextBroker or HistoryContextBroker and PresenceManager implementing
+	// PresenceContextManager. Zero value means no timeout.
+	ClientCommandTimeout time.Duration
+	// CheckClosedChannels enables rejecting client subscriptions to channels closed
+	// with Node.CloseChannel with ErrorChannelClosed. This costs one Broker request
+	// per client subscription (a Redis round trip in case of RedisBroker).
+	CheckClosedChannels bool
 	// ClientChannelPositionCheckDelay defines minimal time from previous
 	// client position check in channel. If client does not pass check it
 	// will be disconnected with DisconnectInsufficientState.
@@ -48,30 +101,113 @@ type Config struct {
 	// bytes. After this queue size exceeded Centrifuge closes client's connection.
 	// Zero value means 1048576 bytes (1MB).
 	ClientQueueMaxSize int
+	// ClientMaxFrameSize limits the size in bytes of a frame built by merging
+	// several queued messages together. Messages left over stay in the queue
+	// and go into the next frame. With ConnectReply.WriteDelay a frame is sent
+	// as soon as queued messages reach this size without waiting for the end
+	// of the delay. Zero value means no limit – only the number of messages in
+	// a frame is limited then.
+	ClientMaxFrameSize int
+	// ClientEventQueueSize is a size of buffer for events passed to ClientEventHandler
+	// (see Node.OnClientEvent). When buffer is full new events are dropped. Zero value
+	// means 4096.
+	ClientEventQueueSize int
+	// ClientMessageSizeLimit is a maximum size in bytes of data received from
+	// client in one frame. Clients sending larger frames are disconnected with
+	// DisconnectBadRequest. Built-in transports with own size limit (such as
+	// WebsocketConfig.MessageSizeLimit or MaxRequestBodySize of HTTP-based
+	// transports) use it instead, for WebsocketHandler ClientMessageSizeLimit is
+	// used when WebsocketConfig.MessageSizeLimit is not set.
+	// Zero value means 65536 bytes (64KB).
+	ClientMessageSizeLimit int
+	// ClientCommandsPerFrameLimit is a maximum number of commands client can send
+	// in one frame. Clients sending more commands are disconnected with
+	// DisconnectBadRequest.
+	// Zero value means 64.
+	ClientCommandsPerFrameLimit int
 	// ClientChannelLimit sets upper limit of client-side channels each client
 	// can subscribe to. Client-side subscriptions attempts will get an ErrorLimitExceeded
 	// in subscribe reply. Server-side subscriptions above limit will result into
 	// DisconnectChannelLimit.
 	// Zero value means 128.
 	ClientChannelLimit int
+	// ClientSubscribeToPublish when enabled requires client to be subscribed to a
+	// channel to publish into it with client-side publish request. Attempts to publish
+	// into other channels get ErrorPermissionDenied without calling PublishHandler.
+	// Server-side Node.Publish calls are not affected.
+	ClientSubscribeToPublish bool
+	// ClientInsecureSkipPayloadValidation disables checking that data published by
+	// clients using JSON protocol is valid JSON. Invalid data is rejected with
+	// ErrorBadRequest by default, since it's embedded into JSON frames as is and
+	// would break them for JSON subscribers.
+	ClientInsecureSkipPayloadValidation bool
+	// ClusterStrictCompatibility when enabled makes Node ignore control commands
+	// (subscribe, unsubscribe, disconnect, refresh, surveys, notifications) coming
+	// from nodes running incompatible control protocol version instead of trying to
+	// process them. Such nodes are still tracked in registry and marked with
+	// NodeInfo.Incompatible flag in Node.Info.
+	ClusterStrictCompatibility bool
 	// UserConnectionLimit limits number of client connections to single Node
 	// from user with the same ID. Zero value means unlimited. Anonymous users
 	// can't be tracked.
 	UserConnectionLimit int
+	// NodeClientConnectionSoftLimit is a number of client connections to single Node
+	// after which new connections are still accepted but counted in node_connection_limit_count
+	// metric with limit="soft" label – to notice overloaded node before it starts rejecting
+	// connections. Zero value means no limit.
+	NodeClientConnectionSoftLimit int
+	// NodeClientConnectionHardLimit is a maximum number of client connections to single
+	// Node. Connections above the limit are rejected with temporary ErrorTooManyRequests
+	// before calling any handler, so clients will reconnect with backoff – possibly to
+	// another node. WebsocketHandler rejects upgrade with 503 status code in this case.
+	// Zero value means no limit.
+	NodeClientConnectionHardLimit int
 	// ChannelMaxLength is the maximum length of a channel name. This is only checked
-	// for client-side subscription requests.
+	// for client-side subscribe and publish requests. Channels in these requests must
+	// also be valid UTF-8 strings without control characters.
 	// Zero value means 255.
 	ChannelMaxLength int
+	// UserSubscribeToPersonal enables automatic server-side subscription of each
+	// connection with non-empty user ID to a personal channel of user. See
+	// Node.PersonalChannel for a personal channel name. Personal channel
+	// subscription is added to connect reply so client SDKs register it, it does
+	// not go through SubscribeHandler.
+	UserSubscribeToPersonal bool
+	// UserPersonalChannelNamespace is a prefix of personal channel name. Personal
+	// channel name is UserPersonalChannelNamespace + "#" + user ID. Zero value means
+	// "user" so personal channels look like "user#42".
+	UserPersonalChannelNamespace string
+	// UserPersonalSingleConnection turns on a mode where user with non-empty ID can
+	// only have one connection in a cluster. Upon connect all previously established
+	// connections of user on all nodes are disconnected with DisconnectConnectionLimit.
+	// Connection time used to resolve concurrent connects – the newest connection wins,
+	// so nodes clocks should be synchronized.
+	UserPersonalSingleConnection bool
+	// ChannelValidator allows setting custom validation of channel names used in
+	// client-side subscribe and publish requests, for example to allow only specific
+	// characters. Called after built-in checks. If returns an error then client
+	// receives ErrorBadRequest.
+	ChannelValidator func(channel string) error
 	// HistoryMaxPublicationLimit allows limiting the maximum number of publications to be
 	// asked over client API history call. This is useful when you have large streams and
 	// want to prevent a massive number of missed messages to be sent to a client when
 	// calling history without any limit explicitly set. By default, no limit used.
 	// This option does not affect Node.History method. See also RecoveryMaxPublicationLimit.
 	HistoryMaxPublicationLimit int
+	// HistoryMaxPublicationsInReply limits the number of publications in a reply to
+	// client API history call. Like HistoryMaxPublicationLimit it limits the request
+	// to Broker, but is also applied to results returned by HistoryHandler – keeping
+	// publications from the start of result, so clients can paginate over history
+	// with Since. By default, no limit used. This option does not affect Node.History
+	// method.
+	HistoryMaxPublicationsInReply int
 	// RecoveryMaxPublicationLimit allows limiting the number of Publications that could be
 	// restored during the automatic recovery process. See also HistoryMaxPublicationLimit.
 	// By default, no limit used.
 	RecoveryMaxPublicationLimit int
+	// Tracer when set enables tracing spans for client commands and for
+	// Broker/PresenceManager operations. See Tracer interface.
+	Tracer Tracer
 	// UseSingleFlight allows turning on mode where singleflight will be automatically used
 	// for Node.History (including recovery) and Node.Presence/Node.PresenceStats calls.
 	UseSingleFlight bool
@@ -93,13 +229,35 @@ type Config struct {
 	// MetricsNamespace is a Prometheus metrics namespace to use for internal metrics.
 	// If not set then the default namespace name "centrifuge" will be used.
 	MetricsNamespace string
+	// DisableMetrics turns off Prometheus metrics: collectors are not created and not
+	// registered, node gauges are not updated periodically and metrics are not shared
+	// between nodes in Node.Info.
+	DisableMetrics bool
 	// GetChannelNamespaceLabel if set will be used by Centrifuge to extract channel_namespace
 	// label for some channel related metrics. Make sure to maintain low cardinality of returned
 	// values to avoid issues with Prometheus performance. This function may introduce sufficient
 	// overhead since it's called in hot paths - so it should be fast. Usage of this function for
-	// specific metrics must be enabled over ChannelNamespaceLabelForTransportMessagesSent and
-	// ChannelNamespaceLabelForTransportMessagesReceived options.
+	// specific metrics must be enabled over ChannelNamespaceLabelForTransportMessagesSent,
+	// ChannelNamespaceLabelForTransportMessagesReceived and ChannelNamespaceLabelForNumChannels
+	// options.
 	GetChannelNamespaceLabel func(channel string) string
+	// GetChannelBroadcastFilter if set will be used by Centrifuge to get BroadcastFilterHandler
+	// for a channel publications are broadcasted into. Returning nil means no filtering
+	// for the channel, and it keeps the fast path of broadcasting one pre-encoded frame
+	// to all subscribers. Called for every broadcast, so it should be fast.
+	GetChannelBroadcastFilter func(channel string) BroadcastFilterHandler
+	// RemoveInactiveChannelHistory if set is called for channel when its last subscriber
+	// on this node unsubscribes. Returning true schedules channel history removal after
+	// InactiveChannelHistoryRemoveDelay. History is only removed if channel still has
+	// no subscribers on all nodes (checked over ChannelActivityChecker if Broker
+	// implements it) and nothing was published to channel during the delay. New
+	// subscription to channel on this node cancels scheduled removal. Useful for
+	// ephemeral channels which are never used again – to not keep their history until
+	// expiration.
+	RemoveInactiveChannelHistory func(channel string) bool
+	// InactiveChannelHistoryRemoveDelay is a delay before removing history of inactive
+	// channel. See RemoveInactiveChannelHistory. Zero value means 1 * time.Minute.
+	InactiveChannelHistoryRemoveDelay time.Duration
 	// ChannelNamespaceLabelForTransportMessagesSent enables using GetChannelNamespaceLabel
 	// function for extracting channel_namespace label for transport_messages_sent and
 	// transport_messages_sent_size.
@@ -108,20 +266,104 @@ type Config struct {
 	// function for extracting channel_namespace label for transport_messages_received and
 	// transport_messages_received_size.
 	ChannelNamespaceLabelForTransportMessagesReceived bool
+	// ChannelNamespaceLabelForNumChannels enables node_num_channels_by_namespace gauge
+	// with number of channels for each channel_namespace label extracted with
+	// GetChannelNamespaceLabel function. The gauge is updated periodically together
+	// with other node gauges.
+	ChannelNamespaceLabelForNumChannels bool
+}
+
+// Validate checks Config for problems. All found problems returned joined into
+// one error so that configuration may be fixed in one pass. Validate called by New
+// so usually there is no need to call it explicitly.
+func (c Config) Validate() error {
+	var errs []error
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"LogSamplingInterval", c.LogSamplingInterval},
+		{"NodeInfoMetricsAggregateInterval", c.NodeInfoMetricsAggregateInterval},
+		{"NodeInfoPublishInterval", c.NodeInfoPublishInterval},
+		{"ClientPresenceUpdateInterval", c.ClientPresenceUpdateInterval},
+		{"JoinLeaveReconcileInterval", c.JoinLeaveReconcileInterval},
+		{"BrokerSubscriptionReconcileInterval", c.BrokerSubscriptionReconcileInterval},
+		{"ClientExpiredCloseDelay", c.ClientExpiredCloseDelay},
+		{"ClientExpiredSubCloseDelay", c.ClientExpiredSubCloseDelay},
+		{"ClientStaleCloseDelay", c.ClientStaleCloseDelay},
+		{"ClientIdleTimeout", c.ClientIdleTimeout},
+		{"ClientCommandTimeout", c.ClientCommandTimeout},
+		{"ClientChannelPositionCheckDelay", c.ClientChannelPositionCheckDelay},
+		{"HistoryMetaTTL", c.HistoryMetaTTL},
+		{"InactiveChannelHistoryRemoveDelay", c.InactiveChannelHistoryRemoveDelay},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", d.name, d.value))
+		}
+	}
+	ints := []struct {
+		name  string
+		value int
+	}{
+		{"ClientQueueMaxSize", c.ClientQueueMaxSize},
+		{"ClientMaxFrameSize", c.ClientMaxFrameSize},
+		{"ClientEventQueueSize", c.ClientEventQueueSize},
+		{"ClientMessageSizeLimit", c.ClientMessageSizeLimit},
+		{"ClientCommandsPerFrameLimit", c.ClientCommandsPerFrameLimit},
+		{"ClientChannelLimit", c.ClientChannelLimit},
+		{"UserConnectionLimit", c.UserConnectionLimit},
+		{"NodeClientConnectionSoftLimit", c.NodeClientConnectionSoftLimit},
+		{"NodeClientConnectionHardLimit", c.NodeClientConnectionHardLimit},
+		{"ChannelMaxLength", c.ChannelMaxLength},
+		{"HistoryMaxPublicationLimit", c.HistoryMaxPublicationLimit},
+		{"RecoveryMaxPublicationLimit", c.RecoveryMaxPublicationLimit},
+	}
+	for _, i := range ints {
+		if i.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", i.name, i.value))
+		}
+	}
+	if c.NodeClientConnectionSoftLimit > 0 && c.NodeClientConnectionHardLimit > 0 && c.NodeClientConnectionSoftLimit > c.NodeClientConnectionHardLimit {
+		errs = append(errs, fmt.Errorf("NodeClientConnectionSoftLimit must not be greater than NodeClientConnectionHardLimit, got %d > %d", c.NodeClientConnectionSoftLimit, c.NodeClientConnectionHardLimit))
+	}
+	if c.NodeInfoPublishClientsChange < 0 {
+		errs = append(errs, fmt.Errorf("NodeInfoPublishClientsChange must not be negative, got %v", c.NodeInfoPublishClientsChange))
+	}
+	if c.GetChannelNamespaceLabel == nil {
+		if c.ChannelNamespaceLabelForTransportMessagesSent {
+			errs = append(errs, errors.New("ChannelNamespaceLabelForTransportMessagesSent requires GetChannelNamespaceLabel"))
+		}
+		if c.ChannelNamespaceLabelForTransportMessagesReceived {
+			errs = append(errs, errors.New("ChannelNamespaceLabelForTransportMessagesReceived requires GetChannelNamespaceLabel"))
+		}
+		if c.ChannelNamespaceLabelForNumChannels {
+			errs = append(errs, errors.New("ChannelNamespaceLabelForNumChannels requires GetChannelNamespaceLabel"))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 const (
-	// nodeInfoPublishInterval is an interval how often node must publish
-	// node control message.
-	nodeInfoPublishInterval = 3 * time.Second
-	// nodeInfoCleanInterval is an interval in seconds, how often node must
-	// clean information about other running nodes.
-	nodeInfoCleanInterval = nodeInfoPublishInterval * 3
-	// nodeInfoMaxDelay is an interval in seconds how long node info is
-	// considered actual.
-	nodeInfoMaxDelay = nodeInfoPublishInterval*2 + time.Second
+	// defaultNodeInfoPublishInterval is a default interval how often node must
+	// publish node control message.
+	defaultNodeInfoPublishInterval = 3 * time.Second
+	// nodeInfoChangeCheckInterval is an interval how often node checks whether
+	// node info changed enough to be published before NodeInfoPublishInterval.
+	nodeInfoChangeCheckInterval = time.Second
 )
 
+// nodeInfoCleanInterval is an interval how often node must clean information
+// about other running nodes.
+func nodeInfoCleanInterval(publishInterval time.Duration) time.Duration {
+	return publishInterval * 3
+}
+
+// nodeInfoMaxDelay is an interval how long node info is considered actual.
+func nodeInfoMaxDelay(publishInterval time.Duration) time.Duration {
+	return publishInterval*2 + time.Second
+}
+
 // PingPongConfig allows configuring application level ping-pong behavior.
 // Note that in current implementation PingPongConfig.PingInterval must be greater than PingPongConfig.PongTimeout.
 type PingPongConfig struct {
@@ -0,0 +1,32 @@
+package centrifuge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	require.NoError(t, Config{}.Validate())
+
+	err := Config{
+		ClientPresenceUpdateInterval:                  -time.Second,
+		ClientQueueMaxSize:                            -1,
+		ChannelNamespaceLabelForTransportMessagesSent: true,
+	}.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ClientPresenceUpdateInterval must not be negative")
+	require.Contains(t, err.Error(), "ClientQueueMaxSize must not be negative")
+	require.Contains(t, err.Error(), "ChannelNamespaceLabelForTransportMessagesSent requires GetChannelNamespaceLabel")
+
+	err = Config{
+		NodeClientConnectionSoftLimit: 2,
+		NodeClientConnectionHardLimit: 1,
+	}.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "NodeClientConnectionSoftLimit must not be greater than NodeClientConnectionHardLimit")
+
+	_, err = New(Config{ClientChannelLimit: -1})
+	require.Error(t, err)
+}
@@ -179,3 +179,42 @@ var (
 		Reason: "too many errors",
 	}
 )
+
+// DisconnectCause is a coarse category of disconnect suitable for auditing.
+// See DisconnectEvent.Cause.
+type DisconnectCause string
+
+// Known disconnect causes.
+const (
+	// DisconnectCauseClient means that connection was closed by a client or lost
+	// without any advice from a server side.
+	DisconnectCauseClient DisconnectCause = "client"
+	// DisconnectCauseWriteError means that connection was closed due to error
+	// writing to it.
+	DisconnectCauseWriteError DisconnectCause = "write_error"
+	// DisconnectCauseExpired means that connection credentials expired.
+	DisconnectCauseExpired DisconnectCause = "expired"
+	// DisconnectCauseSlow means that client was too slow to read messages.
+	DisconnectCauseSlow DisconnectCause = "slow"
+	// DisconnectCauseShutdown means that connection was closed due to Node shutdown.
+	DisconnectCauseShutdown DisconnectCause = "shutdown"
+	// DisconnectCauseServer means any other disconnect initiated by a server.
+	DisconnectCauseServer DisconnectCause = "server"
+)
+
+func disconnectCause(d Disconnect) DisconnectCause {
+	switch d.Code {
+	case DisconnectConnectionClosed.Code:
+		return DisconnectCauseClient
+	case DisconnectWriteError.Code:
+		return DisconnectCauseWriteError
+	case DisconnectExpired.Code:
+		return DisconnectCauseExpired
+	case DisconnectSlow.Code:
+		return DisconnectCauseSlow
+	case DisconnectShutdown.Code:
+		return DisconnectCauseShutdown
+	default:
+		return DisconnectCauseServer
+	}
+}
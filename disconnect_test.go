@@ -23,3 +23,41 @@ func TestDisconnect_Error(t *testing.T) {
 	errorText := d.Error()
 	require.Equal(t, "code: 42, reason: reason", errorText)
 }
+
+func TestDisconnect_BuiltInCodes(t *testing.T) {
+	builtIn := []Disconnect{
+		DisconnectConnectionClosed,
+		DisconnectShutdown,
+		DisconnectServerError,
+		DisconnectExpired,
+		DisconnectSubExpired,
+		DisconnectSlow,
+		DisconnectWriteError,
+		DisconnectInsufficientState,
+		DisconnectForceReconnect,
+		DisconnectNoPong,
+		DisconnectTooManyRequests,
+		DisconnectInvalidToken,
+		DisconnectBadRequest,
+		DisconnectStale,
+		DisconnectForceNoReconnect,
+		DisconnectConnectionLimit,
+		DisconnectChannelLimit,
+		DisconnectInappropriateProtocol,
+		DisconnectPermissionDenied,
+		DisconnectNotAvailable,
+		DisconnectTooManyErrors,
+	}
+	seen := map[uint32]struct{}{}
+	for _, d := range builtIn {
+		// Built-in codes must stay in range reserved by library (not overlap with
+		// 4000-4999 range for application custom disconnects).
+		require.GreaterOrEqual(t, d.Code, uint32(3000), d.String())
+		require.Less(t, d.Code, uint32(4000), d.String())
+		require.NotEmpty(t, d.Reason)
+		require.Less(t, len(d.Reason), 127)
+		_, ok := seen[d.Code]
+		require.False(t, ok, "duplicate code %d", d.Code)
+		seen[d.Code] = struct{}{}
+	}
+}
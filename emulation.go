@@ -78,7 +78,7 @@ func (s *EmulationHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	err = s.emuLayer.Emulate(&req)
 	if err != nil {
-		s.node.logger.log(newLogEntry(LogLevelError, "error processing emulation request", map[string]any{"req": &req, "error": err.Error()}))
+		s.node.logger.log(newErrorLogEntry(err, "error processing emulation request", map[string]any{"req": &req}))
 		if err == errNodeNotFound {
 			rw.WriteHeader(http.StatusNotFound)
 		} else {
@@ -130,7 +130,7 @@ func (h *emulationSurveyHandler) HandleEmulation(e SurveyEvent, cb SurveyCallbac
 	var req protocol.EmulationRequest
 	err := req.UnmarshalVT(e.Data)
 	if err != nil {
-		h.node.logger.log(newLogEntry(LogLevelError, "error unmarshal emulation request", map[string]any{"data": string(e.Data), "error": err.Error()}))
+		h.node.logger.log(newErrorLogEntry(err, "error unmarshal emulation request", map[string]any{"data": string(e.Data)}))
 		cb(SurveyReply{Code: 1})
 		return
 	}
@@ -144,7 +144,7 @@ func (h *emulationSurveyHandler) HandleEmulation(e SurveyEvent, cb SurveyCallbac
 		var d string
 		err = json.Unmarshal(req.Data, &d)
 		if err != nil {
-			h.node.logger.log(newLogEntry(LogLevelError, "error unmarshal emulation request data", map[string]any{"data": string(req.Data), "error": err.Error()}))
+			h.node.logger.log(newErrorLogEntry(err, "error unmarshal emulation request data", map[string]any{"data": string(req.Data)}))
 			cb(SurveyReply{Code: 3})
 			return
 		}
@@ -154,7 +154,8 @@ func (h *emulationSurveyHandler) HandleEmulation(e SurveyEvent, cb SurveyCallbac
 	}
 	go func() {
 		reader := readerpool.GetBytesReader(data)
-		_ = HandleReadFrame(client, reader)
+		// Request body size limited by EmulationHandler.
+		_ = handleReadFrame(client, reader, 0)
 		readerpool.PutBytesReader(reader)
 		cb(SurveyReply{})
 	}()
@@ -12,9 +12,13 @@ var _ error = (*Error)(nil)
 // Library user can define own application specific errors. When defining new
 // custom errors use error codes in range [400, 1999] assuming that codes in
 // interval 0-399 are reserved by Centrifuge.
+// Error may be returned from event handlers wrapped with fmt.Errorf and %w – it will
+// be extracted and sent to a client as is.
 type Error struct {
-	Code      uint32
-	Message   string
+	Code    uint32
+	Message string
+	// Temporary tells a client that error is temporary and the operation may be
+	// retried. Client SDKs retry subscribing upon temporary subscribe errors.
 	Temporary bool
 }
 
@@ -109,4 +113,10 @@ var (
 		Code:    112,
 		Message: "unrecoverable position",
 	}
+	// ErrorChannelClosed means that channel was closed with Node.CloseChannel
+	// and does not accept new subscriptions at the moment.
+	ErrorChannelClosed = &Error{
+		Code:    113,
+		Message: "channel closed",
+	}
 )
@@ -75,6 +75,15 @@ type ConnectReply struct {
 	// PingPongConfig if set, will override Transport's PingPongConfig to enable setting ping/pong interval
 	// for individual client.
 	PingPongConfig *PingPongConfig
+	// MaxConcurrentCommands when set to a positive value enables concurrent processing
+	// of publish, RPC, history, presence and presence stats commands of this connection.
+	// Up to MaxConcurrentCommands such commands are processed at the same time, so a slow
+	// handler does not block subsequent commands. Replies are sent as soon as they are
+	// ready and may arrive in an order different from the order of commands – client
+	// matches them by command ID. Other commands (connect, subscribe, unsubscribe, etc.)
+	// are still processed in order on connection reader. By default, all commands of a
+	// connection are processed sequentially.
+	MaxConcurrentCommands int
 }
 
 // ConnectingHandler called when new client authenticates on server.
@@ -152,6 +161,14 @@ type DisconnectEvent struct {
 	// of disconnect process. When disconnect was not initiated by a server this
 	// is always DisconnectConnectionClosed.
 	Disconnect
+	// Channels contains channels client was subscribed to at the moment of
+	// disconnect. These channels are collected before client unsubscribes from
+	// them so can be used to maintain per-channel state on application side.
+	Channels []string
+	// Cause is a category of disconnect derived from Disconnect.Code. Disconnect
+	// handler is called exactly once per connected client, so Cause can be used
+	// for auditing without deduplication.
+	Cause DisconnectCause
 }
 
 // DisconnectHandler called when client disconnects from server. The important
@@ -192,6 +209,10 @@ type SubscribeReply struct {
 	// SubRefresh handler will be used.
 	ClientSideRefresh bool
 
+	// IgnoreChannelClosed allows subscribing to channel closed with Node.CloseChannel
+	// when Config.CheckClosedChannels is on.
+	IgnoreChannelClosed bool
+
 	// SubscriptionReady channel if provided will be closed as soon as Centrifuge
 	// written subscribe reply to the connection, so it's possible to start writing
 	// publications into a channel using experimental Client.WritePublication method.
@@ -386,6 +407,25 @@ type NotificationEvent struct {
 // NotificationHandler allows handling notifications.
 type NotificationHandler func(NotificationEvent)
 
+// BroadcastFilterEvent contains fields related to broadcast filter call.
+type BroadcastFilterEvent struct {
+	// Channel where publication is broadcasted.
+	Channel string
+	// Subscriber is a snapshot of subscriber's ClientInfo, including ChanInfo
+	// set upon subscription.
+	Subscriber *ClientInfo
+	// Publication to deliver. Shared between all calls for the same broadcast,
+	// so it must not be modified.
+	Publication *Publication
+}
+
+// BroadcastFilterHandler called for every subscriber of channel during publication
+// broadcast on the current Node. Returning false drops delivery to the subscriber.
+// Called while holding hub locks, so it must be fast and must not call Node methods
+// which modify subscriptions. Only applied to real-time delivery – publications
+// returned from history or during recovery are not filtered.
+type BroadcastFilterHandler func(BroadcastFilterEvent) bool
+
 // NodeInfoSendReply can modify sending Node control frame in some ways.
 type NodeInfoSendReply struct {
 	// Data allows setting an arbitrary data to the control node frame which is
@@ -400,6 +440,52 @@ type NodeInfoSendReply struct {
 // arbitrary data to it. See NodeInfoSendReply.
 type NodeInfoSendHandler func() NodeInfoSendReply
 
+// NodeInfoEvent contains information about Node in cluster.
+type NodeInfoEvent struct {
+	// Node contains last known information about Node.
+	Node NodeInfo
+}
+
+// ClientEventType is a type of ClientEvent.
+type ClientEventType uint8
+
+// Known client event types.
+const (
+	// ClientEventConnect emitted when connection established.
+	ClientEventConnect ClientEventType = iota + 1
+	// ClientEventSubscribe emitted when client subscribed to a channel.
+	ClientEventSubscribe
+	// ClientEventPublish emitted when client published to a channel.
+	ClientEventPublish
+	// ClientEventDisconnect emitted when connection closed.
+	ClientEventDisconnect
+)
+
+// ClientEvent describes a successful operation of a client connection. Fields
+// not relevant for event Type are left empty.
+type ClientEvent struct {
+	Type     ClientEventType
+	Time     time.Time
+	ClientID string
+	UserID   string
+	// Channel is set for ClientEventSubscribe and ClientEventPublish.
+	Channel string
+	// PayloadSize is a size of publication data for ClientEventPublish.
+	PayloadSize int
+}
+
+// ClientEventHandler receives ClientEvent of all connections of Node. Events of
+// one connection come in the order they happened. Handler is called from a single
+// goroutine – events are dropped if it does not keep up with the event rate.
+type ClientEventHandler func(ClientEvent)
+
+// NodeJoinHandler called when new Node discovered in cluster.
+type NodeJoinHandler func(NodeInfoEvent)
+
+// NodeLeaveHandler called when Node left cluster – i.e. sent shutdown
+// control command or stopped sending node info for a while.
+type NodeLeaveHandler func(NodeInfoEvent)
+
 // TransportWriteEvent called just before sending data into the client connection. The
 // event is triggered from inside each client's message queue consumer – so it should
 // not directly affect Hub broadcast latencies.
@@ -420,6 +506,35 @@ type TransportWriteEvent struct {
 // filtering based on data content but rather tracing stuff.
 type TransportWriteHandler func(*Client, TransportWriteEvent) bool
 
+// TransportWriteErrorEvent contains details about failed write to the Transport.
+type TransportWriteErrorEvent struct {
+	// Error returned by the Transport.
+	Error error
+	// Size of data which was not written, in bytes.
+	Size int
+}
+
+// TransportWriteErrorDecision tells Client what to do after failed write to the Transport.
+type TransportWriteErrorDecision int
+
+const (
+	// TransportWriteErrorDisconnect closes client connection. This is a default behaviour.
+	TransportWriteErrorDisconnect TransportWriteErrorDecision = iota
+	// TransportWriteErrorDrop skips data which was not written and keeps connection.
+	TransportWriteErrorDrop
+	// TransportWriteErrorRetry writes data once again, connection is closed if retry
+	// fails. Retry happens before writing next messages so the order of messages is
+	// kept.
+	TransportWriteErrorRetry
+)
+
+// TransportWriteErrorHandler called when writing data to the Transport failed.
+// Handler must return a decision about connection. Like TransportWriteHandler it's
+// called from inside client's message queue consumer, so it should be fast. Handler
+// is not called for errors after which connection can't be used – Disconnect returned
+// by Transport or errors of closed connection, connection is always closed then.
+type TransportWriteErrorHandler func(*Client, TransportWriteErrorEvent) TransportWriteErrorDecision
+
 // CommandReadEvent contains protocol.Command processed by Client. Command
 // type and its fields in the event MAY BE POOLED by Centrifuge, so code
 // which wants to use Command AFTER CommandReadHandler handler returns MUST
@@ -469,3 +584,49 @@ func newCommandProcessedEvent(command *protocol.Command, disconnect *Disconnect,
 // purposes this seems tolerable as commands and replies may be matched by id.
 // Also, carefully read docs for CommandProcessedEvent to avoid possible bugs.
 type CommandProcessedHandler func(*Client, CommandProcessedEvent)
+
+// CommandContext contains data available to CommandMiddleware. Command
+// type and its fields MAY BE POOLED by Centrifuge, so code which wants to use
+// Command AFTER CommandHandlerFunc returns MUST MAKE A COPY.
+type CommandContext struct {
+	// Client which sent the command.
+	Client *Client
+	// Method is a name of command type, like "subscribe" or "publish".
+	Method string
+	// Command is a raw command read from the connection with method params.
+	Command *protocol.Command
+
+	ctx    context.Context
+	timing *commandTiming
+}
+
+// Context returns context of command processing. It's derived from Client context
+// and contains command tracing span when Config.Tracer is set.
+func (c CommandContext) Context() context.Context {
+	return c.ctx
+}
+
+// WithContext returns a copy of CommandContext with context replaced by ctx. Middleware
+// may use it to pass a context with extra values down the chain, the context is then
+// used for processing command by Centrifuge.
+func (c CommandContext) WithContext(ctx context.Context) CommandContext {
+	c.ctx = ctx
+	return c
+}
+
+type commandTiming struct {
+	started  time.Time
+	duration time.Duration
+}
+
+// CommandHandlerFunc processes client command. Returned error is handled the same way
+// as errors returned from event handlers: Disconnect closes the connection, other errors
+// are sent to a client in reply to the command. Note, that reply to the command may be
+// sent asynchronously, after CommandHandlerFunc returns – as event handlers are free to
+// call callbacks in separate goroutine.
+type CommandHandlerFunc func(CommandContext) error
+
+// CommandMiddleware wraps CommandHandlerFunc to add cross-cutting behaviour to the
+// processing of every client command. Middleware may stop command processing by
+// returning an error without calling next.
+type CommandMiddleware func(next CommandHandlerFunc) CommandHandlerFunc
@@ -113,7 +113,8 @@ func (h *HTTPStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rc := http.NewResponseController(w)
 
 	reader := readerpool.GetBytesReader(requestData)
-	_ = HandleReadFrame(c, reader)
+	// Request body size limited by MaxRequestBodySize.
+	_ = handleReadFrame(c, reader, 0)
 	readerpool.PutBytesReader(reader)
 
 	for {
@@ -128,14 +129,10 @@ func (h *HTTPStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			_ = rc.SetWriteDeadline(time.Now().Add(streamingResponseWriteTimeout))
 			if protocolType == ProtocolTypeProtobuf {
-				protoType := protocolType.toProto()
-				encoder := protocol.GetDataEncoder(protoType)
-				_ = encoder.Encode(data)
-				_, err := w.Write(encoder.Finish())
+				err = writeHTTPStreamProtobufFrame(w, data)
 				if err != nil {
 					return
 				}
-				protocol.PutDataEncoder(protoType, encoder)
 			} else {
 				_, err = w.Write(data)
 				if err != nil {
@@ -152,6 +149,16 @@ func (h *HTTPStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// writeHTTPStreamProtobufFrame writes length-prefixed protobuf frame. Encoder is
+// returned to pool even if write fails.
+func writeHTTPStreamProtobufFrame(w io.Writer, data []byte) error {
+	encoder := protocol.GetDataEncoder(protocol.TypeProtobuf)
+	defer protocol.PutDataEncoder(protocol.TypeProtobuf, encoder)
+	_ = encoder.Encode(data)
+	_, err := w.Write(encoder.Finish())
+	return err
+}
+
 const (
 	transportHTTPStream = "http_stream"
 )
@@ -4,10 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -66,6 +69,119 @@ func TestHTTPStreamHandler(t *testing.T) {
 	}
 }
 
+func TestHTTPStreamHandler_Protobuf(t *testing.T) {
+	t.Parallel()
+	n, _ := New(Config{})
+
+	n.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{Credentials: &Credentials{
+			UserID: "test",
+		}}, nil
+	})
+
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.Handle("/connection/http_stream", NewHTTPStreamHandler(n, HTTPStreamConfig{}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := server.URL + "/connection/http_stream"
+	client := &http.Client{Timeout: 5 * time.Second}
+	command := &protocol.Command{
+		Id:      1,
+		Connect: &protocol.ConnectRequest{},
+	}
+	commandData, err := command.MarshalVT()
+	require.NoError(t, err)
+	body := binary.AppendUvarint(nil, uint64(len(commandData)))
+	body = append(body, commandData...)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	defer func() { _ = resp.Body.Close() }()
+
+	r := bufio.NewReader(resp.Body)
+	length, err := binary.ReadUvarint(r)
+	require.NoError(t, err)
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	require.NoError(t, err)
+	var reply protocol.Reply
+	require.NoError(t, reply.UnmarshalVT(frame))
+	require.NotNil(t, reply.Connect)
+	require.Equal(t, uint32(1), reply.Id)
+	require.NotZero(t, reply.Connect.Session)
+}
+
+type errorResponseWriter struct {
+	header    http.Header
+	numWrites int32
+}
+
+func (w *errorResponseWriter) Header() http.Header { return w.header }
+func (w *errorResponseWriter) WriteHeader(int)     {}
+func (w *errorResponseWriter) Flush()              {}
+
+var errResponseWrite = errors.New("response write error")
+
+func (w *errorResponseWriter) Write([]byte) (int, error) {
+	atomic.AddInt32(&w.numWrites, 1)
+	return 0, errResponseWrite
+}
+
+func TestHTTPStreamHandler_ProtobufWriteError(t *testing.T) {
+	t.Parallel()
+	n, _ := New(Config{})
+	n.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{Credentials: &Credentials{UserID: "test"}}, nil
+	})
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	command := &protocol.Command{Id: 1, Connect: &protocol.ConnectRequest{}}
+	commandData, err := command.MarshalVT()
+	require.NoError(t, err)
+	body := binary.AppendUvarint(nil, uint64(len(commandData)))
+	body = append(body, commandData...)
+	req := httptest.NewRequest(http.MethodPost, "/connection/http_stream", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	w := &errorResponseWriter{header: http.Header{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewHTTPStreamHandler(n, HTTPStreamConfig{}).ServeHTTP(w, req)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not finished after write error")
+	}
+	// Connect reply write failed and connection was closed right away.
+	require.EqualValues(t, 1, atomic.LoadInt32(&w.numWrites))
+	require.Equal(t, 0, n.hub.NumClients())
+}
+
+func TestWriteHTTPStreamProtobufFrame_WriteError(t *testing.T) {
+	w := &errorResponseWriter{header: http.Header{}}
+	data := []byte("test")
+	require.ErrorIs(t, writeHTTPStreamProtobufFrame(w, data), errResponseWrite)
+	// Encoder is returned to pool on write error, so it's reused by subsequent
+	// writes. The only allocation left is a frame copy made by Finish, while a
+	// new encoder costs two more allocations. Race detector drops some pooled
+	// items, so allow a fraction of allocation on top.
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = writeHTTPStreamProtobufFrame(w, data)
+	})
+	require.Less(t, allocs, float64(2))
+}
+
 func TestHTTPStreamHandler_RequestTooLarge(t *testing.T) {
 	t.Parallel()
 	n, _ := New(Config{})
@@ -14,6 +14,11 @@ type SSEConfig struct {
 	PingPongConfig
 	// MaxRequestBodySize limits initial request body size (when SSE starts with POST).
 	MaxRequestBodySize int
+	// HeartbeatInterval if set makes handler periodically write SSE comment lines
+	// into the connection. This helps to keep the stream alive when intermediaries
+	// (proxies, load balancers) close idle connections faster than application
+	// level pings are sent. Zero value means no heartbeat comments.
+	HeartbeatInterval time.Duration
 }
 
 // SSEHandler handles WebSocket client connections. WebSocket protocol
@@ -39,6 +44,9 @@ const connectUrlParam = "cf_connect"
 
 const defaultMaxSSEBodySize = 64 * 1024
 
+// sseHeartbeat is an SSE comment line, ignored by EventSource implementations.
+var sseHeartbeat = []byte(":\n\n")
+
 func (h *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.node.metrics.incTransportConnect(transportSSE)
 
@@ -117,15 +125,31 @@ func (h *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_ = rc.SetWriteDeadline(time.Time{})
 
 	reader := readerpool.GetBytesReader(requestData)
-	_ = HandleReadFrame(c, reader)
+	// Request body size limited by MaxRequestBodySize.
+	_ = handleReadFrame(c, reader, 0)
 	readerpool.PutBytesReader(reader)
 
+	var heartbeatCh <-chan time.Time
+	if h.config.HeartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(h.config.HeartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeatCh = heartbeatTicker.C
+	}
+
 	for {
 		select {
 		case <-r.Context().Done():
 			return
 		case <-transport.disconnectCh:
 			return
+		case <-heartbeatCh:
+			_ = rc.SetWriteDeadline(time.Now().Add(streamingResponseWriteTimeout))
+			_, err = w.Write(sseHeartbeat)
+			if err != nil {
+				return
+			}
+			_ = rc.Flush()
+			_ = rc.SetWriteDeadline(time.Time{})
 		case data, ok := <-transport.messages:
 			if !ok {
 				return
@@ -164,6 +164,51 @@ func TestSSEHandler_RequestTooLarge(t *testing.T) {
 	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
 }
 
+func TestSSEHandler_Heartbeat(t *testing.T) {
+	t.Parallel()
+	n, _ := New(Config{})
+
+	n.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{Credentials: &Credentials{
+			UserID: "test",
+		}}, nil
+	})
+
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	mux := http.NewServeMux()
+	mux.Handle("/connection/sse", NewSSEHandler(n, SSEConfig{
+		HeartbeatInterval: 10 * time.Millisecond,
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	command := &protocol.Command{
+		Id:      1,
+		Connect: &protocol.ConnectRequest{},
+	}
+	jsonData, err := json.Marshal(command)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/connection/sse", bytes.NewBuffer(jsonData))
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	defer func() { _ = resp.Body.Close() }()
+
+	dec := newSSEStreamDecoder(resp.Body)
+	for {
+		msg, err := dec.decode()
+		require.NoError(t, err)
+		if bytes.Equal(msg.Data, []byte(":")) {
+			break
+		}
+	}
+}
+
 func newSSEStreamDecoder(body io.Reader) *sseStreamDecoder {
 	return &sseStreamDecoder{
 		r: bufio.NewReader(body),
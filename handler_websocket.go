@@ -1,6 +1,7 @@
 package centrifuge
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -35,7 +36,7 @@ type WebsocketConfig struct {
 	UseWriteBufferPool bool
 
 	// MessageSizeLimit sets the maximum size in bytes of allowed message from client.
-	// By default, 65536 bytes (64KB) will be used.
+	// By default, Config.ClientMessageSizeLimit will be used.
 	MessageSizeLimit int
 
 	// WriteTimeout is maximum time of write message operation.
@@ -60,6 +61,14 @@ type WebsocketConfig struct {
 	// WebsocketCompression enabled and compression negotiated with client.
 	CompressionMinSize int
 
+	// Unidirectional enables unidirectional mode where server only pushes data to
+	// a connection. Connect request is constructed from URL params: token is taken
+	// from cf_token, channels a client wants to subscribe to from cf_channel (may be
+	// repeated) – these are available in ConnectEvent.Channels and server-side
+	// subscriptions should be returned over ConnectReply.Subscriptions. Any data frame
+	// received from a client in this mode results into DisconnectBadRequest.
+	Unidirectional bool
+
 	PingPongConfig
 }
 
@@ -103,9 +112,19 @@ func (s *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	var protoType = ProtocolTypeJSON
 	var useFramePingPong bool
+	var connectRequest ConnectRequest
 
 	if r.URL.RawQuery != "" {
 		query := r.URL.Query()
+		if s.config.Unidirectional {
+			connectRequest.Token = query.Get(unidirectionalTokenParam)
+			if channels := query[unidirectionalChannelParam]; len(channels) > 0 {
+				connectRequest.Subs = make(map[string]SubscribeRequest, len(channels))
+				for _, ch := range channels {
+					connectRequest.Subs[ch] = SubscribeRequest{}
+				}
+			}
+		}
 		if query.Get("format") == "protobuf" || query.Get("cf_protocol") == "protobuf" {
 			protoType = ProtocolTypeProtobuf
 		}
@@ -118,20 +137,37 @@ func (s *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	select {
+	case <-s.node.NotifyShutdown():
+		// Reject before upgrade so that client can try another node.
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	if hardLimit := s.node.config.NodeClientConnectionHardLimit; hardLimit > 0 && s.node.hub.NumClients() >= hardLimit {
+		// Shed load before upgrade, connect command would be rejected anyway.
+		s.node.metrics.incNodeConnectionLimit(nodeConnectionLimitHard)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	compression := s.config.Compression
 	compressionLevel := s.config.CompressionLevel
 	compressionMinSize := s.config.CompressionMinSize
 
 	conn, subProtocol, err := s.upgrade.Upgrade(rw, r, nil)
 	if err != nil {
-		s.node.logger.log(newLogEntry(LogLevelDebug, "websocket upgrade error", map[string]any{"error": err.Error()}))
+		s.node.logger.logLazy(LogLevelDebug, "websocket upgrade error", func() map[string]any {
+			return map[string]any{"error": err.Error()}
+		})
 		return
 	}
 
 	if compression {
 		err := conn.SetCompressionLevel(compressionLevel)
 		if err != nil {
-			s.node.logger.log(newLogEntry(LogLevelError, "websocket error setting compression level", map[string]any{"error": err.Error()}))
+			s.node.logger.log(newErrorLogEntry(err, "websocket error setting compression level"))
 		}
 	}
 
@@ -141,7 +177,7 @@ func (s *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 	messageSizeLimit := s.config.MessageSizeLimit
 	if messageSizeLimit == 0 {
-		messageSizeLimit = 65536 // 64KB
+		messageSizeLimit = s.node.config.ClientMessageSizeLimit
 	}
 	if messageSizeLimit > 0 {
 		conn.SetReadLimit(int64(messageSizeLimit))
@@ -167,6 +203,8 @@ func (s *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			writeTimeout:       writeTimeout,
 			compressionMinSize: compressionMinSize,
 			protoType:          protoType,
+			metrics:            s.node.metrics,
+			unidirectional:     s.config.Unidirectional,
 		}
 
 		graceCh := make(chan struct{})
@@ -196,14 +234,28 @@ func (s *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			}(time.Now())
 		}
 
-		for {
-			_, r, err := conn.NextReader()
-			if err != nil {
-				break
+		if s.config.Unidirectional {
+			c.Connect(connectRequest)
+			if _, _, err := conn.NextReader(); err == nil {
+				s.node.logger.log(newLogEntry(LogLevelInfo, "data frame in unidirectional websocket connection", map[string]any{"client": c.ID(), "user": c.UserID()}))
+				c.Disconnect(DisconnectBadRequest)
 			}
-			proceed := HandleReadFrame(c, r)
-			if !proceed {
-				break
+		} else {
+			for {
+				_, r, err := conn.NextReader()
+				if err != nil {
+					if errors.Is(err, websocket.ErrReadLimit) {
+						s.node.metrics.incClientLimitExceeded(clientLimitMessageSize)
+						s.node.logger.log(newLogEntry(LogLevelInfo, "client message size limit exceeded", map[string]any{"client": c.ID(), "user": c.UserID()}))
+						c.Disconnect(DisconnectBadRequest)
+					}
+					break
+				}
+				// Frame size already limited by conn.SetReadLimit.
+				proceed := handleReadFrame(c, r, 0)
+				if !proceed {
+					break
+				}
 			}
 		}
 
@@ -224,18 +276,43 @@ func (s *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 // HandleReadFrame is a helper to read Centrifuge commands from frame-based io.Reader and
 // process them. Frame-based means that EOF treated as the end of the frame, not the entire
-// connection close.
+// connection close. Frame size is limited by Config.ClientMessageSizeLimit.
 func HandleReadFrame(c *Client, r io.Reader) bool {
+	return handleReadFrame(c, r, c.node.config.ClientMessageSizeLimit)
+}
+
+// handleReadFrame is like HandleReadFrame but with custom frame size limit. Built-in
+// transports which already limit frame size on their own (using configured message
+// or request body size limit) pass zero here to avoid applying smaller limit on top.
+func handleReadFrame(c *Client, r io.Reader, messageSizeLimit int) bool {
 	protoType := c.Transport().Protocol().toProto()
+	var lr *io.LimitedReader
+	if messageSizeLimit > 0 {
+		// Read one byte over the limit to find out that frame is too large.
+		lr = &io.LimitedReader{R: r, N: int64(messageSizeLimit) + 1}
+		r = lr
+	}
 	decoder := protocol.GetStreamCommandDecoder(protoType, r)
 	defer protocol.PutStreamCommandDecoder(protoType, decoder)
 
-	hadCommands := false
+	numCommands := 0
 
 	for {
 		cmd, cmdProtocolSize, err := decoder.Decode()
+		if lr != nil && lr.N <= 0 {
+			c.node.metrics.incClientLimitExceeded(clientLimitMessageSize)
+			c.node.logger.log(newLogEntry(LogLevelInfo, "client message size limit exceeded", map[string]any{"client": c.ID(), "user": c.UserID()}))
+			c.Disconnect(DisconnectBadRequest)
+			return false
+		}
 		if cmd != nil {
-			hadCommands = true
+			numCommands++
+			if numCommands > c.node.config.ClientCommandsPerFrameLimit {
+				c.node.metrics.incClientLimitExceeded(clientLimitCommandsPerFrame)
+				c.node.logger.log(newLogEntry(LogLevelInfo, "client commands per frame limit exceeded", map[string]any{"client": c.ID(), "user": c.UserID()}))
+				c.Disconnect(DisconnectBadRequest)
+				return false
+			}
 			proceed := c.HandleCommand(cmd, cmdProtocolSize)
 			if !proceed {
 				return false
@@ -243,7 +320,7 @@ func HandleReadFrame(c *Client, r io.Reader) bool {
 		}
 		if err != nil {
 			if err == io.EOF {
-				if !hadCommands {
+				if numCommands == 0 {
 					c.node.logger.log(newLogEntry(LogLevelInfo, "empty request received", map[string]any{"client": c.ID(), "user": c.UserID()}))
 					c.Disconnect(DisconnectBadRequest)
 					return false
@@ -263,6 +340,12 @@ const (
 	transportWebsocket = "websocket"
 )
 
+// URL params used to construct connect request in unidirectional mode.
+const (
+	unidirectionalTokenParam   = "cf_token"
+	unidirectionalChannelParam = "cf_channel"
+)
+
 // websocketTransport is a wrapper struct over websocket connection to fit session
 // interface so client will accept it.
 type websocketTransport struct {
@@ -280,6 +363,8 @@ type websocketTransportOptions struct {
 	pingPong           PingPongConfig
 	writeTimeout       time.Duration
 	compressionMinSize int
+	metrics            *metrics
+	unidirectional     bool
 }
 
 func newWebsocketTransport(conn *websocket.Conn, opts websocketTransportOptions, graceCh chan struct{}, useNativePingPong bool) *websocketTransport {
@@ -312,7 +397,7 @@ func (t *websocketTransport) ProtocolVersion() ProtocolVersion {
 
 // Unidirectional returns whether transport is unidirectional.
 func (t *websocketTransport) Unidirectional() bool {
-	return false
+	return t.opts.unidirectional
 }
 
 // Emulation ...
@@ -341,7 +426,8 @@ func (t *websocketTransport) PingPongConfig() PingPongConfig {
 }
 
 func (t *websocketTransport) writeData(data []byte) error {
-	if t.opts.compressionMinSize > 0 {
+	negotiated := t.conn.CompressionNegotiated()
+	if negotiated && t.opts.compressionMinSize > 0 {
 		t.conn.EnableWriteCompression(len(data) > t.opts.compressionMinSize)
 	}
 	var messageType = websocket.TextMessage
@@ -358,6 +444,13 @@ func (t *websocketTransport) writeData(data []byte) error {
 	if t.opts.writeTimeout > 0 {
 		_ = t.conn.SetWriteDeadline(time.Time{})
 	}
+	if t.opts.metrics != nil {
+		size, compressed := t.conn.LastMessageWritten()
+		if negotiated {
+			t.opts.metrics.incTransportCompression(compressed)
+		}
+		t.opts.metrics.addWebsocketBytesOut(size, compressed)
+	}
 	return nil
 }
 
@@ -17,6 +17,8 @@ import (
 	"github.com/centrifugal/centrifuge/internal/websocket"
 
 	"github.com/centrifugal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -101,6 +103,41 @@ func TestWebsocketHandlerSubprotocol(t *testing.T) {
 	waitWithTimeout(t, done)
 }
 
+func TestWebsocketHandlerShutdown(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	require.NoError(t, node.Shutdown(context.Background()))
+
+	mux := http.NewServeMux()
+	mux.Handle("/connection/websocket", NewWebsocketHandler(node, WebsocketConfig{}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := "ws" + server.URL[4:]
+	_, resp, _, err := (&websocket.Dialer{}).Dial(url+"/connection/websocket", nil)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestWebsocketHandlerNodeConnectionHardLimit(t *testing.T) {
+	node := defaultTestNode()
+	node.config.NodeClientConnectionHardLimit = 1
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	mux := http.NewServeMux()
+	mux.Handle("/connection/websocket", NewWebsocketHandler(node, WebsocketConfig{}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := "ws" + server.URL[4:]
+	_, resp, _, err := (&websocket.Dialer{}).Dial(url+"/connection/websocket", nil)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
 func TestWebsocketHandlerURLParams(t *testing.T) {
 	node := defaultNodeNoHandlers()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -212,6 +249,172 @@ func TestWebsocketTransportWriteMany(t *testing.T) {
 	require.Equal(t, uint64(1), l2)
 }
 
+func TestWebsocketHandlerCompression(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{
+			Credentials:   &Credentials{UserID: "test"},
+			Subscriptions: map[string]SubscribeOptions{"test": {}},
+		}, nil
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/connection/websocket", NewWebsocketHandler(node, WebsocketConfig{
+		Compression:        true,
+		CompressionLevel:   1,
+		CompressionMinSize: 1024,
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := "ws" + server.URL[4:]
+	dialer := &websocket.Dialer{
+		EnableCompression: true,
+	}
+	conn, resp, _, err := dialer.Dial(url+"/connection/websocket", nil)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.NotNil(t, conn)
+	defer func() { _ = conn.Close() }()
+	err = conn.WriteMessage(websocket.TextMessage, []byte(`{"id":1,"connect":{}}`))
+	require.NoError(t, err)
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var reply protocol.Reply
+	require.NoError(t, json.Unmarshal(msg, &reply))
+	require.NotNil(t, reply.Connect)
+	connectReplySize := len(msg)
+	require.Less(t, connectReplySize, 1024)
+
+	data, err := json.Marshal(map[string]string{"input": strings.Repeat("x", 4096)})
+	require.NoError(t, err)
+	_, err = node.Publish("test", data)
+	require.NoError(t, err)
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), strings.Repeat("x", 4096))
+	publicationSize := len(msg)
+
+	counterValue := func(c prometheus.Counter) float64 {
+		var m dto.Metric
+		require.NoError(t, c.Write(&m))
+		return m.GetCounter().GetValue()
+	}
+	// Metrics are updated after frame is written, client may read it earlier.
+	require.Eventually(t, func() bool {
+		return counterValue(node.metrics.transportCompressionCountYes) == 1 &&
+			counterValue(node.metrics.transportCompressionCountNo) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, float64(connectReplySize), counterValue(node.metrics.transportBytesOutWebsocketUncompressed))
+	compressedSize := counterValue(node.metrics.transportBytesOutWebsocketCompressed)
+	require.Greater(t, compressedSize, float64(0))
+	require.Less(t, compressedSize, float64(publicationSize))
+}
+
+func TestWebsocketHandlerMessageSizeLimit(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	node.config.ClientMessageSizeLimit = 16
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{Credentials: &Credentials{UserID: "test"}}, nil
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/connection/websocket", NewWebsocketHandler(node, WebsocketConfig{
+		MessageSizeLimit: 1024,
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := "ws" + server.URL[4:]
+	dialer := &websocket.Dialer{}
+	conn, resp, _, err := dialer.Dial(url+"/connection/websocket", nil)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	defer func() { _ = conn.Close() }()
+
+	// Frame is larger than ClientMessageSizeLimit but fits WebsocketConfig.MessageSizeLimit.
+	cmd := []byte(`{"id":1,"connect":{"name":"` + strings.Repeat("x", 64) + `"}}`)
+	err = conn.WriteMessage(websocket.TextMessage, cmd)
+	require.NoError(t, err)
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var reply protocol.Reply
+	require.NoError(t, json.Unmarshal(msg, &reply))
+	require.NotNil(t, reply.Connect)
+
+	// Frame larger than WebsocketConfig.MessageSizeLimit closes connection.
+	cmd = []byte(`{"id":2,"rpc":{"data":"` + strings.Repeat("x", 2048) + `"}}`)
+	err = conn.WriteMessage(websocket.TextMessage, cmd)
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseMessageTooBig, closeErr.Code)
+}
+
+func TestWebsocketHandlerUnidirectional(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		require.Equal(t, "secret", event.Token)
+		require.Equal(t, []string{"test"}, event.Channels)
+		subs := make(map[string]SubscribeOptions, len(event.Channels))
+		for _, ch := range event.Channels {
+			subs[ch] = SubscribeOptions{}
+		}
+		return ConnectReply{
+			Credentials:   &Credentials{UserID: "test"},
+			Subscriptions: subs,
+		}, nil
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/connection/websocket", NewWebsocketHandler(node, WebsocketConfig{
+		Unidirectional: true,
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := "ws" + server.URL[4:]
+	dialer := &websocket.Dialer{}
+	conn, resp, _, err := dialer.Dial(url+"/connection/websocket?cf_token=secret&cf_channel=test", nil)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	defer func() { _ = conn.Close() }()
+
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var push protocol.Push
+	require.NoError(t, json.Unmarshal(msg, &push))
+	require.NotNil(t, push.Connect)
+	require.Contains(t, push.Connect.Subs, "test")
+
+	_, err = node.Publish("test", []byte(`{}`))
+	require.NoError(t, err)
+
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	push = protocol.Push{}
+	require.NoError(t, json.Unmarshal(msg, &push))
+	require.Equal(t, "test", push.Channel)
+	require.NotNil(t, push.Pub)
+
+	// Any data from client must result into disconnect.
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{}`)))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, int(DisconnectBadRequest.Code), closeErr.Code)
+}
+
 func getConnectCommandProtobuf(t *testing.T) []byte {
 	connectRequest := &protocol.ConnectRequest{}
 	encoder := protocol.NewProtobufCommandEncoder()
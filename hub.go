@@ -4,18 +4,53 @@ import (
 	"context"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/centrifugal/protocol"
 )
 
 const numHubShards = 64
 
+var (
+	pushPool = sync.Pool{
+		New: func() any { return &protocol.Push{} },
+	}
+	replyPool = sync.Pool{
+		New: func() any { return &protocol.Reply{} },
+	}
+)
+
+// getPush gets Push from pool to encode broadcasted message. Only intermediate
+// Push and Reply objects are pooled, encoded data is not since it's retained
+// in client queues after broadcast.
+func getPush(channel string) *protocol.Push {
+	push := pushPool.Get().(*protocol.Push)
+	push.Channel = channel
+	return push
+}
+
+func putPush(push *protocol.Push) {
+	push.Reset()
+	pushPool.Put(push)
+}
+
+func encodeReplyPush(encoder protocol.ReplyEncoder, push *protocol.Push) ([]byte, error) {
+	reply := replyPool.Get().(*protocol.Reply)
+	reply.Push = push
+	data, err := encoder.Encode(reply)
+	reply.Reset()
+	replyPool.Put(reply)
+	return data, err
+}
+
 // Hub tracks Client connections on the current Node.
 type Hub struct {
 	connShards [numHubShards]*connShard
 	subShards  [numHubShards]*subShard
 	sessionsMu sync.RWMutex
 	sessions   map[string]*Client
+	// getBroadcastFilter is Config.GetChannelBroadcastFilter.
+	getBroadcastFilter func(channel string) BroadcastFilterHandler
 }
 
 // newHub initializes Hub.
@@ -64,6 +99,33 @@ func (h *Hub) shutdown(ctx context.Context) error {
 	return shutdownErr
 }
 
+// disconnectAll closes all connections of the current Node with concurrency limited
+// in the same way as on shutdown. Returns number of closed connections.
+func (h *Hub) disconnectAll(ctx context.Context, disconnect Disconnect) (int, error) {
+	sem := make(chan struct{}, hubShutdownSemaphoreSize)
+
+	var mu sync.Mutex
+	var numClosed int
+	var disconnectErr error
+
+	var wg sync.WaitGroup
+	wg.Add(numHubShards)
+	for i := 0; i < numHubShards; i++ {
+		go func(i int) {
+			defer wg.Done()
+			n, err := h.connShards[i].closeAll(ctx, sem, disconnect)
+			mu.Lock()
+			numClosed += n
+			if err != nil && disconnectErr == nil {
+				disconnectErr = err
+			}
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	return numClosed, disconnectErr
+}
+
 // Add connection into clientHub connections registry.
 func (h *Hub) add(c *Client) error {
 	h.sessionsMu.Lock()
@@ -97,6 +159,53 @@ func (h *Hub) Connections() map[string]*Client {
 	return conns
 }
 
+// WalkClients calls fn for every client connection of the current Node until fn
+// returns false. Connections are iterated over a snapshot taken shard by shard, Hub
+// locks are not held while fn is executed – so fn may call Client and Hub methods.
+// The snapshot may be slightly stale: connections closed during iteration may still
+// be visited, and connections added during iteration may be missed.
+func (h *Hub) WalkClients(fn func(*Client) bool) {
+	for _, shard := range h.connShards {
+		shard.mu.RLock()
+		clients := make([]*Client, 0, len(shard.conns))
+		for _, c := range shard.conns {
+			clients = append(clients, c)
+		}
+		shard.mu.RUnlock()
+		for _, c := range clients {
+			if !fn(c) {
+				return
+			}
+		}
+	}
+}
+
+// WalkSubscribers calls fn for every client connection of the current Node subscribed
+// to channel until fn returns false. Same as for WalkClients, iteration goes over
+// a possibly stale snapshot and no Hub locks are held while fn is executed.
+func (h *Hub) WalkSubscribers(ch string, fn func(*Client) bool) {
+	for _, c := range h.subShards[index(ch, numHubShards)].subscribers(ch) {
+		if !fn(c) {
+			return
+		}
+	}
+}
+
+// Connection returns client connection with provided ID if it's connected to
+// the current Node.
+func (h *Hub) Connection(clientID string) (*Client, bool) {
+	// Connections are sharded by user ID, so we have to look into every shard.
+	for _, shard := range h.connShards {
+		shard.mu.RLock()
+		c, ok := shard.conns[clientID]
+		shard.mu.RUnlock()
+		if ok {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
 // UserConnections returns all user connections to the current Node.
 func (h *Hub) UserConnections(userID string) map[string]*Client {
 	return h.connShards[index(userID, numHubShards)].userConnections(userID)
@@ -114,8 +223,13 @@ func (h *Hub) unsubscribe(userID string, ch string, unsubscribe Unsubscribe, cli
 	return h.connShards[index(userID, numHubShards)].unsubscribe(userID, ch, unsubscribe, clientID, sessionID)
 }
 
-func (h *Hub) disconnect(userID string, disconnect Disconnect, clientID, sessionID string, whitelist []string) error {
-	return h.connShards[index(userID, numHubShards)].disconnect(userID, disconnect, clientID, sessionID, whitelist)
+// unsubscribeAllUsers unsubscribes all connections subscribed to channel.
+func (h *Hub) unsubscribeAllUsers(ch string, unsubscribe Unsubscribe) error {
+	return h.subShards[index(ch, numHubShards)].unsubscribeAll(ch, unsubscribe)
+}
+
+func (h *Hub) disconnect(userID string, disconnect Disconnect, clientID, sessionID string, whitelist []string, connectedBefore int64) error {
+	return h.connShards[index(userID, numHubShards)].disconnect(userID, disconnect, clientID, sessionID, whitelist, connectedBefore)
 }
 
 func (h *Hub) addSub(ch string, c *Client) (bool, error) {
@@ -133,7 +247,19 @@ func (h *Hub) removeSub(ch string, c *Client) (bool, error) {
 // in a channel with incremental offset. By calling BroadcastPublication messages will only be sent
 // to the current node subscribers without any defined offset semantics.
 func (h *Hub) BroadcastPublication(ch string, pub *Publication, sp StreamPosition) error {
-	return h.subShards[index(ch, numHubShards)].broadcastPublication(ch, pubToProto(pub), sp)
+	var filter func(c *Client) bool
+	if h.getBroadcastFilter != nil {
+		if handler := h.getBroadcastFilter(ch); handler != nil {
+			filter = func(c *Client) bool {
+				return handler(BroadcastFilterEvent{
+					Channel:     ch,
+					Subscriber:  c.channelClientInfo(ch),
+					Publication: pub,
+				})
+			}
+		}
+	}
+	return h.subShards[index(ch, numHubShards)].broadcastPublication(ch, pubToProto(pub), sp, pub.ExcludeClient, filter)
 }
 
 // broadcastJoin sends message to all clients subscribed on channel.
@@ -159,6 +285,19 @@ func (h *Hub) Channels() []string {
 	return channels
 }
 
+// channelsFiltered returns active channels accepted by match with a number of
+// subscribers in each. Returns at most limit channels if limit > 0.
+func (h *Hub) channelsFiltered(match func(string) bool, limit int) map[string]int {
+	channels := make(map[string]int)
+	for i := 0; i < numHubShards; i++ {
+		if limit > 0 && len(channels) >= limit {
+			break
+		}
+		h.subShards[i].channelsFiltered(channels, match, limit)
+	}
+	return channels
+}
+
 // NumClients returns total number of client connections.
 func (h *Hub) NumClients() int {
 	var total int
@@ -221,10 +360,16 @@ const (
 
 // shutdown unsubscribes users from all channels and disconnects them.
 func (h *connShard) shutdown(ctx context.Context, sem chan struct{}) error {
-	advice := DisconnectShutdown
+	// At this moment node won't accept new client connections, so closing
+	// a snapshot of existing clients is enough.
+	_, err := h.closeAll(ctx, sem, DisconnectShutdown)
+	return err
+}
+
+// closeAll closes all connections of shard currently registered with concurrency
+// limited by sem. Returns number of closed connections.
+func (h *connShard) closeAll(ctx context.Context, sem chan struct{}, disconnect Disconnect) (int, error) {
 	h.mu.RLock()
-	// At this moment node won't accept new client connections, so we can
-	// safely copy existing clients and release lock.
 	clients := make([]*Client, 0, len(h.conns))
 	for _, client := range h.conns {
 		clients = append(clients, client)
@@ -235,19 +380,19 @@ func (h *connShard) shutdown(ctx context.Context, sem chan struct{}) error {
 	finished := 0
 
 	if len(clients) == 0 {
-		return nil
+		return 0, nil
 	}
 
 	for _, client := range clients {
 		select {
 		case sem <- struct{}{}:
 		case <-ctx.Done():
-			return ctx.Err()
+			return finished, ctx.Err()
 		}
 		go func(cc *Client) {
 			defer func() { <-sem }()
 			defer func() { closeFinishedCh <- struct{}{} }()
-			_ = cc.close(advice)
+			_ = cc.close(disconnect)
 		}(client)
 	}
 
@@ -256,10 +401,10 @@ func (h *connShard) shutdown(ctx context.Context, sem chan struct{}) error {
 		case <-closeFinishedCh:
 			finished++
 			if finished == len(clients) {
-				return nil
+				return finished, nil
 			}
 		case <-ctx.Done():
-			return ctx.Err()
+			return finished, ctx.Err()
 		}
 	}
 }
@@ -352,7 +497,7 @@ func (h *connShard) unsubscribe(user string, ch string, unsubscribe Unsubscribe,
 	return nil
 }
 
-func (h *connShard) disconnect(user string, disconnect Disconnect, clientID string, sessionID string, whitelist []string) error {
+func (h *connShard) disconnect(user string, disconnect Disconnect, clientID string, sessionID string, whitelist []string, connectedBefore int64) error {
 	userConnections := h.userConnections(user)
 
 	var firstErr error
@@ -369,6 +514,9 @@ func (h *connShard) disconnect(user string, disconnect Disconnect, clientID stri
 		if sessionID != "" && c.sessionID() != sessionID {
 			continue
 		}
+		if connectedBefore > 0 && c.connectedAtNano() >= connectedBefore {
+			continue
+		}
 		wg.Add(1)
 		go func(cc *Client) {
 			defer wg.Done()
@@ -475,6 +623,9 @@ type subShard struct {
 	// registry to hold active subscriptions of clients to channels.
 	subs   map[string]map[string]*Client
 	logger *logger
+	// numSubs is a total number of subscriptions in shard. Changed under mu
+	// but may be read without it.
+	numSubs int64
 }
 
 func newSubShard(logger *logger) *subShard {
@@ -495,6 +646,9 @@ func (h *subShard) addSub(ch string, c *Client) (bool, error) {
 	if !ok {
 		h.subs[ch] = make(map[string]*Client)
 	}
+	if _, exists := h.subs[ch][uid]; !exists {
+		atomic.AddInt64(&h.numSubs, 1)
+	}
 	h.subs[ch][uid] = c
 	if !ok {
 		return true, nil
@@ -519,6 +673,7 @@ func (h *subShard) removeSub(ch string, c *Client) (bool, error) {
 
 	// actually remove subscription from hub.
 	delete(h.subs[ch], uid)
+	atomic.AddInt64(&h.numSubs, -1)
 
 	// clean up subs map if it's needed.
 	if len(h.subs[ch]) == 0 {
@@ -529,6 +684,36 @@ func (h *subShard) removeSub(ch string, c *Client) (bool, error) {
 	return false, nil
 }
 
+// subscribers returns a snapshot of connections subscribed to channel.
+func (h *subShard) subscribers(ch string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	subscribers := make([]*Client, 0, len(h.subs[ch]))
+	for _, c := range h.subs[ch] {
+		subscribers = append(subscribers, c)
+	}
+	return subscribers
+}
+
+// unsubscribeAll unsubscribes all connections subscribed to channel. Concurrency
+// limited in the same way as on shutdown to prevent resource usage burst for
+// channels with many subscribers.
+func (h *subShard) unsubscribeAll(ch string, unsubscribe Unsubscribe) error {
+	sem := make(chan struct{}, hubShutdownSemaphoreSize)
+	var wg sync.WaitGroup
+	for _, c := range h.subscribers(ch) {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c.Unsubscribe(ch, unsubscribe)
+		}(c)
+	}
+	wg.Wait()
+	return nil
+}
+
 type encodeError struct {
 	client string
 	user   string
@@ -536,7 +721,7 @@ type encodeError struct {
 }
 
 // broadcastPublication sends message to all clients subscribed on channel.
-func (h *subShard) broadcastPublication(channel string, pub *protocol.Publication, sp StreamPosition) error {
+func (h *subShard) broadcastPublication(channel string, pub *protocol.Publication, sp StreamPosition, excludeClient string, filter func(c *Client) bool) error {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
@@ -553,46 +738,65 @@ func (h *subShard) broadcastPublication(channel string, pub *protocol.Publicatio
 		protobufPush []byte
 
 		jsonEncodeErr *encodeError
+		jsonPub       *protocol.Publication
 	)
 
 	for _, c := range channelSubscribers {
+		if excludeClient != "" && c.ID() == excludeClient {
+			c.skipPublication(channel, pub, sp)
+			continue
+		}
+		if filter != nil && !filter(c) {
+			c.node.metrics.incBroadcastFiltered()
+			c.skipPublication(channel, pub, sp)
+			continue
+		}
 		protoType := c.Transport().Protocol().toProto()
 		if protoType == protocol.TypeJSON {
 			if jsonEncodeErr != nil {
 				go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
 				continue
 			}
+			if jsonPub == nil {
+				jsonPub = pubToJSONProto(pub)
+			}
 			if c.transport.Unidirectional() {
 				if jsonPush == nil {
-					push := &protocol.Push{Channel: channel, Pub: pub}
+					push := getPush(channel)
+					push.Pub = jsonPub
 					var err error
 					jsonPush, err = protocol.DefaultJsonPushEncoder.Encode(push)
+					putPush(push)
 					if err != nil {
 						jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 						go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
 						continue
 					}
 				}
-				_ = c.writePublication(channel, pub, jsonPush, sp)
+				_ = c.writePublication(channel, jsonPub, jsonPush, sp)
 			} else {
 				if jsonReply == nil {
-					push := &protocol.Push{Channel: channel, Pub: pub}
+					push := getPush(channel)
+					push.Pub = jsonPub
 					var err error
-					jsonReply, err = protocol.DefaultJsonReplyEncoder.Encode(&protocol.Reply{Push: push})
+					jsonReply, err = encodeReplyPush(protocol.DefaultJsonReplyEncoder, push)
+					putPush(push)
 					if err != nil {
 						jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 						go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
 						continue
 					}
 				}
-				_ = c.writePublication(channel, pub, jsonReply, sp)
+				_ = c.writePublication(channel, jsonPub, jsonReply, sp)
 			}
 		} else if protoType == protocol.TypeProtobuf {
 			if c.transport.Unidirectional() {
 				if protobufPush == nil {
-					push := &protocol.Push{Channel: channel, Pub: pub}
+					push := getPush(channel)
+					push.Pub = pub
 					var err error
 					protobufPush, err = protocol.DefaultProtobufPushEncoder.Encode(push)
+					putPush(push)
 					if err != nil {
 						return err
 					}
@@ -600,9 +804,11 @@ func (h *subShard) broadcastPublication(channel string, pub *protocol.Publicatio
 				_ = c.writePublication(channel, pub, protobufPush, sp)
 			} else {
 				if protobufReply == nil {
-					push := &protocol.Push{Channel: channel, Pub: pub}
+					push := getPush(channel)
+					push.Pub = pub
 					var err error
-					protobufReply, err = protocol.DefaultProtobufReplyEncoder.Encode(&protocol.Reply{Push: push})
+					protobufReply, err = encodeReplyPush(protocol.DefaultProtobufReplyEncoder, push)
+					putPush(push)
 					if err != nil {
 						return err
 					}
@@ -652,9 +858,11 @@ func (h *subShard) broadcastJoin(channel string, join *protocol.Join) error {
 			}
 			if c.transport.Unidirectional() {
 				if jsonPush == nil {
-					push := &protocol.Push{Channel: channel, Join: join}
+					push := getPush(channel)
+					push.Join = join
 					var err error
 					jsonPush, err = protocol.DefaultJsonPushEncoder.Encode(push)
+					putPush(push)
 					if err != nil {
 						jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 						go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
@@ -664,9 +872,11 @@ func (h *subShard) broadcastJoin(channel string, join *protocol.Join) error {
 				_ = c.writeJoin(channel, join, jsonPush)
 			} else {
 				if jsonReply == nil {
-					push := &protocol.Push{Channel: channel, Join: join}
+					push := getPush(channel)
+					push.Join = join
 					var err error
-					jsonReply, err = protocol.DefaultJsonReplyEncoder.Encode(&protocol.Reply{Push: push})
+					jsonReply, err = encodeReplyPush(protocol.DefaultJsonReplyEncoder, push)
+					putPush(push)
 					if err != nil {
 						jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 						go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
@@ -678,9 +888,11 @@ func (h *subShard) broadcastJoin(channel string, join *protocol.Join) error {
 		} else if protoType == protocol.TypeProtobuf {
 			if c.transport.Unidirectional() {
 				if protobufPush == nil {
-					push := &protocol.Push{Channel: channel, Join: join}
+					push := getPush(channel)
+					push.Join = join
 					var err error
 					protobufPush, err = protocol.DefaultProtobufPushEncoder.Encode(push)
+					putPush(push)
 					if err != nil {
 						return err
 					}
@@ -688,9 +900,11 @@ func (h *subShard) broadcastJoin(channel string, join *protocol.Join) error {
 				_ = c.writeJoin(channel, join, protobufPush)
 			} else {
 				if protobufReply == nil {
-					push := &protocol.Push{Channel: channel, Join: join}
+					push := getPush(channel)
+					push.Join = join
 					var err error
-					protobufReply, err = protocol.DefaultProtobufReplyEncoder.Encode(&protocol.Reply{Push: push})
+					protobufReply, err = encodeReplyPush(protocol.DefaultProtobufReplyEncoder, push)
+					putPush(push)
 					if err != nil {
 						return err
 					}
@@ -740,9 +954,11 @@ func (h *subShard) broadcastLeave(channel string, leave *protocol.Leave) error {
 			}
 			if c.transport.Unidirectional() {
 				if jsonPush == nil {
-					push := &protocol.Push{Channel: channel, Leave: leave}
+					push := getPush(channel)
+					push.Leave = leave
 					var err error
 					jsonPush, err = protocol.DefaultJsonPushEncoder.Encode(push)
+					putPush(push)
 					if err != nil {
 						jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 						go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
@@ -752,9 +968,11 @@ func (h *subShard) broadcastLeave(channel string, leave *protocol.Leave) error {
 				_ = c.writeLeave(channel, leave, jsonPush)
 			} else {
 				if jsonReply == nil {
-					push := &protocol.Push{Channel: channel, Leave: leave}
+					push := getPush(channel)
+					push.Leave = leave
 					var err error
-					jsonReply, err = protocol.DefaultJsonReplyEncoder.Encode(&protocol.Reply{Push: push})
+					jsonReply, err = encodeReplyPush(protocol.DefaultJsonReplyEncoder, push)
+					putPush(push)
 					if err != nil {
 						jsonEncodeErr = &encodeError{client: c.ID(), user: c.UserID(), error: err}
 						go func(c *Client) { c.Disconnect(DisconnectInappropriateProtocol) }(c)
@@ -766,9 +984,11 @@ func (h *subShard) broadcastLeave(channel string, leave *protocol.Leave) error {
 		} else if protoType == protocol.TypeProtobuf {
 			if c.transport.Unidirectional() {
 				if protobufPush == nil {
-					push := &protocol.Push{Channel: channel, Leave: leave}
+					push := getPush(channel)
+					push.Leave = leave
 					var err error
 					protobufPush, err = protocol.DefaultProtobufPushEncoder.Encode(push)
+					putPush(push)
 					if err != nil {
 						return err
 					}
@@ -776,9 +996,11 @@ func (h *subShard) broadcastLeave(channel string, leave *protocol.Leave) error {
 				_ = c.writeLeave(channel, leave, protobufPush)
 			} else {
 				if protobufReply == nil {
-					push := &protocol.Push{Channel: channel, Leave: leave}
+					push := getPush(channel)
+					push.Leave = leave
 					var err error
-					protobufReply, err = protocol.DefaultProtobufReplyEncoder.Encode(&protocol.Reply{Push: push})
+					protobufReply, err = encodeReplyPush(protocol.DefaultProtobufReplyEncoder, push)
+					putPush(push)
 					if err != nil {
 						return err
 					}
@@ -808,13 +1030,7 @@ func (h *subShard) NumChannels() int {
 
 // NumSubscriptions returns total number of subscriptions.
 func (h *subShard) NumSubscriptions() int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-	total := 0
-	for _, subscriptions := range h.subs {
-		total += len(subscriptions)
-	}
-	return total
+	return int(atomic.LoadInt64(&h.numSubs))
 }
 
 // Channels returns a slice of all active channels.
@@ -830,6 +1046,20 @@ func (h *subShard) Channels() []string {
 	return channels
 }
 
+func (h *subShard) channelsFiltered(channels map[string]int, match func(string) bool, limit int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch, conns := range h.subs {
+		if limit > 0 && len(channels) >= limit {
+			return
+		}
+		if !match(ch) {
+			continue
+		}
+		channels[ch] = len(conns)
+	}
+}
+
 // NumSubscribers returns number of current subscribers for a given channel.
 func (h *subShard) NumSubscribers(ch string) int {
 	h.mu.RLock()
@@ -7,9 +7,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/centrifugal/protocol"
 	"github.com/stretchr/testify/require"
 )
 
@@ -173,6 +175,27 @@ func TestHub(t *testing.T) {
 	require.Len(t, h.UserConnections("test"), 0)
 }
 
+func TestHubNumSubscriptions(t *testing.T) {
+	h := newHub(nil)
+	c, err := newClient(context.Background(), defaultTestNode(), newTestTransport(func() {}))
+	require.NoError(t, err)
+
+	_, err = h.addSub("test1", c)
+	require.NoError(t, err)
+	// Repeated subscription to the same channel must not be counted.
+	_, err = h.addSub("test1", c)
+	require.NoError(t, err)
+	_, err = h.addSub("test2", c)
+	require.NoError(t, err)
+	require.Equal(t, 2, h.NumSubscriptions())
+
+	_, err = h.removeSub("test1", c)
+	require.NoError(t, err)
+	_, err = h.removeSub("test1", c)
+	require.NoError(t, err)
+	require.Equal(t, 1, h.NumSubscriptions())
+}
+
 func TestHubUnsubscribe(t *testing.T) {
 	n := defaultTestNode()
 	defer func() { _ = n.Shutdown(context.Background()) }()
@@ -205,6 +228,41 @@ LOOP:
 	require.Zero(t, n.hub.NumSubscribers("test_channel"))
 }
 
+func TestHubUnsubscribeAllUsersConcurrency(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	var numActive, maxActive int64
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+		client.OnUnsubscribe(func(e UnsubscribeEvent) {
+			active := atomic.AddInt64(&numActive, 1)
+			for {
+				current := atomic.LoadInt64(&maxActive)
+				if active <= current || atomic.CompareAndSwapInt64(&maxActive, current, active) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&numActive, -1)
+		})
+	})
+
+	numClients := hubShutdownSemaphoreSize + 32
+	for i := 0; i < numClients; i++ {
+		client := newTestClient(t, node, "42")
+		connectClientV2(t, client)
+		subscribeClientV2(t, client, "test")
+	}
+	require.Equal(t, numClients, node.hub.NumSubscribers("test"))
+
+	require.NoError(t, node.hub.unsubscribeAllUsers("test", unsubscribeServer))
+	require.Equal(t, 0, node.hub.NumSubscribers("test"))
+	require.LessOrEqual(t, atomic.LoadInt64(&maxActive), int64(hubShutdownSemaphoreSize))
+}
+
 func TestHubDisconnect(t *testing.T) {
 	n := defaultNodeNoHandlers()
 	defer func() { _ = n.Shutdown(context.Background()) }()
@@ -236,11 +294,11 @@ func TestHubDisconnect(t *testing.T) {
 	}
 
 	// Disconnect not existed user.
-	err := n.hub.disconnect("1", DisconnectForceNoReconnect, "", "", nil)
+	err := n.hub.disconnect("1", DisconnectForceNoReconnect, "", "", nil, 0)
 	require.NoError(t, err)
 
 	// Disconnect subscribed user.
-	err = n.hub.disconnect("42", DisconnectForceNoReconnect, "", "", nil)
+	err = n.hub.disconnect("42", DisconnectForceNoReconnect, "", "", nil, 0)
 	require.NoError(t, err)
 	select {
 	case <-client.transport.(*testTransport).closeCh:
@@ -251,7 +309,7 @@ func TestHubDisconnect(t *testing.T) {
 	require.Equal(t, 0, n.hub.NumSubscribers("test_channel"))
 
 	// Disconnect subscribed user with reconnect.
-	err = n.hub.disconnect("24", DisconnectForceReconnect, "", "", nil)
+	err = n.hub.disconnect("24", DisconnectForceReconnect, "", "", nil, 0)
 	require.NoError(t, err)
 	select {
 	case <-clientWithReconnect.transport.(*testTransport).closeCh:
@@ -299,7 +357,7 @@ func TestHubDisconnect_ClientWhitelist(t *testing.T) {
 	whitelist := []string{clientToKeep.ID()}
 
 	// Disconnect not existed user.
-	err := n.hub.disconnect("12", DisconnectConnectionLimit, "", "", whitelist)
+	err := n.hub.disconnect("12", DisconnectConnectionLimit, "", "", whitelist, 0)
 	require.NoError(t, err)
 
 	select {
@@ -355,7 +413,7 @@ func TestHubOperationsWithClientID(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, n.hub.NumSubscriptions())
 
-	err = n.hub.disconnect("12", DisconnectConnectionLimit, clientToDisconnect, "", nil)
+	err = n.hub.disconnect("12", DisconnectConnectionLimit, clientToDisconnect, "", nil, 0)
 	require.NoError(t, err)
 
 	select {
@@ -421,7 +479,7 @@ func TestHubOperationsWithSessionID(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 0, n.hub.NumSubscriptions())
 
-	err = n.hub.disconnect("12", DisconnectConnectionLimit, "", sessionToDisconnect, nil)
+	err = n.hub.disconnect("12", DisconnectConnectionLimit, "", sessionToDisconnect, nil, 0)
 	require.NoError(t, err)
 
 	select {
@@ -496,6 +554,153 @@ func TestHubBroadcastPublication(t *testing.T) {
 	}
 }
 
+func TestHubBroadcastPublicationContentType(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	newTransport := func(protocolType ProtocolType) *testTransport {
+		transport := newTestTransport(func() {})
+		transport.sink = make(chan []byte, 100)
+		transport.setProtocolType(protocolType)
+		return transport
+	}
+	jsonTransport := newTransport(ProtocolTypeJSON)
+	protobufTransport := newTransport(ProtocolTypeProtobuf)
+	newTestSubscribedClientWithTransport(t, context.Background(), n, jsonTransport, "42", "test_channel")
+	newTestSubscribedClientWithTransport(t, context.Background(), n, protobufTransport, "43", "test_channel")
+
+	binaryData := []byte{0xff, 0x00, 0x01, 0x02}
+	_, err := n.Publish("test_channel", binaryData, WithContentType("application/octet-stream"))
+	require.NoError(t, err)
+
+	waitData := func(transport *testTransport, expected string) string {
+		for {
+			select {
+			case data := <-transport.sink:
+				if strings.Contains(string(data), expected) {
+					return string(data)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no data in sink")
+			}
+		}
+	}
+	data := waitData(jsonTransport, `"data":"/wABAg=="`)
+	require.Contains(t, data, `"content-type":"application/octet-stream"`)
+	waitData(protobufTransport, string(binaryData))
+}
+
+func TestHubBroadcastPublicationFilter(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	n.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EnablePositioning: true}}, nil)
+		})
+	})
+	n.hub.getBroadcastFilter = func(channel string) BroadcastFilterHandler {
+		if channel != "filtered" {
+			return nil
+		}
+		return func(e BroadcastFilterEvent) bool {
+			require.Equal(t, "filtered", e.Channel)
+			require.Equal(t, []byte(`{}`), e.Publication.Data)
+			return e.Subscriber.UserID != "43"
+		}
+	}
+
+	newTransport := func() *testTransport {
+		transport := newTestTransport(func() {})
+		transport.sink = make(chan []byte, 100)
+		return transport
+	}
+	allowedTransport := newTransport()
+	droppedTransport := newTransport()
+	newTestSubscribedClientWithTransport(t, context.Background(), n, allowedTransport, "42", "filtered")
+	droppedClient := newTestSubscribedClientWithTransport(t, context.Background(), n, droppedTransport, "43", "filtered")
+	subscribeClientV2(t, droppedClient, "not_filtered")
+
+	_, err := n.Publish("filtered", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	_, err = n.Publish("not_filtered", []byte(`{}`))
+	require.NoError(t, err)
+
+	// waitPublication skips connect and subscribe replies written to transport.
+	waitPublication := func(transport *testTransport) string {
+		for {
+			select {
+			case data := <-transport.sink:
+				if strings.Contains(string(data), `"pub"`) {
+					return string(data)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("no publication in sink")
+			}
+		}
+	}
+	require.Contains(t, waitPublication(allowedTransport), `"channel":"filtered"`)
+	// Filtered publication skipped, next one from other channel delivered.
+	require.Contains(t, waitPublication(droppedTransport), `"channel":"not_filtered"`)
+	// Position advanced, so skipped publication not considered lost.
+	droppedClient.mu.RLock()
+	require.Equal(t, uint64(1), droppedClient.channels["filtered"].streamPosition.Offset)
+	droppedClient.mu.RUnlock()
+}
+
+func TestHubBroadcastPublicationFilterNoPositioning(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	n.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+	n.hub.getBroadcastFilter = func(channel string) BroadcastFilterHandler {
+		if channel != "filtered" {
+			return nil
+		}
+		return func(e BroadcastFilterEvent) bool {
+			return false
+		}
+	}
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestSubscribedClientWithTransport(t, context.Background(), n, transport, "42", "filtered")
+	subscribeClientV2(t, client, "not_filtered")
+
+	// Publication with offset is dropped by filter for subscriber without positioning.
+	_, err := n.Publish("filtered", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	_, err = n.Publish("not_filtered", []byte(`{}`))
+	require.NoError(t, err)
+
+	for {
+		select {
+		case data := <-transport.sink:
+			require.NotEmpty(t, data, "empty frame written for skipped publication")
+			require.NotContains(t, string(data), `"channel":"filtered"`)
+			if strings.Contains(string(data), `"channel":"not_filtered"`) {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no publication in sink")
+		}
+	}
+}
+
+func TestPubToJSONProto(t *testing.T) {
+	pub := &protocol.Publication{Data: []byte(`{}`)}
+	require.Equal(t, pub, pubToJSONProto(pub))
+	pub = &protocol.Publication{Data: []byte(`{}`), Tags: map[string]string{PublicationTagContentType: ContentTypeJSON}}
+	require.Equal(t, pub, pubToJSONProto(pub))
+	pub = &protocol.Publication{Offset: 1, Data: []byte("test"), Tags: map[string]string{PublicationTagContentType: "text/plain"}}
+	jsonPub := pubToJSONProto(pub)
+	require.Equal(t, protocol.Raw(`"dGVzdA=="`), jsonPub.Data)
+	require.Equal(t, uint64(1), jsonPub.Offset)
+	require.Equal(t, protocol.Raw("test"), pub.Data)
+}
+
 func TestHubBroadcastJoin(t *testing.T) {
 	tcs := []struct {
 		name            string
@@ -667,6 +872,44 @@ func TestUserConnections(t *testing.T) {
 	require.Equal(t, h.connShards[index(c.UserID(), numHubShards)].conns, connections)
 }
 
+func TestHubWalkClients(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	numClients := 10
+	for i := 0; i < numClients; i++ {
+		client := newTestClient(t, n, strconv.Itoa(i))
+		connectClientV2(t, client)
+		subscribeClientV2(t, client, "test")
+	}
+
+	var numVisited int
+	n.hub.WalkClients(func(c *Client) bool {
+		numVisited++
+		return true
+	})
+	require.Equal(t, numClients, numVisited)
+
+	numVisited = 0
+	n.hub.WalkClients(func(c *Client) bool {
+		numVisited++
+		return numVisited < 3
+	})
+	require.Equal(t, 3, numVisited)
+
+	// Disconnecting clients during walk is safe – no Hub locks held in callback.
+	numVisited = 0
+	n.WalkSubscribers("test", func(c *Client) bool {
+		numVisited++
+		c.Disconnect(DisconnectForceNoReconnect)
+		return true
+	})
+	require.Equal(t, numClients, numVisited)
+	require.Eventually(t, func() bool {
+		return n.hub.NumSubscribers("test") == 0 && n.hub.NumClients() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
 func TestHubSharding(t *testing.T) {
 	numUsers := numHubShards * 10
 	numChannels := numHubShards * 10
@@ -813,6 +1056,112 @@ func BenchmarkHub_MassiveBroadcast(b *testing.B) {
 	}
 }
 
+// BenchmarkHub_BroadcastMixedProtocols allows estimating allocations when broadcasting
+// a single message to 10k subscribers which use different protocol types and transport
+// kinds, so every encoding path involved.
+func BenchmarkHub_BroadcastMixedProtocols(b *testing.B) {
+	pub := &Publication{Data: []byte(`{"input": "test"}`)}
+	streamPosition := StreamPosition{}
+	numSubscribers := 10000
+	channel := "broadcast"
+
+	n := defaultTestNodeBenchmark(b)
+	sink := make(chan []byte, 1024)
+	for i := 0; i < numSubscribers; i++ {
+		t := newTestTransport(func() {})
+		t.setSink(sink)
+		if i%2 == 0 {
+			t.setProtocolType(ProtocolTypeProtobuf)
+		}
+		if i%4 < 2 {
+			t.setUnidirectional(true)
+		}
+		c := newTestConnectedClientWithTransport(b, context.Background(), n, t, "12")
+		_ = n.hub.add(c)
+		_, _ = n.hub.addSub(channel, c)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numSubscribers; j++ {
+				<-sink
+			}
+		}()
+		_ = n.hub.BroadcastPublication(channel, pub, streamPosition)
+		wg.Wait()
+	}
+}
+
+// BenchmarkHub_BroadcastBatched allows estimating allocations when several messages
+// broadcasted to 10k subscribers are merged by client writers into one frame.
+func BenchmarkHub_BroadcastBatched(b *testing.B) {
+	pub := &Publication{Data: []byte(`{"input": "test"}`)}
+	streamPosition := StreamPosition{}
+	numSubscribers := 10000
+	numMessages := 4
+	channel := "broadcast"
+
+	n := defaultTestNodeBenchmark(b)
+	n.OnConnecting(func(ctx context.Context, event ConnectEvent) (ConnectReply, error) {
+		return ConnectReply{WriteDelay: 5 * time.Millisecond, MaxMessagesInFrame: -1}, nil
+	})
+	sink := make(chan []byte, 1024)
+	// Connect replies are written to transport when OnConnecting handler is set.
+	connectedCh := make(chan struct{})
+	go func() {
+		for j := 0; j < numSubscribers; j++ {
+			<-sink
+		}
+		close(connectedCh)
+	}()
+	for i := 0; i < numSubscribers; i++ {
+		t := newTestTransport(func() {})
+		t.setSink(sink)
+		// Pings would be merged into frames together with publications.
+		t.setPing(-1, 0)
+		if i%2 == 0 {
+			t.setProtocolType(ProtocolTypeProtobuf)
+		}
+		c := newTestConnectedClientWithTransport(b, context.Background(), n, t, "12")
+		_ = n.hub.add(c)
+		_, _ = n.hub.addSub(channel, c)
+	}
+	<-connectedCh
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numSubscribers*numMessages; j++ {
+				<-sink
+			}
+		}()
+		for j := 0; j < numMessages; j++ {
+			_ = n.hub.BroadcastPublication(channel, pub, streamPosition)
+		}
+		wg.Wait()
+	}
+}
+
+func TestHubBroadcastPooledPush(t *testing.T) {
+	push := getPush("test")
+	push.Pub = &protocol.Publication{Data: []byte(`{}`)}
+	data, err := encodeReplyPush(protocol.DefaultJsonReplyEncoder, push)
+	require.NoError(t, err)
+	putPush(push)
+	require.Contains(t, string(data), `"channel":"test"`)
+	require.Nil(t, push.Pub)
+	require.Equal(t, "", push.Channel)
+}
+
 func TestHubBroadcastInappropriateProtocol_Publication(t *testing.T) {
 	n := defaultNodeNoHandlers()
 	defer func() { _ = n.Shutdown(context.Background()) }()
@@ -0,0 +1,142 @@
+package centrifuge
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultInactiveHistoryRemoveDelay = time.Minute
+
+// inactiveHistoryRemover keeps channels waiting for history removal after their
+// last local subscriber left. See Config.RemoveInactiveChannelHistory.
+type inactiveHistoryRemover struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+func newInactiveHistoryRemover() *inactiveHistoryRemover {
+	return &inactiveHistoryRemover{
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+// add registers channel as pending and returns a channel closed when pending
+// removal canceled. Previous pending removal of the same channel is canceled.
+func (r *inactiveHistoryRemover) add(ch string) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancelCh, ok := r.pending[ch]; ok {
+		close(cancelCh)
+	}
+	cancelCh := make(chan struct{})
+	r.pending[ch] = cancelCh
+	return cancelCh
+}
+
+// cancel cancels pending removal of channel history if any.
+func (r *inactiveHistoryRemover) cancel(ch string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancelCh, ok := r.pending[ch]; ok {
+		close(cancelCh)
+		delete(r.pending, ch)
+	}
+}
+
+// done removes channel from pending if cancelCh is still the current one for it.
+// Returns false if pending removal was canceled.
+func (r *inactiveHistoryRemover) done(ch string, cancelCh chan struct{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending[ch] != cancelCh {
+		return false
+	}
+	delete(r.pending, ch)
+	return true
+}
+
+func (r *inactiveHistoryRemover) numPending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// scheduleInactiveHistoryRemove schedules channel history removal after delay. Stream
+// top captured at this moment is compared with the one at removal time – so history
+// is kept if anything was published to channel meanwhile.
+func (n *Node) scheduleInactiveHistoryRemove(ch string) {
+	cancelCh := n.inactiveHistoryRemover.add(ch)
+	delay := n.config.InactiveChannelHistoryRemoveDelay
+	if delay == 0 {
+		delay = defaultInactiveHistoryRemoveDelay
+	}
+	go func() {
+		top, err := n.streamTop(ch, 0)
+		if err != nil {
+			n.inactiveHistoryRemover.done(ch, cancelCh)
+			n.logger.log(newErrorLogEntry(err, "error getting stream top for inactive channel", map[string]any{"channel": ch}))
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-cancelCh:
+			return
+		case <-n.shutdownCh:
+			return
+		}
+		if !n.inactiveHistoryRemover.done(ch, cancelCh) {
+			return
+		}
+		n.removeInactiveHistory(ch, top)
+	}()
+}
+
+// removeHistoryIfTop removes channel history if stream top is still equal to top.
+// Brokers which do not implement HistoryConditionalRemover can't check it atomically,
+// so publication which happens between check and removal may be lost.
+func (n *Node) removeHistoryIfTop(ch string, top StreamPosition) (bool, error) {
+	if remover, ok := n.broker.(HistoryConditionalRemover); ok {
+		return remover.RemoveHistoryIfTop(ch, top)
+	}
+	currentTop, err := n.streamTop(ch, 0)
+	if err != nil {
+		return false, err
+	}
+	if currentTop != top {
+		return false, nil
+	}
+	return true, n.broker.RemoveHistory(ch)
+}
+
+// removeInactiveHistory removes channel history if channel still has no subscribers
+// in cluster and stream top has not changed since it became inactive.
+func (n *Node) removeInactiveHistory(ch string, top StreamPosition) {
+	mu := n.subLock(ch)
+	mu.Lock()
+	defer mu.Unlock()
+	if n.hub.NumSubscribers(ch) > 0 {
+		return
+	}
+	if checker, ok := n.broker.(ChannelActivityChecker); ok {
+		active, err := checker.ChannelActive(ch)
+		if err != nil {
+			n.logger.log(newErrorLogEntry(err, "error checking inactive channel activity", map[string]any{"channel": ch}))
+			return
+		}
+		if active {
+			return
+		}
+	}
+	removed, err := n.removeHistoryIfTop(ch, top)
+	if err != nil {
+		n.logger.log(newErrorLogEntry(err, "error removing inactive channel history", map[string]any{"channel": ch}))
+		return
+	}
+	if !removed {
+		// Publication happened while channel was inactive – someone still uses it.
+		return
+	}
+	n.logger.logLazy(LogLevelDebug, "inactive channel history removed", func() map[string]any {
+		return map[string]any{"channel": ch}
+	})
+}
@@ -0,0 +1,130 @@
+package centrifuge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newInactiveHistoryTestNode(t *testing.T) *Node {
+	node, err := New(Config{
+		RemoveInactiveChannelHistory: func(channel string) bool {
+			return channel != "keep"
+		},
+		InactiveChannelHistoryRemoveDelay: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+	})
+	require.NoError(t, node.Run())
+	t.Cleanup(func() { _ = node.Shutdown(context.Background()) })
+	return node
+}
+
+func numHistoryPublications(t *testing.T, node *Node, ch string) int {
+	result, err := node.History(ch, WithLimit(NoLimit))
+	require.NoError(t, err)
+	return len(result.Publications)
+}
+
+func TestNode_RemoveInactiveChannelHistory(t *testing.T) {
+	node := newInactiveHistoryTestNode(t)
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	for _, ch := range []string{"test", "keep"} {
+		subscribeClientV2(t, client, ch)
+		_, err := node.Publish(ch, []byte(`{}`), WithHistory(10, time.Minute))
+		require.NoError(t, err)
+		client.Unsubscribe(ch)
+	}
+
+	require.Eventually(t, func() bool {
+		return numHistoryPublications(t, node, "test") == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, numHistoryPublications(t, node, "keep"))
+	require.Equal(t, 0, node.inactiveHistoryRemover.numPending())
+}
+
+func TestNode_RemoveInactiveChannelHistoryResubscribe(t *testing.T) {
+	node := newInactiveHistoryTestNode(t)
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	subscribeClientV2(t, client, "test")
+	_, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	client.Unsubscribe("test")
+	require.Equal(t, 1, node.inactiveHistoryRemover.numPending())
+
+	// Subscription during delay cancels removal.
+	subscribeClientV2(t, client, "test")
+	require.Equal(t, 0, node.inactiveHistoryRemover.numPending())
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, 1, numHistoryPublications(t, node, "test"))
+}
+
+func TestNode_RemoveInactiveChannelHistoryPublishDuringDelay(t *testing.T) {
+	node := newInactiveHistoryTestNode(t)
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+
+	subscribeClientV2(t, client, "test")
+	_, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	client.Unsubscribe("test")
+
+	// Wait for stream top to be captured and then publish – channel is still in use,
+	// so history must be kept.
+	time.Sleep(50 * time.Millisecond)
+	_, err = node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return node.inactiveHistoryRemover.numPending() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 2, numHistoryPublications(t, node, "test"))
+}
+
+// publishOnRemoveBroker publishes into channel right when history removal is issued
+// to emulate publication racing with inactive history cleanup.
+type publishOnRemoveBroker struct {
+	*MemoryBroker
+}
+
+func (b *publishOnRemoveBroker) publish(ch string) {
+	_, _, _ = b.MemoryBroker.Publish(ch, []byte(`{}`), PublishOptions{HistorySize: 10, HistoryTTL: time.Minute})
+}
+
+func (b *publishOnRemoveBroker) RemoveHistory(ch string) error {
+	b.publish(ch)
+	return b.MemoryBroker.RemoveHistory(ch)
+}
+
+func (b *publishOnRemoveBroker) RemoveHistoryIfTop(ch string, top StreamPosition) (bool, error) {
+	b.publish(ch)
+	return b.MemoryBroker.RemoveHistoryIfTop(ch, top)
+}
+
+func TestNode_RemoveInactiveChannelHistoryPublishRace(t *testing.T) {
+	node, err := New(Config{})
+	require.NoError(t, err)
+	memoryBroker, err := NewMemoryBroker(node, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	node.SetBroker(&publishOnRemoveBroker{MemoryBroker: memoryBroker})
+	require.NoError(t, node.Run())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	res, err := node.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	node.removeInactiveHistory("test", res.StreamPosition)
+	// Publication made concurrently with cleanup must not be lost.
+	require.Equal(t, 2, numHistoryPublications(t, node, "test"))
+}
@@ -31,6 +31,14 @@ func TestNodeProtoExtra(t *testing.T) {
 	require.Equal(t, uint32(12), msg.GetUptime())
 	require.NotNil(t, msg.GetMetrics())
 	require.NotZero(t, msg.String())
+
+	msg.ControlVersion = 1
+	require.Equal(t, uint32(1), msg.GetControlVersion())
+	data, err := msg.MarshalVT()
+	require.NoError(t, err)
+	var decoded Node
+	require.NoError(t, decoded.UnmarshalVT(data))
+	require.Equal(t, uint32(1), decoded.GetControlVersion())
 }
 
 func TestDisconnectProtoExtra(t *testing.T) {
@@ -27,6 +27,8 @@ func genEpoch() string {
 type Item struct {
 	Offset uint64
 	Value  any
+	// Key is a compaction key of item, empty for items added with Add.
+	Key string
 }
 
 // Stream is a non-thread safe in-memory data structure that
@@ -36,6 +38,7 @@ type Stream struct {
 	top   uint64
 	list  *list.List
 	index map[uint64]*list.Element
+	keys  map[string]*list.Element
 	epoch string
 }
 
@@ -44,28 +47,51 @@ func New() *Stream {
 	return &Stream{
 		list:  list.New(),
 		index: make(map[uint64]*list.Element),
+		keys:  make(map[string]*list.Element),
 		epoch: genEpoch(),
 	}
 }
 
 // Add item to stream.
 func (s *Stream) Add(v any, size int) (uint64, error) {
+	return s.AddCompacted(v, size, "")
+}
+
+// AddCompacted adds item to stream replacing existing item with the same
+// compaction key, so at most one item per key is kept. New item always gets
+// next offset and goes to the end of stream. Empty key means no compaction.
+func (s *Stream) AddCompacted(v any, size int, key string) (uint64, error) {
+	if key != "" {
+		if el, ok := s.keys[key]; ok {
+			s.remove(el)
+		}
+	}
 	s.top++
 	item := Item{
 		Offset: s.top,
 		Value:  v,
+		Key:    key,
 	}
 	el := s.list.PushBack(item)
 	s.index[item.Offset] = el
+	if key != "" {
+		s.keys[key] = el
+	}
 	for s.list.Len() > size {
-		el := s.list.Front()
-		item := el.Value.(Item)
-		s.list.Remove(el)
-		delete(s.index, item.Offset)
+		s.remove(s.list.Front())
 	}
 	return s.top, nil
 }
 
+func (s *Stream) remove(el *list.Element) {
+	item := el.Value.(Item)
+	s.list.Remove(el)
+	delete(s.index, item.Offset)
+	if item.Key != "" {
+		delete(s.keys, item.Key)
+	}
+}
+
 // Top returns top of stream.
 func (s *Stream) Top() uint64 {
 	return s.top
@@ -87,6 +113,7 @@ func (s *Stream) Reset() {
 func (s *Stream) Clear() {
 	s.list = list.New()
 	s.index = make(map[uint64]*list.Element)
+	s.keys = make(map[string]*list.Element)
 }
 
 // Get items since provided position.
@@ -101,11 +128,7 @@ func (s *Stream) Get(offset uint64, useOffset bool, limit int, reverse bool) ([]
 		var ok bool
 		el, ok = s.index[offset]
 		if !ok {
-			if reverse {
-				el = nil
-			} else {
-				el = s.list.Front()
-			}
+			el = s.nearest(offset, reverse)
 		}
 	} else {
 		if reverse {
@@ -158,3 +181,23 @@ func (s *Stream) Get(offset uint64, useOffset bool, limit int, reverse bool) ([]
 	}
 	return result, s.top, nil
 }
+
+// nearest returns the first element with offset greater than provided one (or the
+// last element with lesser offset in reverse case). Used when element with exact
+// offset was trimmed or compacted.
+func (s *Stream) nearest(offset uint64, reverse bool) *list.Element {
+	if reverse {
+		for e := s.list.Back(); e != nil; e = e.Prev() {
+			if e.Value.(Item).Offset < offset {
+				return e
+			}
+		}
+		return nil
+	}
+	for e := s.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(Item).Offset > offset {
+			return e
+		}
+	}
+	return nil
+}
@@ -24,12 +24,12 @@ func TestStream(t *testing.T) {
 	items, streamTop, err := s.Get(5, true, 3, false)
 	require.NoError(t, err)
 	require.Equal(t, streamTop, uint64(5))
-	require.Equal(t, []Item{{5, []byte("5")}}, items)
+	require.Equal(t, []Item{{Offset: 5, Value: []byte("5")}}, items)
 
 	items, streamTop, err = s.Get(5, true, 2, true)
 	require.NoError(t, err)
 	require.Equal(t, streamTop, uint64(5))
-	require.Equal(t, []Item{{5, []byte("5")}, {4, []byte("4")}}, items)
+	require.Equal(t, []Item{{Offset: 5, Value: []byte("5")}, {Offset: 4, Value: []byte("4")}}, items)
 
 	items, streamTop, err = s.Get(5, true, 0, false)
 	require.NoError(t, err)
@@ -55,7 +55,7 @@ func TestStream(t *testing.T) {
 	items, streamTop, err = s.Get(1, true, 2, false)
 	require.NoError(t, err)
 	require.Equal(t, streamTop, uint64(5))
-	require.Equal(t, []Item{{1, []byte("1")}, {2, []byte("2")}}, items)
+	require.Equal(t, []Item{{Offset: 1, Value: []byte("1")}, {Offset: 2, Value: []byte("2")}}, items)
 
 	_, err = s.Add([]byte("6"), streamSize)
 	require.NoError(t, err)
@@ -63,22 +63,22 @@ func TestStream(t *testing.T) {
 	items, streamTop, err = s.Get(1, true, 2, false)
 	require.NoError(t, err)
 	require.Equal(t, streamTop, uint64(6))
-	require.Equal(t, []Item{{2, []byte("2")}, {3, []byte("3")}}, items)
+	require.Equal(t, []Item{{Offset: 2, Value: []byte("2")}, {Offset: 3, Value: []byte("3")}}, items)
 
 	items, streamTop, err = s.Get(2, true, 2, false)
 	require.NoError(t, err)
 	require.Equal(t, streamTop, uint64(6))
-	require.Equal(t, []Item{{2, []byte("2")}, {3, []byte("3")}}, items)
+	require.Equal(t, []Item{{Offset: 2, Value: []byte("2")}, {Offset: 3, Value: []byte("3")}}, items)
 
 	items, streamTop, err = s.Get(5, true, 2, false)
 	require.NoError(t, err)
 	require.Equal(t, streamTop, uint64(6))
-	require.Equal(t, []Item{{5, []byte("5")}, {6, []byte("6")}}, items)
+	require.Equal(t, []Item{{Offset: 5, Value: []byte("5")}, {Offset: 6, Value: []byte("6")}}, items)
 
 	items, streamTop, err = s.Get(5, true, 2, true)
 	require.NoError(t, err)
 	require.Equal(t, streamTop, uint64(6))
-	require.Equal(t, []Item{{5, []byte("5")}, {4, []byte("4")}}, items)
+	require.Equal(t, []Item{{Offset: 5, Value: []byte("5")}, {Offset: 4, Value: []byte("4")}}, items)
 
 	_, err = s.Add([]byte("7"), streamSize)
 	require.NoError(t, err)
@@ -173,3 +173,50 @@ func TestStreamNoLimitWithMiddle(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, items, 6)
 }
+
+func TestStreamAddCompacted(t *testing.T) {
+	s := New()
+	const streamSize = 10
+	for _, key := range []string{"a", "b", "a", "c", "b"} {
+		_, err := s.AddCompacted(key, streamSize, key)
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(5), s.Top())
+	items, _, err := s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	require.Equal(t, uint64(3), items[0].Offset)
+	require.Equal(t, "a", items[0].Key)
+	require.Equal(t, uint64(4), items[1].Offset)
+	require.Equal(t, uint64(5), items[2].Offset)
+
+	// Offset 1 was compacted, items since offset returned.
+	items, _, err = s.Get(1, true, -1, false)
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	require.Equal(t, uint64(3), items[0].Offset)
+	items, _, err = s.Get(2, true, -1, true)
+	require.NoError(t, err)
+	require.Len(t, items, 0)
+	items, _, err = s.Get(4, true, -1, true)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+}
+
+func TestStreamAddCompactedTrim(t *testing.T) {
+	s := New()
+	_, err := s.AddCompacted("a", 2, "a")
+	require.NoError(t, err)
+	_, err = s.AddCompacted("b", 2, "b")
+	require.NoError(t, err)
+	_, err = s.AddCompacted("c", 2, "c")
+	require.NoError(t, err)
+	// Key a trimmed by size, new item with key a must not remove anything.
+	_, err = s.AddCompacted("a", 2, "a")
+	require.NoError(t, err)
+	items, _, err := s.Get(0, false, -1, false)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "c", items[0].Key)
+	require.Equal(t, "a", items[1].Key)
+}
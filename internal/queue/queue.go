@@ -161,6 +161,17 @@ func (q *Queue) Remove() (Item, bool) {
 	return i, true
 }
 
+// FrontSize returns the size of Item at the front of the queue without
+// removing it. If false is returned there are no items in the queue.
+func (q *Queue) FrontSize() (int, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.cnt == 0 {
+		return 0, false
+	}
+	return len(q.nodes[q.head].Data), true
+}
+
 // Cap returns the capacity (without allocations)
 func (q *Queue) Cap() int {
 	q.mu.RLock()
@@ -43,6 +43,22 @@ func TestByteQueueSize(t *testing.T) {
 	require.Equal(t, 1, q.Size())
 }
 
+func TestByteQueueFrontSize(t *testing.T) {
+	q := New(initialCapacity)
+	_, ok := q.FrontSize()
+	require.False(t, ok)
+	q.Add(testItem([]byte("12")))
+	q.Add(testItem([]byte("345")))
+	size, ok := q.FrontSize()
+	require.True(t, ok)
+	require.Equal(t, 2, size)
+	require.Equal(t, 2, q.Len())
+	q.Remove()
+	size, ok = q.FrontSize()
+	require.True(t, ok)
+	require.Equal(t, 3, size)
+}
+
 func TestByteQueueWait(t *testing.T) {
 	q := New(initialCapacity)
 	q.Add(testItem([]byte("1")))
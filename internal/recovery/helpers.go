@@ -46,3 +46,32 @@ func MergePublications(recoveredPubs []*protocol.Publication, bufferedPubs []*pr
 	}
 	return recoveredPubs, true
 }
+
+// MergeCompactedPublications is like MergePublications but for channels with
+// compacted history where recovered pubs may contain offset gaps left by
+// compaction. Only publications following the last recovered one are checked
+// for gaps.
+func MergeCompactedPublications(recoveredPubs []*protocol.Publication, bufferedPubs []*protocol.Publication) ([]*protocol.Publication, bool) {
+	if len(bufferedPubs) == 0 {
+		return recoveredPubs, true
+	}
+	var lastRecoveredOffset uint64
+	if len(recoveredPubs) > 0 {
+		lastRecoveredOffset = recoveredPubs[len(recoveredPubs)-1].Offset
+	}
+	recoveredPubs = append(recoveredPubs, bufferedPubs...)
+	sort.Slice(recoveredPubs, func(i, j int) bool {
+		return recoveredPubs[i].Offset < recoveredPubs[j].Offset
+	})
+	if len(recoveredPubs) > 1 {
+		recoveredPubs = uniquePublications(recoveredPubs)
+	}
+	prevOffset := recoveredPubs[0].Offset
+	for _, p := range recoveredPubs[1:] {
+		if p.Offset > lastRecoveredOffset && p.Offset != prevOffset+1 {
+			return nil, false
+		}
+		prevOffset = p.Offset
+	}
+	return recoveredPubs, true
+}
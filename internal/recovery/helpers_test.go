@@ -42,3 +42,27 @@ func TestMergePublicationsBuffered(t *testing.T) {
 	require.True(t, ok)
 	require.Len(t, pubs, 3)
 }
+
+func TestMergeCompactedPublications(t *testing.T) {
+	recoveredPubs := []*protocol.Publication{
+		{Offset: 2},
+		{Offset: 5},
+	}
+	bufferedPubs := []*protocol.Publication{
+		{Offset: 5},
+		{Offset: 6},
+	}
+	pubs, ok := MergeCompactedPublications(recoveredPubs, bufferedPubs)
+	require.True(t, ok)
+	require.Len(t, pubs, 3)
+
+	recoveredPubs = []*protocol.Publication{
+		{Offset: 2},
+		{Offset: 5},
+	}
+	bufferedPubs = []*protocol.Publication{
+		{Offset: 7},
+	}
+	_, ok = MergeCompactedPublications(recoveredPubs, bufferedPubs)
+	require.False(t, ok)
+}
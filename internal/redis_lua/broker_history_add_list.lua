@@ -1,6 +1,7 @@
 local list_key = KEYS[1]
 local meta_key = KEYS[2]
 local result_key = KEYS[3]
+local compaction_key = KEYS[4]
 local message_payload = ARGV[1]
 local ltrim_right_bound = ARGV[2]
 local list_ttl = ARGV[3]
@@ -9,6 +10,8 @@ local meta_expire = ARGV[5]
 local new_epoch_if_empty = ARGV[6]
 local publish_command = ARGV[7]
 local result_key_expire = ARGV[8]
+local pubsub_fields = ARGV[9]
+local compaction_field = ARGV[10]
 
 if result_key_expire ~= '' then
     local cached_result = redis.call("hmget", result_key, "e", "s")
@@ -31,12 +34,24 @@ if meta_expire ~= '0' then
 end
 
 local payload = "__" .. "p1:" .. top_offset .. ":" .. current_epoch .. "__" .. message_payload
+if compaction_field ~= '' then
+  local prev_payload = redis.call("hget", compaction_key, compaction_field)
+  if prev_payload ~= false then
+    redis.call("lrem", list_key, 1, prev_payload)
+  end
+end
+
 redis.call("lpush", list_key, payload)
 redis.call("ltrim", list_key, 0, ltrim_right_bound)
 redis.call("expire", list_key, list_ttl)
 
+if compaction_field ~= '' then
+  redis.call("hset", compaction_key, compaction_field, payload)
+  redis.call("expire", compaction_key, list_ttl)
+end
+
 if channel ~= '' then
-  redis.call(publish_command, channel, payload)
+  redis.call(publish_command, channel, payload .. pubsub_fields)
 end
 
 if result_key_expire ~= '' then
@@ -1,6 +1,7 @@
 local stream_key = KEYS[1]
 local meta_key = KEYS[2]
 local result_key = KEYS[3]
+local compaction_key = KEYS[4]
 local message_payload = ARGV[1]
 local stream_size = ARGV[2]
 local stream_ttl = ARGV[3]
@@ -9,6 +10,8 @@ local meta_expire = ARGV[5]
 local new_epoch_if_empty = ARGV[6]
 local publish_command = ARGV[7]
 local result_key_expire = ARGV[8]
+local pubsub_fields = ARGV[9]
+local compaction_field = ARGV[10]
 
 if result_key_expire ~= '' then
     local cached_result = redis.call("hmget", result_key, "e", "s")
@@ -30,11 +33,23 @@ if meta_expire ~= '0' then
   redis.call("expire", meta_key, meta_expire)
 end
 
+if compaction_field ~= '' then
+  local prev_offset = redis.call("hget", compaction_key, compaction_field)
+  if prev_offset ~= false then
+    redis.call("xdel", stream_key, prev_offset)
+  end
+end
+
 redis.call("xadd", stream_key, "MAXLEN", stream_size, top_offset, "d", message_payload)
 redis.call("expire", stream_key, stream_ttl)
 
+if compaction_field ~= '' then
+  redis.call("hset", compaction_key, compaction_field, top_offset)
+  redis.call("expire", compaction_key, stream_ttl)
+end
+
 if channel ~= '' then
-  local payload = "__" .. "p1:" .. top_offset .. ":" .. current_epoch .. "__" .. message_payload
+  local payload = "__" .. "p1:" .. top_offset .. ":" .. current_epoch .. "__" .. message_payload .. pubsub_fields
   redis.call(publish_command, channel, payload)
 end
 
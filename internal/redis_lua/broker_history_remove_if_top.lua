@@ -0,0 +1,19 @@
+local history_key = KEYS[1]
+local meta_key = KEYS[2]
+local compaction_key = KEYS[3]
+local epoch = ARGV[1]
+local top_offset = ARGV[2]
+
+local stream_meta = redis.call("hmget", meta_key, "e", "s")
+local current_epoch, current_offset = stream_meta[1], stream_meta[2]
+
+if current_offset == false then
+  current_offset = "0"
+end
+
+if current_epoch ~= epoch or current_offset ~= top_offset then
+  return 0
+end
+
+redis.call("del", history_key, compaction_key)
+return 1
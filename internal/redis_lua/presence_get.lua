@@ -2,6 +2,7 @@
 -- KEYS[1] - presence set key
 -- KEYS[2] - presence hash key
 -- ARGV[1] - current timestamp in seconds
+-- Returns number of removed expired entries and presence hash contents.
 local expired = redis.call("zrangebyscore", KEYS[1], "0", ARGV[1])
 if #expired > 0 then
   for num = 1, #expired do
@@ -9,4 +10,4 @@ if #expired > 0 then
   end
   redis.call("zremrangebyscore", KEYS[1], "0", ARGV[1])
 end
-return redis.call("hgetall", KEYS[2])
+return {#expired, redis.call("hgetall", KEYS[2])}
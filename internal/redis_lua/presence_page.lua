@@ -0,0 +1,16 @@
+-- Get a page of presence information.
+-- KEYS[1] - presence set key
+-- KEYS[2] - presence hash key
+-- ARGV[1] - current timestamp in seconds
+-- ARGV[2] - scan cursor
+-- ARGV[3] - page size hint
+-- Returns next cursor, page of presence hash contents and number of removed expired entries.
+local expired = redis.call("zrangebyscore", KEYS[1], "0", ARGV[1])
+if #expired > 0 then
+  for num = 1, #expired do
+    redis.call("hdel", KEYS[2], expired[num])
+  end
+  redis.call("zremrangebyscore", KEYS[1], "0", ARGV[1])
+end
+local page = redis.call("hscan", KEYS[2], ARGV[2], "count", ARGV[3])
+return {page[1], page[2], #expired}
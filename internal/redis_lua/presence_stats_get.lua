@@ -4,6 +4,7 @@
 -- KEYS[3] - per-user zset key
 -- KEYS[4] - per-user hash key
 -- ARGV[1] - current timestamp in seconds
+-- Returns number of clients, number of users and number of removed expired client entries.
 local expired = redis.call("zrangebyscore", KEYS[1], "0", ARGV[1])
 if #expired > 0 then
   for num = 1, #expired do
@@ -23,4 +24,4 @@ end
 local clientCount = redis.call("hlen", KEYS[2])
 local userCount = redis.call("hlen", KEYS[4])
 
-return {clientCount, userCount}
+return {clientCount, userCount, #expired}
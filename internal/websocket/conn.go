@@ -271,6 +271,10 @@ type Conn struct {
 	readFinal              bool // true the current message has more frames.
 	enableWriteCompression bool
 	isServer               bool
+	// Payload size written to the network for the last data message and whether
+	// it was compressed. See LastMessageWritten.
+	lastWriteSize       int
+	lastWriteCompressed bool
 }
 
 func newConn(conn net.Conn, isServer bool, readBufferSize, writeBufferSize int, writeBufferPool BufferPool, br *bufio.Reader, writeBuf []byte) *Conn {
@@ -485,6 +489,10 @@ func (c *Conn) beginMessage(mw *messageWriter, messageType int) error {
 	mw.c = c
 	mw.frameType = messageType
 	mw.pos = maxFrameHeaderSize
+	if isData(messageType) {
+		c.lastWriteSize = 0
+		c.lastWriteCompressed = false
+	}
 
 	if c.writeBuf == nil {
 		wpd, ok := c.writePool.Get().(writePoolData)
@@ -559,8 +567,12 @@ func (w *messageWriter) flushFrame(final bool, extra []byte) error {
 	}
 	if w.compress {
 		b0 |= rsv1Bit
+		c.lastWriteCompressed = true
 	}
 	w.compress = false
+	if !isControl(w.frameType) {
+		c.lastWriteSize += length
+	}
 
 	b1 := byte(0)
 	if !c.isServer {
@@ -1159,6 +1171,18 @@ func (c *Conn) EnableWriteCompression(enable bool) {
 	c.enableWriteCompression = enable
 }
 
+// CompressionNegotiated returns whether compression was negotiated with the peer.
+func (c *Conn) CompressionNegotiated() bool {
+	return c.newCompressionWriter != nil
+}
+
+// LastMessageWritten returns payload size in bytes of the last text or binary
+// message written to the network and whether it was compressed. For compressed
+// messages size is the size after compression.
+func (c *Conn) LastMessageWritten() (size int, compressed bool) {
+	return c.lastWriteSize, c.lastWriteCompressed
+}
+
 // SetCompressionLevel sets the flate compression level for subsequent text and
 // binary messages. This function is a noop if compression was not negotiated
 // with the peer. See the compress/flate package for a description of
@@ -0,0 +1,126 @@
+package centrifuge
+
+import (
+	"sync"
+)
+
+// maxReconcileMembersPerChannel bounds memory used to track announced members of
+// one channel. Joins above the limit are not tracked, so such members never get a
+// synthetic Leave.
+const maxReconcileMembersPerChannel = 1000
+
+type announcedMember struct {
+	info *ClientInfo
+	// seenInPresence is true when member was found in channel presence during
+	// reconciliation. Only such members get a synthetic Leave when their presence
+	// disappears – this way members of channels without presence are never
+	// considered gone.
+	seenInPresence bool
+}
+
+// joinLeaveReconciler tracks members announced with Join messages in channels with
+// local subscribers to find members which disappeared from presence without Leave –
+// for example because the node they were connected to died.
+type joinLeaveReconciler struct {
+	mu       sync.Mutex
+	channels map[string]map[string]*announcedMember
+}
+
+func newJoinLeaveReconciler() *joinLeaveReconciler {
+	return &joinLeaveReconciler{
+		channels: make(map[string]map[string]*announcedMember),
+	}
+}
+
+func (r *joinLeaveReconciler) join(ch string, info *ClientInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members, ok := r.channels[ch]
+	if !ok {
+		members = make(map[string]*announcedMember)
+		r.channels[ch] = members
+	}
+	if _, ok := members[info.ClientID]; !ok && len(members) >= maxReconcileMembersPerChannel {
+		return
+	}
+	members[info.ClientID] = &announcedMember{info: info}
+}
+
+func (r *joinLeaveReconciler) leave(ch string, clientID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members, ok := r.channels[ch]
+	if !ok {
+		return
+	}
+	delete(members, clientID)
+	if len(members) == 0 {
+		delete(r.channels, ch)
+	}
+}
+
+func (r *joinLeaveReconciler) removeChannel(ch string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.channels, ch)
+}
+
+func (r *joinLeaveReconciler) channelNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	channels := make([]string, 0, len(r.channels))
+	for ch := range r.channels {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// expired updates channel members with current presence and returns members whose
+// presence expired. Returned members are not tracked anymore.
+func (r *joinLeaveReconciler) expired(ch string, presence map[string]*ClientInfo) []*ClientInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members, ok := r.channels[ch]
+	if !ok {
+		return nil
+	}
+	var expired []*ClientInfo
+	for clientID, member := range members {
+		if _, ok := presence[clientID]; ok {
+			member.seenInPresence = true
+			continue
+		}
+		if member.seenInPresence {
+			expired = append(expired, member.info)
+			delete(members, clientID)
+		}
+	}
+	if len(members) == 0 {
+		delete(r.channels, ch)
+	}
+	return expired
+}
+
+// reconcileJoinLeave sends synthetic Leave messages to local subscribers for members
+// whose presence expired without Leave. Every node reconciles only for its own
+// subscribers and does not publish Leave over Broker, so several nodes subscribed
+// to the same channel never produce duplicate Leave messages.
+func (n *Node) reconcileJoinLeave() {
+	for _, ch := range n.joinLeaveReconciler.channelNames() {
+		if n.hub.NumSubscribers(ch) == 0 {
+			n.joinLeaveReconciler.removeChannel(ch)
+			continue
+		}
+		result, err := n.Presence(ch)
+		if err != nil {
+			n.logger.log(newErrorLogEntry(err, "error getting presence for join/leave reconciliation", map[string]any{"channel": ch}))
+			continue
+		}
+		for _, info := range n.joinLeaveReconciler.expired(ch, result.Presence) {
+			n.logger.logLazy(LogLevelDebug, "sending leave for expired presence", func() map[string]any {
+				return map[string]any{"channel": ch, "client": info.ClientID, "user": info.UserID}
+			})
+			_ = n.hub.broadcastLeave(ch, info)
+		}
+	}
+}
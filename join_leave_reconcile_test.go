@@ -0,0 +1,81 @@
+package centrifuge
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinLeaveReconciler(t *testing.T) {
+	r := newJoinLeaveReconciler()
+	r.join("test", &ClientInfo{ClientID: "1"})
+	r.join("test", &ClientInfo{ClientID: "2"})
+	r.join("test", &ClientInfo{ClientID: "3"})
+	r.leave("test", "3")
+
+	// Member 2 never seen in presence – must not be considered expired.
+	require.Empty(t, r.expired("test", map[string]*ClientInfo{"1": {ClientID: "1"}}))
+	expired := r.expired("test", map[string]*ClientInfo{})
+	require.Len(t, expired, 1)
+	require.Equal(t, "1", expired[0].ClientID)
+	require.Empty(t, r.expired("test", map[string]*ClientInfo{}))
+	require.Equal(t, []string{"test"}, r.channelNames())
+
+	r.removeChannel("test")
+	require.Empty(t, r.channelNames())
+}
+
+func TestJoinLeaveReconcilerMaxMembers(t *testing.T) {
+	r := newJoinLeaveReconciler()
+	for i := 0; i < maxReconcileMembersPerChannel+10; i++ {
+		r.join("test", &ClientInfo{ClientID: string(rune(i))})
+	}
+	require.Len(t, r.channels["test"], maxReconcileMembersPerChannel)
+}
+
+func TestNode_reconcileJoinLeave(t *testing.T) {
+	node, err := New(Config{JoinLeaveReconcileInterval: time.Hour})
+	require.NoError(t, err)
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{PushJoinLeave: true}}, nil)
+		})
+	})
+	require.NoError(t, node.Run())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestClientCustomTransport(t, context.Background(), node, transport, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	// Join from a client connected to another node.
+	info := &ClientInfo{ClientID: "remote", UserID: "43"}
+	require.NoError(t, node.presenceManager.AddPresence("test", info.ClientID, info))
+	require.NoError(t, node.handleJoin("test", info))
+	node.reconcileJoinLeave()
+
+	// Other node died: presence expired, but Leave was never published.
+	require.NoError(t, node.presenceManager.RemovePresence("test", info.ClientID, info.UserID))
+	node.reconcileJoinLeave()
+
+	var numLeaves int
+	timeout := time.After(time.Second)
+loop:
+	for {
+		select {
+		case data := <-transport.sink:
+			if strings.Contains(string(data), `"leave"`) && strings.Contains(string(data), `"remote"`) {
+				numLeaves++
+			}
+		case <-timeout:
+			break loop
+		}
+	}
+	require.Equal(t, 1, numLeaves)
+	require.Empty(t, node.joinLeaveReconciler.channelNames())
+}
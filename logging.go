@@ -1,5 +1,11 @@
 package centrifuge
 
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // LogLevel describes the chosen log level.
 type LogLevel int
 
@@ -45,6 +51,14 @@ type LogEntry struct {
 	Level   LogLevel
 	Message string
 	Fields  map[string]any
+	// Time when entry was logged. Set automatically by Node if not provided.
+	Time time.Time
+	// NodeID is a unique ID of Node which logged entry. Set automatically by
+	// Node if not provided.
+	NodeID string
+	// Error is an optional error which caused log entry. If set then Fields
+	// also contain error text under "error" key.
+	Error error
 }
 
 // newLogEntry helps to create Entry.
@@ -60,6 +74,18 @@ func newLogEntry(level LogLevel, message string, fields ...map[string]any) LogEn
 	}
 }
 
+// newErrorLogEntry creates Entry with LogLevelError for the error. Error text also
+// put to fields under "error" key.
+func newErrorLogEntry(err error, message string, fields ...map[string]any) LogEntry {
+	entry := newLogEntry(LogLevelError, message, fields...)
+	if entry.Fields == nil {
+		entry.Fields = make(map[string]any, 1)
+	}
+	entry.Fields["error"] = err.Error()
+	entry.Error = err
+	return entry
+}
+
 // NewLogEntry creates new LogEntry.
 func NewLogEntry(level LogLevel, message string, fields ...map[string]any) LogEntry {
 	return newLogEntry(level, message, fields...)
@@ -79,18 +105,124 @@ func newLogger(level LogLevel, handler LogHandler) *logger {
 type logger struct {
 	level   LogLevel
 	handler LogHandler
+	nodeID  string
+	sampler *logSampler
 }
 
-// log calls log handler with provided LogEntry.
+// log calls log handler with provided LogEntry. Constructing LogEntry with fields
+// allocates, so on hot paths logs with low levels should use logLazy.
 func (l *logger) log(entry LogEntry) {
 	if l == nil {
 		return
 	}
 	if l.enabled(entry.Level) {
+		if entry.Time.IsZero() {
+			entry.Time = time.Now()
+		}
+		if entry.NodeID == "" {
+			entry.NodeID = l.nodeID
+		}
+		if l.sampler != nil {
+			allowed, suppressed := l.sampler.sample(entry)
+			if !allowed {
+				return
+			}
+			if suppressed > 0 {
+				l.handler(newSuppressedLogEntry(entry.Level, entry.Message, suppressed, entry.Time, entry.NodeID))
+			}
+		}
 		l.handler(entry)
 	}
 }
 
+// logLazy logs entry with fields built by fields func. The func only called if level
+// is enabled – so fields are not allocated for entries filtered out.
+func (l *logger) logLazy(level LogLevel, message string, fields func() map[string]any) {
+	if !l.enabled(level) {
+		return
+	}
+	l.log(newLogEntry(level, message, fields()))
+}
+
+// flushSampled logs counts of entries suppressed by sampler which were not followed
+// by a similar entry after the sampling interval – otherwise counts would be lost
+// when a burst of entries stops.
+func (l *logger) flushSampled(now time.Time) {
+	if l == nil || l.sampler == nil {
+		return
+	}
+	l.sampler.flush(now.UnixNano(), func(key logSampleKey, suppressed int64) {
+		l.handler(newSuppressedLogEntry(key.level, key.message, suppressed, now, l.nodeID))
+	})
+}
+
+func newSuppressedLogEntry(level LogLevel, message string, suppressed int64, t time.Time, nodeID string) LogEntry {
+	return LogEntry{
+		Level:   level,
+		Message: "suppressed similar log entries",
+		Fields:  map[string]any{"message": message, "suppressed": suppressed},
+		Time:    t,
+		NodeID:  nodeID,
+	}
+}
+
+type logSampleKey struct {
+	level   LogLevel
+	message string
+}
+
+type logSampleState struct {
+	windowStart int64
+	suppressed  int64
+}
+
+// logSampler collapses entries with the same level and message logged within
+// an interval.
+type logSampler struct {
+	interval int64
+	states   sync.Map
+}
+
+func newLogSampler(interval time.Duration) *logSampler {
+	return &logSampler{interval: int64(interval)}
+}
+
+// sample returns whether entry should be logged, and if so – the number of similar
+// entries suppressed since the previous logged one.
+func (s *logSampler) sample(entry LogEntry) (bool, int64) {
+	key := logSampleKey{level: entry.Level, message: entry.Message}
+	now := entry.Time.UnixNano()
+	v, ok := s.states.Load(key)
+	if !ok {
+		v, ok = s.states.LoadOrStore(key, &logSampleState{windowStart: now})
+		if !ok {
+			return true, 0
+		}
+	}
+	state := v.(*logSampleState)
+	windowStart := atomic.LoadInt64(&state.windowStart)
+	if now-windowStart < s.interval || !atomic.CompareAndSwapInt64(&state.windowStart, windowStart, now) {
+		atomic.AddInt64(&state.suppressed, 1)
+		return false, 0
+	}
+	return true, atomic.SwapInt64(&state.suppressed, 0)
+}
+
+// flush calls fn for every entry with pending suppressed count which sampling
+// interval already passed, resetting the count.
+func (s *logSampler) flush(now int64, fn func(key logSampleKey, suppressed int64)) {
+	s.states.Range(func(k, v any) bool {
+		state := v.(*logSampleState)
+		if now-atomic.LoadInt64(&state.windowStart) < s.interval {
+			return true
+		}
+		if suppressed := atomic.SwapInt64(&state.suppressed, 0); suppressed > 0 {
+			fn(k.(logSampleKey), suppressed)
+		}
+		return true
+	})
+}
+
 // enabled says whether specified Level enabled or not.
 func (l *logger) enabled(level LogLevel) bool {
 	if l == nil {
@@ -0,0 +1,53 @@
+//go:build go1.21
+
+package centrifuge
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLevelTrace is a slog.Level used for LogLevelTrace entries by NewSlogLogHandler.
+const SlogLevelTrace = slog.LevelDebug - 4
+
+// NewSlogLogHandler creates LogHandler which passes log entries to slog.Logger. Use it
+// together with LogLevel in Config to adapt Centrifuge logs to slog or to any logging
+// library with slog.Handler implementation (zap, zerolog, etc).
+func NewSlogLogHandler(logger *slog.Logger) LogHandler {
+	return func(entry LogEntry) {
+		level := slogLevel(entry.Level)
+		ctx := context.Background()
+		if !logger.Enabled(ctx, level) {
+			return
+		}
+		record := slog.NewRecord(entry.Time, level, entry.Message, 0)
+		if entry.NodeID != "" {
+			record.AddAttrs(slog.String("node", entry.NodeID))
+		}
+		for k, v := range entry.Fields {
+			if k == "error" && entry.Error != nil {
+				continue
+			}
+			record.AddAttrs(slog.Any(k, v))
+		}
+		if entry.Error != nil {
+			record.AddAttrs(slog.Any("error", entry.Error))
+		}
+		_ = logger.Handler().Handle(ctx, record)
+	}
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelTrace:
+		return SlogLevelTrace
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
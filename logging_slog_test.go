@@ -0,0 +1,32 @@
+//go:build go1.21
+
+package centrifuge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSlogLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	l := newLogger(LogLevelTrace, NewSlogLogHandler(logger))
+	l.nodeID = "node1"
+
+	l.log(newLogEntry(LogLevelTrace, "trace"))
+	require.Zero(t, buf.Len())
+
+	l.log(newErrorLogEntry(errors.New("boom"), "test", map[string]any{"client": "42"}))
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	require.Equal(t, "ERROR", record["level"])
+	require.Equal(t, "test", record["msg"])
+	require.Equal(t, "node1", record["node"])
+	require.Equal(t, "42", record["client"])
+	require.Equal(t, "boom", record["error"])
+}
@@ -1,7 +1,9 @@
 package centrifuge
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -43,3 +45,108 @@ func TestNewLogEntry(t *testing.T) {
 	require.NotNil(t, entry.Fields)
 	require.Equal(t, true, entry.Fields["one"].(bool))
 }
+
+func TestNewErrorLogEntry(t *testing.T) {
+	err := errors.New("boom")
+	entry := newErrorLogEntry(err, "test")
+	require.Equal(t, LogLevelError, entry.Level)
+	require.Equal(t, err, entry.Error)
+	require.Equal(t, "boom", entry.Fields["error"])
+
+	entry = newErrorLogEntry(err, "test", map[string]any{"one": true})
+	require.Equal(t, true, entry.Fields["one"].(bool))
+	require.Equal(t, "boom", entry.Fields["error"])
+}
+
+func TestLoggerSetsTimeAndNode(t *testing.T) {
+	var entries []LogEntry
+	l := newLogger(LogLevelDebug, func(entry LogEntry) {
+		entries = append(entries, entry)
+	})
+	l.nodeID = "node1"
+	l.log(newLogEntry(LogLevelInfo, "test"))
+	require.Len(t, entries, 1)
+	require.Equal(t, "node1", entries[0].NodeID)
+	require.False(t, entries[0].Time.IsZero())
+}
+
+func TestLoggerLogLazy(t *testing.T) {
+	var entries []LogEntry
+	l := newLogger(LogLevelInfo, func(entry LogEntry) {
+		entries = append(entries, entry)
+	})
+	var numCalls int
+	fields := func() map[string]any {
+		numCalls++
+		return map[string]any{"key": "value"}
+	}
+	l.logLazy(LogLevelDebug, "test", fields)
+	require.Equal(t, 0, numCalls)
+	require.Len(t, entries, 0)
+
+	l.logLazy(LogLevelInfo, "test", fields)
+	require.Equal(t, 1, numCalls)
+	require.Len(t, entries, 1)
+	require.Equal(t, "value", entries[0].Fields["key"])
+
+	var nilLogger *logger
+	nilLogger.logLazy(LogLevelError, "test", fields)
+	require.Equal(t, 1, numCalls)
+}
+
+func TestLoggerSampling(t *testing.T) {
+	var entries []LogEntry
+	l := newLogger(LogLevelDebug, func(entry LogEntry) {
+		entries = append(entries, entry)
+	})
+	l.sampler = newLogSampler(time.Minute)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		l.log(LogEntry{Level: LogLevelError, Message: "test", Time: start})
+	}
+	l.log(LogEntry{Level: LogLevelError, Message: "other", Time: start})
+	l.log(LogEntry{Level: LogLevelInfo, Message: "test", Time: start})
+	require.Len(t, entries, 3)
+
+	l.log(LogEntry{Level: LogLevelError, Message: "test", Time: start.Add(time.Minute)})
+	require.Len(t, entries, 5)
+	require.Equal(t, "suppressed similar log entries", entries[3].Message)
+	require.Equal(t, "test", entries[3].Fields["message"])
+	require.Equal(t, int64(9), entries[3].Fields["suppressed"])
+	require.Equal(t, "test", entries[4].Message)
+}
+
+func TestLoggerSamplingFlush(t *testing.T) {
+	var entries []LogEntry
+	l := newLogger(LogLevelDebug, func(entry LogEntry) {
+		entries = append(entries, entry)
+	})
+	l.nodeID = "node1"
+	l.sampler = newLogSampler(time.Minute)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		l.log(LogEntry{Level: LogLevelError, Message: "test", Time: start})
+	}
+	require.Len(t, entries, 1)
+
+	// Interval not passed yet – nothing flushed.
+	l.flushSampled(start.Add(time.Second))
+	require.Len(t, entries, 1)
+
+	// Burst stopped – suppressed count logged on flush.
+	l.flushSampled(start.Add(time.Minute))
+	require.Len(t, entries, 2)
+	require.Equal(t, "suppressed similar log entries", entries[1].Message)
+	require.Equal(t, LogLevelError, entries[1].Level)
+	require.Equal(t, "node1", entries[1].NodeID)
+	require.Equal(t, "test", entries[1].Fields["message"])
+	require.Equal(t, int64(4), entries[1].Fields["suppressed"])
+
+	// Count is not reported twice.
+	l.flushSampled(start.Add(2 * time.Minute))
+	l.log(LogEntry{Level: LogLevelError, Message: "test", Time: start.Add(2 * time.Minute)})
+	require.Len(t, entries, 3)
+	require.Equal(t, "test", entries[2].Message)
+}
@@ -16,6 +16,8 @@ var defaultMetricsNamespace = "centrifuge"
 
 var registryMu sync.RWMutex
 
+// metrics wraps Prometheus collectors used by Node. Nil *metrics is valid and makes
+// all methods no-op, it's used when Config.DisableMetrics is on.
 type metrics struct {
 	messagesSentCount             *prometheus.CounterVec
 	messagesReceivedCount         *prometheus.CounterVec
@@ -25,6 +27,7 @@ type metrics struct {
 	numUsersGauge                 prometheus.Gauge
 	numSubsGauge                  prometheus.Gauge
 	numChannelsGauge              prometheus.Gauge
+	numChannelsByNamespaceGauge   *prometheus.GaugeVec
 	numNodesGauge                 prometheus.Gauge
 	replyErrorCount               *prometheus.CounterVec
 	serverDisconnectCount         *prometheus.CounterVec
@@ -36,6 +39,28 @@ type metrics struct {
 	transportMessagesSentSize     *prometheus.CounterVec
 	transportMessagesReceived     *prometheus.CounterVec
 	transportMessagesReceivedSize *prometheus.CounterVec
+	transportCompressionCount     *prometheus.CounterVec
+	transportBytesOut             *prometheus.CounterVec
+	presenceExpiredCount          prometheus.Counter
+	presenceUpdateBatchDuration   prometheus.Summary
+	commandMiddlewareDuration     prometheus.Summary
+	controlUnknownCount           prometheus.Counter
+	controlIncompatibleCount      prometheus.Counter
+	broadcastFilteredCount        prometheus.Counter
+	clientEventsDroppedCount      prometheus.Counter
+	controlErrorCount             *prometheus.CounterVec
+	numSubscribersCacheCount      *prometheus.CounterVec
+	brokerPubSubQueueFullCount    prometheus.Counter
+	redisPubSubQueueLenGauge      *prometheus.GaugeVec
+	brokerPubSubLatency           *prometheus.HistogramVec
+	redisShardHealthyGauge        *prometheus.GaugeVec
+	clientLimitExceededCount      *prometheus.CounterVec
+	nodeConnectionLimitCount      *prometheus.CounterVec
+	brokerSubsReconciledCount     *prometheus.CounterVec
+	transportWriteErrorCount      *prometheus.CounterVec
+	transportPubEnqueuedCount     *prometheus.CounterVec
+	transportPubDroppedCount      *prometheus.CounterVec
+	handlerPanicCount             *prometheus.CounterVec
 
 	messagesReceivedCountPublication prometheus.Counter
 	messagesReceivedCountJoin        prometheus.Counter
@@ -55,10 +80,14 @@ type metrics struct {
 	actionCountRemovePresence   prometheus.Counter
 	actionCountPresence         prometheus.Counter
 	actionCountPresenceStats    prometheus.Counter
+	actionCountPresenceClean    prometheus.Counter
+	actionCountPresencePage     prometheus.Counter
 	actionCountHistory          prometheus.Counter
 	actionCountHistoryRecover   prometheus.Counter
 	actionCountHistoryStreamTop prometheus.Counter
 	actionCountHistoryRemove    prometheus.Counter
+	actionCountHistoryReset     prometheus.Counter
+	actionCountChannelActive    prometheus.Counter
 	actionCountSurvey           prometheus.Counter
 	actionCountNotify           prometheus.Counter
 
@@ -69,6 +98,28 @@ type metrics struct {
 	transportConnectCountSSE        prometheus.Counter
 	transportConnectCountHTTPStream prometheus.Counter
 
+	transportPubEnqueuedCountWebsocket  prometheus.Counter
+	transportPubEnqueuedCountSSE        prometheus.Counter
+	transportPubEnqueuedCountHTTPStream prometheus.Counter
+
+	transportCompressionCountYes prometheus.Counter
+	transportCompressionCountNo  prometheus.Counter
+
+	transportBytesOutWebsocketCompressed   prometheus.Counter
+	transportBytesOutWebsocketUncompressed prometheus.Counter
+
+	controlErrorCountEncode prometheus.Counter
+	controlErrorCountDecode prometheus.Counter
+
+	numSubscribersCacheCountHit  prometheus.Counter
+	numSubscribersCacheCountMiss prometheus.Counter
+
+	clientLimitExceededCountMessageSize      prometheus.Counter
+	clientLimitExceededCountCommandsPerFrame prometheus.Counter
+
+	nodeConnectionLimitCountSoft prometheus.Counter
+	nodeConnectionLimitCountHard prometheus.Counter
+
 	commandDurationConnect       prometheus.Observer
 	commandDurationSubscribe     prometheus.Observer
 	commandDurationUnsubscribe   prometheus.Observer
@@ -84,6 +135,9 @@ type metrics struct {
 }
 
 func (m *metrics) observeCommandDuration(frameType protocol.FrameType, d time.Duration) {
+	if m == nil {
+		return
+	}
 	var observer prometheus.Observer
 
 	switch frameType {
@@ -116,34 +170,229 @@ func (m *metrics) observeCommandDuration(frameType protocol.FrameType, d time.Du
 }
 
 func (m *metrics) setBuildInfo(version string) {
+	if m == nil {
+		return
+	}
 	m.buildInfoGauge.WithLabelValues(version).Set(1)
 }
 
 func (m *metrics) setNumClients(n float64) {
+	if m == nil {
+		return
+	}
 	m.numClientsGauge.Set(n)
 }
 
 func (m *metrics) setNumUsers(n float64) {
+	if m == nil {
+		return
+	}
 	m.numUsersGauge.Set(n)
 }
 
 func (m *metrics) setNumSubscriptions(n float64) {
+	if m == nil {
+		return
+	}
 	m.numSubsGauge.Set(n)
 }
 
 func (m *metrics) setNumChannels(n float64) {
+	if m == nil {
+		return
+	}
 	m.numChannelsGauge.Set(n)
 }
 
+func (m *metrics) setNumChannelsByNamespace(counts map[string]int) {
+	if m == nil {
+		return
+	}
+	// Reset to drop namespaces without channels.
+	m.numChannelsByNamespaceGauge.Reset()
+	for namespace, n := range counts {
+		m.numChannelsByNamespaceGauge.WithLabelValues(namespace).Set(float64(n))
+	}
+}
+
 func (m *metrics) setNumNodes(n float64) {
+	if m == nil {
+		return
+	}
 	m.numNodesGauge.Set(n)
 }
 
 func (m *metrics) incReplyError(frameType protocol.FrameType, code uint32) {
+	if m == nil {
+		return
+	}
 	m.replyErrorCount.WithLabelValues(frameType.String(), strconv.FormatUint(uint64(code), 10)).Inc()
 }
 
+func (m *metrics) incPresenceExpired(n int) {
+	if m == nil {
+		return
+	}
+	m.presenceExpiredCount.Add(float64(n))
+}
+
+func (m *metrics) observePresenceUpdateBatchDuration(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.presenceUpdateBatchDuration.Observe(d.Seconds())
+}
+
+func (m *metrics) observeCommandMiddlewareDuration(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.commandMiddlewareDuration.Observe(d.Seconds())
+}
+
+func (m *metrics) incControlUnknown() {
+	if m == nil {
+		return
+	}
+	m.controlUnknownCount.Inc()
+}
+
+func (m *metrics) incControlIncompatible() {
+	if m == nil {
+		return
+	}
+	m.controlIncompatibleCount.Inc()
+}
+
+func (m *metrics) incBroadcastFiltered() {
+	if m == nil {
+		return
+	}
+	m.broadcastFilteredCount.Inc()
+}
+
+func (m *metrics) incClientEventDropped() {
+	if m == nil {
+		return
+	}
+	m.clientEventsDroppedCount.Inc()
+}
+
+func (m *metrics) incControlError(encode bool) {
+	if m == nil {
+		return
+	}
+	if encode {
+		m.controlErrorCountEncode.Inc()
+	} else {
+		m.controlErrorCountDecode.Inc()
+	}
+}
+
+func (m *metrics) incNumSubscribersCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.numSubscribersCacheCountHit.Inc()
+	} else {
+		m.numSubscribersCacheCountMiss.Inc()
+	}
+}
+
+func (m *metrics) observePubSubLatency(broker string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.brokerPubSubLatency.WithLabelValues(broker).Observe(d.Seconds())
+}
+
+func (m *metrics) incBrokerPubSubQueueFull() {
+	if m == nil {
+		return
+	}
+	m.brokerPubSubQueueFullCount.Inc()
+}
+
+func (m *metrics) setRedisPubSubQueueLen(shard string, n float64) {
+	if m == nil {
+		return
+	}
+	m.redisPubSubQueueLenGauge.WithLabelValues(shard).Set(n)
+}
+
+func (m *metrics) setRedisShardHealthy(shard string, healthy bool) {
+	if m == nil {
+		return
+	}
+	var value float64
+	if healthy {
+		value = 1
+	}
+	m.redisShardHealthyGauge.WithLabelValues(shard).Set(value)
+}
+
+const (
+	clientLimitMessageSize      = "message_size"
+	clientLimitCommandsPerFrame = "commands_per_frame"
+)
+
+func (m *metrics) incTransportWriteError(transport string, decision TransportWriteErrorDecision) {
+	if m == nil {
+		return
+	}
+	var label string
+	switch decision {
+	case TransportWriteErrorDrop:
+		label = "drop"
+	case TransportWriteErrorRetry:
+		label = "retry"
+	default:
+		label = "disconnect"
+	}
+	m.transportWriteErrorCount.WithLabelValues(transport, label).Inc()
+}
+
+func (m *metrics) incClientLimitExceeded(limit string) {
+	if m == nil {
+		return
+	}
+	switch limit {
+	case clientLimitMessageSize:
+		m.clientLimitExceededCountMessageSize.Inc()
+	case clientLimitCommandsPerFrame:
+		m.clientLimitExceededCountCommandsPerFrame.Inc()
+	}
+}
+
+const (
+	nodeConnectionLimitSoft = "soft"
+	nodeConnectionLimitHard = "hard"
+)
+
+func (m *metrics) incNodeConnectionLimit(limit string) {
+	if m == nil {
+		return
+	}
+	switch limit {
+	case nodeConnectionLimitSoft:
+		m.nodeConnectionLimitCountSoft.Inc()
+	case nodeConnectionLimitHard:
+		m.nodeConnectionLimitCountHard.Inc()
+	}
+}
+
+func (m *metrics) incBrokerSubscriptionReconciled(op string) {
+	if m == nil {
+		return
+	}
+	m.brokerSubsReconciledCount.WithLabelValues(op).Inc()
+}
+
 func (m *metrics) incRecover(success bool) {
+	if m == nil {
+		return
+	}
 	if success {
 		m.recoverCountYes.Inc()
 	} else {
@@ -152,6 +401,9 @@ func (m *metrics) incRecover(success bool) {
 }
 
 func (m *metrics) incTransportConnect(transport string) {
+	if m == nil {
+		return
+	}
 	switch transport {
 	case transportWebsocket:
 		m.transportConnectCountWebsocket.Inc()
@@ -164,6 +416,63 @@ func (m *metrics) incTransportConnect(transport string) {
 	}
 }
 
+const (
+	pubDropReasonSlow   = "slow"
+	pubDropReasonClosed = "closed"
+)
+
+func (m *metrics) incTransportPubEnqueued(transport string) {
+	if m == nil {
+		return
+	}
+	switch transport {
+	case transportWebsocket:
+		m.transportPubEnqueuedCountWebsocket.Inc()
+	case transportSSE:
+		m.transportPubEnqueuedCountSSE.Inc()
+	case transportHTTPStream:
+		m.transportPubEnqueuedCountHTTPStream.Inc()
+	default:
+		m.transportPubEnqueuedCount.WithLabelValues(transport).Inc()
+	}
+}
+
+func (m *metrics) incTransportPubDropped(transport string, reason string) {
+	if m == nil {
+		return
+	}
+	m.transportPubDroppedCount.WithLabelValues(transport, reason).Inc()
+}
+
+func (m *metrics) incHandlerPanic(frameType protocol.FrameType) {
+	if m == nil {
+		return
+	}
+	m.handlerPanicCount.WithLabelValues(frameType.String()).Inc()
+}
+
+func (m *metrics) incTransportCompression(compressed bool) {
+	if m == nil {
+		return
+	}
+	if compressed {
+		m.transportCompressionCountYes.Inc()
+	} else {
+		m.transportCompressionCountNo.Inc()
+	}
+}
+
+func (m *metrics) addWebsocketBytesOut(size int, compressed bool) {
+	if m == nil {
+		return
+	}
+	if compressed {
+		m.transportBytesOutWebsocketCompressed.Add(float64(size))
+	} else {
+		m.transportBytesOutWebsocketUncompressed.Add(float64(size))
+	}
+}
+
 type transportMessageLabels struct {
 	Transport    string
 	ChannelGroup string
@@ -186,6 +495,9 @@ var (
 )
 
 func (m *metrics) incTransportMessagesSent(transport string, frameType protocol.FrameType, channelGroup string, size int) {
+	if m == nil {
+		return
+	}
 	labels := transportMessageLabels{
 		Transport:    transport,
 		ChannelGroup: channelGroup,
@@ -206,6 +518,9 @@ func (m *metrics) incTransportMessagesSent(transport string, frameType protocol.
 }
 
 func (m *metrics) incTransportMessagesReceived(transport string, frameType protocol.FrameType, channelGroup string, size int) {
+	if m == nil {
+		return
+	}
 	labels := transportMessageLabels{
 		Transport:    transport,
 		ChannelGroup: channelGroup,
@@ -226,10 +541,16 @@ func (m *metrics) incTransportMessagesReceived(transport string, frameType proto
 }
 
 func (m *metrics) incServerDisconnect(code uint32) {
+	if m == nil {
+		return
+	}
 	m.serverDisconnectCount.WithLabelValues(strconv.FormatUint(uint64(code), 10)).Inc()
 }
 
 func (m *metrics) incMessagesSent(msgType string) {
+	if m == nil {
+		return
+	}
 	switch msgType {
 	case "publication":
 		m.messagesSentCountPublication.Inc()
@@ -245,6 +566,9 @@ func (m *metrics) incMessagesSent(msgType string) {
 }
 
 func (m *metrics) incMessagesReceived(msgType string) {
+	if m == nil {
+		return
+	}
 	switch msgType {
 	case "publication":
 		m.messagesReceivedCountPublication.Inc()
@@ -260,6 +584,9 @@ func (m *metrics) incMessagesReceived(msgType string) {
 }
 
 func (m *metrics) incActionCount(action string) {
+	if m == nil {
+		return
+	}
 	switch action {
 	case "add_client":
 		m.actionCountAddClient.Inc()
@@ -277,6 +604,10 @@ func (m *metrics) incActionCount(action string) {
 		m.actionCountPresence.Inc()
 	case "presence_stats":
 		m.actionCountPresenceStats.Inc()
+	case "presence_clean":
+		m.actionCountPresenceClean.Inc()
+	case "presence_page":
+		m.actionCountPresencePage.Inc()
 	case "history":
 		m.actionCountHistory.Inc()
 	case "history_recover":
@@ -285,6 +616,10 @@ func (m *metrics) incActionCount(action string) {
 		m.actionCountHistoryStreamTop.Inc()
 	case "history_remove":
 		m.actionCountHistoryRemove.Inc()
+	case "history_reset":
+		m.actionCountHistoryReset.Inc()
+	case "channel_active":
+		m.actionCountChannelActive.Inc()
 	case "survey":
 		m.actionCountSurvey.Inc()
 	case "notify":
@@ -293,6 +628,9 @@ func (m *metrics) incActionCount(action string) {
 }
 
 func (m *metrics) observeSurveyDuration(op string, d time.Duration) {
+	if m == nil {
+		return
+	}
 	m.surveyDurationSummary.WithLabelValues(op).Observe(d.Seconds())
 }
 
@@ -372,6 +710,71 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 		Help:      "Number of channels with one or more subscribers.",
 	})
 
+	m.numChannelsByNamespaceGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "num_channels_by_namespace",
+		Help:      "Number of channels with one or more subscribers by channel namespace.",
+	}, []string{"channel_namespace"})
+
+	m.presenceExpiredCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "presence_expired_count",
+		Help:      "Number of expired presence entries removed.",
+	})
+
+	m.presenceUpdateBatchDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:  metricsNamespace,
+		Subsystem:  "node",
+		Name:       "presence_update_batch_duration_seconds",
+		Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001, 0.999: 0.0001},
+		Help:       "Duration of updating presence for a batch of connected clients.",
+	})
+
+	m.commandMiddlewareDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:  metricsNamespace,
+		Subsystem:  "client",
+		Name:       "command_middleware_duration_seconds",
+		Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001, 0.999: 0.0001},
+		Help:       "Time spent in command middlewares excluding built-in command processing.",
+	})
+
+	m.controlUnknownCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "control_unknown_count",
+		Help:      "Number of unknown control commands received from other nodes.",
+	})
+
+	m.controlIncompatibleCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "control_incompatible_count",
+		Help:      "Number of control commands received from nodes with incompatible control protocol version.",
+	})
+
+	m.broadcastFilteredCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "broadcast_filtered_count",
+		Help:      "Number of publication deliveries to subscribers dropped by broadcast filter.",
+	})
+
+	m.clientEventsDroppedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "client_events_dropped_count",
+		Help:      "Number of client events dropped since ClientEventHandler did not keep up.",
+	})
+
+	m.controlErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "control_error_count",
+		Help:      "Number of control command encode and decode errors.",
+	}, []string{"op"})
+
 	m.surveyDurationSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Namespace:  metricsNamespace,
 		Subsystem:  "node",
@@ -444,6 +847,105 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 		Help:      "Size in bytes of messages received from client connections over specific transport.",
 	}, []string{"transport", "frame_type", "channel_namespace"})
 
+	m.transportCompressionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "transport",
+		Name:      "compression_count",
+		Help:      "Number of frames written to connections with negotiated compression, by whether compression was applied.",
+	}, []string{"compressed"})
+
+	m.transportBytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "transport",
+		Name:      "bytes_out",
+		Help:      "Number of payload bytes written to connections over specific transport, by whether compression was applied.",
+	}, []string{"transport", "compressed"})
+
+	m.numSubscribersCacheCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "num_subscribers_cache_count",
+		Help:      "Number of cluster subscriber count requests by cache result.",
+	}, []string{"result"})
+
+	m.brokerPubSubQueueFullCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "broker",
+		Name:      "pub_sub_queue_full_count",
+		Help:      "Number of times message from broker PUB/SUB waited for a full processor queue.",
+	})
+
+	m.redisPubSubQueueLenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "broker",
+		Name:      "redis_pub_sub_queue_len",
+		Help:      "Number of Redis PUB/SUB messages waiting in processor queues of shard.",
+	}, []string{"shard"})
+
+	m.brokerPubSubLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "broker",
+		Name:      "pub_sub_latency_seconds",
+		Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		Help:      "Time from publish till publication received from broker PUB/SUB. Affected by clock skew between nodes.",
+	}, []string{"broker"})
+
+	m.redisShardHealthyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "broker",
+		Name:      "redis_shard_healthy",
+		Help:      "Redis shard health: 0 when publish circuit breaker is open, 1 otherwise.",
+	}, []string{"shard"})
+
+	m.clientLimitExceededCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "limit_exceeded_count",
+		Help:      "Number of client disconnects caused by exceeding incoming data limits.",
+	}, []string{"limit"})
+
+	m.nodeConnectionLimitCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "connection_limit_count",
+		Help:      "Number of client connection attempts above node connection soft or hard limit.",
+	}, []string{"limit"})
+
+	m.brokerSubsReconciledCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "broker_subscriptions_reconciled_count",
+		Help:      "Number of corrective broker subscribe/unsubscribe calls made during subscription reconciliation.",
+	}, []string{"op"})
+
+	m.transportWriteErrorCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "transport",
+		Name:      "write_error_count",
+		Help:      "Number of transport write errors by decision taken.",
+	}, []string{"transport", "decision"})
+
+	m.transportPubEnqueuedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "transport",
+		Name:      "publications_enqueued_count",
+		Help:      "Number of publications put into client connection write queues.",
+	}, []string{"transport"})
+
+	m.transportPubDroppedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "transport",
+		Name:      "publications_dropped_count",
+		Help:      "Number of publications dropped instead of being written to client connection.",
+	}, []string{"transport", "reason"})
+
+	m.handlerPanicCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "node",
+		Name:      "handler_panics_count",
+		Help:      "Number of panics recovered in event handlers by handler type.",
+	}, []string{"handler"})
+
 	m.messagesReceivedCountPublication = m.messagesReceivedCount.WithLabelValues("publication")
 	m.messagesReceivedCountJoin = m.messagesReceivedCount.WithLabelValues("join")
 	m.messagesReceivedCountLeave = m.messagesReceivedCount.WithLabelValues("leave")
@@ -462,10 +964,14 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 	m.actionCountRemovePresence = m.actionCount.WithLabelValues("remove_presence")
 	m.actionCountPresence = m.actionCount.WithLabelValues("presence")
 	m.actionCountPresenceStats = m.actionCount.WithLabelValues("presence_stats")
+	m.actionCountPresenceClean = m.actionCount.WithLabelValues("presence_clean")
+	m.actionCountPresencePage = m.actionCount.WithLabelValues("presence_page")
 	m.actionCountHistory = m.actionCount.WithLabelValues("history")
 	m.actionCountHistoryRecover = m.actionCount.WithLabelValues("history_recover")
 	m.actionCountHistoryStreamTop = m.actionCount.WithLabelValues("history_stream_top")
 	m.actionCountHistoryRemove = m.actionCount.WithLabelValues("history_remove")
+	m.actionCountHistoryReset = m.actionCount.WithLabelValues("history_reset")
+	m.actionCountChannelActive = m.actionCount.WithLabelValues("channel_active")
 	m.actionCountSurvey = m.actionCount.WithLabelValues("survey")
 	m.actionCountNotify = m.actionCount.WithLabelValues("notify")
 
@@ -476,6 +982,27 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 	m.transportConnectCountHTTPStream = m.transportConnectCount.WithLabelValues(transportHTTPStream)
 	m.transportConnectCountSSE = m.transportConnectCount.WithLabelValues(transportSSE)
 
+	m.transportPubEnqueuedCountWebsocket = m.transportPubEnqueuedCount.WithLabelValues(transportWebsocket)
+	m.transportPubEnqueuedCountHTTPStream = m.transportPubEnqueuedCount.WithLabelValues(transportHTTPStream)
+	m.transportPubEnqueuedCountSSE = m.transportPubEnqueuedCount.WithLabelValues(transportSSE)
+
+	m.transportCompressionCountYes = m.transportCompressionCount.WithLabelValues("yes")
+	m.transportCompressionCountNo = m.transportCompressionCount.WithLabelValues("no")
+
+	m.transportBytesOutWebsocketCompressed = m.transportBytesOut.WithLabelValues(transportWebsocket, "yes")
+	m.transportBytesOutWebsocketUncompressed = m.transportBytesOut.WithLabelValues(transportWebsocket, "no")
+
+	m.controlErrorCountEncode = m.controlErrorCount.WithLabelValues("encode")
+	m.controlErrorCountDecode = m.controlErrorCount.WithLabelValues("decode")
+
+	m.numSubscribersCacheCountHit = m.numSubscribersCacheCount.WithLabelValues("hit")
+	m.numSubscribersCacheCountMiss = m.numSubscribersCacheCount.WithLabelValues("miss")
+
+	m.clientLimitExceededCountMessageSize = m.clientLimitExceededCount.WithLabelValues(clientLimitMessageSize)
+	m.clientLimitExceededCountCommandsPerFrame = m.clientLimitExceededCount.WithLabelValues(clientLimitCommandsPerFrame)
+	m.nodeConnectionLimitCountSoft = m.nodeConnectionLimitCount.WithLabelValues(nodeConnectionLimitSoft)
+	m.nodeConnectionLimitCountHard = m.nodeConnectionLimitCount.WithLabelValues(nodeConnectionLimitHard)
+
 	labelForMethod := func(frameType protocol.FrameType) string {
 		return frameType.String()
 	}
@@ -516,6 +1043,9 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 	if err := registry.Register(m.numChannelsGauge); err != nil && !errors.As(err, &alreadyRegistered) {
 		return nil, err
 	}
+	if err := registry.Register(m.numChannelsByNamespaceGauge); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
 	if err := registry.Register(m.numNodesGauge); err != nil && !errors.As(err, &alreadyRegistered) {
 		return nil, err
 	}
@@ -546,6 +1076,72 @@ func initMetricsRegistry(registry prometheus.Registerer, metricsNamespace string
 	if err := registry.Register(m.transportMessagesReceivedSize); err != nil && !errors.As(err, &alreadyRegistered) {
 		return nil, err
 	}
+	if err := registry.Register(m.transportCompressionCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.transportBytesOut); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.presenceExpiredCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.presenceUpdateBatchDuration); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.commandMiddlewareDuration); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.controlUnknownCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.controlIncompatibleCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.broadcastFilteredCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.clientEventsDroppedCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.controlErrorCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.numSubscribersCacheCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.brokerPubSubQueueFullCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.redisPubSubQueueLenGauge); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.brokerPubSubLatency); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.redisShardHealthyGauge); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.clientLimitExceededCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.nodeConnectionLimitCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.brokerSubsReconciledCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.transportWriteErrorCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.transportPubEnqueuedCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.transportPubDroppedCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
+	if err := registry.Register(m.handlerPanicCount); err != nil && !errors.As(err, &alreadyRegistered) {
+		return nil, err
+	}
 	if err := registry.Register(m.buildInfoGauge); err != nil && !errors.As(err, &alreadyRegistered) {
 		return nil, err
 	}
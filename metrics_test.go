@@ -22,6 +22,18 @@ func BenchmarkTransportMessagesSent(b *testing.B) {
 	})
 }
 
+func BenchmarkTransportMessagesSentDisabled(b *testing.B) {
+	var m *metrics
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			m.incTransportMessagesSent("test", protocol.FrameTypePushPublication, "channel"+strconv.Itoa(i%10), 200)
+		}
+	})
+}
+
 func BenchmarkTransportMessagesReceived(b *testing.B) {
 	m, err := initMetricsRegistry(prometheus.DefaultRegisterer, "test")
 	require.NoError(b, err)
@@ -2,6 +2,7 @@ package centrifuge
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"hash/fnv"
@@ -38,6 +39,8 @@ type Node struct {
 	startedAt int64
 	// config for node.
 	config Config
+	// minCompatibleControlVersion of other nodes, see isCompatibleControlVersion.
+	minCompatibleControlVersion uint32
 	// hub to manage client connections.
 	hub *Hub
 	// broker is responsible for PUB/SUB and history streaming mechanics.
@@ -52,6 +55,10 @@ type Node struct {
 	shutdown bool
 	// shutdownCh is a channel which is closed when node shutdown initiated.
 	shutdownCh chan struct{}
+	// shutdownDoneCh is a channel which is closed when node shutdown finished.
+	shutdownDoneCh chan struct{}
+	// maintenanceWG tracks periodic maintenance loops, see runPeriodically.
+	maintenanceWG sync.WaitGroup
 	// clientEvents to manage event handlers attached to node.
 	clientEvents *eventHub
 	// logger allows to log throughout library code and proxy log entries to
@@ -81,6 +88,35 @@ type Node struct {
 
 	notificationHandler NotificationHandler
 	nodeInfoSendHandler NodeInfoSendHandler
+	nodeJoinHandler     NodeJoinHandler
+	nodeLeaveHandler    NodeLeaveHandler
+
+	// nodeEvents delivers node join/leave events to handlers.
+	nodeEvents *nodeEventQueue
+	// clientEventQueue buffers events for ClientEventHandler. Nil when handler
+	// not set, so emitting client events costs nothing in this case.
+	clientEventQueue chan ClientEvent
+	// joinLeaveReconciler is set when Config.JoinLeaveReconcileInterval is used.
+	joinLeaveReconciler *joinLeaveReconciler
+	// inactiveHistoryRemover is set when Config.RemoveInactiveChannelHistory is used.
+	inactiveHistoryRemover *inactiveHistoryRemover
+	// brokerSubscriptions is set when Config.BrokerSubscriptionReconcileInterval is used.
+	brokerSubscriptions *brokerSubscriptions
+
+	// presenceUpdater periodically refreshes presence of connected clients.
+	presenceUpdater *presenceUpdater
+
+	// numConnecting is a number of connect commands in progress. Used together
+	// with a number of clients in Hub to check NodeClientConnectionHardLimit.
+	numConnecting int64
+
+	numSubscribersCacheMu    sync.Mutex
+	numSubscribersCache      map[string]numSubscribersCacheEntry
+	numSubscribersCacheClean time.Time
+
+	positionTopCacheMu    sync.Mutex
+	positionTopCache      map[string]positionTopCacheEntry
+	positionTopCacheClean time.Time
 
 	emulationSurveyHandler *emulationSurveyHandler
 }
@@ -92,9 +128,15 @@ const (
 
 // New creates Node with provided Config.
 func New(c Config) (*Node, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
 	if c.NodeInfoMetricsAggregateInterval == 0 {
 		c.NodeInfoMetricsAggregateInterval = 60 * time.Second
 	}
+	if c.NodeInfoPublishInterval == 0 {
+		c.NodeInfoPublishInterval = defaultNodeInfoPublishInterval
+	}
 	if c.ClientPresenceUpdateInterval == 0 {
 		c.ClientPresenceUpdateInterval = 25 * time.Second
 	}
@@ -113,6 +155,12 @@ func New(c Config) (*Node, error) {
 	if c.ClientQueueMaxSize == 0 {
 		c.ClientQueueMaxSize = 1048576 // 1MB by default.
 	}
+	if c.ClientMessageSizeLimit == 0 {
+		c.ClientMessageSizeLimit = 65536 // 64KB by default.
+	}
+	if c.ClientCommandsPerFrameLimit == 0 {
+		c.ClientCommandsPerFrameLimit = 64
+	}
 	if c.ClientChannelLimit == 0 {
 		c.ClientChannelLimit = 128
 	}
@@ -122,6 +170,9 @@ func New(c Config) (*Node, error) {
 	if c.HistoryMetaTTL == 0 {
 		c.HistoryMetaTTL = 30 * 24 * time.Hour // 30 days by default.
 	}
+	if c.UserPersonalChannelNamespace == "" {
+		c.UserPersonalChannelNamespace = "user"
+	}
 
 	uidObj, err := uuid.NewRandom()
 	if err != nil {
@@ -145,30 +196,54 @@ func New(c Config) (*Node, error) {
 	var lg *logger
 	if c.LogHandler != nil {
 		lg = newLogger(c.LogLevel, c.LogHandler)
+		lg.nodeID = uid
+		if c.LogSamplingInterval > 0 {
+			lg.sampler = newLogSampler(c.LogSamplingInterval)
+		}
 	}
 
 	n := &Node{
-		uid:            uid,
-		nodes:          newNodeRegistry(uid),
-		config:         c,
-		hub:            newHub(lg),
-		startedAt:      time.Now().Unix(),
-		shutdownCh:     make(chan struct{}),
-		logger:         lg,
-		controlEncoder: controlproto.NewProtobufEncoder(),
-		controlDecoder: controlproto.NewProtobufDecoder(),
-		clientEvents:   &eventHub{},
-		subLocks:       subLocks,
-		subDissolver:   dissolve.New(numSubDissolverWorkers),
-		nowTimeGetter:  nowtime.Get,
-		surveyRegistry: make(map[uint64]chan survey),
+		uid:             uid,
+		nodes:           newNodeRegistry(uid),
+		config:          c,
+		hub:             newHub(lg),
+		startedAt:       time.Now().Unix(),
+		shutdownCh:      make(chan struct{}),
+		shutdownDoneCh:  make(chan struct{}),
+		logger:          lg,
+		controlEncoder:  controlproto.NewProtobufEncoder(),
+		controlDecoder:  controlproto.NewProtobufDecoder(),
+		clientEvents:    &eventHub{},
+		subLocks:        subLocks,
+		subDissolver:    dissolve.New(numSubDissolverWorkers),
+		presenceUpdater: newPresenceUpdater(),
+		nowTimeGetter:   nowtime.Get,
+		surveyRegistry:  make(map[uint64]chan survey),
+
+		numSubscribersCache: make(map[string]numSubscribersCacheEntry),
+		positionTopCache:    make(map[string]positionTopCacheEntry),
+
+		minCompatibleControlVersion: minCompatibleControlVersion,
 	}
 	n.emulationSurveyHandler = newEmulationSurveyHandler(n)
+	n.hub.getBroadcastFilter = c.GetChannelBroadcastFilter
+	if c.JoinLeaveReconcileInterval > 0 {
+		n.joinLeaveReconciler = newJoinLeaveReconciler()
+	}
+	if c.RemoveInactiveChannelHistory != nil {
+		n.inactiveHistoryRemover = newInactiveHistoryRemover()
+	}
+	if c.BrokerSubscriptionReconcileInterval > 0 {
+		n.brokerSubscriptions = newBrokerSubscriptions()
+	}
 
-	if m, err := initMetricsRegistry(prometheus.DefaultRegisterer, c.MetricsNamespace); err != nil {
-		return nil, err
-	} else {
-		n.metrics = m
+	if !c.DisableMetrics {
+		// With metrics disabled n.metrics stays nil – all metrics methods are no-op then.
+		if m, err := initMetricsRegistry(prometheus.DefaultRegisterer, c.MetricsNamespace); err != nil {
+			return nil, err
+		} else {
+			n.metrics = m
+		}
 	}
 
 	b, err := NewMemoryBroker(n, MemoryBrokerConfig{})
@@ -225,25 +300,68 @@ func (n *Node) Hub() *Hub {
 	return n.hub
 }
 
+// WalkSubscribers calls fn for every client connection of this Node subscribed to
+// channel until fn returns false. See Hub.WalkSubscribers for details.
+func (n *Node) WalkSubscribers(ch string, fn func(*Client) bool) {
+	n.hub.WalkSubscribers(ch, fn)
+}
+
 // Run performs node startup actions. At moment must be called once on start
 // after Broker set to Node.
 func (n *Node) Run() error {
+	// Node and client events may be emitted as soon as Broker starts delivering
+	// messages, so queues must exist before that.
+	if n.nodeJoinHandler != nil || n.nodeLeaveHandler != nil {
+		n.nodeEvents = newNodeEventQueue()
+		go n.nodeEvents.run(n.shutdownCh, n.handleNodeEvent)
+	}
+	if n.clientEvents.clientEventHandler != nil {
+		queueSize := n.config.ClientEventQueueSize
+		if queueSize == 0 {
+			queueSize = defaultClientEventQueueSize
+		}
+		n.clientEventQueue = make(chan ClientEvent, queueSize)
+		go n.runClientEvents()
+	}
 	if err := n.broker.Run(&brokerEventHandler{n}); err != nil {
 		return err
 	}
 	err := n.initMetrics()
 	if err != nil {
-		n.logger.log(newLogEntry(LogLevelError, "error on init metrics", map[string]any{"error": err.Error()}))
+		n.logger.log(newErrorLogEntry(err, "error on init metrics"))
 		return err
 	}
 	err = n.pubNode("")
 	if err != nil {
-		n.logger.log(newLogEntry(LogLevelError, "error publishing node control command", map[string]any{"error": err.Error()}))
+		n.logger.log(newErrorLogEntry(err, "error publishing node control command"))
 		return err
 	}
-	go n.sendNodePing()
-	go n.cleanNodeInfo()
-	go n.updateMetrics()
+	n.maintenanceWG.Add(1)
+	go func() {
+		defer n.maintenanceWG.Done()
+		n.sendNodePing()
+	}()
+	n.runPeriodically(nodeInfoCleanInterval(n.config.NodeInfoPublishInterval), n.cleanNodeInfo)
+	if n.metrics != nil {
+		n.updateGauges()
+		n.runPeriodically(updateGaugesInterval, n.updateGauges)
+	}
+	if n.joinLeaveReconciler != nil {
+		n.runPeriodically(n.config.JoinLeaveReconcileInterval, n.reconcileJoinLeave)
+	}
+	if n.brokerSubscriptions != nil {
+		n.runPeriodically(n.config.BrokerSubscriptionReconcileInterval, n.reconcileBrokerSubscriptions)
+	}
+	if n.logger != nil && n.logger.sampler != nil {
+		n.runPeriodically(n.config.LogSamplingInterval, func() {
+			n.logger.flushSampled(time.Now())
+		})
+	}
+	n.maintenanceWG.Add(1)
+	go func() {
+		defer n.maintenanceWG.Done()
+		n.presenceUpdater.run(n.shutdownCh, n.metrics)
+	}()
 	return n.subDissolver.Run()
 }
 
@@ -268,6 +386,8 @@ func (n *Node) Shutdown(ctx context.Context) error {
 	n.shutdown = true
 	close(n.shutdownCh)
 	n.mu.Unlock()
+	// Deferred first to run after Broker and PresenceManager closed.
+	defer close(n.shutdownDoneCh)
 	cmd := &controlpb.Command{
 		Uid:      n.uid,
 		Shutdown: &controlpb.Shutdown{},
@@ -292,19 +412,42 @@ func (n *Node) Shutdown(ctx context.Context) error {
 		_ = n.hub.shutdown(ctx)
 	}()
 	wg.Wait()
+	if n.metricsExporter != nil {
+		_ = n.metricsExporter.Close()
+	}
+	// Maintenance loops exit on shutdownCh, wait for them before closing Broker.
+	maintenanceDone := make(chan struct{})
+	go func() {
+		n.maintenanceWG.Wait()
+		close(maintenanceDone)
+	}()
+	select {
+	case <-maintenanceDone:
+	case <-ctx.Done():
+	}
 	return ctx.Err()
 }
 
 // NotifyShutdown returns a channel which will be closed on node shutdown.
-func (n *Node) NotifyShutdown() chan struct{} {
+func (n *Node) NotifyShutdown() <-chan struct{} {
 	return n.shutdownCh
 }
 
+// ShutdownDone returns a channel which will be closed when node shutdown
+// finished – i.e. clients disconnected (or Shutdown context done) and Broker
+// with PresenceManager closed.
+func (n *Node) ShutdownDone() <-chan struct{} {
+	return n.shutdownDoneCh
+}
+
 func (n *Node) updateGauges() {
 	n.metrics.setNumClients(float64(n.hub.NumClients()))
 	n.metrics.setNumUsers(float64(n.hub.NumUsers()))
 	n.metrics.setNumSubscriptions(float64(n.hub.NumSubscriptions()))
 	n.metrics.setNumChannels(float64(n.hub.NumChannels()))
+	if n.config.GetChannelNamespaceLabel != nil && n.config.ChannelNamespaceLabelForNumChannels {
+		n.metrics.setNumChannelsByNamespace(n.numChannelsByNamespace())
+	}
 	n.metrics.setNumNodes(float64(n.nodes.size()))
 	version := n.config.Version
 	if version == "" {
@@ -313,22 +456,41 @@ func (n *Node) updateGauges() {
 	n.metrics.setBuildInfo(version)
 }
 
-func (n *Node) updateMetrics() {
-	n.updateGauges()
-	for {
-		select {
-		case <-n.shutdownCh:
-			return
-		case <-time.After(10 * time.Second):
-			n.updateGauges()
-		}
+// numChannelsByNamespace counts channels for each channel_namespace label.
+func (n *Node) numChannelsByNamespace() map[string]int {
+	counts := map[string]int{}
+	for _, ch := range n.hub.Channels() {
+		counts[n.config.GetChannelNamespaceLabel(ch)]++
 	}
+	return counts
+}
+
+const updateGaugesInterval = 10 * time.Second
+
+// runPeriodically calls fn every interval in a separate goroutine until Node
+// shutdown. Periodic maintenance loops should use it instead of time.After in
+// a loop which allocates a new timer on every iteration.
+func (n *Node) runPeriodically(interval time.Duration, fn func()) {
+	n.maintenanceWG.Add(1)
+	go func() {
+		defer n.maintenanceWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.shutdownCh:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
 }
 
 // Centrifuge library uses Prometheus metrics for instrumentation. But we also try to
 // aggregate Prometheus metrics periodically and share this information between Nodes.
 func (n *Node) initMetrics() error {
-	if n.config.NodeInfoMetricsAggregateInterval == 0 {
+	if n.config.NodeInfoMetricsAggregateInterval == 0 || n.config.DisableMetrics {
 		return nil
 	}
 	metricsSink := make(chan eagle.Metrics)
@@ -360,27 +522,54 @@ func (n *Node) initMetrics() error {
 }
 
 func (n *Node) sendNodePing() {
+	var changeCheckCh <-chan time.Time
+	if n.config.NodeInfoPublishClientsChange > 0 {
+		ticker := time.NewTicker(nodeInfoChangeCheckInterval)
+		defer ticker.Stop()
+		changeCheckCh = ticker.C
+	}
+	publishTimer := time.NewTimer(n.config.NodeInfoPublishInterval)
+	defer publishTimer.Stop()
+	lastNumClients := n.hub.NumClients()
 	for {
 		select {
 		case <-n.shutdownCh:
 			return
-		case <-time.After(nodeInfoPublishInterval):
-			err := n.pubNode("")
-			if err != nil {
-				n.logger.log(newLogEntry(LogLevelError, "error publishing node control command", map[string]any{"error": err.Error()}))
+		case <-changeCheckCh:
+			if !clientsChanged(lastNumClients, n.hub.NumClients(), n.config.NodeInfoPublishClientsChange) {
+				continue
+			}
+			if !publishTimer.Stop() {
+				<-publishTimer.C
 			}
+		case <-publishTimer.C:
+		}
+		lastNumClients = n.hub.NumClients()
+		err := n.pubNode("")
+		if err != nil {
+			n.logger.log(newErrorLogEntry(err, "error publishing node control command"))
 		}
+		publishTimer.Reset(n.config.NodeInfoPublishInterval)
+	}
+}
+
+// clientsChanged reports whether the number of clients changed by at least
+// fraction of previous value.
+func clientsChanged(prev int, current int, fraction float64) bool {
+	if prev == current {
+		return false
+	}
+	diff := current - prev
+	if diff < 0 {
+		diff = -diff
 	}
+	return float64(diff) >= fraction*float64(prev)
 }
 
 func (n *Node) cleanNodeInfo() {
-	for {
-		select {
-		case <-n.shutdownCh:
-			return
-		case <-time.After(nodeInfoCleanInterval):
-			n.nodes.clean(nodeInfoMaxDelay)
-		}
+	removed := n.nodes.clean(nodeInfoMaxDelay(n.config.NodeInfoPublishInterval))
+	for _, info := range removed {
+		n.emitNodeEvent(nodeEvent{info: info, leave: true})
 	}
 }
 
@@ -397,9 +586,6 @@ func (n *Node) handleNotification(fromNodeID string, req *controlpb.Notification
 }
 
 func (n *Node) handleSurveyRequest(fromNodeID string, req *controlpb.SurveyRequest) error {
-	if n.surveyHandler == nil && n.emulationSurveyHandler == nil {
-		return nil
-	}
 	cb := func(reply SurveyReply) {
 		surveyResponse := &controlpb.SurveyResponse{
 			Id:   req.Id,
@@ -412,17 +598,36 @@ func (n *Node) handleSurveyRequest(fromNodeID string, req *controlpb.SurveyReque
 		}
 		_ = n.publishControl(cmd, fromNodeID)
 	}
-	if req.Op == emulationOp && n.emulationSurveyHandler != nil {
-		n.emulationSurveyHandler.HandleEmulation(SurveyEvent{Op: req.Op, Data: req.Data}, cb)
+	handler := n.getSurveyHandler(req.Op)
+	if handler == nil {
 		return nil
 	}
-	if n.surveyHandler == nil {
-		return nil
-	}
-	n.surveyHandler(SurveyEvent{Op: req.Op, Data: req.Data}, cb)
+	handler(SurveyEvent{Op: req.Op, Data: req.Data}, cb)
 	return nil
 }
 
+// getSurveyHandler returns handler for survey op. Ops reserved by Centrifuge
+// handled internally, all other ops passed to SurveyHandler set by user.
+func (n *Node) getSurveyHandler(op string) SurveyHandler {
+	switch op {
+	case emulationOp:
+		if n.emulationSurveyHandler == nil {
+			return nil
+		}
+		return n.emulationSurveyHandler.HandleEmulation
+	case channelsOp:
+		return n.handleChannelsSurvey
+	case numSubscribersOp:
+		return n.handleNumSubscribersSurvey
+	case unsubscribeClientOp:
+		return n.handleUnsubscribeClientSurvey
+	case disconnectClientOp:
+		return n.handleDisconnectClientSurvey
+	default:
+		return n.surveyHandler
+	}
+}
+
 func (n *Node) handleSurveyResponse(uid string, resp *controlpb.SurveyResponse) error {
 	n.surveyMu.RLock()
 	defer n.surveyMu.RUnlock()
@@ -471,7 +676,8 @@ const defaultSurveyTimeout = 10 * time.Second
 // method to handle received surveys.
 // Survey ops starting with `centrifuge_` are reserved by Centrifuge library.
 func (n *Node) Survey(ctx context.Context, op string, data []byte, toNodeID string) (map[string]SurveyResult, error) {
-	if n.surveyHandler == nil && op != emulationOp {
+	handler := n.getSurveyHandler(op)
+	if handler == nil {
 		return nil, errSurveyHandlerNotRegistered
 	}
 
@@ -522,21 +728,12 @@ func (n *Node) Survey(ctx context.Context, op string, data []byte, toNodeID stri
 		if toNodeID == n.ID() || (toNodeID == "" && numNodes == 1) {
 			needDistributedPublish = false
 		}
-		if op == emulationOp {
-			n.emulationSurveyHandler.HandleEmulation(SurveyEvent{Op: op, Data: data}, func(reply SurveyReply) {
-				surveyChan <- survey{
-					UID:    n.uid,
-					Result: SurveyResult(reply),
-				}
-			})
-		} else {
-			n.surveyHandler(SurveyEvent{Op: op, Data: data}, func(reply SurveyReply) {
-				surveyChan <- survey{
-					UID:    n.uid,
-					Result: SurveyResult(reply),
-				}
-			})
-		}
+		handler(SurveyEvent{Op: op, Data: data}, func(reply SurveyReply) {
+			surveyChan <- survey{
+				UID:    n.uid,
+				Result: SurveyResult(reply),
+			}
+		})
 	}
 
 	var wg sync.WaitGroup
@@ -575,6 +772,12 @@ func (n *Node) Survey(ctx context.Context, op string, data []byte, toNodeID stri
 // Info contains information about all known server nodes.
 type Info struct {
 	Nodes []NodeInfo
+	// Broker contains health details of current node Broker if it implements
+	// StatsReporter interface.
+	Broker map[string]any
+	// PresenceManager contains health details of current node PresenceManager
+	// if it implements StatsReporter interface.
+	PresenceManager map[string]any
 }
 
 // Metrics aggregation over time interval for node.
@@ -595,6 +798,9 @@ type NodeInfo struct {
 	Uptime      uint32
 	Metrics     *Metrics
 	Data        []byte
+	// Incompatible is true when node runs control protocol version which is not
+	// compatible with this node. See Config.ClusterStrictCompatibility.
+	Incompatible bool
 }
 
 // Info returns aggregated stats from all nodes.
@@ -602,31 +808,57 @@ func (n *Node) Info() (Info, error) {
 	nodes := n.nodes.list()
 	nodeResults := make([]NodeInfo, len(nodes))
 	for i, nd := range nodes {
-		info := NodeInfo{
-			UID:         nd.Uid,
-			Name:        nd.Name,
-			Version:     nd.Version,
-			NumClients:  nd.NumClients,
-			NumUsers:    nd.NumUsers,
-			NumSubs:     nd.NumSubs,
-			NumChannels: nd.NumChannels,
-			Uptime:      nd.Uptime,
-			Data:        nd.Data,
-		}
-		if nd.Metrics != nil {
-			info.Metrics = &Metrics{
-				Interval: nd.Metrics.Interval,
-				Items:    nd.Metrics.Items,
-			}
-		}
-		nodeResults[i] = info
+		nodeResults[i] = nodeInfoFromProto(nd)
+		nodeResults[i].Incompatible = !n.isCompatibleControlVersion(nd.ControlVersion)
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), infoStatsTimeout)
+	defer cancel()
+
 	return Info{
-		Nodes: nodeResults,
+		Nodes:           nodeResults,
+		Broker:          collectStats(ctx, n.broker),
+		PresenceManager: collectStats(ctx, n.presenceManager),
 	}, nil
 }
 
+const infoStatsTimeout = 5 * time.Second
+
+// collectStats returns stats of Broker or PresenceManager if it implements StatsReporter.
+// Error is reported inside stats to keep the rest of Info available during incidents.
+func collectStats(ctx context.Context, v any) map[string]any {
+	reporter, ok := v.(StatsReporter)
+	if !ok {
+		return nil
+	}
+	stats, err := reporter.Stats(ctx)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	return stats
+}
+
+func nodeInfoFromProto(nd *controlpb.Node) NodeInfo {
+	info := NodeInfo{
+		UID:         nd.Uid,
+		Name:        nd.Name,
+		Version:     nd.Version,
+		NumClients:  nd.NumClients,
+		NumUsers:    nd.NumUsers,
+		NumSubs:     nd.NumSubs,
+		NumChannels: nd.NumChannels,
+		Uptime:      nd.Uptime,
+		Data:        nd.Data,
+	}
+	if nd.Metrics != nil {
+		info.Metrics = &Metrics{
+			Interval: nd.Metrics.Interval,
+			Items:    nd.Metrics.Items,
+		}
+	}
+	return info
+}
+
 // handleControl handles messages from control channel - control messages used for internal
 // communication between nodes to share state or proto.
 func (n *Node) handleControl(data []byte) error {
@@ -634,7 +866,8 @@ func (n *Node) handleControl(data []byte) error {
 
 	cmd, err := n.controlDecoder.DecodeCommand(data)
 	if err != nil {
-		n.logger.log(newLogEntry(LogLevelError, "error decoding control command", map[string]any{"error": err.Error()}))
+		n.metrics.incControlError(false)
+		n.logger.log(newErrorLogEntry(err, "error decoding control command"))
 		return err
 	}
 
@@ -645,6 +878,15 @@ func (n *Node) handleControl(data []byte) error {
 
 	uid := cmd.Uid
 
+	if !n.isCompatibleControlVersion(cmd.Version) {
+		n.metrics.incControlIncompatible()
+		if n.config.ClusterStrictCompatibility && cmd.Node == nil && cmd.Shutdown == nil {
+			// Node and Shutdown commands are still processed to keep incompatible
+			// node visible in registry.
+			return nil
+		}
+	}
+
 	// control proto v2.
 	if cmd.Node != nil {
 		return n.nodeCmd(cmd.Node)
@@ -652,6 +894,9 @@ func (n *Node) handleControl(data []byte) error {
 		return n.shutdownCmd(uid)
 	} else if cmd.Unsubscribe != nil {
 		cmd := cmd.Unsubscribe
+		if cmd.AllUsers {
+			return n.hub.unsubscribeAllUsers(cmd.Channel, Unsubscribe{Code: cmd.Code, Reason: cmd.Reason})
+		}
 		return n.hub.unsubscribe(cmd.User, cmd.Channel, Unsubscribe{Code: cmd.Code, Reason: cmd.Reason}, cmd.Client, cmd.Session)
 	} else if cmd.Subscribe != nil {
 		cmd := cmd.Subscribe
@@ -662,7 +907,13 @@ func (n *Node) handleControl(data []byte) error {
 		return n.hub.subscribe(cmd.User, cmd.Channel, cmd.Client, cmd.Session, WithExpireAt(cmd.ExpireAt), WithChannelInfo(cmd.ChannelInfo), WithEmitPresence(cmd.EmitPresence), WithEmitJoinLeave(cmd.EmitJoinLeave), WithPushJoinLeave(cmd.PushJoinLeave), WithPositioning(cmd.Position), WithRecovery(cmd.Recover), WithSubscribeData(cmd.Data), WithRecoverSince(recoverSince), WithSubscribeSource(uint8(cmd.Source)))
 	} else if cmd.Disconnect != nil {
 		cmd := cmd.Disconnect
-		return n.hub.disconnect(cmd.User, Disconnect{Code: cmd.Code, Reason: cmd.Reason}, cmd.Client, cmd.Session, cmd.Whitelist)
+		if cmd.AllUsers {
+			go func() {
+				_, _ = n.hub.disconnectAll(context.Background(), Disconnect{Code: cmd.Code, Reason: cmd.Reason})
+			}()
+			return nil
+		}
+		return n.hub.disconnect(cmd.User, Disconnect{Code: cmd.Code, Reason: cmd.Reason}, cmd.Client, cmd.Session, cmd.Whitelist, cmd.ConnectedBefore)
 	} else if cmd.SurveyRequest != nil {
 		cmd := cmd.SurveyRequest
 		return n.handleSurveyRequest(uid, cmd)
@@ -676,10 +927,53 @@ func (n *Node) handleControl(data []byte) error {
 		cmd := cmd.Refresh
 		return n.hub.refresh(cmd.User, cmd.Client, cmd.Session, WithRefreshExpired(cmd.Expired), WithRefreshExpireAt(cmd.ExpireAt), WithRefreshInfo(cmd.Info))
 	}
-	n.logger.log(newLogEntry(LogLevelError, "unknown control command", map[string]any{"command": fmt.Sprintf("%#v", cmd)}))
+	// May happen during rolling upgrade when newer nodes send control commands
+	// this node does not know about yet.
+	n.metrics.incControlUnknown()
+	n.logger.logLazy(LogLevelDebug, "unknown control command", func() map[string]any {
+		return map[string]any{"command": fmt.Sprintf("%#v", cmd), "version": cmd.Version}
+	})
 	return nil
 }
 
+// controlProtocolVersion is a version of control protocol supported by this node.
+// Should be incremented every time new control command is introduced. Nodes which
+// do not send version considered having version 0.
+const controlProtocolVersion uint32 = 3
+
+// minCompatibleControlVersion is a minimal control protocol version of other nodes
+// this node can safely interpret control commands from. Should be raised when control
+// protocol changes in a backwards incompatible way.
+const minCompatibleControlVersion uint32 = 1
+
+// controlVersionUnsubscribeAllUsers is a control protocol version starting from
+// which nodes understand Unsubscribe command with AllUsers flag.
+const controlVersionUnsubscribeAllUsers uint32 = 2
+
+// controlVersionDisconnectAllUsers is a control protocol version starting from
+// which nodes understand Disconnect command with AllUsers flag.
+const controlVersionDisconnectAllUsers uint32 = 3
+
+func (n *Node) isCompatibleControlVersion(version uint32) bool {
+	return version >= n.minCompatibleControlVersion
+}
+
+// minClusterControlVersion returns minimal control protocol version among known
+// nodes in cluster. Can be used to check whether all nodes support some control
+// command before sending it.
+func (n *Node) minClusterControlVersion() uint32 {
+	minVersion := controlProtocolVersion
+	for _, info := range n.nodes.list() {
+		if info.Uid == n.uid {
+			continue
+		}
+		if info.ControlVersion < minVersion {
+			minVersion = info.ControlVersion
+		}
+	}
+	return minVersion
+}
+
 // handlePublication handles messages published into channel and
 // coming from Broker. The goal of method is to deliver this message
 // to all clients on this node currently subscribed to channel.
@@ -702,6 +996,9 @@ func (n *Node) handleJoin(ch string, info *ClientInfo) error {
 	if !hasCurrentSubscribers {
 		return nil
 	}
+	if n.joinLeaveReconciler != nil {
+		n.joinLeaveReconciler.join(ch, info)
+	}
 	return n.hub.broadcastJoin(ch, info)
 }
 
@@ -714,16 +1011,33 @@ func (n *Node) handleLeave(ch string, info *ClientInfo) error {
 	if !hasCurrentSubscribers {
 		return nil
 	}
+	if n.joinLeaveReconciler != nil {
+		n.joinLeaveReconciler.leave(ch, info.ClientID)
+	}
 	return n.hub.broadcastLeave(ch, info)
 }
 
-func (n *Node) publish(ch string, data []byte, opts ...PublishOption) (PublishResult, error) {
+func (n *Node) publish(ctx context.Context, ch string, data []byte, opts ...PublishOption) (_ PublishResult, err error) {
 	pubOpts := &PublishOptions{}
 	for _, opt := range opts {
 		opt(pubOpts)
 	}
+	if pubOpts.ContentType != "" {
+		pubOpts.Tags = withContentTypeTag(pubOpts.Tags, pubOpts.ContentType)
+	}
 	n.metrics.incMessagesSent("publication")
-	streamPos, fromCache, err := n.broker.Publish(ch, data, *pubOpts)
+	if n.config.Tracer != nil {
+		var span Span
+		ctx, span = n.config.Tracer.StartSpan(ctx, spanNamePublish, map[string]string{"channel": ch})
+		defer func() { span.End(err) }()
+	}
+	var streamPos StreamPosition
+	var fromCache bool
+	if contextBroker, ok := n.broker.(PublishContextBroker); ok {
+		streamPos, fromCache, err = contextBroker.PublishContext(ctx, ch, data, *pubOpts)
+	} else {
+		streamPos, fromCache, err = n.broker.Publish(ch, data, *pubOpts)
+	}
 	if err != nil {
 		return PublishResult{}, err
 	}
@@ -744,7 +1058,10 @@ type PublishResult struct {
 // Connections that work over Protobuf protocol can work both with JSON and binary payloads.
 //
 // So the rule here: if you have channel subscribers that work using JSON
-// protocol then you can not publish binary data to these channel.
+// protocol then you can not publish binary data to these channel – unless the
+// content type of data is set with WithContentType option. In this case JSON
+// subscribers receive data encoded to a base64 JSON string, Protobuf subscribers
+// receive data as is.
 //
 // Channels in Centrifuge are ephemeral and its settings not persisted over different
 // publish operations. So if you want to have a channel with history stream behind you
@@ -756,7 +1073,24 @@ type PublishResult struct {
 // enabled (i.e. when Publications only sent to PUB/SUB system) StreamPosition will
 // be an empty struct (i.e. PublishResult.Offset will be zero).
 func (n *Node) Publish(channel string, data []byte, opts ...PublishOption) (PublishResult, error) {
-	return n.publish(channel, data, opts...)
+	return n.publish(context.Background(), channel, data, opts...)
+}
+
+// PublishContext is the same as Publish but stops waiting for result when ctx is
+// done. Only respected by Broker implementing PublishContextBroker.
+func (n *Node) PublishContext(ctx context.Context, channel string, data []byte, opts ...PublishOption) (PublishResult, error) {
+	return n.publish(ctx, channel, data, opts...)
+}
+
+// PersonalChannel returns a name of user personal channel. Connections are subscribed
+// to it automatically if Config.UserSubscribeToPersonal enabled.
+func (n *Node) PersonalChannel(user string) string {
+	return n.config.UserPersonalChannelNamespace + "#" + user
+}
+
+// PublishToUser publishes data to user personal channel. See Node.PersonalChannel.
+func (n *Node) PublishToUser(user string, data []byte, opts ...PublishOption) (PublishResult, error) {
+	return n.publish(context.Background(), n.PersonalChannel(user), data, opts...)
 }
 
 // publishJoin allows publishing join message into channel when someone subscribes on it
@@ -817,8 +1151,11 @@ func (n *Node) Notify(op string, data []byte, toNodeID string) error {
 // nodes will receive and handle it.
 func (n *Node) publishControl(cmd *controlpb.Command, nodeID string) error {
 	n.metrics.incMessagesSent("control")
+	cmd.Version = controlProtocolVersion
 	data, err := n.controlEncoder.EncodeCommand(cmd)
 	if err != nil {
+		n.metrics.incControlError(true)
+		n.logger.log(newErrorLogEntry(err, "error encoding control command"))
 		return err
 	}
 	return n.broker.PublishControl(data, nodeID, "")
@@ -850,6 +1187,8 @@ func (n *Node) pubNode(nodeID string) error {
 		NumSubs:     uint32(n.hub.NumSubscriptions()),
 		Uptime:      uint32(time.Now().Unix() - n.startedAt),
 		Data:        data,
+
+		ControlVersion: controlProtocolVersion,
 	}
 
 	n.metricsMu.Lock()
@@ -869,7 +1208,7 @@ func (n *Node) pubNode(nodeID string) error {
 
 	err := n.nodeCmd(node)
 	if err != nil {
-		n.logger.log(newLogEntry(LogLevelError, "error handling node command", map[string]any{"error": err.Error()}))
+		n.logger.log(newErrorLogEntry(err, "error handling node command"))
 	}
 
 	return n.publishControl(cmd, nodeID)
@@ -938,16 +1277,32 @@ func (n *Node) pubUnsubscribe(user string, ch string, unsubscribe Unsubscribe, c
 	return n.publishControl(cmd, "")
 }
 
+// pubUnsubscribeAllUsers publishes unsubscribe control message to all nodes –
+// so all nodes could unsubscribe all channel subscribers.
+func (n *Node) pubUnsubscribeAllUsers(ch string, unsubscribe Unsubscribe) error {
+	cmd := &controlpb.Command{
+		Uid: n.uid,
+		Unsubscribe: &controlpb.Unsubscribe{
+			Channel:  ch,
+			Code:     unsubscribe.Code,
+			Reason:   unsubscribe.Reason,
+			AllUsers: true,
+		},
+	}
+	return n.publishControl(cmd, "")
+}
+
 // pubDisconnect publishes disconnect control message to all nodes – so all
 // nodes could disconnect user from server.
-func (n *Node) pubDisconnect(user string, disconnect Disconnect, clientID string, sessionID string, whitelist []string) error {
+func (n *Node) pubDisconnect(user string, disconnect Disconnect, clientID string, sessionID string, whitelist []string, connectedBefore int64) error {
 	protoDisconnect := &controlpb.Disconnect{
-		User:      user,
-		Whitelist: whitelist,
-		Code:      disconnect.Code,
-		Reason:    disconnect.Reason,
-		Client:    clientID,
-		Session:   sessionID,
+		User:            user,
+		Whitelist:       whitelist,
+		Code:            disconnect.Code,
+		Reason:          disconnect.Reason,
+		Client:          clientID,
+		Session:         sessionID,
+		ConnectedBefore: connectedBefore,
 	}
 	cmd := &controlpb.Command{
 		Uid:        n.uid,
@@ -956,10 +1311,26 @@ func (n *Node) pubDisconnect(user string, disconnect Disconnect, clientID string
 	return n.publishControl(cmd, "")
 }
 
+// ErrShuttingDown returned when Node does not accept new connections since it's
+// shutting down. Clients should reconnect to another node.
+var ErrShuttingDown = errors.New("node is shutting down")
+
+// ErrControlVersionNotSupported returned when operation requires control command
+// which is not supported yet by some nodes in cluster (for example, during rolling
+// upgrade). Operation should be retried after all nodes are upgraded.
+var ErrControlVersionNotSupported = errors.New("control command not supported by some nodes")
+
 // addClient registers authenticated connection in clientConnectionHub
 // this allows to make operations with user connection on demand.
 func (n *Node) addClient(c *Client) error {
 	n.metrics.incActionCount("add_client")
+	// Read lock is held while adding to Hub so that Shutdown, which sets shutdown
+	// flag under write lock, sees all clients added before it.
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.shutdown {
+		return ErrShuttingDown
+	}
 	return n.hub.add(c)
 }
 
@@ -980,12 +1351,18 @@ func (n *Node) addSubscription(ch string, c *Client) error {
 	if err != nil {
 		return err
 	}
+	if first && n.inactiveHistoryRemover != nil {
+		n.inactiveHistoryRemover.cancel(ch)
+	}
 	if first {
 		err := n.broker.Subscribe(ch)
 		if err != nil {
 			_, _ = n.hub.removeSub(ch, c)
 			return err
 		}
+		if n.brokerSubscriptions != nil {
+			n.brokerSubscriptions.add(ch)
+		}
 	}
 	return nil
 }
@@ -1001,6 +1378,12 @@ func (n *Node) removeSubscription(ch string, c *Client) error {
 	if err != nil {
 		return err
 	}
+	if empty && n.inactiveHistoryRemover != nil && n.config.RemoveInactiveChannelHistory(ch) {
+		n.scheduleInactiveHistoryRemove(ch)
+	}
+	if empty && n.brokerSubscriptions != nil {
+		n.brokerSubscriptions.unsubscribing(ch)
+	}
 	if empty {
 		submittedAt := time.Now()
 		_ = n.subDissolver.Submit(func() error {
@@ -1017,8 +1400,12 @@ func (n *Node) removeSubscription(ch string, c *Client) error {
 				if err != nil {
 					// Cool down a bit since broker is not ready to process unsubscription.
 					time.Sleep(500 * time.Millisecond)
+					return err
 				}
-				return err
+				if n.brokerSubscriptions != nil {
+					n.brokerSubscriptions.remove(ch)
+				}
+				return nil
 			}
 			return nil
 		})
@@ -1031,6 +1418,10 @@ func (n *Node) nodeCmd(node *controlpb.Node) error {
 	isNewNode := n.nodes.add(node)
 	if isNewNode && node.Uid != n.uid {
 		// New Node in cluster
+		if !n.isCompatibleControlVersion(node.ControlVersion) {
+			n.logger.log(newLogEntry(LogLevelWarn, "node with incompatible control protocol version joined cluster", map[string]any{"node": node.Uid, "name": node.Name, "version": node.Version, "control_version": node.ControlVersion, "min_compatible_control_version": n.minCompatibleControlVersion}))
+		}
+		n.emitNodeEvent(nodeEvent{info: node})
 		_ = n.pubNode(node.Uid)
 	}
 	return nil
@@ -1038,10 +1429,33 @@ func (n *Node) nodeCmd(node *controlpb.Node) error {
 
 // shutdownCmd handles shutdown control command sent when node leaves cluster.
 func (n *Node) shutdownCmd(nodeID string) error {
-	n.nodes.remove(nodeID)
+	if info, ok := n.nodes.remove(nodeID); ok {
+		n.emitNodeEvent(nodeEvent{info: info, leave: true})
+	}
 	return nil
 }
 
+func (n *Node) emitNodeEvent(event nodeEvent) {
+	n.metrics.setNumNodes(float64(n.nodes.size()))
+	if n.nodeEvents == nil {
+		return
+	}
+	n.nodeEvents.add(event)
+}
+
+func (n *Node) handleNodeEvent(event nodeEvent) {
+	e := NodeInfoEvent{Node: nodeInfoFromProto(event.info)}
+	if event.leave {
+		if n.nodeLeaveHandler != nil {
+			n.nodeLeaveHandler(e)
+		}
+		return
+	}
+	if n.nodeJoinHandler != nil {
+		n.nodeJoinHandler(e)
+	}
+}
+
 // Subscribe subscribes user to a channel.
 // Note, that OnSubscribe event won't be called in this case
 // since this is a server-side subscription. If user have been already
@@ -1082,6 +1496,47 @@ func (n *Node) Unsubscribe(userID string, channel string, opts ...UnsubscribeOpt
 	return n.pubUnsubscribe(userID, channel, customUnsubscribe, unsubscribeOpts.clientID, unsubscribeOpts.sessionID)
 }
 
+// CloseChannel unsubscribes all channel subscribers on all nodes and makes channel
+// reject new subscriptions with ErrorChannelClosed during ttl – so clients do not
+// resubscribe to deleted channel right away. Subscriptions are only rejected when
+// Config.CheckClosedChannels is on. Returns ErrorNotAvailable if Broker does not
+// implement ChannelCloser and ErrControlVersionNotSupported if some nodes in cluster
+// are too old to unsubscribe all channel subscribers.
+func (n *Node) CloseChannel(ch string, ttl time.Duration) error {
+	n.metrics.incActionCount("channel_close")
+	closer, ok := n.broker.(ChannelCloser)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	if ttl <= 0 {
+		return errors.New("channel close ttl must be positive")
+	}
+	if n.minClusterControlVersion() < controlVersionUnsubscribeAllUsers {
+		return ErrControlVersionNotSupported
+	}
+	// Tombstone is set first so unsubscribed clients can't subscribe back.
+	if err := closer.CloseChannel(ch, ttl); err != nil {
+		return err
+	}
+	// Unsubscribe on this node.
+	err := n.hub.unsubscribeAllUsers(ch, unsubscribeServer)
+	if err != nil {
+		return err
+	}
+	// Send unsubscribe control message to other nodes.
+	return n.pubUnsubscribeAllUsers(ch, unsubscribeServer)
+}
+
+// channelClosed returns true if channel was closed with CloseChannel and tombstone
+// has not expired yet.
+func (n *Node) channelClosed(ch string) (bool, error) {
+	closer, ok := n.broker.(ChannelCloser)
+	if !ok {
+		return false, nil
+	}
+	return closer.ChannelClosed(ch)
+}
+
 // Disconnect allows closing all user connections on all nodes.
 func (n *Node) Disconnect(userID string, opts ...DisconnectOption) error {
 	disconnectOpts := &DisconnectOptions{}
@@ -1093,12 +1548,45 @@ func (n *Node) Disconnect(userID string, opts ...DisconnectOption) error {
 	if disconnectOpts.Disconnect != nil {
 		customDisconnect = *disconnectOpts.Disconnect
 	}
-	err := n.hub.disconnect(userID, customDisconnect, disconnectOpts.clientID, disconnectOpts.sessionID, disconnectOpts.ClientWhitelist)
+	err := n.hub.disconnect(userID, customDisconnect, disconnectOpts.clientID, disconnectOpts.sessionID, disconnectOpts.ClientWhitelist, disconnectOpts.connectedBefore)
 	if err != nil {
 		return err
 	}
 	// Send disconnect control message to other nodes
-	return n.pubDisconnect(userID, customDisconnect, disconnectOpts.clientID, disconnectOpts.sessionID, disconnectOpts.ClientWhitelist)
+	return n.pubDisconnect(userID, customDisconnect, disconnectOpts.clientID, disconnectOpts.sessionID, disconnectOpts.ClientWhitelist, disconnectOpts.connectedBefore)
+}
+
+// DisconnectAll closes all client connections on all nodes with provided Disconnect.
+// Connections of the current Node are closed before returning with concurrency
+// limited in the same way as on Shutdown, other nodes close their connections
+// asynchronously upon receiving control message. Unlike Shutdown node keeps
+// accepting new connections. Returns number of connections closed on the current
+// Node, ctx allows limiting time spent on waiting for local connections to close.
+// Returns ErrControlVersionNotSupported if some nodes in cluster are too old to
+// handle the command.
+func (n *Node) DisconnectAll(ctx context.Context, disconnect Disconnect) (int, error) {
+	n.mu.RLock()
+	shutdown := n.shutdown
+	n.mu.RUnlock()
+	if shutdown {
+		// Shutdown already closes all connections.
+		return 0, ErrShuttingDown
+	}
+	if n.minClusterControlVersion() < controlVersionDisconnectAllUsers {
+		return 0, ErrControlVersionNotSupported
+	}
+	cmd := &controlpb.Command{
+		Uid: n.uid,
+		Disconnect: &controlpb.Disconnect{
+			Code:     disconnect.Code,
+			Reason:   disconnect.Reason,
+			AllUsers: true,
+		},
+	}
+	if err := n.publishControl(cmd, ""); err != nil {
+		return 0, err
+	}
+	return n.hub.disconnectAll(ctx, disconnect)
 }
 
 // Refresh user connection.
@@ -1148,8 +1636,18 @@ type PresenceResult struct {
 	Presence map[string]*ClientInfo
 }
 
-func (n *Node) presence(ch string) (PresenceResult, error) {
-	presence, err := n.presenceManager.Presence(ch)
+func (n *Node) presence(ctx context.Context, ch string) (_ PresenceResult, err error) {
+	if n.config.Tracer != nil {
+		var span Span
+		ctx, span = n.config.Tracer.StartSpan(ctx, spanNamePresence, map[string]string{"channel": ch})
+		defer func() { span.End(err) }()
+	}
+	var presence map[string]*ClientInfo
+	if contextManager, ok := n.presenceManager.(PresenceContextManager); ok {
+		presence, err = contextManager.PresenceContext(ctx, ch)
+	} else {
+		presence, err = n.presenceManager.Presence(ch)
+	}
 	if err != nil {
 		return PresenceResult{}, err
 	}
@@ -1158,17 +1656,84 @@ func (n *Node) presence(ch string) (PresenceResult, error) {
 
 // Presence returns a map with information about active clients in channel.
 func (n *Node) Presence(ch string) (PresenceResult, error) {
+	return n.PresenceContext(context.Background(), ch)
+}
+
+// PresenceContext is the same as Presence but stops waiting for result when ctx is
+// done. Request to PresenceManager itself is only canceled if it implements
+// PresenceContextManager.
+func (n *Node) PresenceContext(ctx context.Context, ch string) (PresenceResult, error) {
 	if n.presenceManager == nil {
 		return PresenceResult{}, ErrorNotAvailable
 	}
 	n.metrics.incActionCount("presence")
 	if n.config.UseSingleFlight {
-		result, err, _ := presenceGroup.Do(ch, func() (any, error) {
-			return n.presence(ch)
+		// Request is shared between callers, so it must not be canceled by context
+		// of one of them – callers only stop waiting for it.
+		resultCh := presenceGroup.DoChan(ch, func() (any, error) {
+			return n.presence(context.Background(), ch)
 		})
-		return result.(PresenceResult), err
+		select {
+		case res := <-resultCh:
+			return res.Val.(PresenceResult), res.Err
+		case <-ctx.Done():
+			return PresenceResult{}, ctx.Err()
+		}
 	}
-	return n.presence(ch)
+	return n.presence(ctx, ch)
+}
+
+// CleanPresence removes presence entries of channel which were not updated within
+// presence TTL of PresenceManager – for example, entries left by connections of a
+// crashed node. Expired entries are not returned in presence results anyway, this
+// allows removing them proactively. Returns the number of removed entries which is
+// also added to expired presence metric. Returns ErrorNotAvailable if PresenceManager
+// does not implement PresenceCleaner.
+func (n *Node) CleanPresence(ch string) (int, error) {
+	cleaner, ok := n.presenceManager.(PresenceCleaner)
+	if !ok {
+		return 0, ErrorNotAvailable
+	}
+	n.metrics.incActionCount("presence_clean")
+	numExpired, err := cleaner.CleanPresence(ch)
+	if err != nil {
+		return 0, err
+	}
+	n.metrics.incPresenceExpired(numExpired)
+	return numExpired, nil
+}
+
+// PresencePage is a page of channel presence information.
+type PresencePage struct {
+	Presence map[string]*ClientInfo
+	// Cursor to pass to Node.PresencePage to get the next page. Empty
+	// when there are no more pages.
+	Cursor string
+}
+
+const defaultPresencePageLimit = 1000
+
+// PresencePage returns a page of active clients in channel. Pass empty cursor to
+// get the first page and then a cursor from the previous page result until it's
+// empty. Zero limit means default page size (1000). Unlike Presence, it does not
+// require loading the entire channel presence into memory which matters for channels
+// with many subscribers. Iteration is not atomic: clients which join or leave during
+// iteration may be missed or returned twice – see PresencePager for details.
+// Returns ErrorNotAvailable if PresenceManager does not implement PresencePager.
+func (n *Node) PresencePage(ch string, cursor string, limit int) (PresencePage, error) {
+	pager, ok := n.presenceManager.(PresencePager)
+	if !ok {
+		return PresencePage{}, ErrorNotAvailable
+	}
+	if limit <= 0 {
+		limit = defaultPresencePageLimit
+	}
+	n.metrics.incActionCount("presence_page")
+	presence, nextCursor, err := pager.PresencePage(ch, cursor, limit)
+	if err != nil {
+		return PresencePage{}, err
+	}
+	return PresencePage{Presence: presence, Cursor: nextCursor}, nil
 }
 
 func infoFromProto(v *protocol.ClientInfo) *ClientInfo {
@@ -1205,6 +1770,44 @@ func infoToProto(v *ClientInfo) *protocol.ClientInfo {
 	return info
 }
 
+// PublicationTagContentType is a key of Publication tag with a content type of
+// publication data, set by WithContentType publish option. Client SDKs may rely
+// on it to decode publication data.
+const PublicationTagContentType = "content-type"
+
+// ContentTypeJSON is a content type of JSON publication data.
+const ContentTypeJSON = "application/json"
+
+// withContentTypeTag returns a copy of tags with content type tag set.
+func withContentTypeTag(tags map[string]string, contentType string) map[string]string {
+	result := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		result[k] = v
+	}
+	result[PublicationTagContentType] = contentType
+	return result
+}
+
+// pubToJSONProto returns Publication to be sent over JSON protocol. Data of publication
+// with non-JSON content type can not be embedded into JSON as is, so it's encoded to a
+// base64 JSON string. The original Publication is returned for JSON content.
+func pubToJSONProto(pub *protocol.Publication) *protocol.Publication {
+	contentType, ok := pub.Tags[PublicationTagContentType]
+	if !ok || contentType == ContentTypeJSON {
+		return pub
+	}
+	data := make([]byte, base64.StdEncoding.EncodedLen(len(pub.Data))+2)
+	data[0] = '"'
+	base64.StdEncoding.Encode(data[1:], pub.Data)
+	data[len(data)-1] = '"'
+	return &protocol.Publication{
+		Offset: pub.Offset,
+		Data:   data,
+		Info:   pub.Info,
+		Tags:   pub.Tags,
+	}
+}
+
 func pubToProto(pub *Publication) *protocol.Publication {
 	if pub == nil {
 		return nil
@@ -1234,7 +1837,11 @@ type PresenceStatsResult struct {
 	PresenceStats
 }
 
-func (n *Node) presenceStats(ch string) (PresenceStatsResult, error) {
+func (n *Node) presenceStats(ctx context.Context, ch string) (_ PresenceStatsResult, err error) {
+	if n.config.Tracer != nil {
+		_, span := n.config.Tracer.StartSpan(ctx, spanNamePresenceStats, map[string]string{"channel": ch})
+		defer func() { span.End(err) }()
+	}
 	presenceStats, err := n.presenceManager.PresenceStats(ch)
 	if err != nil {
 		return PresenceStatsResult{}, err
@@ -1244,17 +1851,31 @@ func (n *Node) presenceStats(ch string) (PresenceStatsResult, error) {
 
 // PresenceStats returns presence stats from PresenceManager.
 func (n *Node) PresenceStats(ch string) (PresenceStatsResult, error) {
+	return n.PresenceStatsContext(context.Background(), ch)
+}
+
+// PresenceStatsContext is the same as PresenceStats but with context used for tracing.
+// With Config.UseSingleFlight it also stops waiting for a shared result when ctx is
+// done. Request to PresenceManager itself is not canceled.
+func (n *Node) PresenceStatsContext(ctx context.Context, ch string) (PresenceStatsResult, error) {
 	if n.presenceManager == nil {
 		return PresenceStatsResult{}, ErrorNotAvailable
 	}
 	n.metrics.incActionCount("presence_stats")
 	if n.config.UseSingleFlight {
-		result, err, _ := presenceStatsGroup.Do(ch, func() (any, error) {
-			return n.presenceStats(ch)
+		// Request is shared between callers, so it must not be canceled by context
+		// of one of them – callers only stop waiting for it.
+		resultCh := presenceStatsGroup.DoChan(ch, func() (any, error) {
+			return n.presenceStats(context.Background(), ch)
 		})
-		return result.(PresenceStatsResult), err
+		select {
+		case res := <-resultCh:
+			return res.Val.(PresenceStatsResult), res.Err
+		case <-ctx.Done():
+			return PresenceStatsResult{}, ctx.Err()
+		}
 	}
-	return n.presenceStats(ch)
+	return n.presenceStats(ctx, ch)
 }
 
 // HistoryResult contains Publications and current stream top StreamPosition.
@@ -1265,11 +1886,22 @@ type HistoryResult struct {
 	Publications []*Publication
 }
 
-func (n *Node) history(ch string, opts *HistoryOptions) (HistoryResult, error) {
+func (n *Node) history(ctx context.Context, ch string, opts *HistoryOptions) (_ HistoryResult, err error) {
 	if opts.Filter.Reverse && opts.Filter.Since != nil && opts.Filter.Since.Offset == 0 {
 		return HistoryResult{}, ErrorBadRequest
 	}
-	pubs, streamTop, err := n.broker.History(ch, *opts)
+	if n.config.Tracer != nil {
+		var span Span
+		ctx, span = n.config.Tracer.StartSpan(ctx, spanNameHistory, map[string]string{"channel": ch})
+		defer func() { span.End(err) }()
+	}
+	var pubs []*Publication
+	var streamTop StreamPosition
+	if contextBroker, ok := n.broker.(HistoryContextBroker); ok {
+		pubs, streamTop, err = contextBroker.HistoryContext(ctx, ch, *opts)
+	} else {
+		pubs, streamTop, err = n.broker.History(ch, *opts)
+	}
 	if err != nil {
 		return HistoryResult{}, err
 	}
@@ -1292,6 +1924,12 @@ func (n *Node) history(ch string, opts *HistoryOptions) (HistoryResult, error) {
 // History allows extracting Publications in channel.
 // The channel must belong to namespace where history is on.
 func (n *Node) History(ch string, opts ...HistoryOption) (HistoryResult, error) {
+	return n.HistoryContext(context.Background(), ch, opts...)
+}
+
+// HistoryContext is the same as History but stops waiting for result when ctx is
+// done. Request to Broker itself is only canceled if it implements HistoryContextBroker.
+func (n *Node) HistoryContext(ctx context.Context, ch string, opts ...HistoryOption) (HistoryResult, error) {
 	n.metrics.incActionCount("history")
 	historyOpts := &HistoryOptions{}
 	for _, opt := range opts {
@@ -1315,12 +1953,88 @@ func (n *Node) History(ch string, opts ...HistoryOption) (HistoryResult, error)
 		builder.WriteString(historyOpts.MetaTTL.String())
 		key := builder.String()
 
-		result, err, _ := historyGroup.Do(key, func() (any, error) {
-			return n.history(ch, historyOpts)
+		// Request is shared between callers, so it must not be canceled by context
+		// of one of them – callers only stop waiting for it.
+		resultCh := historyGroup.DoChan(key, func() (any, error) {
+			return n.history(context.Background(), ch, historyOpts)
 		})
-		return result.(HistoryResult), err
+		select {
+		case res := <-resultCh:
+			return res.Val.(HistoryResult), res.Err
+		case <-ctx.Done():
+			return HistoryResult{}, ctx.Err()
+		}
+	}
+	return n.history(ctx, ch, historyOpts)
+}
+
+// HistoryPageFunc is called for every page of publications during history
+// iteration. Returning false stops iteration.
+type HistoryPageFunc func(pubs []*Publication) bool
+
+const defaultHistoryIterPageSize = 100
+
+// HistoryIter iterates over channel history page by page calling fn for every
+// page of publications. Page size may be set with WithLimit option (100 by default),
+// WithSince and WithReverse options set iteration start position and direction.
+// Stream top position is captured before iteration starts and returned – publications
+// added to a channel concurrently with iteration are not visited. If stream epoch
+// changes during iteration ErrorUnrecoverablePosition returned.
+func (n *Node) HistoryIter(ch string, fn HistoryPageFunc, opts ...HistoryOption) (StreamPosition, error) {
+	historyOpts := &HistoryOptions{}
+	for _, opt := range opts {
+		opt(historyOpts)
+	}
+	pageSize := historyOpts.Filter.Limit
+	if pageSize <= 0 {
+		pageSize = defaultHistoryIterPageSize
+	}
+	reverse := historyOpts.Filter.Reverse
+	metaTTL := historyOpts.MetaTTL
+
+	topResult, err := n.History(ch, WithHistoryMetaTTL(metaTTL))
+	if err != nil {
+		return StreamPosition{}, err
+	}
+	top := topResult.StreamPosition
+
+	since := StreamPosition{Epoch: top.Epoch}
+	if historyOpts.Filter.Since != nil {
+		since = *historyOpts.Filter.Since
+	} else if reverse {
+		since.Offset = top.Offset + 1
 	}
-	return n.history(ch, historyOpts)
+
+	for {
+		if (reverse && since.Offset <= 1) || (!reverse && since.Offset >= top.Offset) {
+			break
+		}
+		result, err := n.History(ch, WithLimit(pageSize), WithSince(&since), WithReverse(reverse), WithHistoryMetaTTL(metaTTL))
+		if err != nil {
+			return top, err
+		}
+		if result.Epoch != top.Epoch {
+			return top, ErrorUnrecoverablePosition
+		}
+		pubs := result.Publications
+		if !reverse {
+			// Skip publications added after iteration started.
+			for i, pub := range pubs {
+				if pub.Offset > top.Offset {
+					pubs = pubs[:i]
+					break
+				}
+			}
+		}
+		if len(pubs) == 0 || !fn(pubs) {
+			break
+		}
+		since.Offset = pubs[len(pubs)-1].Offset
+		if len(result.Publications) < pageSize {
+			break
+		}
+	}
+	return top, nil
 }
 
 // recoverHistory recovers publications since StreamPosition last seen by client.
@@ -1337,6 +2051,14 @@ func (n *Node) recoverHistory(ch string, since StreamPosition, historyMetaTTL ti
 	}), WithHistoryMetaTTL(historyMetaTTL))
 }
 
+// StreamTop returns current top StreamPosition of channel history stream. It
+// does not load any publications from Broker, so it's cheap enough to be called
+// for attaching the current stream position to application responses – clients
+// may then subscribe with recovery starting from it.
+func (n *Node) StreamTop(ch string) (StreamPosition, error) {
+	return n.streamTop(ch, 0)
+}
+
 // streamTop returns current stream top StreamPosition for a channel.
 func (n *Node) streamTop(ch string, historyMetaTTL time.Duration) (StreamPosition, error) {
 	n.metrics.incActionCount("history_stream_top")
@@ -1347,12 +2069,78 @@ func (n *Node) streamTop(ch string, historyMetaTTL time.Duration) (StreamPositio
 	return historyResult.StreamPosition, nil
 }
 
+// positionTopCacheTTL is a time channel stream top is cached on Node for subscription
+// position checks. Clients check positions independently, cache makes checks of many
+// subscribers of the same channel result into one Broker call.
+const positionTopCacheTTL = time.Second
+
+type positionTopCacheEntry struct {
+	position StreamPosition
+	expireAt time.Time
+}
+
+// positionStreamTop returns channel stream top for subscription position check. Result
+// may be cached for positionTopCacheTTL, cached flag tells whether it was.
+func (n *Node) positionStreamTop(ch string, historyMetaTTL time.Duration) (StreamPosition, bool, error) {
+	now := time.Now()
+	n.positionTopCacheMu.Lock()
+	entry, ok := n.positionTopCache[ch]
+	n.positionTopCacheMu.Unlock()
+	if ok && now.Before(entry.expireAt) {
+		return entry.position, true, nil
+	}
+	position, err := n.streamTop(ch, historyMetaTTL)
+	if err != nil {
+		return StreamPosition{}, false, err
+	}
+	n.positionTopCacheMu.Lock()
+	defer n.positionTopCacheMu.Unlock()
+	if now.Sub(n.positionTopCacheClean) > positionTopCacheTTL {
+		for cachedCh, cachedEntry := range n.positionTopCache {
+			if now.After(cachedEntry.expireAt) {
+				delete(n.positionTopCache, cachedCh)
+			}
+		}
+		n.positionTopCacheClean = now
+	}
+	n.positionTopCache[ch] = positionTopCacheEntry{
+		position: position,
+		expireAt: now.Add(positionTopCacheTTL),
+	}
+	return position, false, nil
+}
+
 // RemoveHistory removes channel history.
 func (n *Node) RemoveHistory(ch string) error {
 	n.metrics.incActionCount("history_remove")
 	return n.broker.RemoveHistory(ch)
 }
 
+// ResetHistory removes channel history and rotates history stream epoch. Clients
+// which try to recover from previously seen stream position after reset will get
+// unrecoverable position. Returns ErrorNotAvailable if Broker does not implement
+// HistoryResetter.
+func (n *Node) ResetHistory(ch string) error {
+	n.metrics.incActionCount("history_reset")
+	resetter, ok := n.broker.(HistoryResetter)
+	if !ok {
+		return ErrorNotAvailable
+	}
+	return resetter.ResetHistory(ch)
+}
+
+// ChannelActive returns true if channel has at least one subscriber on any node
+// in cluster. Returns ErrorNotAvailable if Broker does not implement
+// ChannelActivityChecker.
+func (n *Node) ChannelActive(ch string) (bool, error) {
+	n.metrics.incActionCount("channel_active")
+	checker, ok := n.broker.(ChannelActivityChecker)
+	if !ok {
+		return false, ErrorNotAvailable
+	}
+	return checker.ChannelActive(ch)
+}
+
 type nodeRegistry struct {
 	// mu allows synchronizing access to node registry.
 	mu sync.RWMutex
@@ -1416,6 +2204,8 @@ func (r *nodeRegistry) add(info *controlpb.Node) bool {
 				Data:        info.Data,
 				NumSubs:     info.NumSubs,
 				Metrics:     node.Metrics,
+
+				ControlVersion: info.ControlVersion,
 			}
 		}
 	} else {
@@ -1427,16 +2217,20 @@ func (r *nodeRegistry) add(info *controlpb.Node) bool {
 	return isNewNode
 }
 
-func (r *nodeRegistry) remove(uid string) {
+func (r *nodeRegistry) remove(uid string) (*controlpb.Node, bool) {
 	r.mu.Lock()
+	info, ok := r.nodes[uid]
 	delete(r.nodes, uid)
 	delete(r.updates, uid)
 	r.mu.Unlock()
+	return info, ok
 }
 
-func (r *nodeRegistry) clean(delay time.Duration) {
+// clean removes nodes not updated for a delay and returns removed nodes.
+func (r *nodeRegistry) clean(delay time.Duration) []*controlpb.Node {
+	var removed []*controlpb.Node
 	r.mu.Lock()
-	for uid := range r.nodes {
+	for uid, info := range r.nodes {
 		if uid == r.currentUID {
 			// No need to clean info for current node.
 			continue
@@ -1445,15 +2239,88 @@ func (r *nodeRegistry) clean(delay time.Duration) {
 		if !ok {
 			// As we do all operations with nodes under lock this should never happen.
 			delete(r.nodes, uid)
+			removed = append(removed, info)
 			continue
 		}
 		if time.Now().Unix()-updated > int64(delay.Seconds()) {
 			// Too many seconds since this node have been last seen - remove it from map.
 			delete(r.nodes, uid)
 			delete(r.updates, uid)
+			removed = append(removed, info)
 		}
 	}
 	r.mu.Unlock()
+	return removed
+}
+
+type nodeEvent struct {
+	info  *controlpb.Node
+	leave bool
+}
+
+// nodeEventQueue is an unbounded queue of node events processed by a single
+// goroutine. So slow event handlers do not block node registry maintenance
+// and events delivered in order.
+type nodeEventQueue struct {
+	mu       sync.Mutex
+	events   []nodeEvent
+	notifyCh chan struct{}
+}
+
+func newNodeEventQueue() *nodeEventQueue {
+	return &nodeEventQueue{
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+func (q *nodeEventQueue) add(event nodeEvent) {
+	q.mu.Lock()
+	q.events = append(q.events, event)
+	q.mu.Unlock()
+	select {
+	case q.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (q *nodeEventQueue) run(closeCh chan struct{}, handle func(nodeEvent)) {
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-q.notifyCh:
+		}
+		q.mu.Lock()
+		events := q.events
+		q.events = nil
+		q.mu.Unlock()
+		for _, event := range events {
+			handle(event)
+		}
+	}
+}
+
+const defaultClientEventQueueSize = 4096
+
+// emitClientEvent passes event to ClientEventHandler. Event is dropped if handler
+// does not keep up.
+func (n *Node) emitClientEvent(event ClientEvent) {
+	select {
+	case n.clientEventQueue <- event:
+	default:
+		n.metrics.incClientEventDropped()
+	}
+}
+
+func (n *Node) runClientEvents() {
+	for {
+		select {
+		case <-n.shutdownCh:
+			return
+		case event := <-n.clientEventQueue:
+			n.clientEvents.clientEventHandler(event)
+		}
+	}
 }
 
 // OnSurvey allows setting SurveyHandler. This should be done before Node.Run called.
@@ -1471,15 +2338,33 @@ func (n *Node) OnNodeInfoSend(handler NodeInfoSendHandler) {
 	n.nodeInfoSendHandler = handler
 }
 
+// OnNodeJoin allows setting NodeJoinHandler. Handler called from a separate goroutine
+// so it does not block cluster membership maintenance. This should be done before
+// Node.Run called.
+func (n *Node) OnNodeJoin(handler NodeJoinHandler) {
+	n.nodeJoinHandler = handler
+}
+
+// OnNodeLeave allows setting NodeLeaveHandler. Handler called from a separate goroutine
+// so it does not block cluster membership maintenance. This should be done before
+// Node.Run called.
+func (n *Node) OnNodeLeave(handler NodeLeaveHandler) {
+	n.nodeLeaveHandler = handler
+}
+
 // eventHub allows binding client event handlers.
 // All eventHub methods are not goroutine-safe and supposed
 // to be called once before Node Run called.
 type eventHub struct {
-	connectingHandler       ConnectingHandler
-	connectHandler          ConnectHandler
-	transportWriteHandler   TransportWriteHandler
-	commandReadHandler      CommandReadHandler
-	commandProcessedHandler CommandProcessedHandler
+	connectingHandler          ConnectingHandler
+	connectHandler             ConnectHandler
+	transportWriteHandler      TransportWriteHandler
+	transportWriteErrorHandler TransportWriteErrorHandler
+	commandReadHandler         CommandReadHandler
+	commandProcessedHandler    CommandProcessedHandler
+	commandMiddlewares         []CommandMiddleware
+	commandHandler             CommandHandlerFunc
+	clientEventHandler         ClientEventHandler
 }
 
 // OnConnecting allows setting ConnectingHandler.
@@ -1497,16 +2382,42 @@ func (n *Node) OnConnect(handler ConnectHandler) {
 	n.clientEvents.connectHandler = handler
 }
 
+// OnClientEvent allows setting ClientEventHandler to receive events about connect,
+// subscribe, publish and disconnect operations of all connections of this Node –
+// for example for audit logging. This should be done before Node.Run called.
+func (n *Node) OnClientEvent(handler ClientEventHandler) {
+	n.clientEvents.clientEventHandler = handler
+}
+
 // OnTransportWrite allows setting TransportWriteHandler. This should be done before Node.Run called.
 func (n *Node) OnTransportWrite(handler TransportWriteHandler) {
 	n.clientEvents.transportWriteHandler = handler
 }
 
+// OnTransportWriteError allows setting TransportWriteErrorHandler. When not set client
+// connection is closed upon write error. This should be done before Node.Run called.
+func (n *Node) OnTransportWriteError(handler TransportWriteErrorHandler) {
+	n.clientEvents.transportWriteErrorHandler = handler
+}
+
 // OnCommandRead allows setting CommandReadHandler. This should be done before Node.Run called.
 func (n *Node) OnCommandRead(handler CommandReadHandler) {
 	n.clientEvents.commandReadHandler = handler
 }
 
+// UseCommandMiddleware adds CommandMiddleware to a chain of middlewares applied
+// around built-in processing of every client command. Middlewares run in order of
+// registration – the first registered middleware is the outermost one. This should
+// be done before Node.Run called.
+func (n *Node) UseCommandMiddleware(m CommandMiddleware) {
+	n.clientEvents.commandMiddlewares = append(n.clientEvents.commandMiddlewares, m)
+	handler := CommandHandlerFunc(handleCommandContext)
+	for i := len(n.clientEvents.commandMiddlewares) - 1; i >= 0; i-- {
+		handler = n.clientEvents.commandMiddlewares[i](handler)
+	}
+	n.clientEvents.commandHandler = handler
+}
+
 // OnCommandProcessed allows setting CommandProcessedHandler. This should be done before Node.Run called.
 func (n *Node) OnCommandProcessed(handler CommandProcessedHandler) {
 	n.clientEvents.commandProcessedHandler = handler
@@ -6,6 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -32,6 +36,11 @@ type TestBroker struct {
 	publishJoinCount    int32
 	publishLeaveCount   int32
 	publishControlCount int32
+	subscribeCount      int32
+	unsubscribeCount    int32
+
+	// subscribed keeps channels broker is currently subscribed to.
+	subscribed sync.Map
 }
 
 func NewTestBroker() *TestBroker {
@@ -77,17 +86,21 @@ func (e *TestBroker) PublishControl(_ []byte, _, _ string) error {
 	return nil
 }
 
-func (e *TestBroker) Subscribe(_ string) error {
+func (e *TestBroker) Subscribe(ch string) error {
 	if e.errorOnSubscribe {
 		return errors.New("boom")
 	}
+	atomic.AddInt32(&e.subscribeCount, 1)
+	e.subscribed.Store(ch, struct{}{})
 	return nil
 }
 
-func (e *TestBroker) Unsubscribe(_ string) error {
+func (e *TestBroker) Unsubscribe(ch string) error {
 	if e.errorOnUnsubscribe {
 		return errors.New("boom")
 	}
+	atomic.AddInt32(&e.unsubscribeCount, 1)
+	e.subscribed.Delete(ch)
 	return nil
 }
 
@@ -110,6 +123,7 @@ type TestPresenceManager struct {
 	errorOnPresenceStats  bool
 	errorOnAddPresence    bool
 	errorOnRemovePresence bool
+	addPresenceCount      int32
 }
 
 func NewTestPresenceManager() *TestPresenceManager {
@@ -117,6 +131,7 @@ func NewTestPresenceManager() *TestPresenceManager {
 }
 
 func (e *TestPresenceManager) AddPresence(_ string, _ string, _ *ClientInfo) error {
+	atomic.AddInt32(&e.addPresenceCount, 1)
 	if e.errorOnAddPresence {
 		return errors.New("boom")
 	}
@@ -243,6 +258,61 @@ func TestNode_Shutdown(t *testing.T) {
 	require.NoError(t, n.Shutdown(context.Background()))
 }
 
+func TestNode_ShutdownDone(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	select {
+	case <-n.ShutdownDone():
+		require.Fail(t, "shutdown done before shutdown")
+	default:
+	}
+	require.NoError(t, n.Shutdown(context.Background()))
+	select {
+	case <-n.NotifyShutdown():
+	default:
+		require.Fail(t, "shutdown not notified")
+	}
+	select {
+	case <-n.ShutdownDone():
+	default:
+		require.Fail(t, "shutdown not done")
+	}
+}
+
+func TestNode_numChannelsByNamespace(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	n.config.GetChannelNamespaceLabel = func(ch string) string {
+		if i := strings.Index(ch, ":"); i > 0 {
+			return ch[:i]
+		}
+		return "default"
+	}
+	n.config.ChannelNamespaceLabelForNumChannels = true
+
+	client := newTestConnectedClientV2(t, n, "42")
+	for _, ch := range []string{"chat:1", "chat:2", "news:1", "test"} {
+		subscribeClientV2(t, client, ch)
+	}
+	require.Equal(t, map[string]int{"chat": 2, "news": 1, "default": 1}, n.numChannelsByNamespace())
+	n.updateGauges()
+}
+
+func TestNode_clientsChanged(t *testing.T) {
+	require.False(t, clientsChanged(0, 0, 0.1))
+	require.True(t, clientsChanged(0, 1, 0.1))
+	require.False(t, clientsChanged(100, 109, 0.1))
+	require.True(t, clientsChanged(100, 110, 0.1))
+	require.True(t, clientsChanged(100, 90, 0.1))
+	require.False(t, clientsChanged(100, 91, 0.1))
+}
+
+func TestNode_nodeInfoIntervals(t *testing.T) {
+	require.Equal(t, 9*time.Second, nodeInfoCleanInterval(3*time.Second))
+	require.Equal(t, 7*time.Second, nodeInfoMaxDelay(3*time.Second))
+	require.Equal(t, 3*time.Minute, nodeInfoCleanInterval(time.Minute))
+	require.Equal(t, 2*time.Minute+time.Second, nodeInfoMaxDelay(time.Minute))
+}
+
 func TestNode_shutdownCmd(t *testing.T) {
 	// Testing that shutdownCmd removes node from nodes registry.
 	n := defaultNodeNoHandlers()
@@ -271,9 +341,11 @@ func TestNodeRegistry(t *testing.T) {
 	info, ok := registry.get("node1")
 	require.True(t, ok)
 	require.Equal(t, "node1", info.Uid)
-	registry.clean(10 * time.Second)
+	require.Len(t, registry.clean(10*time.Second), 0)
 	time.Sleep(2 * time.Second)
-	registry.clean(time.Second)
+	removed := registry.clean(time.Second)
+	require.Len(t, removed, 1)
+	require.Equal(t, "node2", removed[0].Uid)
 	// Current node info should still be in node registry - we never delete it.
 	require.Equal(t, 1, len(registry.list()))
 	require.Equal(t, 1, registry.size())
@@ -315,6 +387,24 @@ func TestNode_SetPresenceManager_NilPresenceManager(t *testing.T) {
 	require.Equal(t, ErrorNotAvailable, err)
 	_, err = n.PresenceStats("test")
 	require.Equal(t, ErrorNotAvailable, err)
+	_, err = n.PresencePage("test", "", 0)
+	require.Equal(t, ErrorNotAvailable, err)
+}
+
+func TestNode_PresencePage(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, n.addPresence("test", "uid"+strconv.Itoa(i), &ClientInfo{}))
+	}
+	page, err := n.PresencePage("test", "", 2)
+	require.NoError(t, err)
+	require.Len(t, page.Presence, 2)
+	require.NotEmpty(t, page.Cursor)
+	page, err = n.PresencePage("test", page.Cursor, 2)
+	require.NoError(t, err)
+	require.Len(t, page.Presence, 1)
+	require.Empty(t, page.Cursor)
 }
 
 func TestNode_LogEnabled(t *testing.T) {
@@ -361,6 +451,40 @@ func TestNode_Info(t *testing.T) {
 	require.Len(t, info.Nodes, 1)
 }
 
+func TestNode_DisableMetrics(t *testing.T) {
+	n, err := New(Config{DisableMetrics: true})
+	require.NoError(t, err)
+	require.Nil(t, n.metrics)
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, n, "42")
+	connectClientV2(t, client)
+	_, err = n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	info, err := n.Info()
+	require.NoError(t, err)
+	require.Len(t, info.Nodes, 1)
+	require.Nil(t, info.Nodes[0].Metrics)
+}
+
+func TestNode_InfoBrokerStats(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	_, err := n.Publish("test", []byte(`{"key": "value"}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+
+	info, err := n.Info()
+	require.NoError(t, err)
+	require.NotNil(t, info.Broker)
+	require.Equal(t, 1, info.Broker["history_num_streams"])
+	require.Equal(t, 1, info.Broker["history_num_publications"])
+	require.Greater(t, info.Broker["history_memory_bytes_estimate"], len(`{"key": "value"}`))
+	require.Nil(t, info.PresenceManager)
+}
+
 func TestNode_handleJoin(t *testing.T) {
 	n := defaultNodeNoHandlers()
 	defer func() { _ = n.Shutdown(context.Background()) }()
@@ -465,6 +589,51 @@ func TestNode_Disconnect(t *testing.T) {
 	require.True(t, len(n.hub.UserConnections("42")) == 0)
 }
 
+func TestNode_DisconnectAll(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	var numDisconnects int32
+	n.OnConnect(func(client *Client) {
+		client.OnDisconnect(func(event DisconnectEvent) {
+			// Connection left after DisconnectAll is closed with shutdown code.
+			if event.Code == DisconnectBadRequest.Code {
+				atomic.AddInt32(&numDisconnects, 1)
+			}
+		})
+	})
+
+	newTestConnectedClientV2(t, n, "42")
+	newTestConnectedClientV2(t, n, "42")
+	newTestConnectedClientV2(t, n, "43")
+
+	numClosed, err := n.DisconnectAll(context.Background(), DisconnectBadRequest)
+	require.NoError(t, err)
+	require.Equal(t, 3, numClosed)
+	require.EqualValues(t, 3, atomic.LoadInt32(&numDisconnects))
+	require.Equal(t, 0, n.hub.NumClients())
+
+	// Node still accepts connections.
+	newTestConnectedClientV2(t, n, "42")
+	require.Equal(t, 1, n.hub.NumClients())
+
+	require.NoError(t, n.Shutdown(context.Background()))
+	_, err = n.DisconnectAll(context.Background(), DisconnectBadRequest)
+	require.ErrorIs(t, err, ErrShuttingDown)
+}
+
+func TestNode_DisconnectAllControlVersion(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	newTestConnectedClientV2(t, n, "42")
+
+	n.nodes.add(&controlpb.Node{Uid: "old_node", ControlVersion: controlVersionDisconnectAllUsers - 1})
+	_, err := n.DisconnectAll(context.Background(), DisconnectBadRequest)
+	require.ErrorIs(t, err, ErrControlVersionNotSupported)
+	require.Equal(t, 1, n.hub.NumClients())
+}
+
 func TestNode_pubUnsubscribe(t *testing.T) {
 	node := nodeWithTestBroker()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -484,7 +653,7 @@ func TestNode_pubDisconnect(t *testing.T) {
 	testBroker, _ := node.broker.(*TestBroker)
 	require.EqualValues(t, 1, testBroker.publishControlCount)
 
-	err := node.pubDisconnect("42", DisconnectForceNoReconnect, "", "", nil)
+	err := node.pubDisconnect("42", DisconnectForceNoReconnect, "", "", nil, 0)
 	require.NoError(t, err)
 	require.EqualValues(t, 2, testBroker.publishControlCount)
 }
@@ -533,6 +702,143 @@ func TestNode_RemoveHistory(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestNode_PublishWithoutHistoryKeepsStream(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	_, err := n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	res, err := n.Publish("test", []byte(`{"typing": true}`))
+	require.NoError(t, err)
+	require.Zero(t, res.Offset)
+
+	historyResult, err := n.History("test", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Len(t, historyResult.Publications, 1)
+	require.Equal(t, uint64(1), historyResult.Offset)
+}
+
+func TestNode_ResetHistory(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	_, err := n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+	require.NoError(t, err)
+	res, err := n.History("test")
+	require.NoError(t, err)
+	sp := res.StreamPosition
+
+	require.NoError(t, n.ResetHistory("test"))
+
+	res, err = n.History("test", WithLimit(NoLimit), WithSince(&sp))
+	require.ErrorIs(t, err, ErrorUnrecoverablePosition)
+	require.NotEqual(t, sp.Epoch, res.Epoch)
+	require.Zero(t, res.Offset)
+}
+
+func TestNode_CloseChannel(t *testing.T) {
+	node := defaultTestNode()
+	node.config.CheckClosedChannels = true
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+	require.Equal(t, 1, node.hub.NumSubscribers("test"))
+
+	require.NoError(t, node.CloseChannel("test", time.Minute))
+	require.Equal(t, 0, node.hub.NumSubscribers("test"))
+
+	rwWrapper := testReplyWriterWrapper()
+	err := client.handleSubscribe(&protocol.SubscribeRequest{
+		Channel: "test",
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Len(t, rwWrapper.replies, 1)
+	require.Equal(t, ErrorChannelClosed.Code, rwWrapper.replies[0].Error.Code)
+	require.Equal(t, 0, node.hub.NumSubscribers("test"))
+
+	// Other channels are not affected.
+	subscribeClientV2(t, client, "other")
+}
+
+func TestNode_CloseChannelControlVersion(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+
+	node.nodes.add(&controlpb.Node{Uid: "old_node", ControlVersion: controlVersionUnsubscribeAllUsers - 1})
+	require.ErrorIs(t, node.CloseChannel("test", time.Minute), ErrControlVersionNotSupported)
+	require.Equal(t, 1, node.hub.NumSubscribers("test"))
+	closed, err := node.channelClosed("test")
+	require.NoError(t, err)
+	require.False(t, closed)
+}
+
+func TestNode_CloseChannelIgnoreChannelClosed(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	node.config.CheckClosedChannels = true
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{IgnoreChannelClosed: true}, nil)
+		})
+	})
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	require.NoError(t, node.CloseChannel("test", time.Minute))
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+	require.Equal(t, 1, node.hub.NumSubscribers("test"))
+}
+
+func TestNode_ChannelActive(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	active, err := n.ChannelActive("test")
+	require.NoError(t, err)
+	require.False(t, active)
+
+	newTestSubscribedClientV2(t, n, "42", "test")
+
+	active, err = n.ChannelActive("test")
+	require.NoError(t, err)
+	require.True(t, active)
+}
+
+func TestNode_ShutdownConcurrentConnect(t *testing.T) {
+	node := defaultTestNode()
+
+	numClients := 100
+	errCh := make(chan error, numClients)
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := newTestClientV2(t, node, strconv.Itoa(i))
+			rwWrapper := testReplyWriterWrapper()
+			_, err := client.connectCmd(&protocol.ConnectRequest{}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+			errCh <- err
+		}(i)
+	}
+	require.NoError(t, node.Shutdown(context.Background()))
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			require.Equal(t, DisconnectShutdown, err)
+		}
+	}
+	require.Zero(t, node.Hub().NumClients())
+}
+
 func TestNode_History_ErrorOnReverseWithZeroOffset(t *testing.T) {
 	n := defaultNodeNoHandlers()
 	defer func() { _ = n.Shutdown(context.Background()) }()
@@ -540,6 +846,396 @@ func TestNode_History_ErrorOnReverseWithZeroOffset(t *testing.T) {
 	require.Equal(t, err, ErrorBadRequest)
 }
 
+func TestNode_History_StreamPositionNoPublications(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	for i := 0; i < 2; i++ {
+		_, err := n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+		require.NoError(t, err)
+	}
+	res, err := n.History("test")
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 0)
+	require.Equal(t, uint64(2), res.Offset)
+	require.NotZero(t, res.Epoch)
+
+	sp := res.StreamPosition
+	res, err = n.History("test", WithLimit(NoLimit), WithSince(&sp))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 0)
+	require.Equal(t, uint64(2), res.Offset)
+	require.NotZero(t, res.Epoch)
+}
+
+func TestNode_PublishWithClientInfo(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	info := NewClientInfo("42", "client", []byte(`{"name":"John"}`), []byte(`{"role":"admin"}`))
+	_, err := n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute), WithClientInfo(info))
+	require.NoError(t, err)
+	res, err := n.History("test", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 1)
+	require.Equal(t, info, res.Publications[0].Info)
+}
+
+func TestNode_PublishExcludeClient(t *testing.T) {
+	n := defaultTestNode()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	transport1 := newTestTransport(func() {})
+	transport1.sink = make(chan []byte, 100)
+	client1 := newTestSubscribedClientWithTransport(t, context.Background(), n, transport1, "1", "test")
+	transport2 := newTestTransport(func() {})
+	transport2.sink = make(chan []byte, 100)
+	newTestSubscribedClientWithTransport(t, context.Background(), n, transport2, "2", "test")
+
+	_, err := n.Publish("test", []byte(`{"data":"excluded"}`), WithHistory(10, time.Minute), WithExcludeClient(client1.ID()))
+	require.NoError(t, err)
+
+	waitForData := func(sink chan []byte, timeout time.Duration) bool {
+		for {
+			select {
+			case data := <-sink:
+				if strings.Contains(string(data), "excluded") {
+					return true
+				}
+			case <-time.After(timeout):
+				return false
+			}
+		}
+	}
+	require.True(t, waitForData(transport2.sink, time.Second))
+	require.False(t, waitForData(transport1.sink, 100*time.Millisecond))
+
+	res, err := n.History("test", WithLimit(NoLimit))
+	require.NoError(t, err)
+	require.Len(t, res.Publications, 1)
+	require.Empty(t, res.Publications[0].ExcludeClient)
+}
+
+func TestNode_PublishExcludeClientPositioning(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	n.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{Options: SubscribeOptions{EnablePositioning: true}}, nil)
+		})
+	})
+
+	transport := newTestTransport(func() {})
+	transport.sink = make(chan []byte, 100)
+	client := newTestSubscribedClientWithTransport(t, context.Background(), n, transport, "1", "test")
+
+	_, err := n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute), WithExcludeClient(client.ID()))
+	require.NoError(t, err)
+
+	// Position of excluded client advanced, so publication not considered lost.
+	require.Eventually(t, func() bool {
+		client.mu.RLock()
+		defer client.mu.RUnlock()
+		return client.channels["test"].streamPosition.Offset == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNode_StreamTop(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	sp, err := n.StreamTop("test")
+	require.NoError(t, err)
+	require.Zero(t, sp.Offset)
+
+	for i := 0; i < 2; i++ {
+		_, err := n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+		require.NoError(t, err)
+	}
+	top, err := n.StreamTop("test")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), top.Offset)
+	require.NotZero(t, top.Epoch)
+	require.Equal(t, sp.Epoch, top.Epoch)
+}
+
+func TestNode_HistoryIter(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	for i := 0; i < 10; i++ {
+		_, err := n.Publish("test", []byte(`{}`), WithHistory(10, time.Minute))
+		require.NoError(t, err)
+	}
+
+	var offsets []uint64
+	numPages := 0
+	top, err := n.HistoryIter("test", func(pubs []*Publication) bool {
+		numPages++
+		for _, pub := range pubs {
+			offsets = append(offsets, pub.Offset)
+		}
+		// Publish concurrently – must not be visited.
+		_, err := n.Publish("test", []byte(`{}`), WithHistory(20, time.Minute))
+		require.NoError(t, err)
+		return true
+	}, WithLimit(3))
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), top.Offset)
+	require.Equal(t, 4, numPages)
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, offsets)
+
+	offsets = nil
+	_, err = n.HistoryIter("test", func(pubs []*Publication) bool {
+		for _, pub := range pubs {
+			offsets = append(offsets, pub.Offset)
+		}
+		return len(offsets) < 4
+	}, WithLimit(2), WithReverse(true))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{14, 13, 12, 11}, offsets)
+}
+
+func TestNode_handleControlUnknown(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	enc := controlproto.NewProtobufEncoder()
+	cmdBytes, err := enc.EncodeCommand(&controlpb.Command{
+		Uid:     "other_node",
+		Version: controlProtocolVersion + 1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, n.handleControl(cmdBytes))
+}
+
+func TestNode_minClusterControlVersion(t *testing.T) {
+	n := defaultNodeNoHandlers()
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	require.Equal(t, controlProtocolVersion, n.minClusterControlVersion())
+	n.nodes.add(&controlpb.Node{Uid: "new_node", ControlVersion: controlProtocolVersion})
+	require.Equal(t, controlProtocolVersion, n.minClusterControlVersion())
+	n.nodes.add(&controlpb.Node{Uid: "old_node"})
+	require.Equal(t, uint32(0), n.minClusterControlVersion())
+}
+
+func TestNode_handleControlIncompatible(t *testing.T) {
+	testCases := []struct {
+		name     string
+		strict   bool
+		notified bool
+	}{
+		{"default", false, true},
+		{"strict", true, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := New(Config{ClusterStrictCompatibility: tc.strict})
+			require.NoError(t, err)
+			n.minCompatibleControlVersion = controlProtocolVersion
+			var numNotifications int
+			n.OnNotification(func(e NotificationEvent) {
+				numNotifications++
+			})
+			require.NoError(t, n.Run())
+			defer func() { _ = n.Shutdown(context.Background()) }()
+
+			enc := controlproto.NewProtobufEncoder()
+			nodeBytes, err := enc.EncodeCommand(&controlpb.Command{
+				Uid:  "old_node",
+				Node: &controlpb.Node{Uid: "old_node"},
+			})
+			require.NoError(t, err)
+			require.NoError(t, n.handleControl(nodeBytes))
+
+			notificationBytes, err := enc.EncodeCommand(&controlpb.Command{
+				Uid:          "old_node",
+				Notification: &controlpb.Notification{Op: "test"},
+			})
+			require.NoError(t, err)
+			require.NoError(t, n.handleControl(notificationBytes))
+			require.Equal(t, tc.notified, numNotifications == 1)
+
+			info, err := n.Info()
+			require.NoError(t, err)
+			require.Len(t, info.Nodes, 2)
+			for _, nd := range info.Nodes {
+				require.Equal(t, nd.UID == "old_node", nd.Incompatible, nd.UID)
+			}
+		})
+	}
+}
+
+func TestNode_runPeriodically(t *testing.T) {
+	n, err := New(Config{NodeInfoPublishInterval: time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, n.Run())
+
+	var numTicks int64
+	var numRunning int32
+	var overlapped int32
+	n.runPeriodically(time.Millisecond, func() {
+		atomic.AddInt64(&numTicks, 1)
+		// Maintenance loops must not spawn goroutines on every tick, so slow
+		// function calls never overlap.
+		if atomic.AddInt32(&numRunning, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		time.Sleep(2 * time.Millisecond)
+		atomic.AddInt32(&numRunning, -1)
+	})
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&numTicks) >= 100
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, atomic.LoadInt32(&overlapped))
+
+	require.NoError(t, n.Shutdown(context.Background()))
+	// Shutdown waits for maintenance loops, no ticks after it.
+	ticksAfterShutdown := atomic.LoadInt64(&numTicks)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, ticksAfterShutdown, atomic.LoadInt64(&numTicks))
+}
+
+func TestNode_ShutdownNoGoroutineLeak(t *testing.T) {
+	// Not parallel: relies on global goroutine count.
+	numGoroutines := runtime.NumGoroutine()
+
+	n, err := New(Config{NodeInfoPublishInterval: time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, n.Run())
+	var numTicks int64
+	n.runPeriodically(time.Millisecond, func() {
+		atomic.AddInt64(&numTicks, 1)
+	})
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&numTicks) >= 100
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, n.Shutdown(context.Background()))
+
+	// All maintenance goroutines stopped upon shutdown. Not using require.Eventually
+	// here since it runs condition in a separate goroutine.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > numGoroutines {
+		if time.Now().After(deadline) {
+			require.Fail(t, "goroutine leak", "before: %d, after: %d", numGoroutines, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNode_ShutdownContextMaintenance(t *testing.T) {
+	n, err := New(Config{})
+	require.NoError(t, err)
+	require.NoError(t, n.Run())
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	n.runPeriodically(time.Millisecond, func() {
+		once.Do(func() { close(started) })
+		<-release
+	})
+	defer close(release)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// Stuck maintenance loop does not block Shutdown past ctx.
+	require.ErrorIs(t, n.Shutdown(ctx), context.DeadlineExceeded)
+}
+
+func TestNode_OnNodeJoinLeave(t *testing.T) {
+	n, err := New(Config{
+		LogLevel:   LogLevelTrace,
+		LogHandler: func(entry LogEntry) {},
+	})
+	require.NoError(t, err)
+
+	joinCh := make(chan NodeInfoEvent, 1)
+	leaveCh := make(chan NodeInfoEvent, 1)
+	n.OnNodeJoin(func(e NodeInfoEvent) {
+		joinCh <- e
+	})
+	n.OnNodeLeave(func(e NodeInfoEvent) {
+		leaveCh <- e
+	})
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	require.NoError(t, n.nodeCmd(&controlpb.Node{Uid: "other_node", Name: "other", NumClients: 2}))
+	select {
+	case e := <-joinCh:
+		require.Equal(t, "other_node", e.Node.UID)
+		require.Equal(t, "other", e.Node.Name)
+		require.Equal(t, uint32(2), e.Node.NumClients)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for join event")
+	}
+
+	// Node info update must not produce join event.
+	require.NoError(t, n.nodeCmd(&controlpb.Node{Uid: "other_node", Name: "other", NumClients: 3}))
+	select {
+	case <-joinCh:
+		t.Fatal("unexpected join event")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, n.shutdownCmd("other_node"))
+	select {
+	case e := <-leaveCh:
+		require.Equal(t, "other_node", e.Node.UID)
+		require.Equal(t, uint32(3), e.Node.NumClients)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for leave event")
+	}
+
+	// Unknown node shutdown must not produce leave event.
+	require.NoError(t, n.shutdownCmd("unknown_node"))
+	select {
+	case <-leaveCh:
+		t.Fatal("unexpected leave event")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// controlOnRunBroker delivers control data to node right from Run.
+type controlOnRunBroker struct {
+	*MemoryBroker
+	data []byte
+}
+
+func (b *controlOnRunBroker) Run(h BrokerEventHandler) error {
+	if err := b.MemoryBroker.Run(h); err != nil {
+		return err
+	}
+	return h.HandleControl(b.data)
+}
+
+func TestNode_OnNodeJoinEmittedOnRun(t *testing.T) {
+	n, err := New(Config{})
+	require.NoError(t, err)
+	data, err := controlproto.NewProtobufEncoder().EncodeCommand(&controlpb.Command{
+		Uid:  "other_node",
+		Node: &controlpb.Node{Uid: "other_node", ControlVersion: controlProtocolVersion},
+	})
+	require.NoError(t, err)
+	b, err := NewMemoryBroker(n, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	n.SetBroker(&controlOnRunBroker{MemoryBroker: b, data: data})
+
+	joinCh := make(chan NodeInfoEvent, 1)
+	n.OnNodeJoin(func(e NodeInfoEvent) {
+		joinCh <- e
+	})
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	select {
+	case e := <-joinCh:
+		require.Equal(t, "other_node", e.Node.UID)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for join event")
+	}
+}
+
 func TestIndex(t *testing.T) {
 	require.Equal(t, 0, index("2121", 1))
 }
@@ -690,6 +1386,64 @@ func BenchmarkHistory(b *testing.B) {
 	b.ReportAllocs()
 }
 
+// controlCaptureBroker is a MemoryBroker which keeps published control
+// messages so that they can be passed to another Node.
+type controlCaptureBroker struct {
+	*MemoryBroker
+	mu      sync.Mutex
+	control [][]byte
+}
+
+func (b *controlCaptureBroker) PublishControl(data []byte, nodeID, shardKey string) error {
+	b.mu.Lock()
+	b.control = append(b.control, data)
+	b.mu.Unlock()
+	return b.MemoryBroker.PublishControl(data, nodeID, shardKey)
+}
+
+func TestNode_DisconnectControlRoundTrip(t *testing.T) {
+	sender, err := New(Config{
+		LogLevel:   LogLevelTrace,
+		LogHandler: func(entry LogEntry) {},
+	})
+	require.NoError(t, err)
+	memoryBroker, err := NewMemoryBroker(sender, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	broker := &controlCaptureBroker{MemoryBroker: memoryBroker}
+	sender.SetBroker(broker)
+	require.NoError(t, sender.Run())
+	defer func() { _ = sender.Shutdown(context.Background()) }()
+
+	receiver := defaultTestNode()
+	defer func() { _ = receiver.Shutdown(context.Background()) }()
+
+	disconnectCh := make(chan DisconnectEvent, 1)
+	receiver.OnConnect(func(client *Client) {
+		client.OnDisconnect(func(event DisconnectEvent) {
+			disconnectCh <- event
+		})
+	})
+	newTestConnectedClientV2(t, receiver, "42")
+
+	// Terminal code – client must not reconnect.
+	banned := Disconnect{Code: 4501, Reason: "banned"}
+	require.NoError(t, sender.Disconnect("42", WithCustomDisconnect(banned)))
+
+	broker.mu.Lock()
+	control := broker.control
+	broker.mu.Unlock()
+	for _, data := range control {
+		require.NoError(t, receiver.handleControl(data))
+	}
+
+	select {
+	case event := <-disconnectCh:
+		require.Equal(t, banned, event.Disconnect)
+	case <-time.After(time.Second):
+		require.Fail(t, "timeout waiting for disconnect")
+	}
+}
+
 func TestNode_handleControl(t *testing.T) {
 	t.Run("BrokenData", func(t *testing.T) {
 		t.Parallel()
@@ -1165,6 +1919,84 @@ func TestSingleFlightPresence(t *testing.T) {
 	require.Equal(t, 1, stats.NumUsers)
 }
 
+// blockingContextBroker is a MemoryBroker which History and Publish block until
+// context done.
+type blockingContextBroker struct {
+	*MemoryBroker
+}
+
+func (b *blockingContextBroker) HistoryContext(ctx context.Context, _ string, _ HistoryOptions) ([]*Publication, StreamPosition, error) {
+	<-ctx.Done()
+	return nil, StreamPosition{}, ctx.Err()
+}
+
+func (b *blockingContextBroker) PublishContext(ctx context.Context, _ string, _ []byte, _ PublishOptions) (StreamPosition, bool, error) {
+	<-ctx.Done()
+	return StreamPosition{}, false, ctx.Err()
+}
+
+// blockingPresenceManager is a MemoryPresenceManager which Presence blocks until
+// unblock channel closed.
+type blockingPresenceManager struct {
+	*MemoryPresenceManager
+	unblock chan struct{}
+}
+
+func (m *blockingPresenceManager) Presence(ch string) (map[string]*ClientInfo, error) {
+	<-m.unblock
+	return m.MemoryPresenceManager.Presence(ch)
+}
+
+func newBlockingContextBroker(t *testing.T, node *Node) *blockingContextBroker {
+	memoryBroker, err := NewMemoryBroker(node, MemoryBrokerConfig{})
+	require.NoError(t, err)
+	broker := &blockingContextBroker{MemoryBroker: memoryBroker}
+	require.NoError(t, broker.Run(&brokerEventHandler{node}))
+	return broker
+}
+
+func TestNode_HistoryContext(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.SetBroker(newBlockingContextBroker(t, node))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := node.HistoryContext(ctx, "test")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNode_PublishContext(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	node.SetBroker(newBlockingContextBroker(t, node))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := node.PublishContext(ctx, "test", []byte(`{}`))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNode_PresenceContextSingleFlight(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	node.config.UseSingleFlight = true
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	memoryPresenceManager, err := NewMemoryPresenceManager(node, MemoryPresenceManagerConfig{})
+	require.NoError(t, err)
+	presenceManager := &blockingPresenceManager{MemoryPresenceManager: memoryPresenceManager, unblock: make(chan struct{})}
+	node.SetPresenceManager(presenceManager)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = node.PresenceContext(ctx, "test")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(presenceManager.unblock)
+	result, err := node.PresenceContext(context.Background(), "test")
+	require.NoError(t, err)
+	require.Len(t, result.Presence, 0)
+}
+
 func TestBrokerEventHandler_PanicsOnNil(t *testing.T) {
 	node := defaultNodeNoHandlers()
 	defer func() { _ = node.Shutdown(context.Background()) }()
@@ -1344,3 +2176,83 @@ func TestNode_OnCommandRead(t *testing.T) {
 		require.Fail(t, "timeout subscribe")
 	}
 }
+
+func TestNode_OnClientEvent(t *testing.T) {
+	node, err := New(Config{})
+	require.NoError(t, err)
+	eventCh := make(chan ClientEvent, 10)
+	node.OnClientEvent(func(event ClientEvent) {
+		eventCh <- event
+	})
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(e SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{}, nil)
+		})
+		client.OnPublish(func(e PublishEvent, cb PublishCallback) {
+			cb(PublishReply{}, nil)
+		})
+	})
+	require.NoError(t, node.Run())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test")
+	rwWrapper := testReplyWriterWrapper()
+	err = client.handlePublish(client.Context(), &protocol.PublishRequest{
+		Channel: "test",
+		Data:    []byte(`{"input":"test"}`),
+	}, &protocol.Command{}, time.Now(), rwWrapper.rw)
+	require.NoError(t, err)
+	require.Nil(t, rwWrapper.replies[0].Error)
+	require.NoError(t, client.close(DisconnectForceNoReconnect))
+
+	expected := []ClientEvent{
+		{Type: ClientEventConnect},
+		{Type: ClientEventSubscribe, Channel: "test"},
+		{Type: ClientEventPublish, Channel: "test", PayloadSize: len(`{"input":"test"}`)},
+		{Type: ClientEventDisconnect},
+	}
+	for _, exp := range expected {
+		select {
+		case event := <-eventCh:
+			require.Equal(t, exp.Type, event.Type)
+			require.Equal(t, exp.Channel, event.Channel)
+			require.Equal(t, exp.PayloadSize, event.PayloadSize)
+			require.Equal(t, client.ID(), event.ClientID)
+			require.Equal(t, "42", event.UserID)
+			require.False(t, event.Time.IsZero())
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for client event")
+		}
+	}
+}
+
+func TestNode_OnClientEventDropped(t *testing.T) {
+	node, err := New(Config{ClientEventQueueSize: 1})
+	require.NoError(t, err)
+	unblockCh := make(chan struct{})
+	var numEvents int64
+	node.OnClientEvent(func(event ClientEvent) {
+		<-unblockCh
+		atomic.AddInt64(&numEvents, 1)
+	})
+	require.NoError(t, node.Run())
+	defer func() { _ = node.Shutdown(context.Background()) }()
+
+	node.emitClientEvent(ClientEvent{Type: ClientEventConnect})
+	// Wait for the first event to be taken by blocked handler.
+	require.Eventually(t, func() bool {
+		return len(node.clientEventQueue) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	node.emitClientEvent(ClientEvent{Type: ClientEventConnect})
+	// Queue is full – dropped.
+	node.emitClientEvent(ClientEvent{Type: ClientEventConnect})
+	close(unblockCh)
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&numEvents) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(2), atomic.LoadInt64(&numEvents))
+}
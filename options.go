@@ -6,6 +6,10 @@ import "time"
 type PublishOption func(*PublishOptions)
 
 // WithHistory tells Broker to save message to history stream with provided size and ttl.
+// History is configured per publication, so ephemeral messages (like typing indicators)
+// may be published into the same channel without this option – such publications are
+// delivered to subscribers but not saved into history stream and do not change stream
+// position.
 func WithHistory(size int, ttl time.Duration, metaTTL ...time.Duration) PublishOption {
 	return func(opts *PublishOptions) {
 		opts.HistorySize = size
@@ -39,6 +43,30 @@ func WithClientInfo(info *ClientInfo) PublishOption {
 	}
 }
 
+// WithExcludeClient tells Centrifuge to not deliver publication to a client connection
+// with provided ID. See PublishOptions.ExcludeClient.
+func WithExcludeClient(clientID string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.ExcludeClient = clientID
+	}
+}
+
+// WithCompactionKey sets compaction key for the publication.
+// See PublishOptions.CompactionKey.
+func WithCompactionKey(key string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.CompactionKey = key
+	}
+}
+
+// WithContentType sets content type of publication data.
+// See PublishOptions.ContentType.
+func WithContentType(contentType string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.ContentType = contentType
+	}
+}
+
 // WithTags allows setting Publication.Tags.
 func WithTags(meta map[string]string) PublishOption {
 	return func(opts *PublishOptions) {
@@ -86,6 +114,14 @@ type SubscribeOptions struct {
 	// HistoryMetaTTL allows to override default (set in Config.HistoryMetaTTL) history
 	// meta information expiration time.
 	HistoryMetaTTL time.Duration
+	// CompactedHistory tells that channel history is compacted (publications are published
+	// with PublishOptions.CompactionKey). In this case gaps in offsets of publications
+	// recovered from history are expected and not treated as lost messages: recovery is
+	// successful if history contains publications up to the current stream top and epoch
+	// did not change. Compaction keeps at most one publication per key only while history
+	// size is enough for all keys – make sure history size is larger than number of keys
+	// in channel, otherwise state loss won't be detected.
+	CompactedHistory bool
 
 	// clientID to subscribe.
 	clientID string
@@ -185,6 +221,13 @@ func WithSubscribeSource(source uint8) SubscribeOption {
 	}
 }
 
+// WithCompactedHistory sets CompactedHistory option.
+func WithCompactedHistory(enabled bool) SubscribeOption {
+	return func(opts *SubscribeOptions) {
+		opts.CompactedHistory = enabled
+	}
+}
+
 // WithSubscribeHistoryMetaTTL allows setting SubscribeOptions.HistoryMetaTTL.
 func WithSubscribeHistoryMetaTTL(metaTTL time.Duration) SubscribeOption {
 	return func(opts *SubscribeOptions) {
@@ -293,6 +336,9 @@ type DisconnectOptions struct {
 	clientID string
 	// sessionID to disconnect.
 	sessionID string
+	// connectedBefore if set only connections established before
+	// this time (Unix nanoseconds) are disconnected.
+	connectedBefore int64
 }
 
 // DisconnectOption is a type to represent various Disconnect options.
@@ -319,6 +365,14 @@ func WithDisconnectSession(sessionID string) DisconnectOption {
 	}
 }
 
+// withDisconnectConnectedBefore allows disconnecting only connections
+// established before the time (in Unix nanoseconds).
+func withDisconnectConnectedBefore(connectedBefore int64) DisconnectOption {
+	return func(opts *DisconnectOptions) {
+		opts.connectedBefore = connectedBefore
+	}
+}
+
 // WithDisconnectClientWhitelist allows setting ClientWhitelist.
 func WithDisconnectClientWhitelist(whitelist []string) DisconnectOption {
 	return func(opts *DisconnectOptions) {
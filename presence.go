@@ -1,5 +1,7 @@
 package centrifuge
 
+import "context"
+
 // PresenceStats represents a short presence information for channel.
 type PresenceStats struct {
 	// NumClients is a number of client connections in channel.
@@ -25,3 +27,36 @@ type PresenceManager interface {
 	// with specified client and user identifiers.
 	RemovePresence(ch string, clientID string, userID string) error
 }
+
+// PresenceCleaner is an optional interface PresenceManager may implement to remove
+// expired presence entries of channel on demand. See Node.CleanPresence.
+type PresenceCleaner interface {
+	// CleanPresence removes channel presence entries which were not updated within
+	// presence TTL and returns the number of removed entries.
+	CleanPresence(ch string) (int, error)
+}
+
+// PresenceContextManager is an optional interface PresenceManager may implement to
+// respect caller context (deadline and cancellation) when loading channel presence.
+// See Node.PresenceContext.
+type PresenceContextManager interface {
+	// PresenceContext is the same as PresenceManager.Presence but aborts when ctx
+	// is done.
+	PresenceContext(ctx context.Context, ch string) (map[string]*ClientInfo, error)
+}
+
+// PresencePager is an optional interface PresenceManager may implement to return
+// channel presence in pages. This allows iterating over presence of channels with
+// huge number of subscribers without loading everything into memory at once.
+// See Node.PresencePage.
+type PresencePager interface {
+	// PresencePage returns up to limit presence entries of channel starting from
+	// cursor (empty string to start from the beginning) and a cursor to request the
+	// next page with. Empty next cursor means that iteration is complete. Limit is a
+	// hint, implementation may return a bit more or less entries in one page.
+	//
+	// Iteration is not a snapshot: clients joining or leaving channel while iterating
+	// may be missed, and implementations are allowed to return the same entry in
+	// different pages.
+	PresencePage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error)
+}
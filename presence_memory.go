@@ -2,7 +2,9 @@ package centrifuge
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 )
 
 // MemoryPresenceManager is builtin default PresenceManager which allows running
@@ -20,20 +22,52 @@ type MemoryPresenceManager struct {
 	node        *Node
 	config      MemoryPresenceManagerConfig
 	presenceHub *presenceHub
+	closeOnce   sync.Once
+	closeCh     chan struct{}
 }
 
 var _ PresenceManager = (*MemoryPresenceManager)(nil)
+var _ PresenceCleaner = (*MemoryPresenceManager)(nil)
 
 // MemoryPresenceManagerConfig is a MemoryPresenceManager config.
-type MemoryPresenceManagerConfig struct{}
+type MemoryPresenceManagerConfig struct {
+	// PresenceTTL is an interval how long to consider presence info valid after
+	// receiving presence update. Expired entries are not returned in presence
+	// results and periodically removed from memory. Zero value means that presence
+	// entries never expire and only removed upon unsubscribe.
+	PresenceTTL time.Duration
+}
 
 // NewMemoryPresenceManager initializes MemoryPresenceManager.
 func NewMemoryPresenceManager(n *Node, c MemoryPresenceManagerConfig) (*MemoryPresenceManager, error) {
-	return &MemoryPresenceManager{
+	hub := newPresenceHub()
+	hub.ttl = c.PresenceTTL
+	m := &MemoryPresenceManager{
 		node:        n,
 		config:      c,
-		presenceHub: newPresenceHub(),
-	}, nil
+		presenceHub: hub,
+		closeCh:     make(chan struct{}),
+	}
+	if c.PresenceTTL > 0 {
+		go m.expire()
+	}
+	return m, nil
+}
+
+func (m *MemoryPresenceManager) expire() {
+	ticker := time.NewTicker(m.config.PresenceTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closeCh:
+			return
+		case <-ticker.C:
+			numExpired := m.presenceHub.clean()
+			if numExpired > 0 {
+				m.node.metrics.incPresenceExpired(numExpired)
+			}
+		}
+	}
 }
 
 // AddPresence - see PresenceManager interface description.
@@ -51,39 +85,142 @@ func (m *MemoryPresenceManager) Presence(ch string) (map[string]*ClientInfo, err
 	return m.presenceHub.get(ch)
 }
 
+// PresencePage - see PresencePager interface description. Entries are ordered by
+// client ID, cursor is the last client ID of the previous page. So clients which
+// join during iteration are only returned if their ID is greater than cursor.
+func (m *MemoryPresenceManager) PresencePage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	return m.presenceHub.getPage(ch, cursor, limit)
+}
+
 // PresenceStats - see PresenceManager interface description.
 func (m *MemoryPresenceManager) PresenceStats(ch string) (PresenceStats, error) {
 	return m.presenceHub.getStats(ch)
 }
 
-// Close is noop for now.
+// CleanPresence - see PresenceCleaner interface description.
+func (m *MemoryPresenceManager) CleanPresence(ch string) (int, error) {
+	return m.presenceHub.cleanChannel(ch), nil
+}
+
+// Close stops expiration of presence entries.
 func (m *MemoryPresenceManager) Close(_ context.Context) error {
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+	})
 	return nil
 }
 
+type presenceEntry struct {
+	info *ClientInfo
+	// expireAt is a Unix time in nanoseconds, zero means no expiration.
+	expireAt int64
+}
+
+func (e presenceEntry) expired(now int64) bool {
+	return e.expireAt > 0 && e.expireAt <= now
+}
+
 type presenceHub struct {
 	sync.RWMutex
-	presence map[string]map[string]*ClientInfo
+	presence map[string]map[string]presenceEntry
+	// sortedIDs keeps sorted client IDs of channels requested with getPage, so pages
+	// are served without sorting the entire channel presence every time.
+	sortedIDs map[string][]string
+	ttl       time.Duration
 }
 
 func newPresenceHub() *presenceHub {
 	return &presenceHub{
-		presence: make(map[string]map[string]*ClientInfo),
+		presence:  make(map[string]map[string]presenceEntry),
+		sortedIDs: make(map[string][]string),
 	}
 }
 
+func insertSortedID(ids []string, id string) []string {
+	i := sort.SearchStrings(ids, id)
+	ids = append(ids, "")
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func removeSortedID(ids []string, id string) []string {
+	i := sort.SearchStrings(ids, id)
+	if i < len(ids) && ids[i] == id {
+		ids = append(ids[:i], ids[i+1:]...)
+	}
+	return ids
+}
+
 func (h *presenceHub) add(ch string, uid string, info *ClientInfo) error {
 	h.Lock()
 	defer h.Unlock()
 
 	_, ok := h.presence[ch]
 	if !ok {
-		h.presence[ch] = make(map[string]*ClientInfo)
+		h.presence[ch] = make(map[string]presenceEntry)
+	}
+	var expireAt int64
+	if h.ttl > 0 {
+		expireAt = time.Now().Add(h.ttl).UnixNano()
+	}
+	if _, exists := h.presence[ch][uid]; !exists {
+		if ids, ok := h.sortedIDs[ch]; ok {
+			h.sortedIDs[ch] = insertSortedID(ids, uid)
+		}
 	}
-	h.presence[ch][uid] = info
+	h.presence[ch][uid] = presenceEntry{info: info, expireAt: expireAt}
 	return nil
 }
 
+// clean removes expired presence entries and returns number of removed entries.
+func (h *presenceHub) clean() int {
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now().UnixNano()
+	numExpired := 0
+	for ch := range h.presence {
+		numExpired += h.cleanChannelLocked(ch, now)
+	}
+	return numExpired
+}
+
+// cleanChannel removes expired presence entries of channel and returns number of
+// removed entries.
+func (h *presenceHub) cleanChannel(ch string) int {
+	h.Lock()
+	defer h.Unlock()
+	return h.cleanChannelLocked(ch, time.Now().UnixNano())
+}
+
+func (h *presenceHub) cleanChannelLocked(ch string, now int64) int {
+	presence, ok := h.presence[ch]
+	if !ok {
+		return 0
+	}
+	numExpired := 0
+	for uid, entry := range presence {
+		if entry.expired(now) {
+			delete(presence, uid)
+			numExpired++
+		}
+	}
+	if len(presence) == 0 {
+		delete(h.presence, ch)
+		delete(h.sortedIDs, ch)
+	} else if ids, ok := h.sortedIDs[ch]; ok && numExpired > 0 {
+		valid := ids[:0]
+		for _, uid := range ids {
+			if _, ok := presence[uid]; ok {
+				valid = append(valid, uid)
+			}
+		}
+		h.sortedIDs[ch] = valid
+	}
+	return numExpired
+}
+
 func (h *presenceHub) remove(ch string, uid string) error {
 	h.Lock()
 	defer h.Unlock()
@@ -96,10 +233,14 @@ func (h *presenceHub) remove(ch string, uid string) error {
 	}
 
 	delete(h.presence[ch], uid)
+	if ids, ok := h.sortedIDs[ch]; ok {
+		h.sortedIDs[ch] = removeSortedID(ids, uid)
+	}
 
 	// clean up map if needed
 	if len(h.presence[ch]) == 0 {
 		delete(h.presence, ch)
+		delete(h.sortedIDs, ch)
 	}
 
 	return nil
@@ -115,13 +256,61 @@ func (h *presenceHub) get(ch string) (map[string]*ClientInfo, error) {
 		return nil, nil
 	}
 
+	now := time.Now().UnixNano()
 	data := make(map[string]*ClientInfo, len(presence))
 	for k, v := range presence {
-		data[k] = v
+		if v.expired(now) {
+			continue
+		}
+		data[k] = v.info
 	}
 	return data, nil
 }
 
+func (h *presenceHub) getPage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	// Write lock since sorted index of channel may be built here.
+	h.Lock()
+	defer h.Unlock()
+
+	presence, ok := h.presence[ch]
+	if !ok {
+		return nil, "", nil
+	}
+
+	ids, ok := h.sortedIDs[ch]
+	if !ok {
+		ids = make([]string, 0, len(presence))
+		for uid := range presence {
+			ids = append(ids, uid)
+		}
+		sort.Strings(ids)
+		h.sortedIDs[ch] = ids
+	}
+
+	now := time.Now().UnixNano()
+	size := limit
+	if len(ids) < size {
+		size = len(ids)
+	}
+	data := make(map[string]*ClientInfo, size)
+	var lastID, nextCursor string
+	for i := sort.SearchStrings(ids, cursor); i < len(ids); i++ {
+		uid := ids[i]
+		entry := presence[uid]
+		if uid <= cursor || entry.expired(now) {
+			continue
+		}
+		if len(data) == limit {
+			// There are more entries after this page.
+			nextCursor = lastID
+			break
+		}
+		data[uid] = entry.info
+		lastID = uid
+	}
+	return data, nextCursor, nil
+}
+
 func (h *presenceHub) getStats(ch string) (PresenceStats, error) {
 	h.RLock()
 	defer h.RUnlock()
@@ -132,12 +321,17 @@ func (h *presenceHub) getStats(ch string) (PresenceStats, error) {
 		return PresenceStats{}, nil
 	}
 
-	numClients := len(presence)
+	now := time.Now().UnixNano()
+	numClients := 0
 	numUsers := 0
 	uniqueUsers := map[string]struct{}{}
 
-	for _, info := range presence {
-		userID := info.UserID
+	for _, entry := range presence {
+		if entry.expired(now) {
+			continue
+		}
+		numClients++
+		userID := entry.info.UserID
 		if _, ok := uniqueUsers[userID]; !ok {
 			uniqueUsers[userID] = struct{}{}
 			numUsers++
@@ -2,8 +2,11 @@ package centrifuge
 
 import (
 	"context"
+	"strconv"
 	"testing"
+	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,6 +35,71 @@ func TestNewMemoryPresenceManager_RemovePresence(t *testing.T) {
 	require.Equal(t, 0, len(p))
 }
 
+func TestMemoryPresenceManager_PresenceTTL(t *testing.T) {
+	n, _ := New(Config{
+		LogLevel:   LogLevelDebug,
+		LogHandler: func(entry LogEntry) {},
+	})
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+	m, _ := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{
+		PresenceTTL: 50 * time.Millisecond,
+	})
+	defer func() { _ = m.Close(context.Background()) }()
+
+	require.NoError(t, m.AddPresence("channel", "uid", &ClientInfo{UserID: "user"}))
+	p, err := m.Presence("channel")
+	require.NoError(t, err)
+	require.Len(t, p, 1)
+
+	time.Sleep(60 * time.Millisecond)
+	p, err = m.Presence("channel")
+	require.NoError(t, err)
+	require.Len(t, p, 0)
+	stats, err := m.PresenceStats("channel")
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.NumClients)
+
+	require.Eventually(t, func() bool {
+		m.presenceHub.RLock()
+		defer m.presenceHub.RUnlock()
+		return len(m.presenceHub.presence) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryPresenceManager_CleanPresence(t *testing.T) {
+	n, _ := New(Config{
+		LogLevel:   LogLevelDebug,
+		LogHandler: func(entry LogEntry) {},
+	})
+	// No PresenceTTL in config so periodic expiration does not interfere.
+	m, _ := NewMemoryPresenceManager(n, MemoryPresenceManagerConfig{})
+	m.presenceHub.ttl = 50 * time.Millisecond
+	n.SetPresenceManager(m)
+	require.NoError(t, n.Run())
+	defer func() { _ = n.Shutdown(context.Background()) }()
+
+	require.NoError(t, m.AddPresence("channel", "uid-1", &ClientInfo{UserID: "1"}))
+	require.NoError(t, m.AddPresence("channel", "uid-2", &ClientInfo{UserID: "2"}))
+	require.NoError(t, m.AddPresence("other", "uid-3", &ClientInfo{UserID: "3"}))
+	numExpired, err := n.CleanPresence("channel")
+	require.NoError(t, err)
+	require.Equal(t, 0, numExpired)
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, m.AddPresence("channel", "uid-4", &ClientInfo{UserID: "4"}))
+	numExpired, err = n.CleanPresence("channel")
+	require.NoError(t, err)
+	require.Equal(t, 2, numExpired)
+	require.Len(t, m.presenceHub.presence["channel"], 1)
+	// Other channels are not touched.
+	require.Len(t, m.presenceHub.presence["other"], 1)
+
+	var metric dto.Metric
+	require.NoError(t, n.metrics.presenceExpiredCount.Write(&metric))
+	require.Equal(t, float64(2), metric.GetCounter().GetValue())
+}
+
 func TestMemoryPresenceHub(t *testing.T) {
 	h := newPresenceHub()
 	require.Equal(t, 0, len(h.presence))
@@ -143,3 +211,78 @@ func BenchmarkMemoryPresence_OneChannel_Parallel(b *testing.B) {
 		}
 	})
 }
+
+func TestMemoryPresenceManager_PresencePage(t *testing.T) {
+	m := testMemoryPresenceManager(t)
+	defer func() { _ = m.node.Shutdown(context.Background()) }()
+
+	for i := 10; i < 35; i++ {
+		uid := "uid" + strconv.Itoa(i)
+		require.NoError(t, m.AddPresence("channel", uid, &ClientInfo{ClientID: uid}))
+	}
+
+	page, cursor, err := m.PresencePage("channel", "", 10)
+	require.NoError(t, err)
+	require.Len(t, page, 10)
+	require.Equal(t, "uid19", cursor)
+	require.Contains(t, page, "uid10")
+	require.Contains(t, page, "uid19")
+
+	// Concurrent joins: entries ordered before cursor are missed, after – returned.
+	require.NoError(t, m.AddPresence("channel", "uid15a", &ClientInfo{ClientID: "uid15a"}))
+	require.NoError(t, m.AddPresence("channel", "uid35", &ClientInfo{ClientID: "uid35"}))
+	// Concurrent leave of entry not yet returned.
+	require.NoError(t, m.RemovePresence("channel", "uid20", ""))
+
+	page, cursor, err = m.PresencePage("channel", cursor, 10)
+	require.NoError(t, err)
+	require.Len(t, page, 10)
+	require.Equal(t, "uid30", cursor)
+	require.NotContains(t, page, "uid15a")
+	require.NotContains(t, page, "uid20")
+
+	page, cursor, err = m.PresencePage("channel", cursor, 10)
+	require.NoError(t, err)
+	require.Len(t, page, 5)
+	require.Empty(t, cursor)
+	require.Contains(t, page, "uid35")
+
+	page, cursor, err = m.PresencePage("unknown", "", 10)
+	require.NoError(t, err)
+	require.Len(t, page, 0)
+	require.Empty(t, cursor)
+}
+
+func TestMemoryPresenceManager_PresencePageSortedIndex(t *testing.T) {
+	h := newPresenceHub()
+	h.ttl = time.Minute
+	for _, uid := range []string{"c", "a", "b"} {
+		require.NoError(t, h.add("channel", uid, &ClientInfo{ClientID: uid}))
+	}
+	_, _, err := h.getPage("channel", "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, h.sortedIDs["channel"])
+
+	// Index kept in sync without re-sorting on every page.
+	require.NoError(t, h.add("channel", "bb", &ClientInfo{ClientID: "bb"}))
+	require.NoError(t, h.add("channel", "a", &ClientInfo{ClientID: "a"}))
+	require.NoError(t, h.remove("channel", "c"))
+	require.Equal(t, []string{"a", "b", "bb"}, h.sortedIDs["channel"])
+
+	// Expired entries skipped in pages and removed from index on clean.
+	h.presence["channel"]["b"] = presenceEntry{info: &ClientInfo{ClientID: "b"}, expireAt: 1}
+	page, cursor, err := h.getPage("channel", "", 1)
+	require.NoError(t, err)
+	require.Contains(t, page, "a")
+	require.Equal(t, "a", cursor)
+	page, cursor, err = h.getPage("channel", cursor, 1)
+	require.NoError(t, err)
+	require.Contains(t, page, "bb")
+	require.Empty(t, cursor)
+	require.Equal(t, 1, h.cleanChannel("channel"))
+	require.Equal(t, []string{"a", "bb"}, h.sortedIDs["channel"])
+
+	require.NoError(t, h.remove("channel", "a"))
+	require.NoError(t, h.remove("channel", "bb"))
+	require.NotContains(t, h.sortedIDs, "channel")
+}
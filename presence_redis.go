@@ -16,6 +16,7 @@ import (
 )
 
 var _ PresenceManager = (*RedisPresenceManager)(nil)
+var _ PresenceCleaner = (*RedisPresenceManager)(nil)
 
 // RedisPresenceManager keeps presence in Redis thus allows scaling nodes.
 type RedisPresenceManager struct {
@@ -27,6 +28,8 @@ type RedisPresenceManager struct {
 	remPresenceScript   *rueidis.Lua
 	presenceScript      *rueidis.Lua
 	presenceStatsScript *rueidis.Lua
+	cleanPresenceScript *rueidis.Lua
+	presencePageScript  *rueidis.Lua
 }
 
 // RedisPresenceManagerConfig is a config for RedisPresenceManager.
@@ -66,6 +69,12 @@ var (
 
 	//go:embed internal/redis_lua/presence_stats_get.lua
 	presenceStatsScriptSource string
+
+	//go:embed internal/redis_lua/presence_clean.lua
+	cleanPresenceScriptSource string
+
+	//go:embed internal/redis_lua/presence_page.lua
+	presencePageScriptSource string
 )
 
 // NewRedisPresenceManager creates new RedisPresenceManager.
@@ -96,6 +105,8 @@ func NewRedisPresenceManager(n *Node, config RedisPresenceManagerConfig) (*Redis
 		remPresenceScript:   rueidis.NewLuaScript(remPresenceScriptSource),
 		presenceScript:      rueidis.NewLuaScript(presenceScriptSource),
 		presenceStatsScript: rueidis.NewLuaScript(presenceStatsScriptSource),
+		cleanPresenceScript: rueidis.NewLuaScript(cleanPresenceScriptSource),
+		presencePageScript:  rueidis.NewLuaScript(presencePageScriptSource),
 	}
 	return m, nil
 }
@@ -188,7 +199,12 @@ func (m *RedisPresenceManager) removePresence(s *RedisShard, ch string, clientID
 
 // Presence - see PresenceManager interface description.
 func (m *RedisPresenceManager) Presence(ch string) (map[string]*ClientInfo, error) {
-	return m.presence(m.getShard(ch), ch)
+	return m.presence(context.Background(), m.getShard(ch), ch)
+}
+
+// PresenceContext - see PresenceContextManager.PresenceContext.
+func (m *RedisPresenceManager) PresenceContext(ctx context.Context, ch string) (map[string]*ClientInfo, error) {
+	return m.presence(ctx, m.getShard(ch), ch)
 }
 
 func (m *RedisPresenceManager) presenceScriptKeysArgs(s *RedisShard, ch string) ([]string, []string, error) {
@@ -202,6 +218,47 @@ func (m *RedisPresenceManager) presenceScriptKeysArgs(s *RedisShard, ch string)
 	return keys, args, nil
 }
 
+// PresencePage - see PresencePager interface description. Implemented with HSCAN,
+// so it inherits its guarantees: entries present during the whole iteration are
+// returned at least once, but may be returned more than once.
+func (m *RedisPresenceManager) PresencePage(ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	return m.presencePage(m.getShard(ch), ch, cursor, limit)
+}
+
+func (m *RedisPresenceManager) presencePage(s *RedisShard, ch string, cursor string, limit int) (map[string]*ClientInfo, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	keys := []string{string(m.presenceSetKey(s, ch)), string(m.presenceHashKey(s, ch))}
+	args := []string{strconv.Itoa(int(time.Now().Unix())), cursor, strconv.Itoa(limit)}
+	resp, err := m.presencePageScript.Exec(context.Background(), s.client, keys, args).ToArray()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(resp) != 3 {
+		return nil, "", errors.New("wrong Redis reply: must have three values")
+	}
+	if err := m.reportExpired(resp[2]); err != nil {
+		return nil, "", err
+	}
+	nextCursor, err := resp[0].ToString()
+	if err != nil {
+		return nil, "", errors.New("wrong Redis reply cursor")
+	}
+	if nextCursor == "0" {
+		nextCursor = ""
+	}
+	values, err := resp[1].ToArray()
+	if err != nil {
+		return nil, "", err
+	}
+	presence, err := mapStringClientInfo(values)
+	if err != nil {
+		return nil, "", err
+	}
+	return presence, nextCursor, nil
+}
+
 func (m *RedisPresenceManager) presenceStatsScriptKeysArgs(s *RedisShard, ch string) ([]string, []string, error) {
 	setKey := m.presenceSetKey(s, ch)
 	hashKey := m.presenceHashKey(s, ch)
@@ -215,16 +272,55 @@ func (m *RedisPresenceManager) presenceStatsScriptKeysArgs(s *RedisShard, ch str
 	return keys, args, nil
 }
 
-func (m *RedisPresenceManager) presence(s *RedisShard, ch string) (map[string]*ClientInfo, error) {
+func (m *RedisPresenceManager) presence(ctx context.Context, s *RedisShard, ch string) (map[string]*ClientInfo, error) {
 	keys, args, err := m.presenceScriptKeysArgs(s, ch)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := m.presenceScript.Exec(context.Background(), s.client, keys, args).ToArray()
+	resp, err := m.presenceScript.Exec(ctx, s.client, keys, args).ToArray()
 	if err != nil {
 		return nil, err
 	}
-	return mapStringClientInfo(resp)
+	if len(resp) != 2 {
+		return nil, errors.New("wrong Redis reply: must have two values")
+	}
+	if err := m.reportExpired(resp[0]); err != nil {
+		return nil, err
+	}
+	values, err := resp[1].ToArray()
+	if err != nil {
+		return nil, err
+	}
+	return mapStringClientInfo(values)
+}
+
+// reportExpired accounts number of expired presence entries removed by Lua script.
+func (m *RedisPresenceManager) reportExpired(reply rueidis.RedisMessage) error {
+	numExpired, err := reply.AsInt64()
+	if err != nil {
+		return errors.New("wrong Redis reply num expired")
+	}
+	if numExpired > 0 {
+		m.node.metrics.incPresenceExpired(int(numExpired))
+	}
+	return nil
+}
+
+// CleanPresence - see PresenceCleaner interface description.
+func (m *RedisPresenceManager) CleanPresence(ch string) (int, error) {
+	return m.cleanPresence(m.getShard(ch), ch)
+}
+
+func (m *RedisPresenceManager) cleanPresence(s *RedisShard, ch string) (int, error) {
+	keys, args, err := m.presenceStatsScriptKeysArgs(s, ch)
+	if err != nil {
+		return 0, err
+	}
+	numExpired, err := m.cleanPresenceScript.Exec(context.Background(), s.client, keys, args).AsInt64()
+	if err != nil {
+		return 0, err
+	}
+	return int(numExpired), nil
 }
 
 func mapStringClientInfo(result []rueidis.RedisMessage) (map[string]*ClientInfo, error) {
@@ -260,8 +356,11 @@ func (m *RedisPresenceManager) presenceStats(s *RedisShard, ch string) (Presence
 	if err != nil {
 		return PresenceStats{}, err
 	}
-	if len(replies) != 2 {
-		return PresenceStats{}, errors.New("wrong Redis reply: must have two values")
+	if len(replies) != 3 {
+		return PresenceStats{}, errors.New("wrong Redis reply: must have three values")
+	}
+	if err := m.reportExpired(replies[2]); err != nil {
+		return PresenceStats{}, err
 	}
 	numClients, err := replies[0].AsInt64()
 	if err != nil {
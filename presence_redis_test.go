@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -111,6 +112,43 @@ func TestRedisPresenceManager(t *testing.T) {
 	}
 }
 
+func TestRedisPresenceManagerPresencePage(t *testing.T) {
+	for _, tt := range redisPresenceTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			pm := newTestRedisPresenceManager(t, node, tt.UseCluster, false)
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisPresenceManager(pm)
+
+			const numClients = 1000
+			for i := 0; i < numClients; i++ {
+				uid := "uid" + strconv.Itoa(i)
+				require.NoError(t, pm.AddPresence("channel", uid, &ClientInfo{ClientID: uid}))
+			}
+
+			// HSCAN may return the same entry several times, so count unique entries.
+			seen := map[string]struct{}{}
+			cursor := ""
+			numPages := 0
+			for {
+				page, nextCursor, err := pm.PresencePage("channel", cursor, 100)
+				require.NoError(t, err)
+				numPages++
+				for uid, info := range page {
+					require.Equal(t, uid, info.ClientID)
+					seen[uid] = struct{}{}
+				}
+				if nextCursor == "" {
+					break
+				}
+				cursor = nextCursor
+			}
+			require.Len(t, seen, numClients)
+			require.Greater(t, numPages, 1)
+		})
+	}
+}
+
 func TestRedisPresenceManagerWithUserMapping(t *testing.T) {
 	for _, tt := range redisPresenceTests {
 		t.Run(tt.Name, func(t *testing.T) {
@@ -391,3 +429,64 @@ func BenchmarkRedisPresenceStatsWithMapping(b *testing.B) {
 		}
 	})
 }
+
+func TestRedisPresenceManagerCleanPresence(t *testing.T) {
+	for _, tt := range redisPresenceTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			pm := newTestRedisPresenceManager(t, node, tt.UseCluster, true)
+			pm.config.PresenceTTL = time.Second
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisPresenceManager(pm)
+
+			require.NoError(t, pm.AddPresence("channel", "uid-1", &ClientInfo{ClientID: "uid-1", UserID: "1"}))
+			require.NoError(t, pm.AddPresence("channel", "uid-2", &ClientInfo{ClientID: "uid-2", UserID: "2"}))
+			numExpired, err := node.CleanPresence("channel")
+			require.NoError(t, err)
+			require.Equal(t, 0, numExpired)
+
+			time.Sleep(2100 * time.Millisecond)
+			require.NoError(t, pm.AddPresence("channel", "uid-3", &ClientInfo{ClientID: "uid-3", UserID: "3"}))
+			numExpired, err = node.CleanPresence("channel")
+			require.NoError(t, err)
+			require.Equal(t, 2, numExpired)
+
+			stats, err := pm.PresenceStats("channel")
+			require.NoError(t, err)
+			require.Equal(t, 1, stats.NumClients)
+			require.Equal(t, 1, stats.NumUsers)
+		})
+	}
+}
+
+func TestRedisPresenceManagerExpiredMetric(t *testing.T) {
+	for _, tt := range redisPresenceTests {
+		t.Run(tt.Name, func(t *testing.T) {
+			node := testNode(t)
+			pm := newTestRedisPresenceManager(t, node, tt.UseCluster, false)
+			pm.config.PresenceTTL = time.Second
+			defer func() { _ = node.Shutdown(context.Background()) }()
+			defer stopRedisPresenceManager(pm)
+
+			counterValue := func() float64 {
+				var m dto.Metric
+				require.NoError(t, node.metrics.presenceExpiredCount.Write(&m))
+				return m.GetCounter().GetValue()
+			}
+
+			require.NoError(t, pm.AddPresence("channel", "uid-1", &ClientInfo{ClientID: "uid-1"}))
+			require.NoError(t, pm.AddPresence("channel", "uid-2", &ClientInfo{ClientID: "uid-2"}))
+			time.Sleep(2100 * time.Millisecond)
+
+			p, err := pm.Presence("channel")
+			require.NoError(t, err)
+			require.Len(t, p, 0)
+			require.Equal(t, float64(2), counterValue())
+
+			// Already removed entries are not counted again.
+			_, err = pm.Presence("channel")
+			require.NoError(t, err)
+			require.Equal(t, float64(2), counterValue())
+		})
+	}
+}
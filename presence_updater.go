@@ -0,0 +1,94 @@
+package centrifuge
+
+import (
+	"sync"
+	"time"
+)
+
+// presenceUpdateBatchSize is a max number of clients which presence is refreshed
+// in one batch. Presence of clients in a batch is updated concurrently, so this
+// also limits the number of concurrent PresenceManager calls made by updater.
+const presenceUpdateBatchSize = 128
+
+// presenceUpdater refreshes presence of connected clients in a single goroutine.
+// Clients add themselves to the queue every ClientPresenceUpdateInterval, updater
+// processes queued clients in batches. A client is queued at most once, so slow
+// PresenceManager results in less frequent updates instead of growing queue.
+type presenceUpdater struct {
+	mu       sync.Mutex
+	clients  []*Client
+	queued   map[*Client]struct{}
+	notifyCh chan struct{}
+}
+
+func newPresenceUpdater() *presenceUpdater {
+	return &presenceUpdater{
+		queued:   make(map[*Client]struct{}),
+		notifyCh: make(chan struct{}, 1),
+	}
+}
+
+func (u *presenceUpdater) add(c *Client) {
+	u.mu.Lock()
+	if _, ok := u.queued[c]; ok {
+		u.mu.Unlock()
+		return
+	}
+	u.queued[c] = struct{}{}
+	u.clients = append(u.clients, c)
+	u.mu.Unlock()
+	select {
+	case u.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// next returns up to presenceUpdateBatchSize queued clients.
+func (u *presenceUpdater) next() []*Client {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n := len(u.clients)
+	if n > presenceUpdateBatchSize {
+		n = presenceUpdateBatchSize
+	}
+	batch := make([]*Client, n)
+	copy(batch, u.clients)
+	for i := 0; i < n; i++ {
+		delete(u.queued, u.clients[i])
+		u.clients[i] = nil
+	}
+	u.clients = u.clients[n:]
+	return batch
+}
+
+func (u *presenceUpdater) run(closeCh chan struct{}, m *metrics) {
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-u.notifyCh:
+		}
+		for {
+			batch := u.next()
+			if len(batch) == 0 {
+				break
+			}
+			started := time.Now()
+			var wg sync.WaitGroup
+			wg.Add(len(batch))
+			for _, c := range batch {
+				go func(c *Client) {
+					defer wg.Done()
+					c.refreshPresence()
+				}(c)
+			}
+			wg.Wait()
+			m.observePresenceUpdateBatchDuration(time.Since(started))
+			select {
+			case <-closeCh:
+				return
+			default:
+			}
+		}
+	}
+}
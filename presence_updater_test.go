@@ -0,0 +1,71 @@
+package centrifuge
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresenceUpdaterBatches(t *testing.T) {
+	u := newPresenceUpdater()
+	clients := make([]*Client, presenceUpdateBatchSize*2+10)
+	for i := range clients {
+		clients[i] = &Client{}
+		u.add(clients[i])
+	}
+	// Already queued client is not added twice.
+	u.add(clients[0])
+	require.Len(t, u.clients, len(clients))
+
+	require.Equal(t, clients[:presenceUpdateBatchSize], u.next())
+	require.Equal(t, clients[presenceUpdateBatchSize:2*presenceUpdateBatchSize], u.next())
+	// Client may be queued again after it was taken into a batch.
+	u.add(clients[0])
+	require.Equal(t, append(clients[2*presenceUpdateBatchSize:], clients[0]), u.next())
+	require.Len(t, u.next(), 0)
+	require.Len(t, u.queued, 0)
+}
+
+func TestClientPresenceUpdateBatched(t *testing.T) {
+	t.Parallel()
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	presenceManager := NewTestPresenceManager()
+	node.SetPresenceManager(presenceManager)
+
+	node.OnConnect(func(client *Client) {
+		client.OnSubscribe(func(event SubscribeEvent, cb SubscribeCallback) {
+			cb(SubscribeReply{
+				Options: SubscribeOptions{EmitPresence: event.Channel != "no_presence"},
+			}, nil)
+		})
+	})
+
+	client := newTestClient(t, node, "42")
+	connectClientV2(t, client)
+	subscribeClientV2(t, client, "test1")
+	subscribeClientV2(t, client, "test2")
+	subscribeClientV2(t, client, "no_presence")
+	numAdded := atomic.LoadInt32(&presenceManager.addPresenceCount)
+	require.EqualValues(t, 2, numAdded)
+
+	client.updatePresence()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&presenceManager.addPresenceCount) == numAdded+2
+	}, time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		var m dto.Metric
+		require.NoError(t, node.metrics.presenceUpdateBatchDuration.Write(&m))
+		return m.GetSummary().GetSampleCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Closed client does not update presence.
+	_ = client.close(DisconnectForceNoReconnect)
+	client.refreshPresence()
+	require.EqualValues(t, numAdded+2, atomic.LoadInt32(&presenceManager.addPresenceCount))
+}
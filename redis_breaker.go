@@ -0,0 +1,91 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultRedisPublishBreakerCooldown = 5 * time.Second
+
+var (
+	// ErrRedisPublishTimeout returned by RedisBroker.Publish when publish was not
+	// finished within RedisBrokerConfig.PublishTimeout.
+	ErrRedisPublishTimeout = errors.New("redis: publish timeout")
+	// ErrRedisShardUnhealthy returned by RedisBroker.Publish when Redis shard circuit
+	// breaker is open and publish fails fast. See RedisBrokerConfig.PublishBreakerThreshold.
+	ErrRedisShardUnhealthy = errors.New("redis: shard unhealthy")
+)
+
+// shardBreaker is a circuit breaker for publishes to a single Redis shard. After
+// threshold consecutive publish timeouts breaker opens, and publishes fail fast
+// for cooldown. After cooldown a single probe publish is let through – breaker
+// closes if it succeeds.
+type shardBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newShardBreaker(threshold int, cooldown time.Duration) *shardBreaker {
+	return &shardBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether publish may proceed and whether it's a probe publish.
+func (cb *shardBreaker) allow() (ok bool, probe bool) {
+	if cb.threshold <= 0 {
+		return true, false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.failures < cb.threshold {
+		return true, false
+	}
+	if cb.probing || time.Since(cb.openedAt) < cb.cooldown {
+		return false, false
+	}
+	cb.probing = true
+	return true, true
+}
+
+// done must be called with publish result after allow returned true. Returns true
+// in changed if shard health changed, in this case healthy contains new state.
+func (cb *shardBreaker) done(probe bool, err error) (changed bool, healthy bool) {
+	if cb.threshold <= 0 {
+		return false, true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe {
+		cb.probing = false
+	}
+	if err == nil {
+		wasOpen := cb.failures >= cb.threshold
+		cb.failures = 0
+		return wasOpen, true
+	}
+	if !isTimeoutError(err) {
+		// Redis responded – not a reason to change breaker state.
+		return false, cb.failures < cb.threshold
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openedAt = time.Now()
+	}
+	return cb.failures == cb.threshold, cb.failures < cb.threshold
+}
+
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, ErrRedisPublishTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,99 @@
+package centrifuge
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardBreaker(t *testing.T) {
+	cb := newShardBreaker(2, 50*time.Millisecond)
+
+	ok, probe := cb.allow()
+	require.True(t, ok)
+	require.False(t, probe)
+	changed, _ := cb.done(false, context.DeadlineExceeded)
+	require.False(t, changed)
+
+	// Non-timeout errors do not affect breaker state.
+	changed, healthy := cb.done(false, errors.New("boom"))
+	require.False(t, changed)
+	require.True(t, healthy)
+
+	changed, healthy = cb.done(false, ErrRedisPublishTimeout)
+	require.True(t, changed)
+	require.False(t, healthy)
+
+	ok, _ = cb.allow()
+	require.False(t, ok)
+
+	time.Sleep(60 * time.Millisecond)
+	ok, probe = cb.allow()
+	require.True(t, ok)
+	require.True(t, probe)
+	// Only one probe at a time.
+	ok, _ = cb.allow()
+	require.False(t, ok)
+
+	// Failed probe keeps breaker open for another cool-down.
+	changed, healthy = cb.done(true, context.DeadlineExceeded)
+	require.False(t, changed)
+	require.False(t, healthy)
+	ok, _ = cb.allow()
+	require.False(t, ok)
+
+	time.Sleep(60 * time.Millisecond)
+	ok, probe = cb.allow()
+	require.True(t, ok)
+	require.True(t, probe)
+	changed, healthy = cb.done(true, nil)
+	require.True(t, changed)
+	require.True(t, healthy)
+
+	ok, probe = cb.allow()
+	require.True(t, ok)
+	require.False(t, probe)
+}
+
+func TestShardBreakerDisabled(t *testing.T) {
+	cb := newShardBreaker(0, time.Second)
+	for i := 0; i < 10; i++ {
+		ok, _ := cb.allow()
+		require.True(t, ok)
+		changed, healthy := cb.done(false, context.DeadlineExceeded)
+		require.False(t, changed)
+		require.True(t, healthy)
+	}
+}
+
+func TestRedisBrokerPublishBreakerConfig(t *testing.T) {
+	node, _ := New(Config{})
+	b, err := NewRedisBroker(node, RedisBrokerConfig{
+		Shards:                  []*RedisShard{{}, {}},
+		PublishBreakerThreshold: 3,
+	})
+	require.NoError(t, err)
+	require.Equal(t, defaultRedisPublishBreakerCooldown, b.config.PublishBreakerCooldown)
+	for i, s := range b.shards {
+		require.Equal(t, strconv.Itoa(i), s.index)
+		require.Equal(t, 3, s.breaker.threshold)
+		require.Equal(t, defaultRedisPublishBreakerCooldown, s.breaker.cooldown)
+	}
+
+	b, err = NewRedisBroker(node, RedisBrokerConfig{
+		Shards:                  []*RedisShard{{}},
+		PublishBreakerThreshold: 1,
+		PublishBreakerCooldown:  time.Minute,
+	})
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, b.shards[0].breaker.cooldown)
+
+	// Open breaker – publish must fail fast without reaching Redis.
+	b.shards[0].breaker.done(false, ErrRedisPublishTimeout)
+	_, _, err = b.Publish("test", []byte(`{}`), PublishOptions{})
+	require.ErrorIs(t, err, ErrRedisShardUnhealthy)
+}
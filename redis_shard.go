@@ -137,6 +137,9 @@ func NewRedisShard(_ *Node, conf RedisShardConfig) (*RedisShard, error) {
 
 	client, err := rueidis.NewClient(options)
 	if err != nil {
+		if isRedisAuthError(err) {
+			return nil, fmt.Errorf("error authenticating in Redis, check User and Password: %w", err)
+		}
 		return nil, err
 	}
 
@@ -144,6 +147,25 @@ func NewRedisShard(_ *Node, conf RedisShardConfig) (*RedisShard, error) {
 	return shard, nil
 }
 
+// isRedisAuthError reports whether err is a Redis authentication or ACL permission
+// error – such errors are not fixed by reconnecting and need configuration changes.
+func isRedisAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "WRONGPASS") || strings.Contains(msg, "NOAUTH") || strings.Contains(msg, "NOPERM")
+}
+
+// redisErrorLogFields returns log fields for Redis error marking authentication errors.
+func redisErrorLogFields(err error) map[string]any {
+	fields := map[string]any{"error": err.Error()}
+	if isRedisAuthError(err) {
+		fields["auth_error"] = true
+	}
+	return fields
+}
+
 // RedisShardConfig contains Redis connection options.
 type RedisShardConfig struct {
 	// Address is a Redis server connection address.
@@ -211,6 +233,14 @@ func (s *RedisShard) Close() {
 	})
 }
 
+// RedisClient returns rueidis.Client used by RedisShard. This allows running custom
+// commands and Lua scripts over the same connection pool as Centrifuge does. Client
+// must not be closed, and keys used by Centrifuge must not be modified – their format
+// is not a part of public API and may change between releases. Use own keys only.
+func (s *RedisShard) RedisClient() rueidis.Client {
+	return s.client
+}
+
 func (s *RedisShard) string() string {
 	return s.config.address
 }
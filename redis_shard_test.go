@@ -1,6 +1,8 @@
 package centrifuge
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -49,3 +51,16 @@ func TestRedisShard_ConfFromAddress(t *testing.T) {
 	require.Equal(t, 0, conf.DB)
 	require.Equal(t, "pass", conf.Password)
 }
+
+func TestIsRedisAuthError(t *testing.T) {
+	require.False(t, isRedisAuthError(nil))
+	require.False(t, isRedisAuthError(errors.New("dial tcp: connection refused")))
+	require.True(t, isRedisAuthError(errors.New("WRONGPASS invalid username-password pair or user is disabled.")))
+	require.True(t, isRedisAuthError(fmt.Errorf("wrapped: %w", errors.New("NOAUTH Authentication required."))))
+	require.True(t, isRedisAuthError(errors.New("NOPERM this user has no permissions to run the 'publish' command")))
+
+	fields := redisErrorLogFields(errors.New("NOAUTH Authentication required."))
+	require.Equal(t, true, fields["auth_error"])
+	fields = redisErrorLogFields(errors.New("i/o timeout"))
+	require.NotContains(t, fields, "auth_error")
+}
@@ -0,0 +1,30 @@
+package centrifuge
+
+import "context"
+
+// Tracer allows tracing client command processing and Broker/PresenceManager
+// operations. It's an interface so that any tracing library could be used – for
+// example, an adapter over OpenTelemetry trace.Tracer may be written in several
+// lines of code. Tracing is off if Tracer not set in Config.
+type Tracer interface {
+	// StartSpan starts a new span with provided name and attributes. Returned
+	// context must contain started span.
+	StartSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, Span)
+}
+
+// Span is a started tracing span.
+type Span interface {
+	// End finishes span. Error is nil if traced operation was successful.
+	End(err error)
+}
+
+const (
+	spanNamePublish       = "centrifuge.broker.publish"
+	spanNameHistory       = "centrifuge.broker.history"
+	spanNamePresence      = "centrifuge.presence_manager.presence"
+	spanNamePresenceStats = "centrifuge.presence_manager.presence_stats"
+)
+
+func commandSpanName(frameType string) string {
+	return "centrifuge.command." + frameType
+}
@@ -0,0 +1,120 @@
+package centrifuge
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/centrifugal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+type testSpan struct {
+	name       string
+	attributes map[string]string
+	parent     *testSpan
+	ended      bool
+	err        error
+}
+
+type testSpanContextKey struct{}
+
+func testSpanFromContext(ctx context.Context) *testSpan {
+	span, _ := ctx.Value(testSpanContextKey{}).(*testSpan)
+	return span
+}
+
+func (s *testSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &testSpan{name: name, attributes: attributes, parent: testSpanFromContext(ctx)}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, testSpanContextKey{}, span), span
+}
+
+func (t *testTracer) getSpans() []*testSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.spans
+}
+
+func TestTracer_NodeOperations(t *testing.T) {
+	node := defaultNodeNoHandlers()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	tracer := &testTracer{}
+	node.config.Tracer = tracer
+
+	_, err := node.Publish("test", []byte(`{}`))
+	require.NoError(t, err)
+	_, err = node.History("test")
+	require.NoError(t, err)
+	_, err = node.Presence("test")
+	require.NoError(t, err)
+	_, err = node.PresenceStats("test")
+	require.NoError(t, err)
+
+	spans := tracer.getSpans()
+	require.Len(t, spans, 4)
+	require.Equal(t, spanNamePublish, spans[0].name)
+	require.Equal(t, spanNameHistory, spans[1].name)
+	require.Equal(t, spanNamePresence, spans[2].name)
+	require.Equal(t, spanNamePresenceStats, spans[3].name)
+	for _, span := range spans {
+		require.True(t, span.ended)
+		require.NoError(t, span.err)
+		require.Equal(t, "test", span.attributes["channel"])
+	}
+}
+
+func TestTracer_ClientCommand(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	client := newTestConnectedClientV2(t, node, "42")
+	tracer := &testTracer{}
+	node.config.Tracer = tracer
+
+	ok := client.HandleCommand(&protocol.Command{
+		Id:        1,
+		Subscribe: &protocol.SubscribeRequest{Channel: "test"},
+	}, 0)
+	require.True(t, ok)
+
+	spans := tracer.getSpans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "centrifuge.command.subscribe", spans[0].name)
+	require.Equal(t, "42", spans[0].attributes["user"])
+	require.Equal(t, client.ID(), spans[0].attributes["client"])
+	require.Equal(t, "test", spans[0].attributes["channel"])
+	require.True(t, spans[0].ended)
+}
+
+func TestTracer_ClientCommandBrokerSpan(t *testing.T) {
+	node := defaultTestNode()
+	defer func() { _ = node.Shutdown(context.Background()) }()
+	client := newTestConnectedClientV2(t, node, "42")
+	tracer := &testTracer{}
+	node.config.Tracer = tracer
+
+	ok := client.HandleCommand(&protocol.Command{
+		Id:      1,
+		Publish: &protocol.PublishRequest{Channel: "test", Data: []byte(`{}`)},
+	}, 0)
+	require.True(t, ok)
+
+	spans := tracer.getSpans()
+	require.Len(t, spans, 2)
+	require.Equal(t, "centrifuge.command.publish", spans[0].name)
+	require.Equal(t, spanNamePublish, spans[1].name)
+	// Broker span started within command span.
+	require.Equal(t, spans[0], spans[1].parent)
+}
@@ -70,6 +70,21 @@ type TransportInfo interface {
 // Transport abstracts a connection transport between server and client.
 // It does not contain Read method as reading can be handled by connection
 // handler code (for example by WebsocketHandler.ServeHTTP).
+//
+// Custom transports are built the same way as builtin ones:
+//   - connection handler creates Client with NewClient when a new connection
+//     established;
+//   - every inbound frame is passed to Client.Handle (or HandleReadFrame for
+//     io.Reader based frames). Unidirectional transports call Client.Connect
+//     instead since clients do not send commands;
+//   - when the underlying connection is gone the handler calls ClientCloseFunc
+//     returned by NewClient exactly once. This runs Client.OnDisconnect handler
+//     (if client was connected) and cleans up subscriptions.
+//
+// Transport.Close is called by Client only, when server decides to close the
+// connection (disconnect, shutdown, slow client, etc.). After Close transport
+// should stop reading and close underlying connection – connection handler then
+// notices that and calls ClientCloseFunc as usual.
 type Transport interface {
 	TransportInfo
 	// Write should write single push data into a connection. Every byte slice
@@ -81,7 +96,8 @@ type Transport interface {
 	// transport ProtocolType.
 	// The reason why we have both Write and WriteMany here is to have a path
 	// without extra allocations for massive broadcasts (since variadic args cause
-	// allocation).
+	// allocation). Slice of messages is reused after WriteMany returns, so
+	// Transport must not retain it.
 	WriteMany(...[]byte) error
 	// Close must close transport. Transport implementation can optionally
 	// handle Disconnect passed here. For example builtin WebSocket transport
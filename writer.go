@@ -1,7 +1,10 @@
 package centrifuge
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/centrifugal/centrifuge/internal/queue"
@@ -12,6 +15,57 @@ type writerConfig struct {
 	WriteManyFn  func(...queue.Item) error
 	WriteFn      func(item queue.Item) error
 	MaxQueueSize int
+	// MaxFrameSize limits the total size in bytes of messages merged into
+	// one frame. A single message larger than the limit is still sent.
+	// Zero value means no limit.
+	MaxFrameSize int
+}
+
+var (
+	itemsPool    sync.Pool
+	messagesPool sync.Pool
+)
+
+// getItems returns empty slice of queue items from pool. Every connection
+// batching messages into a frame needs one during massive broadcasts.
+func getItems(capacity int) *[]queue.Item {
+	if v := itemsPool.Get(); v != nil {
+		items := v.(*[]queue.Item)
+		if cap(*items) >= capacity {
+			return items
+		}
+	}
+	items := make([]queue.Item, 0, capacity)
+	return &items
+}
+
+func putItems(items *[]queue.Item) {
+	for i := range *items {
+		(*items)[i] = queue.Item{}
+	}
+	*items = (*items)[:0]
+	itemsPool.Put(items)
+}
+
+// getMessages returns empty slice of encoded messages from pool to pass into
+// Transport.WriteMany. Transport must not retain messages after WriteMany returns.
+func getMessages(capacity int) *[][]byte {
+	if v := messagesPool.Get(); v != nil {
+		messages := v.(*[][]byte)
+		if cap(*messages) >= capacity {
+			return messages
+		}
+	}
+	messages := make([][]byte, 0, capacity)
+	return &messages
+}
+
+func putMessages(messages *[][]byte) {
+	for i := range *messages {
+		(*messages)[i] = nil
+	}
+	*messages = (*messages)[:0]
+	messagesPool.Put(messages)
 }
 
 // writer helps to manage per-connection message byte queue.
@@ -21,6 +75,43 @@ type writer struct {
 	messages *queue.Queue
 	closed   bool
 	closeCh  chan struct{}
+	// frameFullCh signals that queue has enough data for a frame of MaxFrameSize
+	// or flush requested, so there is no need to wait for the end of write delay.
+	frameFullCh chan struct{}
+	// numEnqueued and numWritten count messages added to queue and written to
+	// transport, this allows flush to wait for messages queued before its call.
+	numEnqueued uint64
+	numWritten  uint64
+	// flushWaiters wait until numWritten reaches their position. Write delay
+	// is skipped while there are waiters.
+	flushWaiters []flushWaiter
+	// retry is a failed write to be retried on next iteration, see writeRetryError.
+	retry *pendingRetry
+}
+
+// writeRetryError may be returned by WriteFn and WriteManyFn to ask writer to call
+// retry once on next iteration – before writing other messages from queue.
+type writeRetryError struct {
+	err   error
+	retry func() error
+}
+
+func (e *writeRetryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *writeRetryError) Unwrap() error {
+	return e.err
+}
+
+type pendingRetry struct {
+	retry       func() error
+	numMessages uint64
+}
+
+type flushWaiter struct {
+	position uint64
+	ch       chan struct{}
 }
 
 func newWriter(config writerConfig, queueInitialCap int) *writer {
@@ -31,6 +122,8 @@ func newWriter(config writerConfig, queueInitialCap int) *writer {
 		config:   config,
 		messages: queue.New(queueInitialCap),
 		closeCh:  make(chan struct{}),
+
+		frameFullCh: make(chan struct{}, 1),
 	}
 	return w
 }
@@ -40,17 +133,22 @@ const (
 )
 
 func (w *writer) waitSendMessage(maxMessagesInFrame int, writeDelay time.Duration) bool {
+	if ok := w.writeRetry(writeDelay); !ok {
+		return false
+	}
+
 	// Wait for message from the queue.
 	ok := w.messages.Wait()
 	if !ok {
 		return false
 	}
 
-	if writeDelay > 0 {
+	if writeDelay > 0 && !w.flushPending() {
 		tm := timers.AcquireTimer(writeDelay)
 		if writeDelay > 0 {
 			select {
 			case <-tm.C:
+			case <-w.frameFullCh:
 			case <-w.closeCh:
 				timers.ReleaseTimer(tm)
 				return false
@@ -68,6 +166,7 @@ func (w *writer) waitSendMessage(maxMessagesInFrame int, writeDelay time.Duratio
 	}
 
 	var writeErr error
+	var numMessages uint64
 
 	messageCount := w.messages.Len()
 	if (maxMessagesInFrame == -1 || maxMessagesInFrame > 1) && messageCount > 0 {
@@ -81,14 +180,26 @@ func (w *writer) waitSendMessage(maxMessagesInFrame int, writeDelay time.Duratio
 			messagesCap = maxMessagesInFrame
 		}
 
-		messages := make([]queue.Item, 0, messagesCap)
-		messages = append(messages, msg)
+		items := getItems(messagesCap)
+		messages := append(*items, msg)
+		defer func() {
+			*items = messages
+			putItems(items)
+		}()
+		frameSize := len(msg.Data)
 
 		for messageCount > 0 {
 			messageCount--
 			if maxMessagesInFrame > -1 && len(messages) >= maxMessagesInFrame {
 				break
 			}
+			if w.config.MaxFrameSize > 0 {
+				size, ok := w.messages.FrontSize()
+				if !ok || frameSize+size > w.config.MaxFrameSize {
+					break
+				}
+				frameSize += size
+			}
 			m, ok := w.messages.Remove()
 			if ok {
 				messages = append(messages, m)
@@ -104,17 +215,84 @@ func (w *writer) waitSendMessage(maxMessagesInFrame int, writeDelay time.Duratio
 		} else {
 			writeErr = w.config.WriteManyFn(messages...)
 		}
+		numMessages = uint64(len(messages))
 	} else {
 		// WriteMany single message without allocating new slice.
 		writeErr = w.config.WriteFn(msg)
+		numMessages = 1
 	}
 	if writeErr != nil {
+		var retryErr *writeRetryError
+		if errors.As(writeErr, &retryErr) {
+			w.retry = &pendingRetry{retry: retryErr.retry, numMessages: numMessages}
+			return true
+		}
 		// WriteMany failed, transport must close itself, here we just return from routine.
 		return false
 	}
+	w.numWritten += numMessages
+	w.notifyFlushWaiters()
 	return true
 }
 
+// writeRetry retries failed write if any. Write delay respected before retry to
+// give transport a chance to recover.
+func (w *writer) writeRetry(writeDelay time.Duration) bool {
+	w.mu.Lock()
+	hasRetry := w.retry != nil
+	w.mu.Unlock()
+	if !hasRetry {
+		return true
+	}
+	if writeDelay > 0 {
+		tm := timers.AcquireTimer(writeDelay)
+		select {
+		case <-tm.C:
+		case <-w.closeCh:
+			timers.ReleaseTimer(tm)
+			return false
+		}
+		timers.ReleaseTimer(tm)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.retry == nil {
+		// Retried on close.
+		return false
+	}
+	retry := w.retry
+	w.retry = nil
+	if err := retry.retry(); err != nil {
+		// Retry failed, transport must close itself.
+		return false
+	}
+	w.numWritten += retry.numMessages
+	w.notifyFlushWaiters()
+	return true
+}
+
+func (w *writer) flushPending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.flushWaiters) > 0
+}
+
+// notifyFlushWaiters must be called with mu held.
+func (w *writer) notifyFlushWaiters() {
+	if len(w.flushWaiters) == 0 {
+		return
+	}
+	waiters := w.flushWaiters[:0]
+	for _, waiter := range w.flushWaiters {
+		if waiter.position <= w.numWritten {
+			close(waiter.ch)
+			continue
+		}
+		waiters = append(waiters, waiter)
+	}
+	w.flushWaiters = waiters
+}
+
 // run supposed to be run in goroutine, this goroutine will be closed as
 // soon as queue is closed.
 func (w *writer) run(writeDelay time.Duration, maxMessagesInFrame int) {
@@ -133,12 +311,57 @@ func (w *writer) enqueue(item queue.Item) *Disconnect {
 	if !ok {
 		return &DisconnectConnectionClosed
 	}
+	atomic.AddUint64(&w.numEnqueued, 1)
 	if w.config.MaxQueueSize > 0 && w.messages.Size() > w.config.MaxQueueSize {
 		return &DisconnectSlow
 	}
+	if w.config.MaxFrameSize > 0 && w.messages.Size() >= w.config.MaxFrameSize {
+		select {
+		case w.frameFullCh <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
+// flush blocks until messages enqueued before the call are written to transport,
+// writer closed or ctx done. Messages enqueued later do not prolong waiting. Write
+// delay is not respected while flush waits.
+func (w *writer) flush(ctx context.Context) error {
+	position := atomic.LoadUint64(&w.numEnqueued)
+	w.mu.Lock()
+	if w.closed || w.numWritten >= position {
+		w.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	w.flushWaiters = append(w.flushWaiters, flushWaiter{position: position, ch: ch})
+	w.mu.Unlock()
+
+	// Interrupt write delay which may be in progress.
+	select {
+	case w.frameFullCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-w.closeCh:
+		return nil
+	case <-ctx.Done():
+		w.mu.Lock()
+		for i, waiter := range w.flushWaiters {
+			if waiter.ch == ch {
+				w.flushWaiters = append(w.flushWaiters[:i], w.flushWaiters[i+1:]...)
+				break
+			}
+		}
+		w.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
 func (w *writer) close(flushRemaining bool) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -147,6 +370,11 @@ func (w *writer) close(flushRemaining bool) error {
 	}
 	w.closed = true
 
+	if flushRemaining && w.retry != nil {
+		_ = w.retry.retry()
+	}
+	w.retry = nil
+
 	if flushRemaining {
 		remaining := w.messages.CloseRemaining()
 		if len(remaining) > 0 {
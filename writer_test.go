@@ -2,8 +2,10 @@ package centrifuge
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"os"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -16,10 +18,11 @@ import (
 const numQueueMessages = 4
 
 type benchmarkTransport struct {
-	f     *os.File
-	ch    chan struct{}
-	count int64
-	buf   []byte
+	f      *os.File
+	ch     chan struct{}
+	count  int64
+	writes int64
+	buf    []byte
 }
 
 func newBenchmarkTransport() *benchmarkTransport {
@@ -57,6 +60,7 @@ func (t *benchmarkTransport) writeCombined(items ...queue.Item) error {
 	if err != nil {
 		panic(err)
 	}
+	atomic.AddInt64(&t.writes, 1)
 	t.inc(len(buffers))
 	return nil
 }
@@ -66,6 +70,7 @@ func (t *benchmarkTransport) writeSingle(item queue.Item) error {
 	if err != nil {
 		panic(err)
 	}
+	atomic.AddInt64(&t.writes, 1)
 	t.inc(1)
 	return nil
 }
@@ -84,6 +89,11 @@ func runWrite(w *writer, t *benchmarkTransport) {
 	t.ch = make(chan struct{})
 }
 
+// reportWrites reports the number of write syscalls made per benchmark op.
+func reportWrites(b *testing.B, t *benchmarkTransport) {
+	b.ReportMetric(float64(atomic.LoadInt64(&t.writes))/float64(b.N), "writes/op")
+}
+
 // BenchmarkWriteMerge allows to be sure that merging messages into one frame
 // works and makes sense from syscall economy perspective. Compare result to
 // BenchmarkWriteMergeDisabled.
@@ -101,6 +111,27 @@ func BenchmarkWriteMerge(b *testing.B) {
 		runWrite(writer, transport)
 	}
 	b.StopTimer()
+	reportWrites(b, transport)
+}
+
+// BenchmarkWriteMergeMaxFrameSize shows how limiting frame size affects
+// the number of write syscalls.
+func BenchmarkWriteMergeMaxFrameSize(b *testing.B) {
+	transport := newBenchmarkTransport()
+	defer func() { _ = transport.close() }()
+	writer := newWriter(writerConfig{
+		WriteFn:      transport.writeSingle,
+		WriteManyFn:  transport.writeCombined,
+		MaxFrameSize: 2 * len(transport.buf),
+	}, 0)
+	go writer.run(0, 4)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runWrite(writer, transport)
+	}
+	b.StopTimer()
+	reportWrites(b, transport)
 }
 
 func BenchmarkWriteMergeDisabled(b *testing.B) {
@@ -117,6 +148,7 @@ func BenchmarkWriteMergeDisabled(b *testing.B) {
 		runWrite(writer, transport)
 	}
 	b.StopTimer()
+	reportWrites(b, transport)
 }
 
 type fakeTransport struct {
@@ -215,6 +247,207 @@ func TestWriterWriteMany(t *testing.T) {
 	}
 }
 
+func TestWriterMaxFrameSize(t *testing.T) {
+	transport := newFakeTransport(nil)
+
+	w := newWriter(writerConfig{
+		MaxQueueSize: 10 * 1024,
+		MaxFrameSize: 8,
+		WriteFn:      transport.write,
+		WriteManyFn:  transport.writeMany,
+	}, 0)
+
+	numMessages := 16
+	for i := 0; i < numMessages; i++ {
+		disconnect := w.enqueue(queue.Item{Data: []byte("test")})
+		require.Nil(t, disconnect)
+	}
+
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+		w.run(0, numMessages)
+	}()
+
+	for i := 0; i < numMessages; i++ {
+		<-transport.ch
+	}
+
+	require.Equal(t, numMessages, transport.count)
+	// Only two 4-byte messages fit into 8-byte frame.
+	require.Equal(t, numMessages/2, transport.writeManyCalls)
+	require.Equal(t, 0, transport.writeCalls)
+	err := w.close(true)
+	require.NoError(t, err)
+
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for write routine close")
+	}
+}
+
+func TestWriterWriteDelayFlushOnMaxFrameSize(t *testing.T) {
+	transport := newFakeTransport(nil)
+	transport.ch = make(chan struct{}, 2)
+
+	w := newWriter(writerConfig{
+		MaxFrameSize: 8,
+		WriteFn:      transport.write,
+		WriteManyFn:  transport.writeMany,
+	}, 0)
+	go w.run(time.Minute, -1)
+	defer func() { _ = w.close(false) }()
+
+	for i := 0; i < 2; i++ {
+		require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+	}
+
+	// Frame is full – must be sent without waiting for write delay.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-transport.ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for write")
+		}
+	}
+	require.Equal(t, 1, transport.writeManyCalls)
+}
+
+func TestWriterWriteDelayLatency(t *testing.T) {
+	transport := newFakeTransport(nil)
+
+	writeDelay := 50 * time.Millisecond
+	w := newWriter(writerConfig{
+		MaxFrameSize: 1024,
+		WriteFn:      transport.write,
+		WriteManyFn:  transport.writeMany,
+	}, 0)
+	go w.run(writeDelay, -1)
+	defer func() { _ = w.close(false) }()
+
+	for i := 0; i < 3; i++ {
+		started := time.Now()
+		require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+		select {
+		case <-transport.ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for write")
+		}
+		// Added latency is bounded by write delay (with some room for scheduling).
+		require.Less(t, time.Since(started), 2*writeDelay)
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	var numWritten int64
+	w := newWriter(writerConfig{
+		WriteFn: func(item queue.Item) error {
+			atomic.AddInt64(&numWritten, 1)
+			return nil
+		},
+		WriteManyFn: func(items ...queue.Item) error {
+			atomic.AddInt64(&numWritten, int64(len(items)))
+			return nil
+		},
+	}, 0)
+	// Large write delay, flush must not wait for it.
+	go w.run(time.Minute, -1)
+	defer func() { _ = w.close(false) }()
+
+	// Nothing to flush.
+	require.NoError(t, w.flush(context.Background()))
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, w.flush(ctx))
+	require.EqualValues(t, 10, atomic.LoadInt64(&numWritten))
+}
+
+func TestWriterFlushSeveralFrames(t *testing.T) {
+	var numWritten int64
+	w := newWriter(writerConfig{
+		WriteFn: func(item queue.Item) error {
+			atomic.AddInt64(&numWritten, 1)
+			return nil
+		},
+		WriteManyFn: func(items ...queue.Item) error {
+			atomic.AddInt64(&numWritten, int64(len(items)))
+			return nil
+		},
+	}, 0)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+	}
+	// One message per frame – write delay skipped for every frame until flushed.
+	go w.run(time.Minute, 1)
+	defer func() { _ = w.close(false) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, w.flush(ctx))
+	require.EqualValues(t, 3, atomic.LoadInt64(&numWritten))
+}
+
+func TestWriterFlushPosition(t *testing.T) {
+	releaseCh := make(chan struct{})
+	var numWritten int64
+	w := newWriter(writerConfig{
+		WriteFn: func(item queue.Item) error {
+			if atomic.AddInt64(&numWritten, 1) > 1 {
+				// Block writing messages enqueued after flush call.
+				<-releaseCh
+			}
+			return nil
+		},
+	}, 0)
+	defer func() { _ = w.close(false) }()
+	defer close(releaseCh)
+
+	require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- w.flush(context.Background())
+	}()
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.flushWaiters) == 1
+	}, time.Second, time.Millisecond)
+	// Messages enqueued after flush call do not prolong waiting.
+	require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+	go w.run(0, 1)
+
+	select {
+	case err := <-flushed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for flush")
+	}
+}
+
+func TestWriterFlushContextDone(t *testing.T) {
+	w := newWriter(writerConfig{
+		WriteFn: func(item queue.Item) error {
+			return nil
+		},
+		WriteManyFn: func(items ...queue.Item) error {
+			return nil
+		},
+	}, 0)
+	// Writer not running so queue is never drained.
+	defer func() { _ = w.close(false) }()
+	require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, w.flush(ctx), context.DeadlineExceeded)
+}
+
 func TestWriterWriteRemaining(t *testing.T) {
 	transport := newFakeTransport(nil)
 
@@ -311,3 +544,67 @@ func TestWriterWriteError(t *testing.T) {
 		t.Fatal("timeout waiting for write routine close")
 	}
 }
+
+func TestWriterWriteRetry(t *testing.T) {
+	var mu sync.Mutex
+	var written []string
+	var numRetries int
+	write := func(item queue.Item) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if string(item.Data) == "fail" && numRetries == 0 {
+			return &writeRetryError{err: errors.New("boom"), retry: func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				numRetries++
+				written = append(written, string(item.Data))
+				return nil
+			}}
+		}
+		written = append(written, string(item.Data))
+		return nil
+	}
+	w := newWriter(writerConfig{
+		WriteFn: write,
+		WriteManyFn: func(items ...queue.Item) error {
+			for _, item := range items {
+				if err := write(item); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, 0)
+
+	require.Nil(t, w.enqueue(queue.Item{Data: []byte("fail")}))
+	go w.run(0, 1)
+	defer func() { _ = w.close(false) }()
+	require.Nil(t, w.enqueue(queue.Item{Data: []byte("test")}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, w.flush(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, numRetries)
+	require.Equal(t, []string{"fail", "test"}, written)
+}
+
+func TestWriterPooledSlicesCleared(t *testing.T) {
+	items := getItems(2)
+	*items = append(*items, queue.Item{Data: []byte("1")}, queue.Item{Data: []byte("2")})
+	putItems(items)
+	require.Len(t, *items, 0)
+	for _, item := range (*items)[:2] {
+		require.Nil(t, item.Data)
+	}
+
+	messages := getMessages(2)
+	*messages = append(*messages, []byte("1"), []byte("2"))
+	putMessages(messages)
+	require.Len(t, *messages, 0)
+	for _, message := range (*messages)[:2] {
+		require.Nil(t, message)
+	}
+}